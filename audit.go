@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"slices"
+	"sync"
+)
+
+// auditLog records the primary keys of the rows of every dumped table, so
+// that it can be audited exactly which rows left the database.
+type auditLog struct {
+	mu     sync.Mutex
+	tables map[string]*auditTable
+}
+
+func newAuditLog() *auditLog {
+	return &auditLog{tables: make(map[string]*auditTable)}
+}
+
+// auditTable records the keys of the rows of a table in the COPY data
+// passing through it.
+type auditTable struct {
+	w    io.Writer
+	key  []string
+	pos  []int
+	rows int
+	keys [][]*string
+	line []byte
+}
+
+// table returns a writer recording the rows of table, with the columns cols
+// and the primary key pk, passing the COPY data on to w. The rows recorded
+// before for the same table, e.g. by an attempt which lost the connection,
+// are discarded.
+func (a *auditLog) table(table string, cols []string, pk []string, w io.Writer) io.Writer {
+	t := &auditTable{w: w}
+	for _, col := range pk {
+		i := slices.Index(cols, col)
+		if i == -1 {
+			// Rows are only counted if the key isn't dumped
+			t.key, t.pos = nil, nil
+			break
+		}
+		t.key = append(t.key, col)
+		t.pos = append(t.pos, i)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.tables[table] = t
+	return t
+}
+
+func (t *auditTable) Write(p []byte) (int, error) {
+	t.line = append(t.line, p...)
+	for {
+		end := bytes.IndexByte(t.line, '\n')
+		if end == -1 {
+			break
+		}
+		t.rows++
+		if t.key != nil {
+			row := decodeCopyRow(string(t.line[:end]))
+			values := make([]*string, 0, len(t.pos))
+			for _, i := range t.pos {
+				values = append(values, row[i])
+			}
+			t.keys = append(t.keys, values)
+		}
+		t.line = t.line[end+1:]
+	}
+	return t.w.Write(p)
+}
+
+// auditEntry is a line of the audit log: the key of a dumped row, or the
+// number of rows dumped from a table without a primary key.
+type auditEntry struct {
+	Table string             `json:"table"`
+	Key   map[string]*string `json:"key,omitempty"`
+	Rows  int                `json:"rows,omitempty"`
+}
+
+// write writes the audit log of the items to w as JSON lines, in the order
+// of the items.
+func (a *auditLog) write(w io.Writer, items []ManifestItem) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	enc := json.NewEncoder(w)
+	for _, v := range items {
+		t, ok := a.tables[v.Table]
+		if !ok {
+			continue
+		}
+		if t.key == nil {
+			err := enc.Encode(auditEntry{Table: v.Table, Rows: t.rows})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		for _, values := range t.keys {
+			key := make(map[string]*string, len(t.key))
+			for i, col := range t.key {
+				key[col] = values[i]
+			}
+			err := enc.Encode(auditEntry{Table: v.Table, Key: key})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeAuditLog writes the audit log of the items to the file path.
+func writeAuditLog(path string, a *auditLog, items []ManifestItem) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	bw := bufio.NewWriter(f)
+	err = a.write(bw, items)
+	if err != nil {
+		return err
+	}
+	err = bw.Flush()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
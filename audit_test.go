@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	a := newAuditLog()
+
+	// A failed attempt is replaced by the next one
+	w := a.table("users", []string{"id", "name"}, []string{"id"}, io.Discard)
+	w.Write([]byte("1\talice\n"))
+	var data bytes.Buffer
+	w = a.table("users", []string{"id", "name"}, []string{"id"}, &data)
+	w.Write([]byte("1\talice\n2\t"))
+	w.Write([]byte("bob\n"))
+
+	w = a.table("order_items", []string{"order_id", "n", "sku"}, []string{"order_id", "n"}, io.Discard)
+	w.Write([]byte("7\t1\tA\n7\t2\t\\N\n"))
+	w = a.table("logs", []string{"line"}, nil, io.Discard)
+	w.Write([]byte("x\ny\n"))
+
+	if data.String() != "1\talice\n2\tbob\n" {
+		t.Errorf("expected the data to be passed on, got %q", data.String())
+	}
+
+	var buf bytes.Buffer
+	items := []ManifestItem{{Table: "logs"}, {Table: "users"}, {Table: "order_items"}, {Table: "skipped"}}
+	err := a.write(&buf, items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"table":"logs","rows":2}
+{"table":"users","key":{"id":"1"}}
+{"table":"users","key":{"id":"2"}}
+{"table":"order_items","key":{"n":"1","order_id":"7"}}
+{"table":"order_items","key":{"n":"2","order_id":"7"}}
+`
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestMakeDump_AuditLogSourceKeys(t *testing.T) {
+	db := requireDB(t)
+
+	// The audit log has the keys of the source rows, not the transformed
+	// ones of the dump
+	manifest := &Manifest{Tables: []ManifestItem{{
+		Table:      "users",
+		Query:      "SELECT * FROM users WHERE id <= 2",
+		Transforms: map[string]Transform{"id": {Type: "bucket", Size: 10}},
+	}}}
+	a := newAuditLog()
+	var buf bytes.Buffer
+	err := makeDump(db, manifest, &buf, DumpOptions{audit: a})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+	users := a.tables["users"]
+	if users == nil || len(users.keys) != 2 || *users.keys[0][0] != "1" || *users.keys[1][0] != "2" {
+		t.Errorf("expected the keys 1 and 2 of the source, got %v", users)
+	}
+}
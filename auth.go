@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	pg "github.com/go-pg/pg/v10"
+)
+
+// unsupportedAuthMethods maps the authentication request codes of the
+// PostgreSQL protocol that the driver can't answer to their names. LDAP and
+// RADIUS aren't listed: the server asks the client for a cleartext password
+// in those cases, which works as usual (preferably over --tls).
+var unsupportedAuthMethods = map[int32]string{
+	2: "Kerberos V5",
+	7: "GSSAPI (Kerberos)",
+	8: "GSSAPI (Kerberos)",
+	9: "SSPI",
+}
+
+// unsupportedAuthError is returned when the server requests an
+// authentication method that pg_dump_sample doesn't implement.
+type unsupportedAuthError struct {
+	Method string
+}
+
+func (e *unsupportedAuthError) Error() string {
+	return fmt.Sprintf("server requested %s authentication, which is not supported; "+
+		"configure pg_hba.conf to use password, md5, scram-sha-256 or ldap for this user", e.Method)
+}
+
+// checkAuthError translates the driver's error for an unknown
+// authentication request into an unsupportedAuthError. Other errors are
+// returned unchanged.
+func checkAuthError(err error) error {
+	if err == nil {
+		return nil
+	}
+	for code, method := range unsupportedAuthMethods {
+		if strings.HasSuffix(err.Error(), fmt.Sprintf("unknown authentication message response: %q", code)) {
+			return &unsupportedAuthError{Method: method}
+		}
+	}
+	return err
+}
+
+// authFailureError is returned when the server refuses the connection, with
+// guidance on why and on how to reproduce the failure with psql.
+type authFailureError struct {
+	Err  error
+	Hint string
+	Psql string
+	// Password tells whether another password may be accepted
+	Password bool
+}
+
+func (e *authFailureError) Error() string {
+	return fmt.Sprintf("%v\n%s\nTo debug the connection, run: %s", e.Err, e.Hint, e.Psql)
+}
+
+func (e *authFailureError) Unwrap() error {
+	return e.Err
+}
+
+// explainAuthError translates the server refusing the connection into an
+// authFailureError, telling a wrong password, a missing pg_hba.conf entry and
+// SSL being required or unavailable apart. Other errors are returned
+// unchanged.
+func explainAuthError(err error, opts *Options) error {
+	if err == nil {
+		return nil
+	}
+	failure := &authFailureError{Err: err, Psql: psqlCommand(opts)}
+	var pgErr pg.Error
+	if !errors.As(err, &pgErr) {
+		if err.Error() != "pg: SSL is not enabled on the server" {
+			return err
+		}
+		failure.Hint = "The server doesn't accept SSL connections, connect without --tls."
+		return failure
+	}
+
+	message := pgErr.Field('M')
+	switch {
+	case pgErr.Field('C') == "28P01":
+		failure.Hint = fmt.Sprintf("The password of user %s was rejected, check it, PGPASSWORD or ~/.pgpass.", opts.Username)
+		failure.Password = true
+	case pgErr.Field('C') != "28000":
+		return err
+	case strings.HasPrefix(message, "no pg_hba.conf entry") && !opts.UseTls &&
+		(strings.HasSuffix(message, "SSL off") || strings.HasSuffix(message, "no encryption")):
+		// Hosts may only be allowed over SSL, with hostssl entries
+		failure.Hint = "The server only accepts SSL connections from this host, connect with --tls."
+	case strings.HasPrefix(message, "no pg_hba.conf entry"):
+		failure.Hint = fmt.Sprintf("No entry of pg_hba.conf on the server allows user %s to connect to database %s from this host, "+
+			"add one and reload the server configuration.", opts.Username, opts.Database)
+	case strings.HasPrefix(message, "role ") && strings.HasSuffix(message, " does not exist"):
+		failure.Hint = fmt.Sprintf("User %s doesn't exist on the server, check --username.", opts.Username)
+	default:
+		failure.Hint = fmt.Sprintf("The server refused user %s, check pg_hba.conf on the server and that the user may log in.", opts.Username)
+	}
+	return failure
+}
+
+// psqlCommand returns the psql command connecting to the database like
+// pg_dump_sample does, for debugging connection failures.
+func psqlCommand(opts *Options) string {
+	return fmt.Sprintf("PGSSLMODE=%s psql -h %s -p %d -U %s -d %s", sslMode(opts),
+		shellQuote(opts.Host), opts.Port, shellQuote(opts.Username), shellQuote(opts.Database))
+}
+
+// sslMode returns the libpq sslmode matching the connections of
+// pg_dump_sample.
+func sslMode(opts *Options) string {
+	if opts.UseTls {
+		return "require"
+	}
+	return "disable"
+}
+
+// shellQuote quotes s as a single word of a POSIX shell, if needed.
+func shellQuote(s string) string {
+	safe := s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("@%+=:,./_-", r))
+	}) == -1
+	if safe {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
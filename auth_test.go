@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCheckAuthError(t *testing.T) {
+	tests := []struct {
+		err    error
+		method string
+	}{
+		{fmt.Errorf("pg: unknown authentication message response: %q", int32(7)), "GSSAPI (Kerberos)"},
+		{fmt.Errorf("pg: unknown authentication message response: %q", int32(9)), "SSPI"},
+		{fmt.Errorf("pg: unknown authentication message response: %q", int32(2)), "Kerberos V5"},
+	}
+	for _, tt := range tests {
+		var authErr *unsupportedAuthError
+		if !errors.As(checkAuthError(tt.err), &authErr) {
+			t.Errorf("checkAuthError(%v) is not an unsupportedAuthError", tt.err)
+			continue
+		}
+		if authErr.Method != tt.method {
+			t.Errorf("checkAuthError(%v).Method = %q, want %q", tt.err, authErr.Method, tt.method)
+		}
+	}
+
+	other := errors.New("pg: password authentication failed")
+	if got := checkAuthError(other); got != other {
+		t.Errorf("checkAuthError(%v) = %v, want it unchanged", other, got)
+	}
+	if checkAuthError(nil) != nil {
+		t.Error("checkAuthError(nil) should be nil")
+	}
+}
+
+// serverError is an error reported by the server, with its code and
+// message.
+type serverError struct {
+	code    string
+	message string
+}
+
+func (e *serverError) Error() string { return "FATAL: " + e.message }
+
+func (e *serverError) Field(field byte) string {
+	return map[byte]string{'C': e.code, 'M': e.message}[field]
+}
+
+func (e *serverError) IntegrityViolation() bool { return false }
+
+func TestExplainAuthError(t *testing.T) {
+	opts := &Options{Host: "db.example.com", Port: 5432, Username: "alice", Database: "app"}
+	tls := &Options{Host: "db.example.com", Port: 5432, Username: "alice", Database: "app", UseTls: true}
+	tests := []struct {
+		err      error
+		opts     *Options
+		hint     string
+		password bool
+	}{
+		{&serverError{"28P01", `password authentication failed for user "alice"`}, opts, "The password of user alice was rejected", true},
+		{&serverError{"28000", `no pg_hba.conf entry for host "10.0.0.1", user "alice", database "app", no encryption`}, opts, "The server only accepts SSL connections", false},
+		{&serverError{"28000", `no pg_hba.conf entry for host "10.0.0.1", user "alice", database "app", SSL off`}, opts, "The server only accepts SSL connections", false},
+		{&serverError{"28000", `no pg_hba.conf entry for host "10.0.0.1", user "alice", database "app", SSL encryption`}, tls, "No entry of pg_hba.conf", false},
+		{&serverError{"28000", `role "alice" does not exist`}, opts, "User alice doesn't exist", false},
+		{errors.New("pg: SSL is not enabled on the server"), tls, "The server doesn't accept SSL connections", false},
+	}
+	for _, tt := range tests {
+		var failure *authFailureError
+		if !errors.As(explainAuthError(tt.err, tt.opts), &failure) {
+			t.Errorf("explainAuthError(%v) is not an authFailureError", tt.err)
+			continue
+		}
+		if !strings.HasPrefix(failure.Hint, tt.hint) || failure.Password != tt.password {
+			t.Errorf("explainAuthError(%v) = %q, %v, want %q..., %v", tt.err, failure.Hint, failure.Password, tt.hint, tt.password)
+		}
+	}
+
+	for _, err := range []error{nil, errors.New("dial tcp: connection refused"), &serverError{"3D000", `database "app" does not exist`}} {
+		if got := explainAuthError(err, opts); got != err {
+			t.Errorf("explainAuthError(%v) = %v, want it unchanged", err, got)
+		}
+	}
+}
+
+func TestPsqlCommand(t *testing.T) {
+	opts := &Options{Host: "/var/run/postgresql", Port: 5432, Username: "o'brien", Database: "my app", UseTls: true}
+	expected := `PGSSLMODE=require psql -h /var/run/postgresql -p 5432 -U 'o'\''brien' -d 'my app'`
+	if got := psqlCommand(opts); got != expected {
+		t.Errorf("psqlCommand() = %q, want %q", got, expected)
+	}
+}
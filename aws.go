@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/rds/auth"
+	pg "github.com/go-pg/pg/v10"
+)
+
+// RDS_TOKEN_PLACEHOLDER is the password go-pg sends with IAM authentication,
+// which the connection replaces with a token made for it.
+const RDS_TOKEN_PLACEHOLDER = "pg_dump_sample-rds-iam-token"
+
+// SSL_REQUEST_CODE asks the server to switch to TLS before the startup
+// message.
+const SSL_REQUEST_CODE = 80877103
+
+// awsRegion returns the region of an RDS endpoint from its host name, as in
+// mydb.123456789012.us-east-1.rds.amazonaws.com.
+func awsRegion(host string) (string, error) {
+	labels := strings.Split(host, ".")
+	for i := 1; i < len(labels); i++ {
+		if labels[i] == "rds" {
+			return labels[i-1], nil
+		}
+	}
+	return "", fmt.Errorf("can't tell the AWS region of %s, set AWS_REGION", host)
+}
+
+// startTLS asks the server of conn to switch to TLS, as go-pg does, and
+// returns the encrypted connection.
+func startTLS(ctx context.Context, conn net.Conn, config *tls.Config) (net.Conn, error) {
+	request := binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, 8), SSL_REQUEST_CODE)
+	_, err := conn.Write(request)
+	if err != nil {
+		return nil, err
+	}
+	answer := make([]byte, 1)
+	_, err = io.ReadFull(conn, answer)
+	if err != nil {
+		return nil, err
+	}
+	if answer[0] != 'S' {
+		return nil, fmt.Errorf("the server doesn't support TLS, which RDS IAM authentication requires")
+	}
+	tlsConn := tls.Client(conn, config)
+	err = tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// passwordMessage returns the message of the frontend protocol sending
+// password.
+func passwordMessage(password string) []byte {
+	msg := []byte{'p'}
+	msg = binary.BigEndian.AppendUint32(msg, uint32(len(password)+5))
+	msg = append(msg, password...)
+	return append(msg, 0)
+}
+
+// iamAuthConn sends token as the password of the connection in place of
+// RDS_TOKEN_PLACEHOLDER, so that every connection authenticates with a
+// token of its own without go-pg's options being changed while in use.
+type iamAuthConn struct {
+	net.Conn
+	token string
+	sent  bool
+}
+
+func (c *iamAuthConn) Write(p []byte) (int, error) {
+	placeholder := passwordMessage(RDS_TOKEN_PLACEHOLDER)
+	i := bytes.Index(p, placeholder)
+	if c.sent || i == -1 {
+		return c.Conn.Write(p)
+	}
+	c.sent = true
+	_, err := c.Conn.Write(slices.Concat(p[:i], passwordMessage(c.token), p[i+len(placeholder):]))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// useAwsIamAuth makes connections authenticate with RDS IAM tokens instead of
+// a password, from the credentials of the default chain of the AWS SDK:
+// environment, shared files and SSO, web identity (e.g. EKS), ECS and EC2
+// instance roles. Tokens expire after 15 minutes, so every connection the
+// pool dials gets a fresh one. RDS requires TLS for IAM authentication, and
+// its certificate is verified against rootCert.
+func useAwsIamAuth(pgOpts *pg.Options, host string, rootCert string) error {
+	if rootCert == "" {
+		return fmt.Errorf("--aws-iam-auth requires the RDS CA bundle in --tls-root-cert or $PGSSLROOTCERT, from https://truststore.pki.rds.amazonaws.com/global/global-bundle.pem")
+	}
+	tlsConfig, err := verifiedTLSConfig(host, rootCert)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return err
+	}
+	region := cfg.Region
+	if region == "" {
+		region, err = awsRegion(host)
+		if err != nil {
+			return err
+		}
+	}
+	// Missing credentials are reported before connecting
+	creds, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("no AWS credentials: %v", err)
+	}
+	addSecret(creds.SecretAccessKey)
+	addSecret(creds.SessionToken)
+
+	dial := pgOpts.Dialer
+	user := pgOpts.User
+	pgOpts.Dialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		token, err := auth.BuildAuthToken(ctx, addr, region, user, cfg.Credentials)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn, err := startTLS(ctx, conn, tlsConfig)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return &iamAuthConn{Conn: tlsConn, token: token}, nil
+	}
+	pgOpts.Password = RDS_TOKEN_PLACEHOLDER
+	// TLS is started by the dialer, which go-pg would otherwise start again
+	pgOpts.TLSConfig = nil
+	return nil
+}
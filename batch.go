@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// DATABASE_PLACEHOLDER is replaced with the name of the database in the
+// output file of every database of a batch.
+const DATABASE_PLACEHOLDER = "{{database}}"
+
+// databaseOutput returns the output file of database in a batch.
+func databaseOutput(output string, database string) string {
+	return strings.ReplaceAll(output, DATABASE_PLACEHOLDER, fileName(database))
+}
+
+// dumpDatabases dumps every database of the options with the same manifest,
+// opts.DatabaseJobs at a time, into output files of their own. All databases
+// are dumped even if some of them fail, and the failures are returned
+// together. Passwords can't be asked for, since databases may be dumped in
+// parallel.
+func dumpDatabases(opts *Options) error {
+	errs := make([]error, len(opts.Databases))
+	sem := make(chan struct{}, opts.DatabaseJobs)
+	var wg sync.WaitGroup
+	for i, database := range opts.Databases {
+		o := *opts
+		o.Database = database
+		o.Databases = nil
+		o.OutputFile = databaseOutput(opts.OutputFile, database)
+		o.FKReport = databaseOutput(opts.FKReport, database)
+		o.AuditLog = databaseOutput(opts.AuditLog, database)
+		o.NoPasswordPrompt = true
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			err := run(&o)
+			if err != nil {
+				errs[i] = fmt.Errorf("database %s: %w", database, err)
+				return
+			}
+			fmt.Fprintf(os.Stderr, "database %s dumped to %s\n", database, o.OutputFile)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
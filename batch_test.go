@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	pg "github.com/go-pg/pg/v10"
+)
+
+func TestDatabaseOutput(t *testing.T) {
+	if out := databaseOutput("dumps/{{database}}.sql", "tenant_1"); out != "dumps/tenant_1.sql" {
+		t.Errorf("unexpected output file %s", out)
+	}
+	if out := databaseOutput("dumps/{{database}}/{{database}}.sql", "a/b"); out != "dumps/a_b/a_b.sql" {
+		t.Errorf("expected the name to be made safe for a path, got %s", out)
+	}
+}
+
+func TestDumpDatabases(t *testing.T) {
+	requireDB(t)
+
+	dbOpts := testDBOpts()
+	host, port, _ := strings.Cut(dbOpts.Addr, ":")
+	portNum, _ := strconv.Atoi(port)
+	dir := t.TempDir()
+	opts := &Options{
+		Host:             host,
+		Port:             portNum,
+		Username:         dbOpts.User,
+		Password:         dbOpts.Password,
+		Manifest:         []byte("tables:\n  - table: users\n"),
+		OutputFile:       filepath.Join(dir, "{{database}}.sql"),
+		AuditLog:         filepath.Join(dir, "{{database}}.audit.jsonl"),
+		Format:           "plain",
+		Dialect:          "postgresql",
+		Jobs:             1,
+		SensitivePattern: regexp.MustCompile("password"),
+		Databases:        []string{dbOpts.Database, "pg_dump_sample_missing"},
+		DatabaseJobs:     2,
+	}
+
+	err := dumpDatabases(opts)
+	if err == nil || !strings.Contains(err.Error(), "database pg_dump_sample_missing") {
+		t.Errorf("expected the missing database to fail, got %v", err)
+	}
+	out, err := os.ReadFile(filepath.Join(dir, dbOpts.Database+".sql"))
+	if err != nil {
+		t.Fatalf("expected a dump of %s: %v", dbOpts.Database, err)
+	}
+	if !strings.Contains(string(out), "alice@example.com") {
+		t.Errorf("unexpected dump:\n%s", out)
+	}
+	// Every database has an audit log of its own
+	audit, err := os.ReadFile(filepath.Join(dir, dbOpts.Database+".audit.jsonl"))
+	if err != nil || !strings.Contains(string(audit), `{"table":"users","key":{"id":"1"}}`) {
+		t.Errorf("expected the audit log of %s, got %q, %v", dbOpts.Database, audit, err)
+	}
+}
+
+func TestMakeDump_Shards(t *testing.T) {
+	db := requireDB(t)
+	shard := pg.Connect(testDBOpts())
+	defer shard.Close()
+
+	manifest := &Manifest{Tables: []ManifestItem{{
+		Table:      "users",
+		Query:      "SELECT * FROM users WHERE id = 1",
+		Transforms: map[string]Transform{"username": {Type: "redact"}},
+	}}}
+	var buf bytes.Buffer
+	err := makeDump(db, manifest, &buf, DumpOptions{Shards: []*pg.DB{shard}})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+	out := buf.String()
+	if n := strings.Count(out, "alice@example.com"); n != 2 {
+		t.Errorf("expected the row of each shard in the same dump, got %d:\n%s", n, out)
+	}
+	if strings.Contains(out, "\talice\t") {
+		t.Errorf("expected the rows of every shard to be transformed, got:\n%s", out)
+	}
+}
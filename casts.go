@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// castColumns returns query, selecting the rows of table, with its columns
+// cols cast to the types given by casts, by column, so that they can be
+// loaded into columns of other types, e.g. enums which don't exist where the
+// dump is restored. All rows of the table are selected if query is empty.
+func castColumns(query string, table string, cols []string, casts map[string]string) (string, error) {
+	if len(casts) == 0 {
+		return query, nil
+	}
+	for col, typ := range casts {
+		if !slices.Contains(cols, col) {
+			return "", fmt.Errorf("cast of unknown column %s", col)
+		}
+		if strings.TrimSpace(typ) == "" {
+			return "", fmt.Errorf("cast of column %s has no type", col)
+		}
+	}
+
+	if query == "" {
+		query = fmt.Sprintf("SELECT * FROM %s", table)
+	}
+	exprs := make([]string, 0, len(cols))
+	for _, col := range cols {
+		if typ, ok := casts[col]; ok {
+			exprs = append(exprs, fmt.Sprintf("CAST(c.%s AS %s) AS %s", quoteIdent(col), typ, quoteIdent(col)))
+		} else {
+			exprs = append(exprs, "c."+quoteIdent(col))
+		}
+	}
+	return fmt.Sprintf("SELECT %s FROM (%s) AS c", strings.Join(exprs, ", "), query), nil
+}
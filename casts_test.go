@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestCastColumns(t *testing.T) {
+	cols := []string{"id", "status"}
+	query, err := castColumns("", "orders", cols, map[string]string{"status": "text"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `SELECT c."id", CAST(c."status" AS text) AS "status" FROM (SELECT * FROM orders) AS c`
+	if query != expected {
+		t.Errorf("expected %s, got %s", expected, query)
+	}
+
+	query, err = castColumns("SELECT * FROM orders LIMIT 5", "orders", cols, nil)
+	if err != nil || query != "SELECT * FROM orders LIMIT 5" {
+		t.Errorf("expected the query to be kept without casts, got %s, %v", query, err)
+	}
+
+	for _, casts := range []map[string]string{{"missing": "text"}, {"status": " "}} {
+		if _, err := castColumns("", "orders", cols, casts); err == nil {
+			t.Errorf("expected an error for casts %v", casts)
+		}
+	}
+}
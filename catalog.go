@@ -0,0 +1,232 @@
+package main
+
+import (
+	"slices"
+	"sync"
+
+	pg "github.com/go-pg/pg/v10"
+)
+
+// catalogs holds the catalogs loaded by loadCatalog, by database.
+var catalogs sync.Map
+
+// catalog holds the metadata of every table of a database, by canonical table
+// name, so that it can be loaded in a few queries instead of querying every
+// dumped table separately.
+type catalog struct {
+	columns     map[string][]string
+	primaryKeys map[string][]string
+	foreignKeys []ForeignKey
+	sequences   map[string][]Sequence
+	rows        map[string]int64
+}
+
+// Sequence is a sequence owned by a column of a table, like the sequences of
+// serial and identity columns. Name is the canonical name of the sequence.
+type Sequence struct {
+	Name   string
+	Column string
+}
+
+// loadCatalog loads the metadata of all the tables of the database. Until
+// forgetCatalog is called, the metadata of tables referred to by their
+// canonical names is read from it instead of the database, so tables created
+// or altered in the meantime aren't seen.
+func loadCatalog(db *pg.DB) error {
+	c := catalog{
+		columns:     make(map[string][]string),
+		primaryKeys: make(map[string][]string),
+		sequences:   make(map[string][]Sequence),
+		rows:        make(map[string]int64),
+	}
+
+	var tables []struct {
+		Tablename string
+		Columns   []string `pg:",array"`
+		Rows      int64
+	}
+	generated := ""
+	if serverVersion(db) >= PG12 {
+		generated = "AND a.attgenerated = ''"
+	}
+	sql := `
+		SELECT
+			` + relNameSQL("c.oid") + ` AS tablename,
+			ARRAY(
+				SELECT a.attname
+				FROM pg_catalog.pg_attribute a
+				WHERE
+					a.attrelid = c.oid
+					AND a.attnum > 0
+					AND a.attisdropped = FALSE
+					` + generated + `
+				ORDER BY a.attnum
+			)::text[] AS columns,
+			GREATEST(c.reltuples, 0)::bigint AS rows
+		FROM pg_catalog.pg_class c
+		JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE
+			c.relkind IN ('r', 'p', 'v', 'm', 'f')
+			AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+			AND n.nspname !~ '^pg_toast'
+	`
+	_, err := db.Query(&tables, sql)
+	if err != nil {
+		return err
+	}
+	for _, v := range tables {
+		c.columns[v.Tablename] = v.Columns
+		c.rows[v.Tablename] = v.Rows
+	}
+
+	var pks []struct {
+		Tablename string
+		Columns   []string `pg:",array"`
+	}
+	sql = `
+		SELECT
+			` + relNameSQL("c.conrelid") + ` AS tablename,
+			ARRAY(
+				SELECT a.attname
+				FROM unnest(c.conkey) WITH ORDINALITY AS k(attnum, n)
+				JOIN pg_catalog.pg_attribute a
+					ON a.attrelid = c.conrelid AND a.attnum = k.attnum
+				ORDER BY k.n
+			)::text[] AS columns
+		FROM pg_catalog.pg_constraint c
+		WHERE c.contype = 'p'
+	`
+	_, err = db.Query(&pks, sql)
+	if err != nil {
+		return err
+	}
+	for _, v := range pks {
+		c.primaryKeys[v.Tablename] = v.Columns
+	}
+
+	c.foreignKeys, err = getForeignKeys(db)
+	if err != nil {
+		return err
+	}
+
+	var sequences []struct {
+		Tablename string
+		Colname   string
+		Seqname   string
+	}
+	// Sequences of serial columns depend on them automatically, those of
+	// identity columns internally
+	sql = `
+		SELECT
+			` + relNameSQL("d.refobjid") + ` AS tablename,
+			a.attname AS colname,
+			` + relNameSQL("d.objid") + ` AS seqname
+		FROM pg_catalog.pg_depend d
+		JOIN pg_catalog.pg_class s ON s.oid = d.objid AND s.relkind = 'S'
+		JOIN pg_catalog.pg_attribute a
+			ON a.attrelid = d.refobjid AND a.attnum = d.refobjsubid
+		WHERE
+			d.classid = 'pg_catalog.pg_class'::regclass
+			AND d.refclassid = 'pg_catalog.pg_class'::regclass
+			AND d.deptype IN ('a', 'i')
+		ORDER BY tablename, a.attnum
+	`
+	_, err = db.Query(&sequences, sql)
+	if err != nil {
+		return err
+	}
+	for _, v := range sequences {
+		c.sequences[v.Tablename] = append(c.sequences[v.Tablename], Sequence{Name: v.Seqname, Column: v.Colname})
+	}
+
+	catalogs.Store(db, &c)
+	return nil
+}
+
+// forgetCatalog drops the catalog loaded by loadCatalog.
+func forgetCatalog(db *pg.DB) {
+	catalogs.Delete(db)
+}
+
+// cachedCatalog returns the catalog of db if it was loaded and knows table
+// by that name, nil otherwise.
+func cachedCatalog(db *pg.DB, table string) *catalog {
+	v, ok := catalogs.Load(db)
+	if !ok {
+		return nil
+	}
+	c := v.(*catalog)
+	if _, ok := c.columns[table]; !ok {
+		return nil
+	}
+	return c
+}
+
+// tableForeignKeys returns the foreign keys of the catalog defined on table
+// and, if refTable is given, referencing it.
+func (c *catalog) tableForeignKeys(table string, refTable string) []ForeignKey {
+	fks := make([]ForeignKey, 0)
+	for _, fk := range c.foreignKeys {
+		if fk.Table == table && (refTable == "" || fk.RefTable == refTable) {
+			fks = append(fks, fk)
+		}
+	}
+	return fks
+}
+
+// getOwnedSequences returns the sequences owned by columns of the table.
+func getOwnedSequences(db *pg.DB, table string) ([]Sequence, error) {
+	if c := cachedCatalog(db, table); c != nil {
+		return slices.Clone(c.sequences[table]), nil
+	}
+
+	var model []struct {
+		Colname string
+		Seqname string
+	}
+	sql := `
+		SELECT
+			a.attname AS colname,
+			` + relNameSQL("d.objid") + ` AS seqname
+		FROM pg_catalog.pg_depend d
+		JOIN pg_catalog.pg_class s ON s.oid = d.objid AND s.relkind = 'S'
+		JOIN pg_catalog.pg_attribute a
+			ON a.attrelid = d.refobjid AND a.attnum = d.refobjsubid
+		WHERE
+			d.classid = 'pg_catalog.pg_class'::regclass
+			AND d.refclassid = 'pg_catalog.pg_class'::regclass
+			AND d.refobjid = ?::regclass
+			AND d.deptype IN ('a', 'i')
+		ORDER BY a.attnum
+	`
+	_, err := db.Query(&model, sql, table)
+	if err != nil {
+		return nil, err
+	}
+
+	sequences := make([]Sequence, 0)
+	for _, v := range model {
+		sequences = append(sequences, Sequence{Name: v.Seqname, Column: v.Colname})
+	}
+	return sequences, nil
+}
+
+// estimateRows returns the number of rows of the table estimated by the
+// planner statistics, 0 if the table hasn't been analyzed yet.
+func estimateRows(db *pg.DB, table string) (int64, error) {
+	if c := cachedCatalog(db, table); c != nil {
+		return c.rows[table], nil
+	}
+
+	var rows int64
+	_, err := db.QueryOne(pg.Scan(&rows), `SELECT GREATEST(reltuples, 0)::bigint FROM pg_catalog.pg_class WHERE oid = ?::regclass`, table)
+	return rows, err
+}
+
+// getTableSize returns the size of the table on disk in bytes, including its
+// indexes and TOAST data.
+func getTableSize(db *pg.DB, table string) (int64, error) {
+	var size int64
+	_, err := db.QueryOne(pg.Scan(&size), `SELECT pg_catalog.pg_total_relation_size(?::regclass)`, table)
+	return size, err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	pg "github.com/go-pg/pg/v10"
+)
+
+func TestCachedCatalog(t *testing.T) {
+	db := &pg.DB{}
+	catalogs.Store(db, &catalog{
+		columns: map[string][]string{
+			"users":          {"id", "manager_id", "name"},
+			"billing.orders": {"id", "user_id"},
+		},
+		primaryKeys: map[string][]string{"users": {"id"}},
+		foreignKeys: []ForeignKey{
+			{Name: "orders_user_id_fkey", Table: "billing.orders", Columns: []string{"user_id"}, RefTable: "users", RefColumns: []string{"id"}},
+			{Name: "users_manager_id_fkey", Table: "users", Columns: []string{"manager_id"}, RefTable: "users", RefColumns: []string{"id"}},
+		},
+		sequences: map[string][]Sequence{"users": {{Name: "users_id_seq", Column: "id"}}},
+	})
+	defer forgetCatalog(db)
+
+	cols, err := getTableCols(db, "users")
+	if err != nil || !reflect.DeepEqual(cols, []string{"id", "manager_id", "name"}) {
+		t.Errorf("unexpected columns %v (%v)", cols, err)
+	}
+
+	pk, err := getPrimaryKey(db, "billing.orders")
+	if err != nil || len(pk) != 0 {
+		t.Errorf("expected no primary key, got %v (%v)", pk, err)
+	}
+
+	table, err := resolveTable(db, "billing.orders")
+	if err != nil || table != "billing.orders" {
+		t.Errorf("expected canonical name to resolve to itself, got %q (%v)", table, err)
+	}
+
+	deps, err := getTableDeps(db, "billing.orders")
+	if err != nil || !reflect.DeepEqual(deps, []string{"users"}) {
+		t.Errorf("unexpected dependencies %v (%v)", deps, err)
+	}
+
+	selfRefs, err := getSelfReferences(db, "users")
+	if err != nil || len(selfRefs) != 1 || selfRefs[0].Name != "users_manager_id_fkey" {
+		t.Errorf("unexpected self references %v (%v)", selfRefs, err)
+	}
+
+	sequences, err := getOwnedSequences(db, "users")
+	if err != nil || !reflect.DeepEqual(sequences, []Sequence{{Name: "users_id_seq", Column: "id"}}) {
+		t.Errorf("unexpected sequences %v (%v)", sequences, err)
+	}
+
+	if cachedCatalog(db, "public.users") != nil {
+		t.Error("expected names not in the catalog to be looked up in the database")
+	}
+}
+
+func TestLoadCatalog(t *testing.T) {
+	db := requireDB(t)
+
+	tables := []string{"users", "posts", "comments"}
+	expected := make(map[string][]string)
+	for _, table := range tables {
+		cols, err := getTableCols(db, table)
+		if err != nil {
+			t.Fatalf("getTableCols error: %v", err)
+		}
+		expected[table] = cols
+	}
+
+	err := loadCatalog(db)
+	if err != nil {
+		t.Fatalf("loadCatalog error: %v", err)
+	}
+	defer forgetCatalog(db)
+
+	for _, table := range tables {
+		if cachedCatalog(db, table) == nil {
+			t.Fatalf("table %q missing from the catalog", table)
+		}
+		cols, err := getTableCols(db, table)
+		if err != nil || !reflect.DeepEqual(cols, expected[table]) {
+			t.Errorf("table %q: expected columns %v, got %v (%v)", table, expected[table], cols, err)
+		}
+	}
+}
@@ -0,0 +1,606 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	pg "github.com/go-pg/pg/v10"
+)
+
+const (
+	// CHANGES_DECODER is the output plugin of the replication slot, which
+	// comes with PostgreSQL
+	CHANGES_DECODER = "test_decoding"
+
+	// CHANGES_STATE_FILE keeps the sampled keys and the number of files
+	// written in the changes directory, so that following can be resumed
+	CHANGES_STATE_FILE = "changes.json"
+
+	// CHANGES_TEMP_TABLE is the prefix of the temporary tables the changed
+	// rows are loaded into before they are merged
+	CHANGES_TEMP_TABLE = "pg_dump_sample_changes"
+
+	// CHANGES_BATCH_SIZE is about the most changes read from the replication
+	// slot at once, which are written to a file of their own. Transactions
+	// aren't split, so a batch ends with the transaction passing it.
+	CHANGES_BATCH_SIZE = 10000
+)
+
+// changeFeed follows the changes to the sampled rows through a logical
+// replication slot.
+type changeFeed struct {
+	Slot   string           `json:"slot"`
+	Files  int              `json:"files"`
+	Tables []*followedTable `json:"tables"`
+
+	// Hash of the manifest the sample was dumped with
+	Manifest string `json:"manifest,omitempty"`
+}
+
+// followedTable is a dumped table whose changes are followed: changes to the
+// rows with the sampled keys, and new rows if the whole table is dumped.
+type followedTable struct {
+	// Canonical name of the table and the name it was dumped with
+	Name  string `json:"name"`
+	Table string `json:"table"`
+
+	Key     []string `json:"key"`
+	Inserts bool     `json:"inserts"`
+
+	// Sampled keys, encoded as COPY text format rows. They're the keys of
+	// the rows in the database, before transforms.
+	Keys []string `json:"keys"`
+	keys map[string]bool
+
+	// The key is transformed in the sample, where deleted rows can't be
+	// found by their key
+	KeyTransformed bool `json:"key_transformed,omitempty"`
+}
+
+func (t *followedTable) has(key []string) bool {
+	if t.keys == nil {
+		t.keys = make(map[string]bool, len(t.Keys))
+		for _, k := range t.Keys {
+			t.keys[k] = true
+		}
+	}
+	return t.keys[encodeKey(key)]
+}
+
+func (t *followedTable) add(key []string) {
+	if !t.has(key) {
+		t.keys[encodeKey(key)] = true
+		t.Keys = append(t.Keys, encodeKey(key))
+	}
+}
+
+func encodeKey(key []string) string {
+	row := make([]*string, 0, len(key))
+	for i := range key {
+		row = append(row, &key[i])
+	}
+	return encodeCopyRow(row)
+}
+
+// change is a change decoded from the output of test_decoding: the keys of
+// the changed row, the old and the new one if the key was updated, or none
+// if the table has no replica identity.
+type change struct {
+	Table string
+	Op    string
+	Keys  []map[string]string
+}
+
+// parseChange decodes a line of the output of test_decoding, e.g.
+//
+//	table public.users: UPDATE: id[integer]:1 name[text]:'alice'
+//
+// Lines which don't describe changes to rows, like BEGIN and COMMIT, return
+// nil.
+func parseChange(line string) (*change, error) {
+	if !strings.HasPrefix(line, "table ") {
+		return nil, nil
+	}
+	rest := line[len("table "):]
+	var c change
+	for _, op := range []string{"INSERT", "UPDATE", "DELETE"} {
+		if i := strings.Index(rest, ": "+op+": "); i != -1 {
+			c.Table, c.Op, rest = rest[:i], op, rest[i+len(op)+4:]
+			break
+		}
+	}
+	if c.Op == "" {
+		// e.g. TRUNCATE
+		return nil, nil
+	}
+	if rest == "(no-tuple-data)" {
+		// The table has no replica identity
+		return &c, nil
+	}
+
+	tuple := make(map[string]string)
+	for rest != "" {
+		if strings.HasPrefix(rest, "old-key: ") || strings.HasPrefix(rest, "new-tuple: ") {
+			if len(tuple) > 0 {
+				c.Keys = append(c.Keys, tuple)
+				tuple = make(map[string]string)
+			}
+			rest = rest[strings.Index(rest, " ")+1:]
+			continue
+		}
+
+		var name string
+		if strings.HasPrefix(rest, `"`) {
+			// Quotes are doubled inside quoted names
+			end := 1
+			for end < len(rest) && (rest[end] != '"' || strings.HasPrefix(rest[end:], `""`)) {
+				if rest[end] == '"' {
+					end++
+				}
+				end++
+			}
+			if end >= len(rest) {
+				return nil, fmt.Errorf("unterminated column name in %q", line)
+			}
+			name = strings.ReplaceAll(rest[1:end], `""`, `"`)
+			rest = rest[end+1:]
+		} else {
+			end := strings.IndexByte(rest, '[')
+			if end == -1 {
+				return nil, fmt.Errorf("missing column type in %q", line)
+			}
+			name, rest = rest[:end], rest[end:]
+		}
+		// Types may have brackets of their own, like integer[]
+		end := strings.Index(rest, "]:")
+		if !strings.HasPrefix(rest, "[") || end == -1 {
+			return nil, fmt.Errorf("missing column type in %q", line)
+		}
+		rest = rest[end+2:]
+
+		var value string
+		if strings.HasPrefix(rest, "'") {
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest); i++ {
+				if rest[i] == '\'' {
+					if strings.HasPrefix(rest[i:], "''") {
+						b.WriteByte('\'')
+						i++
+						continue
+					}
+					break
+				}
+				b.WriteByte(rest[i])
+			}
+			if i >= len(rest) {
+				return nil, fmt.Errorf("unterminated value in %q", line)
+			}
+			value, rest = b.String(), rest[i+1:]
+		} else {
+			end := strings.IndexByte(rest, ' ')
+			if end == -1 {
+				end = len(rest)
+			}
+			value, rest = rest[:end], rest[end:]
+		}
+		tuple[name] = value
+		rest = strings.TrimPrefix(rest, " ")
+	}
+	c.Keys = append(c.Keys, tuple)
+	return &c, nil
+}
+
+// followChanges writes the initial sample of the manifest into dir, unless
+// it was already written, and then, every interval until ctx is done,
+// writes the changes to the sampled rows into the next numbered SQL file.
+// The files restore the sample as of their time when loaded in order. It only
+// resumes following with another manifest than the sample's if forced.
+func followChanges(ctx context.Context, w io.Writer, db *pg.DB, manifest *Manifest, dir string, slot string, interval time.Duration, force bool, opts DumpOptions) error {
+	if opts.ExcludeSubjects != "" {
+		var err error
+		opts.exclusions, err = loadSubjectExclusions(db, opts.ExcludeSubjects)
+		if err != nil {
+			return err
+		}
+	}
+
+	feed, err := readChangeFeed(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		feed, err = startChangeFeed(db, manifest, dir, slot, opts)
+		if err == nil {
+			fmt.Fprintf(w, "%s written, following changes\n", changesFile(dir, 0))
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if feed.Slot != slot {
+		return fmt.Errorf("%s follows the changes of slot %s, not %s", dir, feed.Slot, slot)
+	}
+	err = checkFeedManifest(dir, feed, manifest, force)
+	if err != nil {
+		return err
+	}
+	if feed.Manifest != manifest.Hash {
+		feed.Manifest = manifest.Hash
+		err = writeChangeFeed(dir, feed)
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		// The changes are read in batches until the slot has none left
+		for more := true; more; {
+			var written bool
+			written, more, err = pollChanges(db, manifest, dir, feed, opts)
+			if err != nil {
+				return err
+			}
+			if written {
+				fmt.Fprintf(w, "%s written\n", changesFile(dir, feed.Files-1))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// checkFeedManifest returns an error if feed was started with another
+// manifest than manifest, as the sample and its changes would then select
+// and transform rows differently, unless forced.
+func checkFeedManifest(dir string, feed *changeFeed, manifest *Manifest, force bool) error {
+	if force || feed.Manifest == "" || feed.Manifest == manifest.Hash {
+		return nil
+	}
+	return fmt.Errorf("%s was started with another manifest (SHA-256 %s, now %s), use --force to resume with this one", dir, feed.Manifest, manifest.Hash)
+}
+
+func changesFile(dir string, n int) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d.sql", n))
+}
+
+func readChangeFeed(dir string) (*changeFeed, error) {
+	data, err := os.ReadFile(filepath.Join(dir, CHANGES_STATE_FILE))
+	if err != nil {
+		return nil, err
+	}
+	var feed changeFeed
+	err = json.Unmarshal(data, &feed)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", CHANGES_STATE_FILE, err)
+	}
+	return &feed, nil
+}
+
+func writeChangeFeed(dir string, feed *changeFeed) error {
+	data, err := json.Marshal(feed)
+	if err != nil {
+		return err
+	}
+	// Replaced at once, so that it's never left half written
+	path := filepath.Join(dir, CHANGES_STATE_FILE)
+	err = os.WriteFile(path+".tmp", data, 0666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// startChangeFeed creates the replication slot and then dumps the sample
+// into the first file of dir, recording the keys of the dumped rows. Changes
+// committed while the dump starts may be both in the dump and in the first
+// changes, which is harmless since loading changes is idempotent.
+func startChangeFeed(db *pg.DB, manifest *Manifest, dir string, slot string, opts DumpOptions) (*changeFeed, error) {
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec("SELECT pg_create_logical_replication_slot(?, ?)", slot, CHANGES_DECODER)
+	if err != nil {
+		return nil, fmt.Errorf("create replication slot %s: %w", slot, err)
+	}
+	// The slot would hold back WAL with nobody following it
+	started := false
+	defer func() {
+		if !started {
+			db.Exec("SELECT pg_drop_replication_slot(?)", slot)
+		}
+	}()
+
+	f, err := os.Create(changesFile(dir, 0))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	opts.audit = newAuditLog()
+	err = makeDump(db, manifest, f, opts)
+	if err != nil {
+		return nil, err
+	}
+	err = f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// Tables are followed in the order they were dumped, parents first
+	feed := &changeFeed{Slot: slot, Files: 1, Manifest: manifest.Hash}
+	iterator, err := NewManifestIterator(db, manifest)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		v, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			break
+		}
+		t := opts.audit.tables[v.Table]
+		if t == nil {
+			continue
+		}
+		if t.key == nil {
+			opts.warn("changes to %s aren't followed, its primary key isn't dumped", v.Table)
+			continue
+		}
+		name, err := resolveTable(db, v.Table)
+		if err != nil {
+			return nil, err
+		}
+		ft := &followedTable{Name: name, Table: v.Table, Key: t.key, Keys: make([]string, 0, len(t.keys))}
+		for _, key := range t.keys {
+			ft.Keys = append(ft.Keys, encodeCopyRow(key))
+		}
+		if item := findItem(manifest, v.Table); item != nil {
+			ft.Inserts = item.Query == "" && item.Sample == nil && item.SampleHash == nil && item.PerParent == nil && item.Limit == 0 && item.Sampler == nil
+			transforms, err := itemTransforms(*item)
+			if err != nil {
+				return nil, err
+			}
+			for _, col := range ft.Key {
+				if _, ok := transforms[col]; ok {
+					ft.KeyTransformed = true
+				}
+			}
+			if ft.KeyTransformed {
+				opts.warn("rows deleted from %s aren't deleted from the sample, as its primary key is transformed", v.Table)
+			}
+		}
+		feed.Tables = append(feed.Tables, ft)
+	}
+	err = writeChangeFeed(dir, feed)
+	if err != nil {
+		return nil, err
+	}
+	started = true
+	return feed, nil
+}
+
+// findItem returns the manifest item of table, nil if it's only dumped as a
+// dependency.
+func findItem(manifest *Manifest, table string) *ManifestItem {
+	for i, v := range manifest.Tables {
+		if v.Table == table {
+			return &manifest.Tables[i]
+		}
+	}
+	return nil
+}
+
+// pollChanges writes the changes to the followed rows in the next batch the
+// replication slot has into the next file of dir, if there are any, and
+// moves the slot past them. It tells whether the batch was written, and
+// whether the slot may have more changes.
+func pollChanges(db *pg.DB, manifest *Manifest, dir string, feed *changeFeed, opts DumpOptions) (bool, bool, error) {
+	var changes []struct {
+		Lsn  string
+		Data string
+	}
+	_, err := db.Query(&changes, "SELECT lsn::text AS lsn, data FROM pg_logical_slot_peek_changes(?, NULL, ?)", feed.Slot, CHANGES_BATCH_SIZE)
+	if err != nil {
+		return false, false, fmt.Errorf("read replication slot %s: %w", feed.Slot, err)
+	}
+	if len(changes) == 0 {
+		return false, false, nil
+	}
+
+	tables := make(map[string]*followedTable, len(feed.Tables))
+	for _, t := range feed.Tables {
+		tables[t.Name] = t
+	}
+	names := make(map[string]string)
+	changed := make(map[*followedTable][][]string)
+	inserted := make(map[*followedTable][][]string)
+	seen := make(map[*followedTable]map[string]bool)
+	for _, row := range changes {
+		c, err := parseChange(row.Data)
+		if err != nil {
+			return false, false, err
+		}
+		if c == nil {
+			continue
+		}
+		name, ok := names[c.Table]
+		if !ok {
+			name, err = resolveTable(db, c.Table)
+			var notFound *TableNotFoundError
+			if errors.As(err, &notFound) {
+				// Dropped since
+				name, err = "", nil
+			}
+			if err != nil {
+				return false, false, err
+			}
+			names[c.Table] = name
+		}
+		t := tables[name]
+		if t == nil {
+			continue
+		}
+		if len(c.Keys) == 0 {
+			return false, false, fmt.Errorf("%s of %s without the key of the row, the table needs a replica identity", c.Op, t.Table)
+		}
+		if seen[t] == nil {
+			seen[t] = make(map[string]bool)
+		}
+		for _, tuple := range c.Keys {
+			key := make([]string, 0, len(t.Key))
+			for _, col := range t.Key {
+				key = append(key, tuple[col])
+			}
+			if seen[t][encodeKey(key)] {
+				continue
+			}
+			if t.has(key) {
+				changed[t] = append(changed[t], key)
+			} else if t.Inserts && c.Op == "INSERT" {
+				changed[t] = append(changed[t], key)
+				inserted[t] = append(inserted[t], key)
+			} else {
+				continue
+			}
+			seen[t][encodeKey(key)] = true
+		}
+	}
+
+	written := len(changed) > 0
+	if written {
+		err = writeChanges(changesFile(dir, feed.Files), db, manifest, feed, changed, opts)
+		if err != nil {
+			return false, false, err
+		}
+		feed.Files++
+		for t, keys := range inserted {
+			for _, key := range keys {
+				t.add(key)
+			}
+		}
+		err = writeChangeFeed(dir, feed)
+		if err != nil {
+			return false, false, err
+		}
+	}
+
+	_, err = db.Exec("SELECT pg_replication_slot_advance(?, ?::pg_lsn)", feed.Slot, changes[len(changes)-1].Lsn)
+	if err != nil {
+		return false, false, fmt.Errorf("advance replication slot %s: %w", feed.Slot, err)
+	}
+	return written, len(changes) >= CHANGES_BATCH_SIZE, nil
+}
+
+// writeChanges writes SQL which loads the current rows of the changed keys,
+// with the manifest's transforms, and deletes the rows which are gone.
+// Tables are merged in the order they were dumped, and rows are deleted in
+// the reverse order, so that foreign keys hold.
+func writeChanges(path string, db *pg.DB, manifest *Manifest, feed *changeFeed, changed map[*followedTable][][]string, opts DumpOptions) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	beginDump(f)
+	if opts.ReplicaRole {
+		replicaRole(f)
+	}
+	temps := make(map[*followedTable]string)
+	for i, t := range feed.Tables {
+		keys := changed[t]
+		if len(keys) == 0 {
+			continue
+		}
+		temp := fmt.Sprintf("%s_%d", CHANGES_TEMP_TABLE, i)
+		temps[t] = temp
+
+		v := ManifestItem{Table: t.Table}
+		if item := findItem(manifest, t.Table); item != nil {
+			v = *item
+		}
+		v.Query = fmt.Sprintf("SELECT * FROM %s WHERE (%s) IN (%s)", t.Table, quoteIdents(t.Key), keyList(keys))
+		v.Sample, v.SampleHash, v.PerParent, v.Sampler = nil, nil, nil, nil
+		v.Limit, v.ChunkBy, v.ChunkSize, v.Compress = 0, "", 0, ""
+		v.PostActions = nil
+
+		cw := &changesDumpWriter{sqlDumpWriter: newSQLDumpWriter(f, opts), temp: temp}
+		err := dumpItem(cw, db, manifest, v, opts)
+		if err != nil {
+			return err
+		}
+		dumpSqlCmd(f, mergeChanges(t.Table, temp, cw.cols, t.Key))
+	}
+	for i := len(feed.Tables) - 1; i >= 0; i-- {
+		t := feed.Tables[i]
+		if temp, ok := temps[t]; ok && !t.KeyTransformed {
+			key := quoteIdents(t.Key)
+			dumpSqlCmd(f, fmt.Sprintf("DELETE FROM %s WHERE (%s) IN (%s) AND (%s) NOT IN (SELECT %s FROM %s)", t.Table, key, keyList(changed[t]), key, key, temp))
+		}
+	}
+	if opts.ReplicaRole {
+		resetReplicaRole(f)
+	}
+	endDump(f)
+	return f.Close()
+}
+
+// keyList returns the keys as a list of row literals for IN.
+func keyList(keys [][]string) string {
+	rows := make([]string, 0, len(keys))
+	for _, key := range keys {
+		literals := make([]string, 0, len(key))
+		for _, v := range key {
+			literals = append(literals, quoteLiteral(v))
+		}
+		rows = append(rows, "("+strings.Join(literals, ", ")+")")
+	}
+	return strings.Join(rows, ", ")
+}
+
+// mergeChanges returns the statement inserting the rows of temp into table,
+// updating the rows which already exist.
+func mergeChanges(table string, temp string, cols []string, key []string) string {
+	sets := make([]string, 0, len(cols))
+	for _, col := range cols {
+		if !slices.Contains(key, col) {
+			sets = append(sets, fmt.Sprintf("%s = EXCLUDED.%s", quoteIdent(col), quoteIdent(col)))
+		}
+	}
+	action := "NOTHING"
+	if len(sets) > 0 {
+		action = "UPDATE SET " + strings.Join(sets, ", ")
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s ON CONFLICT (%s) DO %s", table, quoteIdents(cols), quoteIdents(cols), temp, quoteIdents(key), action)
+}
+
+// changesDumpWriter writes the changed rows of a table into a temporary
+// table, to be merged into the table.
+type changesDumpWriter struct {
+	*sqlDumpWriter
+	temp string
+	cols []string
+}
+
+func (c *changesDumpWriter) BeginTable(table string, query string, cols []string) error {
+	c.cols = cols
+	dumpSqlCmd(c.w, fmt.Sprintf("CREATE TEMP TABLE %s ON COMMIT DROP AS SELECT %s FROM %s WITH NO DATA", c.temp, quoteIdents(cols), table))
+	return c.sqlDumpWriter.BeginTable(c.temp, query, cols)
+}
+
+func (c *changesDumpWriter) EndTable(rows int, duration time.Duration) error {
+	endTable(c.w)
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	pg "github.com/go-pg/pg/v10"
+)
+
+func TestParseChange(t *testing.T) {
+	for _, tc := range []struct {
+		line     string
+		expected *change
+	}{
+		{"BEGIN 529", nil},
+		{"COMMIT 529", nil},
+		{"table public.users: TRUNCATE: (no-flags)", nil},
+		{
+			"table public.users: INSERT: id[integer]:6 username[character varying]:'frank' email[text]:null",
+			&change{Table: "public.users", Op: "INSERT", Keys: []map[string]string{{"id": "6", "username": "frank", "email": "null"}}},
+		},
+		{
+			`table public."My Table": UPDATE: "Key ""A"""[text]:'it''s: here' tags[text[]]:'{a,b}'`,
+			&change{Table: `public."My Table"`, Op: "UPDATE", Keys: []map[string]string{{`Key "A"`: "it's: here", "tags": "{a,b}"}}},
+		},
+		{
+			"table public.users: UPDATE: old-key: id[integer]:1 new-tuple: id[integer]:7 username[text]:'alice'",
+			&change{Table: "public.users", Op: "UPDATE", Keys: []map[string]string{{"id": "1"}, {"id": "7", "username": "alice"}}},
+		},
+		{
+			`table "склад"."商品": INSERT: id[integer]:1 "名前"[text]:'りんご' "цена"[integer]:120`,
+			&change{Table: `"склад"."商品"`, Op: "INSERT", Keys: []map[string]string{{"id": "1", "名前": "りんご", "цена": "120"}}},
+		},
+		{
+			"table public.logs: DELETE: (no-tuple-data)",
+			&change{Table: "public.logs", Op: "DELETE"},
+		},
+		{
+			"table public.users: DELETE: id[integer]:2",
+			&change{Table: "public.users", Op: "DELETE", Keys: []map[string]string{{"id": "2"}}},
+		},
+	} {
+		c, err := parseChange(tc.line)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(c, tc.expected) {
+			t.Errorf("%s: expected %+v, got %+v", tc.line, tc.expected, c)
+		}
+	}
+
+	for _, line := range []string{
+		"table public.users: INSERT: id[integer]:6 name[text]:'unterminated",
+		"table public.users: INSERT: id:6",
+	} {
+		_, err := parseChange(line)
+		if err == nil {
+			t.Errorf("%s: expected an error", line)
+		}
+	}
+}
+
+func TestFollowedTable(t *testing.T) {
+	ft := &followedTable{Key: []string{"id", "lang"}, Keys: []string{"1\ten"}}
+	if !ft.has([]string{"1", "en"}) || ft.has([]string{"1", "pt"}) {
+		t.Fatalf("unexpected sampled keys %v", ft.Keys)
+	}
+	ft.add([]string{"1", "pt"})
+	ft.add([]string{"1", "pt"})
+	if !reflect.DeepEqual(ft.Keys, []string{"1\ten", "1\tpt"}) {
+		t.Errorf("expected the new key to be added once, got %q", ft.Keys)
+	}
+}
+
+func TestCheckFeedManifest(t *testing.T) {
+	manifest := &Manifest{Hash: "new"}
+
+	if err := checkFeedManifest("changes", &changeFeed{Manifest: "new"}, manifest, false); err != nil {
+		t.Errorf("expected the same manifest to resume, got %v", err)
+	}
+	// Feeds started before the hash was kept
+	if err := checkFeedManifest("changes", &changeFeed{}, manifest, false); err != nil {
+		t.Errorf("expected a feed without a hash to resume, got %v", err)
+	}
+	err := checkFeedManifest("changes", &changeFeed{Manifest: "old"}, manifest, false)
+	if err == nil || !strings.Contains(err.Error(), "--force") {
+		t.Errorf("expected another manifest to be refused, got %v", err)
+	}
+	if err := checkFeedManifest("changes", &changeFeed{Manifest: "old"}, manifest, true); err != nil {
+		t.Errorf("expected --force to resume with another manifest, got %v", err)
+	}
+}
+
+func TestMergeChanges(t *testing.T) {
+	if list := keyList([][]string{{"1", "it's"}, {"2", "b"}}); list != "('1', 'it''s'), ('2', 'b')" {
+		t.Errorf("unexpected key list %s", list)
+	}
+
+	sql := mergeChanges("users", "pg_dump_sample_changes_0", []string{"id", "email"}, []string{"id"})
+	expected := `INSERT INTO users ("id", "email") SELECT "id", "email" FROM pg_dump_sample_changes_0 ON CONFLICT ("id") DO UPDATE SET "email" = EXCLUDED."email"`
+	if sql != expected {
+		t.Errorf("unexpected merge\n got: %s\nwant: %s", sql, expected)
+	}
+	sql = mergeChanges("tags", "pg_dump_sample_changes_1", []string{"name"}, []string{"name"})
+	if !strings.HasSuffix(sql, `ON CONFLICT ("name") DO NOTHING`) {
+		t.Errorf("expected rows with only a key to be left as they are, got %s", sql)
+	}
+}
+
+func TestFollowChanges(t *testing.T) {
+	db := requireDB(t)
+	var walLevel string
+	_, err := db.QueryOne(pg.Scan(&walLevel), "SHOW wal_level")
+	if err != nil || walLevel != "logical" {
+		t.Skipf("skipping: the test database needs wal_level = logical, got %q", walLevel)
+	}
+
+	slot := "pg_dump_sample_test"
+	t.Cleanup(func() {
+		db.Exec("SELECT pg_drop_replication_slot(?)", slot)
+		db.Exec("UPDATE users SET email = 'bob@example.com' WHERE id = 2")
+		db.Exec("UPDATE users SET email = 'eve@example.com' WHERE id = 5")
+	})
+	dir := t.TempDir()
+	manifest := &Manifest{Tables: []ManifestItem{{
+		Table:      "users",
+		Query:      "SELECT * FROM users WHERE id <= 2",
+		Transforms: map[string]Transform{"username": {Type: "redact"}},
+	}}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = followChanges(ctx, io.Discard, db, manifest, dir, slot, time.Millisecond, false, DumpOptions{})
+	if err != nil {
+		t.Fatalf("followChanges error: %v", err)
+	}
+	initial, _ := os.ReadFile(filepath.Join(dir, "000000.sql"))
+	if !strings.Contains(string(initial), "bob@example.com") {
+		t.Fatalf("expected the initial sample, got:\n%s", initial)
+	}
+
+	// Only the change to a sampled row is followed
+	_, err = db.Exec("UPDATE users SET email = 'bob@example.org' WHERE id = 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("UPDATE users SET email = 'eve@example.org' WHERE id = 5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = followChanges(ctx, io.Discard, db, manifest, dir, slot, time.Millisecond, false, DumpOptions{})
+	if err != nil {
+		t.Fatalf("followChanges error: %v", err)
+	}
+	changes, err := os.ReadFile(filepath.Join(dir, "000001.sql"))
+	if err != nil {
+		t.Fatalf("expected a file of changes: %v", err)
+	}
+	out := string(changes)
+	if !strings.Contains(out, "bob@example.org") || strings.Contains(out, "eve@") || strings.Contains(out, "\tbob\t") {
+		t.Errorf("expected only the transformed change of bob, got:\n%s", out)
+	}
+	if !strings.Contains(out, "ON CONFLICT (\"id\") DO UPDATE") || !strings.Contains(out, "DELETE FROM users WHERE (\"id\") IN ('2')") {
+		t.Errorf("expected the change to be merged, got:\n%s", out)
+	}
+}
+
+func TestStartChangeFeed_DropsSlotOnError(t *testing.T) {
+	db := requireDB(t)
+	var walLevel string
+	_, err := db.QueryOne(pg.Scan(&walLevel), "SHOW wal_level")
+	if err != nil || walLevel != "logical" {
+		t.Skipf("skipping: the test database needs wal_level = logical, got %q", walLevel)
+	}
+
+	slot := "pg_dump_sample_test_failed"
+	t.Cleanup(func() { db.Exec("SELECT pg_drop_replication_slot(?)", slot) })
+	manifest := &Manifest{Tables: []ManifestItem{{Table: "no_such_table"}}}
+	_, err = startChangeFeed(db, manifest, t.TempDir(), slot, DumpOptions{})
+	if err == nil {
+		t.Fatal("expected the dump of a missing table to fail")
+	}
+	var slots int
+	_, err = db.QueryOne(pg.Scan(&slots), "SELECT count(*) FROM pg_catalog.pg_replication_slots WHERE slot_name = ?", slot)
+	if err != nil || slots != 0 {
+		t.Errorf("expected the slot to be dropped, got %d, %v", slots, err)
+	}
+}
+
+func TestStartChangeFeed_SourceKeys(t *testing.T) {
+	db := requireDB(t)
+	var walLevel string
+	_, err := db.QueryOne(pg.Scan(&walLevel), "SHOW wal_level")
+	if err != nil || walLevel != "logical" {
+		t.Skipf("skipping: the test database needs wal_level = logical, got %q", walLevel)
+	}
+
+	slot := "pg_dump_sample_test_keys"
+	t.Cleanup(func() { db.Exec("SELECT pg_drop_replication_slot(?)", slot) })
+	// The keys of the rows are followed as they are in the database, not as
+	// they were transformed
+	manifest := &Manifest{Tables: []ManifestItem{{
+		Table:      "users",
+		Query:      "SELECT * FROM users WHERE id <= 2",
+		Transforms: map[string]Transform{"id": {Type: "bucket", Size: 10}},
+	}}}
+	feed, err := startChangeFeed(db, manifest, t.TempDir(), slot, DumpOptions{warnFunc: func(string) {}})
+	if err != nil {
+		t.Fatalf("startChangeFeed error: %v", err)
+	}
+	users := feed.Tables[0]
+	if !users.has([]string{"1"}) || !users.has([]string{"2"}) || !users.KeyTransformed {
+		t.Errorf("expected the keys 1 and 2 of the source, got %v", users.Keys)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+
+	pg "github.com/go-pg/pg/v10"
+)
+
+// DEFAULT_CHUNK_SIZE is the number of values of the chunk_by column read by
+// each chunk of a table unless chunk_size says otherwise.
+const DEFAULT_CHUNK_SIZE = 100000
+
+// chunkQueries splits query into queries returning its rows in consecutive
+// ranges of size values of the integer column col, each ordered by orderBy.
+// It returns nil if query returns no rows.
+func chunkQueries(db *pg.DB, query string, col string, size int, orderBy string) ([]string, error) {
+	var bounds struct {
+		Min *int64
+		Max *int64
+	}
+	sql := fmt.Sprintf(`SELECT min(c.%[1]s)::bigint AS min, max(c.%[1]s)::bigint AS max FROM (%[2]s) AS c`, quoteIdent(col), query)
+	_, err := db.QueryOne(&bounds, sql)
+	if err != nil {
+		return nil, err
+	}
+	if bounds.Min == nil {
+		return nil, nil
+	}
+
+	order := ""
+	if orderBy != "" {
+		order = " ORDER BY " + orderBy
+	}
+	chunks := make([]string, 0)
+	for lo := *bounds.Min; ; lo += int64(size) {
+		hi := *bounds.Max
+		if hi-lo >= int64(size) {
+			hi = lo + int64(size) - 1
+		}
+		chunks = append(chunks, fmt.Sprintf("SELECT * FROM (%s) AS c WHERE c.%s BETWEEN %d AND %d%s",
+			query, quoteIdent(col), lo, hi, order))
+		if hi == *bounds.Max {
+			break
+		}
+	}
+	return chunks, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"slices"
+	"strings"
+
+	flags "github.com/jessevdk/go-flags"
+)
+
+// Options taking a path, completed with file names
+var fileOptions = []string{"manifest-file", "output-file", "audit-log", "exclude-subjects", "config", "token-file", "profiles", "transform-key-file", "tls-root-cert"}
+
+var completionShells = []string{"bash", "zsh", "fish"}
+
+var commands = []string{"init", "preview", "check-expiry", "selftest", "follow", "serve", "schema", "completion"}
+
+// writeCompletion writes a completion script for shell covering all options
+// of parser and the completion subcommand.
+func writeCompletion(w io.Writer, parser *flags.Parser, shell string) error {
+	options := groupOptions(parser.Groups())
+	switch shell {
+	case "bash":
+		return writeBashCompletion(w, options)
+	case "zsh":
+		return writeZshCompletion(w, options)
+	case "fish":
+		return writeFishCompletion(w, options)
+	default:
+		return fmt.Errorf("unsupported shell %q, expected one of %s", shell, strings.Join(completionShells, ", "))
+	}
+}
+
+func groupOptions(groups []*flags.Group) []*flags.Option {
+	options := make([]*flags.Option, 0)
+	for _, group := range groups {
+		options = append(options, group.Options()...)
+		options = append(options, groupOptions(group.Groups())...)
+	}
+	return options
+}
+
+func isFlag(option *flags.Option) bool {
+	return option.Field().Type.Kind() == reflect.Bool
+}
+
+func isFileOption(option *flags.Option) bool {
+	return slices.Contains(fileOptions, option.LongName)
+}
+
+func writeBashCompletion(w io.Writer, options []*flags.Option) error {
+	names := make([]string, 0)
+	files := make([]string, 0)
+	values := make([]string, 0)
+	for _, option := range options {
+		optionNames := make([]string, 0, 2)
+		if option.ShortName != 0 {
+			optionNames = append(optionNames, "-"+string(option.ShortName))
+		}
+		optionNames = append(optionNames, "--"+option.LongName)
+		names = append(names, optionNames...)
+		if isFileOption(option) {
+			files = append(files, optionNames...)
+		} else if !isFlag(option) {
+			values = append(values, optionNames...)
+		}
+	}
+
+	_, err := fmt.Fprintf(w, `_pg_dump_sample() {
+	local cur="${COMP_WORDS[COMP_CWORD]}"
+	local prev="${COMP_WORDS[COMP_CWORD-1]}"
+	if [ "$COMP_CWORD" -eq 1 ] && [[ "$cur" != -* ]]; then
+		COMPREPLY=($(compgen -W "%s" -- "$cur"))
+		return
+	fi
+	if [ "${COMP_WORDS[1]}" = "completion" ]; then
+		COMPREPLY=($(compgen -W "%s" -- "$cur"))
+		return
+	fi
+	case "$prev" in
+		%s)
+			COMPREPLY=($(compgen -f -- "$cur"))
+			return
+			;;
+		%s)
+			return
+			;;
+	esac
+	COMPREPLY=($(compgen -W "%s" -- "$cur"))
+}
+complete -F _pg_dump_sample pg_dump_sample
+`, strings.Join(commands, " "), strings.Join(completionShells, " "), strings.Join(files, "|"), strings.Join(values, "|"), strings.Join(names, " "))
+	return err
+}
+
+var zshEscaper = strings.NewReplacer(`'`, `'\''`, `[`, `\[`, `]`, `\]`, `:`, `\:`)
+
+func writeZshCompletion(w io.Writer, options []*flags.Option) error {
+	specs := make([]string, 0)
+	for _, option := range options {
+		description := zshEscaper.Replace(option.Description)
+		action := ""
+		if isFileOption(option) {
+			action = ":file:_files"
+		} else if !isFlag(option) {
+			action = ":value: "
+		}
+		names := []string{"--" + option.LongName}
+		if option.ShortName != 0 {
+			names = append(names, "-"+string(option.ShortName))
+		}
+		for _, name := range names {
+			if action != "" && strings.HasPrefix(name, "--") {
+				name += "="
+			} else if action != "" {
+				name += "+"
+			}
+			specs = append(specs, fmt.Sprintf("'%s[%s]%s'", name, description, action))
+		}
+	}
+
+	_, err := fmt.Fprintf(w, `#compdef pg_dump_sample
+
+if [[ "${words[2]}" == "completion" ]]; then
+	_arguments '2:shell:(%s)'
+	return
+fi
+
+_arguments -s \
+	%s \
+	'1:database or command:(%s)'
+`, strings.Join(completionShells, " "), strings.Join(specs, " \\\n\t"), strings.Join(commands, " "))
+	return err
+}
+
+var fishEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+func writeFishCompletion(w io.Writer, options []*flags.Option) error {
+	var b strings.Builder
+	b.WriteString("complete -c pg_dump_sample -n '__fish_use_subcommand' -f -a init -d 'Write a manifest interactively'\n")
+	b.WriteString("complete -c pg_dump_sample -n '__fish_use_subcommand' -f -a preview -d 'Print the first rows dumped from a table'\n")
+	b.WriteString("complete -c pg_dump_sample -n '__fish_use_subcommand' -f -a completion -d 'Print a shell completion script'\n")
+	fmt.Fprintf(&b, "complete -c pg_dump_sample -n '__fish_seen_subcommand_from completion' -f -a '%s'\n", strings.Join(completionShells, " "))
+	for _, option := range options {
+		b.WriteString("complete -c pg_dump_sample")
+		if option.ShortName != 0 {
+			fmt.Fprintf(&b, " -s %c", option.ShortName)
+		}
+		fmt.Fprintf(&b, " -l %s", option.LongName)
+		if isFileOption(option) {
+			b.WriteString(" -r -F")
+		} else if !isFlag(option) {
+			b.WriteString(" -r -f")
+		}
+		fmt.Fprintf(&b, " -d '%s'\n", fishEscaper.Replace(option.Description))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
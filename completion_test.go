@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	flags "github.com/jessevdk/go-flags"
+)
+
+func testCompletionParser() *flags.Parser {
+	var opts struct {
+		Host         string `short:"h" long:"host" description:"Database server host"`
+		ManifestFile string `short:"f" long:"manifest-file" description:"Path to manifest file"`
+		Analyze      bool   `long:"analyze" description:"Analyze [dumped] tables: it's fast"`
+	}
+	return flags.NewParser(&opts, flags.None)
+}
+
+func TestWriteCompletion(t *testing.T) {
+	for shell, expected := range map[string][]string{
+		"bash": {"--host", "-f|--manifest-file", "--analyze", "compgen -f"},
+		"zsh":  {"'--host=[Database server host]:value: '", "'-f+[Path to manifest file]:file:_files'", `'--analyze[Analyze \[dumped\] tables\: it'\''s fast]'`},
+		"fish": {"-s h -l host -r -f", "-s f -l manifest-file -r -F", `-l analyze -d 'Analyze [dumped] tables: it\'s fast'`},
+	} {
+		var buf bytes.Buffer
+		err := writeCompletion(&buf, testCompletionParser(), shell)
+		if err != nil {
+			t.Fatalf("%s: writeCompletion error: %v", shell, err)
+		}
+		for _, s := range expected {
+			if !strings.Contains(buf.String(), s) {
+				t.Errorf("%s completion should contain %q, got:\n%s", shell, s, buf.String())
+			}
+		}
+		if !strings.Contains(buf.String(), "completion") {
+			t.Errorf("%s completion should complete the completion subcommand", shell)
+		}
+	}
+}
+
+func TestWriteCompletion_UnknownShell(t *testing.T) {
+	err := writeCompletion(&bytes.Buffer{}, testCompletionParser(), "tcsh")
+	if err == nil {
+		t.Error("expected an error for an unsupported shell")
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	flags "github.com/jessevdk/go-flags"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Config holds defaults read from a YAML config file. Options are keyed by
+// the long names of command-line options, e.g. `host` or `fast-restore`,
+// Vars are defaults for the manifest vars, Databases are dumped when no
+// database is given and Schedules are the jobs run by serve.
+type Config struct {
+	Options   map[string]string
+	Vars      map[string]string
+	Databases []string
+	Schedules []ScheduledJob
+}
+
+// ScheduledJob is a dump made by serve on a cron schedule, e.g.
+//
+//	schedules:
+//	  - name: nightly
+//	    cron: "0 3 * * *"
+//	    manifest: nightly.yaml
+//	    output: /srv/samples
+//	    keep: 7
+type ScheduledJob struct {
+	Name string `yaml:"name"`
+	Cron string `yaml:"cron"`
+	// Path of the manifest file, relative to the config file
+	Manifest string `yaml:"manifest"`
+	// Directory the dumps are written to, relative to the config file
+	Output string `yaml:"output"`
+	// Number of dumps kept in the output directory, all if 0
+	Keep int `yaml:"keep"`
+
+	schedule *cronSchedule
+}
+
+// defaultConfigPath returns the path of the config file read unless
+// --config is given.
+func defaultConfigPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".pg_dump_sample.yaml")
+}
+
+func readConfig(r io.Reader) (*Config, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make(map[string]yaml.Node)
+	err = yaml.Unmarshal(data, &nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	config := Config{
+		Options: make(map[string]string),
+		Vars:    make(map[string]string),
+	}
+	for key, node := range nodes {
+		if key == "vars" {
+			err = node.Decode(&config.Vars)
+			if err != nil {
+				return nil, fmt.Errorf("vars: %v", err)
+			}
+			continue
+		}
+		if key == "databases" {
+			err = node.Decode(&config.Databases)
+			if err != nil {
+				return nil, fmt.Errorf("databases: %v", err)
+			}
+			continue
+		}
+		if key == "schedules" {
+			config.Schedules, err = readSchedules(&node)
+			if err != nil {
+				return nil, fmt.Errorf("schedules: %v", err)
+			}
+			continue
+		}
+		if node.Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("%s: expected a single value", key)
+		}
+		config.Options[key] = node.Value
+	}
+	return &config, nil
+}
+
+// readSchedules reads and checks the scheduled jobs of a config file.
+func readSchedules(node *yaml.Node) ([]ScheduledJob, error) {
+	var jobs []ScheduledJob
+	err := node.Decode(&jobs)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(jobs))
+	for i := range jobs {
+		job := &jobs[i]
+		if !profileNameRegexp.MatchString(job.Name) {
+			return nil, fmt.Errorf("invalid job name %q, expected letters, digits, - and _", job.Name)
+		}
+		if names[job.Name] {
+			return nil, fmt.Errorf("job %s defined twice", job.Name)
+		}
+		names[job.Name] = true
+		if job.Manifest == "" || job.Output == "" {
+			return nil, fmt.Errorf("job %s requires a manifest and an output directory", job.Name)
+		}
+		if job.Keep < 0 {
+			return nil, fmt.Errorf("job %s: keep must not be negative", job.Name)
+		}
+		job.schedule, err = parseCron(job.Cron)
+		if err != nil {
+			return nil, fmt.Errorf("job %s: %v", job.Name, err)
+		}
+	}
+	return jobs, nil
+}
+
+// loadConfig reads the config file at path. A missing file is only an error
+// if it was given explicitly.
+func loadConfig(path string, explicit bool) (*Config, error) {
+	if path == "" {
+		return &Config{}, nil
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) && !explicit {
+		return &Config{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	config, err := readConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for i := range config.Schedules {
+		job := &config.Schedules[i]
+		job.Manifest = relativeTo(path, job.Manifest)
+		job.Output = relativeTo(path, job.Output)
+	}
+	return config, nil
+}
+
+// relativeTo resolves the relative path of a file named in the file at
+// base against the directory of base.
+func relativeTo(base string, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(base), path)
+}
+
+// applyConfig sets the options of parser to the values from the config file
+// before the command line is parsed, so that command-line options and
+// environment variables take precedence.
+func applyConfig(parser *flags.Parser, config *Config) error {
+	keys := make([]string, 0, len(config.Options))
+	for key := range config.Options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		option := parser.FindOptionByLongName(key)
+		if option == nil || key == "config" {
+			return fmt.Errorf("unknown option %q in config file", key)
+		}
+		if env := option.EnvKeyWithNamespace(); env != "" {
+			if _, ok := os.LookupEnv(env); ok {
+				continue
+			}
+		}
+		value := config.Options[key]
+		err := option.Set(&value)
+		if err != nil {
+			return fmt.Errorf("config file option %q: %v", key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	flags "github.com/jessevdk/go-flags"
+)
+
+func TestReadConfig(t *testing.T) {
+	config, err := readConfig(strings.NewReader(`
+host: db.example.com
+port: 6432
+fast-restore: true
+vars:
+  matching_user_id: "users.id < 100"
+databases: [tenant_1, tenant_2]
+`))
+	if err != nil {
+		t.Fatalf("readConfig error: %v", err)
+	}
+	if config.Options["host"] != "db.example.com" || config.Options["port"] != "6432" || config.Options["fast-restore"] != "true" {
+		t.Errorf("unexpected options: %v", config.Options)
+	}
+	if config.Vars["matching_user_id"] != "users.id < 100" {
+		t.Errorf("unexpected vars: %v", config.Vars)
+	}
+	if strings.Join(config.Databases, ",") != "tenant_1,tenant_2" {
+		t.Errorf("unexpected databases: %v", config.Databases)
+	}
+
+	_, err = readConfig(strings.NewReader("host: [a, b]\n"))
+	if err == nil {
+		t.Error("expected an error for a list value")
+	}
+}
+
+func TestReadConfig_Schedules(t *testing.T) {
+	config, err := readConfig(strings.NewReader(`
+jobs: 4
+schedules:
+  - name: nightly
+    cron: "0 3 * * *"
+    manifest: nightly.yaml
+    output: /srv/samples
+    keep: 7
+`))
+	if err != nil {
+		t.Fatalf("readConfig error: %v", err)
+	}
+	if config.Options["jobs"] != "4" || len(config.Schedules) != 1 {
+		t.Fatalf("unexpected config: %+v", config)
+	}
+	job := config.Schedules[0]
+	if job.Name != "nightly" || job.Manifest != "nightly.yaml" || job.Output != "/srv/samples" || job.Keep != 7 || job.schedule == nil {
+		t.Errorf("unexpected job: %+v", job)
+	}
+
+	for _, schedules := range []string{
+		"[{name: a b, cron: '@daily', manifest: m.yaml, output: out}]",
+		"[{name: a, cron: '@daily', manifest: m.yaml, output: out}, {name: a, cron: '@daily', manifest: m.yaml, output: out}]",
+		"[{name: a, cron: '@daily', output: out}]",
+		"[{name: a, cron: '@daily', manifest: m.yaml}]",
+		"[{name: a, cron: '@daily', manifest: m.yaml, output: out, keep: -1}]",
+		"[{name: a, cron: '0 3 * *', manifest: m.yaml, output: out}]",
+	} {
+		_, err := readConfig(strings.NewReader("schedules: " + schedules + "\n"))
+		if err == nil {
+			t.Errorf("%s: expected an error", schedules)
+		}
+	}
+}
+
+func TestLoadConfig_Schedules(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	err := os.WriteFile(path, []byte("schedules: [{name: a, cron: '@daily', manifest: m.yaml, output: /srv/out}]\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadConfig(path, true)
+	if err != nil {
+		t.Fatalf("loadConfig error: %v", err)
+	}
+	// Relative paths are relative to the config file
+	if job := config.Schedules[0]; job.Manifest != filepath.Join(dir, "m.yaml") || job.Output != "/srv/out" {
+		t.Errorf("unexpected paths: %+v", job)
+	}
+}
+
+func TestLoadConfig_Missing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing.yaml")
+	config, err := loadConfig(path, false)
+	if err != nil {
+		t.Fatalf("a missing default config file should be ignored: %v", err)
+	}
+	if len(config.Options) != 0 {
+		t.Errorf("expected no options, got %v", config.Options)
+	}
+
+	_, err = loadConfig(path, true)
+	if err == nil {
+		t.Error("expected an error for a missing explicit config file")
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	var opts struct {
+		Host    string `long:"host" default:"/tmp" env:"PG_DUMP_SAMPLE_TEST_HOST"`
+		User    string `long:"username" env:"PG_DUMP_SAMPLE_TEST_USER"`
+		Port    int    `long:"port" default:"5432"`
+		Analyze bool   `long:"analyze"`
+	}
+	t.Setenv("PG_DUMP_SAMPLE_TEST_USER", "from-env")
+
+	parser := flags.NewParser(&opts, flags.None)
+	config := &Config{Options: map[string]string{
+		"host":     "from-config",
+		"username": "from-config",
+		"port":     "6432",
+		"analyze":  "true",
+	}}
+	err := applyConfig(parser, config)
+	if err != nil {
+		t.Fatalf("applyConfig error: %v", err)
+	}
+	_, err = parser.ParseArgs([]string{"--port", "7432"})
+	if err != nil {
+		t.Fatalf("ParseArgs error: %v", err)
+	}
+
+	if opts.Host != "from-config" {
+		t.Errorf("config should override defaults, got host %q", opts.Host)
+	}
+	if opts.User != "from-env" {
+		t.Errorf("environment should override config, got username %q", opts.User)
+	}
+	if opts.Port != 7432 {
+		t.Errorf("command line should override config, got port %d", opts.Port)
+	}
+	if !opts.Analyze {
+		t.Error("expected analyze to be set from config")
+	}
+}
+
+func TestApplyConfig_UnknownOption(t *testing.T) {
+	var opts struct {
+		Host string `long:"host"`
+	}
+	parser := flags.NewParser(&opts, flags.None)
+	err := applyConfig(parser, &Config{Options: map[string]string{"hots": "x"}})
+	if err == nil {
+		t.Error("expected an error for an unknown option")
+	}
+}
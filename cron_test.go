@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	from := time.Date(2026, 10, 17, 14, 30, 20, 0, time.UTC) // a Saturday
+	for _, tc := range []struct {
+		expr     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2026, 10, 17, 14, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, 10, 17, 14, 45, 0, 0, time.UTC)},
+		{"30 2 * * *", time.Date(2026, 10, 18, 2, 30, 0, 0, time.UTC)},
+		{"@daily", time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2026, 10, 17, 15, 0, 0, 0, time.UTC)},
+		{"0 3 * * 1-5", time.Date(2026, 10, 19, 3, 0, 0, 0, time.UTC)},
+		{"0 3 * * 7", time.Date(2026, 10, 18, 3, 0, 0, 0, time.UTC)},
+		{"0 0 1 1 *", time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 12 1,20 * *", time.Date(2026, 10, 20, 12, 0, 0, 0, time.UTC)},
+		// Either the day of month or of week matches if both are given
+		{"0 0 1 * 1", time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	} {
+		c, err := parseCron(tc.expr)
+		if err != nil {
+			t.Errorf("%s: parseCron error: %v", tc.expr, err)
+			continue
+		}
+		if next := c.next(from); !next.Equal(tc.expected) {
+			t.Errorf("%s: expected %s, got %s", tc.expr, tc.expected, next)
+		}
+	}
+}
+
+func TestParseCron_Invalid(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "a * * * *", "@sometimes"} {
+		_, err := parseCron(expr)
+		if err == nil {
+			t.Errorf("%q: expected an error", expr)
+		}
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	pg "github.com/go-pg/pg/v10"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	INCLUDE_DUMP = "\n\\ir %s\n"
+
+	BEGIN_COMPRESSED_TABLE_DUMP = `
+--
+-- Data for Name: %s; Type: TABLE DATA
+%s--
+
+\copy %s (%s) FROM PROGRAM %s
+`
+)
+
+// Programs decompressing the data files of compressed tables
+var decompressors = map[string]string{
+	"gzip": "gzip -dc",
+	"zstd": "zstd -dc",
+}
+
+var compressedExtensions = map[string]string{
+	"gzip": ".gz",
+	"zstd": ".zst",
+}
+
+// IDENT_MAX_BYTES is the length PostgreSQL truncates identifiers to,
+// NAMEDATALEN - 1.
+const IDENT_MAX_BYTES = 63
+
+// splitTableName splits a table name into its schema and table, removing the
+// quoting. Tables without a schema are in the public schema.
+func splitTableName(name string) (string, string) {
+	parts, err := parseTableName(name)
+	if err != nil {
+		// Names of the manifest were checked when reading it, others come
+		// from the catalog
+		return "public", name
+	}
+	if len(parts) == 1 {
+		return "public", parts[0]
+	}
+	return parts[len(parts)-2], parts[len(parts)-1]
+}
+
+// parseTableName splits a table name written as in SQL, e.g. billing.invoices
+// or "Billing"."Invoice.Lines", into its parts the way PostgreSQL does: dots
+// only separate parts outside quotes, unquoted parts are folded to lower
+// case and parts longer than IDENT_MAX_BYTES are truncated. A name may be
+// qualified by its database, then its schema.
+func parseTableName(name string) ([]string, error) {
+	parts := make([]string, 0, 2)
+	var b strings.Builder
+	quoted, partQuoted, ended := false, false, false
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case quoted && c == '"' && i+1 < len(name) && name[i+1] == '"':
+			b.WriteByte('"')
+			i++
+		case quoted && c == '"':
+			quoted, ended = false, true
+		case quoted:
+			b.WriteByte(c)
+		case c == ' ' || c == '\t':
+			// Whitespace is allowed around the dots only
+			if b.Len() > 0 || partQuoted {
+				ended = true
+			}
+		case c == '.':
+			if b.Len() == 0 {
+				return nil, fmt.Errorf("empty name before %q", name[i:])
+			}
+			parts = append(parts, truncateIdent(b.String()))
+			b.Reset()
+			partQuoted, ended = false, false
+		case ended:
+			return nil, fmt.Errorf("unexpected %q after name", name[i:])
+		case c == '"':
+			if b.Len() > 0 {
+				return nil, fmt.Errorf("unexpected quote in %q", name)
+			}
+			quoted, partQuoted = true, true
+		case c >= 'A' && c <= 'Z':
+			b.WriteByte(c + 'a' - 'A')
+		default:
+			b.WriteByte(c)
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quoted name in %q", name)
+	}
+	if b.Len() == 0 {
+		return nil, fmt.Errorf("missing name in %q", name)
+	}
+	parts = append(parts, truncateIdent(b.String()))
+	if len(parts) > 3 {
+		return nil, fmt.Errorf("too many dotted names in %q", name)
+	}
+	return parts, nil
+}
+
+// truncateIdent truncates an identifier to IDENT_MAX_BYTES like PostgreSQL
+// does, without splitting a multibyte character.
+func truncateIdent(v string) string {
+	if len(v) <= IDENT_MAX_BYTES {
+		return v
+	}
+	n := IDENT_MAX_BYTES
+	for n > 0 && !utf8.RuneStart(v[n]) {
+		n--
+	}
+	return v[:n]
+}
+
+// fileName makes an identifier safe to use as a file name.
+func fileName(v string) string {
+	return strings.NewReplacer("/", "_", `\`, "_", ":", "_", "'", "_").Replace(v)
+}
+
+// tableFile returns the path of the data file of table within the dump
+// directory, using slashes as in psql's \ir.
+func tableFile(table string) string {
+	schema, name := splitTableName(table)
+	return path.Join(fileName(schema), fileName(name)+".sql")
+}
+
+// dataFile returns the path of the compressed data file of table within the
+// dump directory.
+func dataFile(table string, compress string) string {
+	return strings.TrimSuffix(tableFile(table), ".sql") + ".copy" + compressedExtensions[compress]
+}
+
+// dumpItemFile dumps a manifest item into its own file in dir.
+func dumpItemFile(dir string, db *pg.DB, manifest *Manifest, v ManifestItem, opts DumpOptions) error {
+	if v.Compress != "" && v.Compress != "none" && decompressors[v.Compress] == "" {
+		return fmt.Errorf("table %s: unknown compression %q", v.Table, v.Compress)
+	}
+
+	file := filepath.Join(dir, filepath.FromSlash(tableFile(v.Table)))
+	err := os.MkdirAll(filepath.Dir(file), 0777)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if decompressors[v.Compress] != "" {
+		err = dumpCompressedItem(f, dir, db, manifest, v, opts)
+	} else {
+		err = dumpItem(newSQLDumpWriter(f, opts), db, manifest, v, opts)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// dumpCompressedItem writes the data of a manifest item into a compressed
+// file, and SQL loading it with psql's \copy into w. Paths are relative to
+// the dump directory, which has to be the working directory of psql.
+func dumpCompressedItem(w io.Writer, dir string, db *pg.DB, manifest *Manifest, v ManifestItem, opts DumpOptions) error {
+	data := dataFile(v.Table, v.Compress)
+	f, err := os.Create(filepath.Join(dir, filepath.FromSlash(data)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cw, err := newCompressor(f, v.Compress)
+	if err != nil {
+		return err
+	}
+
+	q, err := prepareItem(cw, db, manifest, v, opts)
+	if err != nil {
+		return err
+	}
+
+	program := decompressProgram(v.Compress, data)
+	fmt.Fprintf(w, BEGIN_COMPRESSED_TABLE_DUMP, v.Table, provenance(q.Source), v.Table, columnList(q.Cols), program)
+	start := time.Now()
+	rows, err := copyItem(db, v.Table, q)
+	if err != nil {
+		return err
+	}
+	err = cw.Close()
+	if err != nil {
+		return err
+	}
+	duration := time.Since(start)
+	if opts.Deterministic {
+		duration = 0
+	}
+	tableStats(w, rows, duration)
+
+	actions, err := renderPostActions(v, q, rows)
+	if err != nil {
+		return err
+	}
+	for _, sql := range actions {
+		dumpSqlCmd(w, sql)
+	}
+
+	return f.Close()
+}
+
+// decompressProgram returns the psql literal of the shell command writing
+// the decompressed data file to its standard output. Table names may have any
+// character, so the path is quoted for the shell.
+func decompressProgram(compress string, data string) string {
+	return quoteLiteral(fmt.Sprintf("%s %s", decompressors[compress], shellQuote(data)))
+}
+
+func newCompressor(w io.Writer, compress string) (io.WriteCloser, error) {
+	switch compress {
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		return zstd.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("unknown compression %q", compress)
+	}
+}
+
+// writeSchemaScripts writes a restore.sql into every schema directory which
+// loads only the tables of that schema, in dependency order.
+func writeSchemaScripts(dir string, items []ManifestItem, opts DumpOptions) error {
+	schemas := make([]string, 0)
+	tables := make(map[string][]string)
+	for _, v := range items {
+		schema, _ := splitTableName(v.Table)
+		if _, ok := tables[schema]; !ok {
+			schemas = append(schemas, schema)
+		}
+		tables[schema] = append(tables[schema], path.Base(tableFile(v.Table)))
+	}
+
+	for _, schema := range schemas {
+		f, err := os.Create(filepath.Join(dir, fileName(schema), "restore.sql"))
+		if err != nil {
+			return err
+		}
+		writeSchemaScript(f, tables[schema], opts)
+		err = f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeSchemaScript(w io.Writer, files []string, opts DumpOptions) {
+	beginDump(w)
+	if opts.ReplicaRole {
+		replicaRole(w)
+	}
+	for _, file := range files {
+		fmt.Fprintf(w, INCLUDE_DUMP, file)
+	}
+	if opts.ReplicaRole {
+		resetReplicaRole(w)
+	}
+	endDump(w)
+}
+
+const RESTORE_SCRIPT_HEADER = `#!/bin/sh
+# Restores the dump, loading independent tables in parallel. Arguments are
+# passed on to psql, e.g. ./restore.sh -d mydb. JOBS sets the number of
+# concurrent psql sessions.
+set -e
+cd "$(dirname "$0")"
+JOBS=${JOBS:-4}
+
+psql "$@" -X -q -v ON_ERROR_STOP=1 --single-transaction -f session.sql -f pre.sql
+`
+
+// loadLevels groups items into levels which can be loaded in parallel: every
+// item only references items of lower levels.
+func loadLevels(items []ManifestItem, deps map[string][]string) [][]ManifestItem {
+	level := make(map[string]int)
+	levels := make([][]ManifestItem, 0)
+	for _, v := range items {
+		l := 0
+		for _, dep := range deps[v.Table] {
+			if dep == v.Table {
+				continue
+			}
+			if depLevel, ok := level[dep]; ok && depLevel+1 > l {
+				l = depLevel + 1
+			}
+		}
+		level[v.Table] = l
+		for len(levels) <= l {
+			levels = append(levels, make([]ManifestItem, 0))
+		}
+		levels[l] = append(levels[l], v)
+	}
+	return levels
+}
+
+// writeParallelRestore writes restore.sh, which loads the tables of the
+// dump directory in parallel where dependencies allow, together with the
+// SQL it runs before and after loading them.
+func writeParallelRestore(dir string, db *pg.DB, manifest *Manifest, opts DumpOptions, items []ManifestItem, enc *Encoding, extensions []Extension, fks []ForeignKey, indexes []Index, comments []Comment) error {
+	// Dependencies by the names used in the manifest
+	names := make(map[string]string)
+	for _, v := range items {
+		name, err := resolveTable(db, v.Table)
+		if err != nil {
+			return err
+		}
+		names[name] = v.Table
+	}
+	deps := make(map[string][]string)
+	for _, v := range items {
+		tableDeps, err := getTableDeps(db, v.Table)
+		if err != nil {
+			return err
+		}
+		for _, dep := range tableDeps {
+			if name, ok := names[dep]; ok {
+				deps[v.Table] = append(deps[v.Table], name)
+			}
+		}
+	}
+
+	// Every psql session restore.sh runs starts with session.sql
+	session := SESSION_DUMP
+	if opts.ReplicaRole {
+		session += REPLICA_ROLE_DUMP
+	}
+	err := os.WriteFile(filepath.Join(dir, "session.sql"), []byte(session), 0666)
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	if opts.AssertEncoding {
+		assertEncoding(&b, enc)
+	}
+	err = dumpPreamble(&b, manifest, opts, items, extensions, fks, indexes)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(dir, "pre.sql"), []byte(b.String()), 0666)
+	if err != nil {
+		return err
+	}
+
+	b.Reset()
+	err = dumpPostamble(&b, manifest, opts, items, fks, indexes, comments)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(dir, "post.sql"), []byte(b.String()), 0666)
+	if err != nil {
+		return err
+	}
+
+	b.Reset()
+	writeRestoreScript(&b, loadLevels(items, deps))
+	return os.WriteFile(filepath.Join(dir, "restore.sh"), []byte(b.String()), 0777)
+}
+
+func writeRestoreScript(w io.Writer, levels [][]ManifestItem) {
+	fmt.Fprint(w, RESTORE_SCRIPT_HEADER)
+	for _, level := range levels {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "xargs -P \"$JOBS\" -I {} psql \"$@\" -X -q -v ON_ERROR_STOP=1 --single-transaction -f session.sql -f {} <<'EOF'")
+		for _, v := range level {
+			fmt.Fprintln(w, tableFile(v.Table))
+		}
+		fmt.Fprintln(w, "EOF")
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "psql \"$@\" -X -q -v ON_ERROR_STOP=1 --single-transaction -f session.sql -f post.sql")
+}
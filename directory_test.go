@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestSplitTableName(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		schema string
+		table  string
+	}{
+		{"users", "public", "users"},
+		{"billing.invoices", "billing", "invoices"},
+		{`"Billing"."Invoice.Lines"`, "Billing", "Invoice.Lines"},
+		{`"say ""hi"""`, "public", `say "hi"`},
+		{"склад.商品", "склад", "商品"},
+		{`"Склад"."Заказы.2024"`, "Склад", "Заказы.2024"},
+		{"Billing.Invoices", "billing", "invoices"},
+		{`billing . "a.b"`, "billing", "a.b"},
+		{"mydb.billing.invoices", "billing", "invoices"},
+	} {
+		schema, table := splitTableName(tc.name)
+		if schema != tc.schema || table != tc.table {
+			t.Errorf("splitTableName(%q): expected %q %q, got %q %q", tc.name, tc.schema, tc.table, schema, table)
+		}
+	}
+}
+
+func TestParseTableName(t *testing.T) {
+	long := strings.Repeat("a", 70)
+	// 63 bytes are 31 two-byte characters and half of the next one
+	cyrillic := strings.Repeat("ж", 40)
+	for _, tc := range []struct {
+		name     string
+		expected []string
+	}{
+		{long, []string{long[:63]}},
+		{`"` + long + `".t`, []string{long[:63], "t"}},
+		{cyrillic, []string{strings.Repeat("ж", 31)}},
+		{`"a""b".c`, []string{`a"b`, "c"}},
+	} {
+		parts, err := parseTableName(tc.name)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+			continue
+		}
+		if !slices.Equal(parts, tc.expected) {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.expected, parts)
+		}
+	}
+
+	for _, name := range []string{"", "a..b", "a.", ".a", `"a`, `"a"b`, `a"b"`, "a b", `""."x"`, "a.b.c.d"} {
+		_, err := parseTableName(name)
+		if err == nil {
+			t.Errorf("%q: expected an error", name)
+		}
+	}
+}
+
+func TestTableFile(t *testing.T) {
+	if f := tableFile("users"); f != "public/users.sql" {
+		t.Errorf("expected public/users.sql, got %q", f)
+	}
+	if f := tableFile(`billing."a/b"`); f != "billing/a_b.sql" {
+		t.Errorf("expected billing/a_b.sql, got %q", f)
+	}
+	if f := tableFile(`"склад"."商品"`); f != "склад/商品.sql" {
+		t.Errorf("expected склад/商品.sql, got %q", f)
+	}
+}
+
+func TestDataFile(t *testing.T) {
+	if f := dataFile("billing.invoices", "gzip"); f != "billing/invoices.copy.gz" {
+		t.Errorf("expected billing/invoices.copy.gz, got %q", f)
+	}
+	if f := dataFile("users", "zstd"); f != "public/users.copy.zst" {
+		t.Errorf("expected public/users.copy.zst, got %q", f)
+	}
+}
+
+func TestDecompressProgram(t *testing.T) {
+	if p := decompressProgram("gzip", dataFile("billing.invoices", "gzip")); p != "'gzip -dc billing/invoices.copy.gz'" {
+		t.Errorf("expected the plain path, got %s", p)
+	}
+	// Names can't run shell commands
+	data := dataFile("\"it's; rm -rf $HOME `id`\"", "zstd")
+	expected := "'zstd -dc ''public/it_s; rm -rf $HOME `id`.copy.zst'''"
+	if p := decompressProgram("zstd", data); p != expected {
+		t.Errorf("expected %s, got %s", expected, p)
+	}
+}
+
+func TestNewCompressor(t *testing.T) {
+	for _, compress := range []string{"gzip", "zstd"} {
+		var buf bytes.Buffer
+		w, err := newCompressor(&buf, compress)
+		if err != nil {
+			t.Fatalf("%s: newCompressor error: %v", compress, err)
+		}
+		io.WriteString(w, "1\talice\n")
+		w.Close()
+
+		var r io.Reader
+		if compress == "gzip" {
+			r, err = gzip.NewReader(&buf)
+		} else {
+			r, err = zstd.NewReader(&buf)
+		}
+		if err != nil {
+			t.Fatalf("%s: reader error: %v", compress, err)
+		}
+		out, _ := io.ReadAll(r)
+		if string(out) != "1\talice\n" {
+			t.Errorf("%s: expected the original data, got %q", compress, out)
+		}
+	}
+
+	if _, err := newCompressor(&bytes.Buffer{}, "lzma"); err == nil {
+		t.Error("expected an error for an unknown compression")
+	}
+}
+
+func TestDumpItemFile_UnknownCompression(t *testing.T) {
+	err := dumpItemFile(t.TempDir(), nil, &Manifest{}, ManifestItem{Table: "users", Compress: "lzma"}, DumpOptions{})
+	if err == nil {
+		t.Error("expected an error for an unknown compression")
+	}
+}
+
+func TestWriteSchemaScripts(t *testing.T) {
+	dir := t.TempDir()
+	items := []ManifestItem{{Table: "users"}, {Table: "billing.invoices"}, {Table: "posts"}}
+	for _, schema := range []string{"public", "billing"} {
+		os.MkdirAll(filepath.Join(dir, schema), 0777)
+	}
+
+	err := writeSchemaScripts(dir, items, DumpOptions{ReplicaRole: true})
+	if err != nil {
+		t.Fatalf("writeSchemaScripts error: %v", err)
+	}
+
+	public, _ := os.ReadFile(filepath.Join(dir, "public", "restore.sql"))
+	if !strings.Contains(string(public), "\\ir users.sql\n\n\\ir posts.sql") {
+		t.Errorf("public restore script should load users and posts in order, got:\n%s", public)
+	}
+	if strings.Contains(string(public), "invoices") {
+		t.Error("public restore script should not load tables of other schemas")
+	}
+	billing, _ := os.ReadFile(filepath.Join(dir, "billing", "restore.sql"))
+	if !strings.Contains(string(billing), "\\ir invoices.sql") || !strings.Contains(string(billing), "COMMIT;") {
+		t.Errorf("billing restore script should load invoices in a transaction, got:\n%s", billing)
+	}
+	set := strings.Index(string(billing), "SET session_replication_role = replica;")
+	if set < 0 || set > strings.Index(string(billing), "invoices") || !strings.Contains(string(billing), "RESET session_replication_role;\n\nCOMMIT;") {
+		t.Errorf("billing restore script should load invoices with the replica role, got:\n%s", billing)
+	}
+}
+
+func TestLoadLevels(t *testing.T) {
+	items := []ManifestItem{
+		{Table: "users"}, {Table: "employees"}, {Table: "posts"}, {Table: "comments"}, {Table: "billing.invoices"},
+	}
+	deps := map[string][]string{
+		"employees":        {"employees"},
+		"posts":            {"users"},
+		"comments":         {"posts", "users"},
+		"billing.invoices": {"users", "audit_log"},
+	}
+
+	levels := loadLevels(items, deps)
+	expected := [][]string{{"users", "employees"}, {"posts", "billing.invoices"}, {"comments"}}
+	if len(levels) != len(expected) {
+		t.Fatalf("expected %d levels, got %v", len(expected), levels)
+	}
+	for i, level := range levels {
+		tables := make([]string, 0)
+		for _, v := range level {
+			tables = append(tables, v.Table)
+		}
+		if strings.Join(tables, ",") != strings.Join(expected[i], ",") {
+			t.Errorf("level %d: expected %v, got %v", i, expected[i], tables)
+		}
+	}
+}
+
+func TestWriteRestoreScript(t *testing.T) {
+	var buf bytes.Buffer
+	writeRestoreScript(&buf, [][]ManifestItem{{{Table: "users"}, {Table: "tags"}}, {{Table: "posts"}}})
+	script := buf.String()
+
+	users := strings.Index(script, "public/users.sql\npublic/tags.sql\nEOF")
+	posts := strings.Index(script, "public/posts.sql")
+	if users == -1 || posts < users {
+		t.Errorf("tables should be loaded level by level, got:\n%s", script)
+	}
+	if strings.Count(script, "xargs -P") != 2 {
+		t.Errorf("expected one parallel load per level, got:\n%s", script)
+	}
+
+	if _, err := exec.LookPath("sh"); err == nil {
+		out, err := exec.Command("sh", "-n", "-c", script).CombinedOutput()
+		if err != nil {
+			t.Errorf("restore script is not valid: %v\n%s", err, out)
+		}
+	}
+}
+
+func TestMakeDump_Directory(t *testing.T) {
+	db := requireDB(t)
+
+	f, err := os.Open("testdata/manifest_cross_schema.yaml")
+	if err != nil {
+		t.Fatalf("failed to open manifest: %v", err)
+	}
+	defer f.Close()
+
+	manifest, err := readManifest(f)
+	if err != nil {
+		t.Fatalf("readManifest error: %v", err)
+	}
+
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	err = makeDump(db, manifest, &buf, DumpOptions{Directory: dir})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+
+	out := buf.String()
+	if strings.Contains(out, "COPY ") {
+		t.Errorf("restore script should not contain table data, got:\n%s", out)
+	}
+	users := strings.Index(out, "\\ir public/users.sql")
+	invoices := strings.Index(out, "\\ir billing/invoices.sql")
+	if users == -1 || invoices == -1 || users > invoices {
+		t.Errorf("restore script should load public.users before billing.invoices, got:\n%s", out)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "billing", "invoices.sql"))
+	if err != nil {
+		t.Fatalf("failed to read table file: %v", err)
+	}
+	if !strings.Contains(string(data), "COPY billing.invoices") {
+		t.Errorf("table file should contain the data of billing.invoices, got:\n%s", data)
+	}
+	for _, schema := range []string{"public", "billing"} {
+		if _, err := os.Stat(filepath.Join(dir, schema, "restore.sql")); err != nil {
+			t.Errorf("expected a restore script for schema %s: %v", schema, err)
+		}
+	}
+
+	script, err := os.ReadFile(filepath.Join(dir, "restore.sh"))
+	if err != nil {
+		t.Fatalf("failed to read restore.sh: %v", err)
+	}
+	users = strings.Index(string(script), "public/users.sql")
+	invoices = strings.Index(string(script), "billing/invoices.sql")
+	if users == -1 || invoices == -1 || users > invoices || strings.Count(string(script), "xargs") != 2 {
+		t.Errorf("restore.sh should load billing.invoices after public.users, got:\n%s", script)
+	}
+	for _, file := range []string{"session.sql", "pre.sql", "post.sql"} {
+		if _, err := os.Stat(filepath.Join(dir, file)); err != nil {
+			t.Errorf("expected %s: %v", file, err)
+		}
+	}
+}
+
+func TestMakeDump_DirectoryCompressed(t *testing.T) {
+	db := requireDB(t)
+
+	manifest := &Manifest{Tables: []ManifestItem{
+		{Table: "users", Compress: "gzip"},
+		{Table: "posts", Compress: "zstd"},
+		{Table: "comments", Compress: "none"},
+	}}
+
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	err := makeDump(db, manifest, &buf, DumpOptions{Directory: dir})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+
+	users, _ := os.ReadFile(filepath.Join(dir, "public", "users.sql"))
+	if !strings.Contains(string(users), `\copy users ("id", `) || !strings.Contains(string(users), "FROM PROGRAM 'gzip -dc public/users.copy.gz'") {
+		t.Errorf("users should be loaded from its compressed data file, got:\n%s", users)
+	}
+	f, err := os.Open(filepath.Join(dir, "public", "users.copy.gz"))
+	if err != nil {
+		t.Fatalf("failed to open data file: %v", err)
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("gzip error: %v", err)
+	}
+	data, _ := io.ReadAll(r)
+	if !strings.Contains(string(data), "alice@example.com") {
+		t.Errorf("data file should contain the rows of users, got %q", data)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "public", "posts.copy.zst")); err != nil {
+		t.Errorf("expected a zstd data file for posts: %v", err)
+	}
+	comments, _ := os.ReadFile(filepath.Join(dir, "public", "comments.sql"))
+	if !strings.Contains(string(comments), "COPY comments") {
+		t.Errorf("comments should not be compressed, got:\n%s", comments)
+	}
+}
+
+func TestMakeDump_DirectoryTableNames(t *testing.T) {
+	db := requireDB(t)
+
+	long := "events_" + strings.Repeat("x", 70)
+	_, err := db.Exec(`
+		CREATE SCHEMA "Billing";
+		CREATE TABLE "Billing"."Invoice.Lines" (id int PRIMARY KEY, "say ""hi""" text);
+		CREATE TABLE ` + long + ` (id int PRIMARY KEY);
+		INSERT INTO "Billing"."Invoice.Lines" VALUES (1, 'hello');
+		INSERT INTO ` + long + ` VALUES (1);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec(`DROP SCHEMA "Billing" CASCADE`)
+		db.Exec(`DROP TABLE ` + long)
+	})
+
+	manifest := &Manifest{Tables: []ManifestItem{
+		{Table: `"Billing"."Invoice.Lines"`},
+		{Table: long},
+	}}
+	dir := t.TempDir()
+	err = makeDump(db, manifest, io.Discard, DumpOptions{Directory: dir})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "Billing", "Invoice.Lines.sql"))
+	if err != nil {
+		t.Fatalf("expected the table file in the schema of the table: %v", err)
+	}
+	if !strings.Contains(string(data), `COPY "Billing"."Invoice.Lines" ("id", "say ""hi""") FROM stdin;`) {
+		t.Errorf("unexpected table file:\n%s", data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "public", long[:IDENT_MAX_BYTES]+".sql")); err != nil {
+		t.Errorf("expected the file of the long table to be named as truncated by PostgreSQL: %v", err)
+	}
+}
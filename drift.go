@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+
+	pg "github.com/go-pg/pg/v10"
+)
+
+// columnDef describes a column of a table, as far as loading data into it is
+// concerned.
+type columnDef struct {
+	Name       string
+	Type       string
+	NotNull    bool
+	HasDefault bool
+	Generated  bool
+}
+
+// getColumnDefs returns the definitions of the table's columns, or nil if the
+// table doesn't exist.
+func getColumnDefs(db *pg.DB, table string) ([]columnDef, error) {
+	var exists bool
+	_, err := db.QueryOne(pg.Scan(&exists), `SELECT to_regclass(?) IS NOT NULL`, table)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, nil
+	}
+
+	hasDefault := "a.atthasdef"
+	if serverVersion(db) >= PG10 {
+		hasDefault += " OR a.attidentity != ''"
+	}
+	generated := "false"
+	if serverVersion(db) >= PG12 {
+		generated = "a.attgenerated != ''"
+	}
+	var defs []columnDef
+	sql := `
+		SELECT
+			a.attname AS name,
+			format_type(a.atttypid, a.atttypmod) AS type,
+			a.attnotnull AS not_null,
+			(` + hasDefault + `) AS has_default,
+			` + generated + ` AS generated
+		FROM pg_catalog.pg_attribute a
+		WHERE
+			a.attrelid = ?::regclass
+			AND a.attnum > 0
+			AND NOT a.attisdropped
+		ORDER BY a.attnum
+	`
+	_, err = db.Query(&defs, sql, table)
+	if err != nil {
+		return nil, err
+	}
+	return defs, nil
+}
+
+// checkTarget compares the columns of the items dumped from db with the
+// schema of the target database the dump is restored into, and returns the
+// mismatches which would make the restore fail or change the data. The types
+// of cast columns aren't compared.
+//
+// With match set, only the columns the target can load are dumped, in the
+// order of the target, instead of reporting the others. The columns to dump
+// are returned by table, for tables where they differ.
+func checkTarget(db *pg.DB, target *pg.DB, items []ManifestItem, match bool) ([]string, map[string][]string, error) {
+	findings := make([]string, 0)
+	matched := make(map[string][]string)
+	for _, v := range items {
+		cols := v.Columns
+		if len(cols) == 0 {
+			var err error
+			cols, err = getTableCols(db, v.Table)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		source, err := getColumnDefs(db, v.Table)
+		if err != nil {
+			return nil, nil, err
+		}
+		defs, err := getColumnDefs(target, v.Table)
+		if err != nil {
+			return nil, nil, err
+		}
+		if defs == nil {
+			findings = append(findings, fmt.Sprintf("table %s doesn't exist in the target", v.Table))
+			continue
+		}
+		if match {
+			if m := matchColumns(cols, defs); !slices.Equal(m, cols) {
+				matched[v.Table] = m
+				cols = m
+			}
+		}
+		findings = append(findings, compareColumns(v, cols, source, defs)...)
+	}
+	return findings, matched, nil
+}
+
+// matchColumns returns the columns of cols the target can load, in the order
+// of the target's columns.
+func matchColumns(cols []string, target []columnDef) []string {
+	matched := make([]string, 0, len(cols))
+	for _, t := range target {
+		if !t.Generated && slices.Contains(cols, t.Name) {
+			matched = append(matched, t.Name)
+		}
+	}
+	return matched
+}
+
+// compareColumns compares the columns cols dumped from a table defined as
+// source with the same table of the target, defined as target.
+func compareColumns(v ManifestItem, cols []string, source []columnDef, target []columnDef) []string {
+	findings := make([]string, 0)
+	find := func(defs []columnDef, col string) (columnDef, bool) {
+		i := slices.IndexFunc(defs, func(d columnDef) bool { return d.Name == col })
+		if i == -1 {
+			return columnDef{}, false
+		}
+		return defs[i], true
+	}
+
+	for _, col := range cols {
+		t, ok := find(target, col)
+		if !ok {
+			findings = append(findings, fmt.Sprintf("column %s.%s doesn't exist in the target", v.Table, col))
+			continue
+		}
+		if t.Generated {
+			findings = append(findings, fmt.Sprintf("column %s.%s is generated in the target", v.Table, col))
+			continue
+		}
+		if _, cast := v.Casts[col]; cast {
+			continue
+		}
+		if s, ok := find(source, col); ok && s.Type != t.Type {
+			findings = append(findings, fmt.Sprintf("column %s.%s is %s in the source but %s in the target", v.Table, col, s.Type, t.Type))
+		}
+	}
+	for _, t := range target {
+		if t.NotNull && !t.HasDefault && !t.Generated && !slices.Contains(cols, t.Name) {
+			findings = append(findings, fmt.Sprintf("column %s.%s of the target is NOT NULL without a default, but isn't dumped", v.Table, t.Name))
+		}
+	}
+	return findings
+}
+
+// connectTarget connects to the target database given by a postgres:// URL.
+func connectTarget(dsn string) (*pg.DB, error) {
+	opts, err := pg.ParseURL(dsn)
+	if err != nil {
+		// The error quotes the DSN, password included
+		return nil, fmt.Errorf("invalid target DSN: %s", redact(err.Error()))
+	}
+	addSecret(opts.Password)
+	return connectDB(opts)
+}
+
+// columnMapper passes COPY data with the columns from on to w, with the
+// columns to instead, which are a subset of them.
+type columnMapper struct {
+	w    io.Writer
+	pos  []int
+	line []byte
+}
+
+func newColumnMapper(w io.Writer, from []string, to []string) *columnMapper {
+	pos := make([]int, 0, len(to))
+	for _, col := range to {
+		pos = append(pos, slices.Index(from, col))
+	}
+	return &columnMapper{w: w, pos: pos}
+}
+
+func (m *columnMapper) Write(p []byte) (int, error) {
+	m.line = append(m.line, p...)
+	var out bytes.Buffer
+	for {
+		end := bytes.IndexByte(m.line, '\n')
+		if end == -1 {
+			break
+		}
+		row := decodeCopyRow(string(m.line[:end]))
+		mapped := make([]*string, 0, len(m.pos))
+		for _, i := range m.pos {
+			mapped = append(mapped, row[i])
+		}
+		out.WriteString(encodeCopyRow(mapped))
+		out.WriteByte('\n')
+		m.line = m.line[end+1:]
+	}
+	_, err := m.w.Write(out.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
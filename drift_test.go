@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestCompareColumns(t *testing.T) {
+	source := []columnDef{
+		{Name: "id", Type: "integer", NotNull: true, HasDefault: true},
+		{Name: "status", Type: "order_status"},
+		{Name: "total", Type: "numeric(10,2)"},
+		{Name: "note", Type: "text"},
+		{Name: "total_cents", Type: "bigint"},
+	}
+	target := []columnDef{
+		{Name: "id", Type: "bigint", NotNull: true, HasDefault: true},
+		{Name: "status", Type: "text"},
+		{Name: "total", Type: "numeric(10,2)"},
+		{Name: "total_cents", Type: "bigint", Generated: true},
+		{Name: "region", Type: "text", NotNull: true},
+		{Name: "created_at", Type: "timestamp", NotNull: true, HasDefault: true},
+	}
+	v := ManifestItem{Table: "orders", Casts: map[string]string{"status": "text"}}
+	findings := compareColumns(v, []string{"id", "status", "total", "note", "total_cents"}, source, target)
+	expected := []string{
+		"column orders.id is integer in the source but bigint in the target",
+		"column orders.note doesn't exist in the target",
+		"column orders.total_cents is generated in the target",
+		"column orders.region of the target is NOT NULL without a default, but isn't dumped",
+	}
+	if !reflect.DeepEqual(findings, expected) {
+		t.Errorf("expected %q, got %q", expected, findings)
+	}
+}
+
+func TestMatchColumns(t *testing.T) {
+	target := []columnDef{
+		{Name: "total"},
+		{Name: "id"},
+		{Name: "total_cents", Generated: true},
+		{Name: "region"},
+	}
+	matched := matchColumns([]string{"id", "note", "total", "total_cents"}, target)
+	expected := []string{"total", "id"}
+	if !reflect.DeepEqual(matched, expected) {
+		t.Errorf("expected %q, got %q", expected, matched)
+	}
+}
+
+func TestColumnMapper(t *testing.T) {
+	var buf bytes.Buffer
+	m := newColumnMapper(&buf, []string{"id", "note", "total"}, []string{"total", "id"})
+	for _, p := range []string{"1\tfirst\\tnote\t9.50\n2\t\\N", "\t\\N\n"} {
+		_, err := m.Write([]byte(p))
+		if err != nil {
+			t.Fatalf("Write error: %v", err)
+		}
+	}
+	expected := "9.50\t1\n\\N\t2\n"
+	if buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, buf.String())
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+)
+
+// DumpWriter writes a dump in some output format. makeDump calls BeginDump
+// once, then BeginTable, WriteRow for every row, EndTable and PostAction for
+// the post actions of every table, and EndDump once at the end.
+type DumpWriter interface {
+	BeginDump(info *DumpInfo) error
+	BeginTable(table string, query string, cols []string) error
+	WriteRow(row []*string) error
+	EndTable(rows int, duration time.Duration) error
+	PostAction(sql string) error
+	EndDump() error
+}
+
+// DumpInfo describes a dump to its writer: the dumped tables and the schema
+// objects to be recreated around their data.
+type DumpInfo struct {
+	Manifest    *Manifest
+	Items       []ManifestItem
+	Encoding    *Encoding
+	Extensions  []Extension
+	ForeignKeys []ForeignKey
+	Indexes     []Index
+	Comments    []Comment
+}
+
+// sqlDumpWriter writes the dump as an SQL script loading the data with COPY,
+// as expected by psql.
+type sqlDumpWriter struct {
+	w    io.Writer
+	opts DumpOptions
+	info *DumpInfo
+}
+
+// writeAsOf writes the instant the dump is as of to its header. Deterministic
+// dumps only have it if the manifest sets it, since it's otherwise the time
+// the dump started.
+func writeAsOf(w io.Writer, manifest *Manifest, opts DumpOptions) {
+	if manifest.asOf.IsZero() || (opts.Deterministic && manifest.AsOf == "") {
+		return
+	}
+	fmt.Fprintf(w, AS_OF_DUMP, manifest.asOf.Format(time.RFC3339Nano))
+}
+
+func newSQLDumpWriter(w io.Writer, opts DumpOptions) *sqlDumpWriter {
+	return &sqlDumpWriter{w: w, opts: opts}
+}
+
+func (s *sqlDumpWriter) BeginDump(info *DumpInfo) error {
+	s.info = info
+	beginDump(s.w)
+	if info.Manifest.Hash != "" {
+		fmt.Fprintf(s.w, MANIFEST_HASH_DUMP, info.Manifest.Hash)
+	}
+	if !s.opts.Expires.IsZero() {
+		fmt.Fprintf(s.w, EXPIRES_DUMP, s.opts.Expires.UTC().Format(time.RFC3339))
+	}
+	writeAsOf(s.w, info.Manifest, s.opts)
+	fmt.Fprintf(s.w, ENCODING_DUMP, info.Encoding.Encoding, info.Encoding.Collation, info.Encoding.Ctype)
+	if s.opts.AssertEncoding {
+		assertEncoding(s.w, info.Encoding)
+	}
+	if s.opts.ReplicaRole {
+		replicaRole(s.w)
+	}
+	return dumpPreamble(s.w, info.Manifest, s.opts, info.Items, info.Extensions, info.ForeignKeys, info.Indexes)
+}
+
+func (s *sqlDumpWriter) BeginTable(table string, query string, cols []string) error {
+	beginTable(s.w, table, query, cols, s.opts.Freeze)
+	return nil
+}
+
+func (s *sqlDumpWriter) WriteRow(row []*string) error {
+	_, err := io.WriteString(s.w, encodeCopyRow(row)+"\n")
+	return err
+}
+
+// WriteCopyLine writes a row already in COPY text format, as dumped by the
+// database, so that it isn't decoded and encoded again.
+func (s *sqlDumpWriter) WriteCopyLine(line []byte) error {
+	_, err := s.w.Write(line)
+	return err
+}
+
+func (s *sqlDumpWriter) EndTable(rows int, duration time.Duration) error {
+	endTable(s.w)
+	tableStats(s.w, rows, duration)
+	return nil
+}
+
+func (s *sqlDumpWriter) PostAction(sql string) error {
+	dumpSqlCmd(s.w, sql)
+	return nil
+}
+
+func (s *sqlDumpWriter) EndDump() error {
+	info := s.info
+	err := dumpPostamble(s.w, info.Manifest, s.opts, info.Items, info.ForeignKeys, info.Indexes, info.Comments)
+	if err != nil {
+		return err
+	}
+	if s.opts.ReplicaRole {
+		resetReplicaRole(s.w)
+	}
+	endDump(s.w)
+	return nil
+}
+
+// copyLineWriter is implemented by the DumpWriters writing rows in COPY text
+// format, which are passed the lines of COPY data as they are.
+type copyLineWriter interface {
+	WriteCopyLine(line []byte) error
+}
+
+// writeCopyLine passes a line of COPY text format data, ending with a
+// newline, to dw.
+func writeCopyLine(dw DumpWriter, line []byte) error {
+	if lw, ok := dw.(copyLineWriter); ok {
+		return lw.WriteCopyLine(line)
+	}
+	return dw.WriteRow(decodeCopyRow(string(line[:len(line)-1])))
+}
+
+// rowWriter is a writer passing the rows of COPY text format data written
+// to it to a DumpWriter.
+type rowWriter struct {
+	dw  DumpWriter
+	buf []byte
+}
+
+func (r *rowWriter) Write(p []byte) (int, error) {
+	r.buf = append(r.buf, p...)
+	for {
+		// Newlines inside values are escaped, so every line is a row
+		end := bytes.IndexByte(r.buf, '\n')
+		if end == -1 {
+			break
+		}
+		err := writeCopyLine(r.dw, r.buf[:end+1])
+		if err != nil {
+			return 0, err
+		}
+		r.buf = r.buf[end+1:]
+	}
+	return len(p), nil
+}
+
+// writeRows passes the rows of COPY text format data read from r to dw.
+func writeRows(dw DumpWriter, r io.Reader) error {
+	br := bufio.NewReaderSize(r, 64<<10)
+	for {
+		line, err := br.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// Rows longer than the buffer are read whole
+			line = slices.Clone(line)
+			var rest []byte
+			rest, err = br.ReadBytes('\n')
+			line = append(line, rest...)
+		}
+		if err == io.EOF {
+			if len(line) == 0 {
+				return nil
+			}
+			line = append(slices.Clone(line), '\n')
+		} else if err != nil {
+			return err
+		}
+		err = writeCopyLine(dw, line)
+		if err != nil {
+			return err
+		}
+	}
+}
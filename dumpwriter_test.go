@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+type recordingDumpWriter struct {
+	DumpWriter
+	rows [][]*string
+}
+
+func (r *recordingDumpWriter) WriteRow(row []*string) error {
+	r.rows = append(r.rows, row)
+	return nil
+}
+
+func TestRowWriter(t *testing.T) {
+	dw := &recordingDumpWriter{}
+	w := &rowWriter{dw: dw}
+
+	// Rows split across writes are only passed on once complete
+	for _, chunk := range []string{"1\tal", "ice\n2\t\\N\n3\tline\\n", "break\n"} {
+		_, err := w.Write([]byte(chunk))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(dw.rows) != 3 {
+		t.Fatalf("expected 3 rows, got %d", len(dw.rows))
+	}
+	if *dw.rows[0][1] != "alice" {
+		t.Errorf("expected alice, got %q", *dw.rows[0][1])
+	}
+	if dw.rows[1][1] != nil {
+		t.Errorf("expected NULL, got %q", *dw.rows[1][1])
+	}
+	if *dw.rows[2][1] != "line\nbreak" {
+		t.Errorf("expected escaped newline to be decoded, got %q", *dw.rows[2][1])
+	}
+}
+
+func TestSQLDumpWriter_Table(t *testing.T) {
+	var buf bytes.Buffer
+	dw := newSQLDumpWriter(&buf, DumpOptions{})
+
+	err := dw.BeginTable(`"users"`, "", []string{"id", "name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeRows(dw, strings.NewReader("1\talice\n2\t\\N\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dw.EndTable(2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dw.PostAction("ANALYZE users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	for _, expected := range []string{
+		`COPY "users" ("id", "name") FROM stdin;`,
+		"1\talice\n2\t\\N\n\\.\n",
+		"-- Rows: 2\n",
+		"ANALYZE users",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected output to contain %q, got:\n%s", expected, out)
+		}
+	}
+}
+
+func TestSQLDumpWriter_ReplicaRole(t *testing.T) {
+	var buf bytes.Buffer
+	dw := newSQLDumpWriter(&buf, DumpOptions{ReplicaRole: true})
+	info := &DumpInfo{Manifest: &Manifest{}, Encoding: &Encoding{Encoding: "UTF8"}}
+	err := dw.BeginDump(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dw.BeginTable(`"users"`, "", []string{"id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dw.EndTable(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dw.EndDump()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	set := strings.Index(out, "SET session_replication_role = replica;")
+	reset := strings.Index(out, "RESET session_replication_role;")
+	copy := strings.Index(out, "COPY")
+	commit := strings.Index(out, "COMMIT;")
+	if set < 0 || set > copy || reset < copy || reset > commit {
+		t.Errorf("expected the data to be loaded with the replica role, got:\n%s", out)
+	}
+}
+
+func TestWriteRows_LongRows(t *testing.T) {
+	dw := &recordingDumpWriter{}
+	long := strings.Repeat("x", 200<<10)
+
+	// The last row may miss its newline
+	err := writeRows(dw, strings.NewReader("1\t"+long+"\n2\tbob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dw.rows) != 2 || *dw.rows[0][1] != long || *dw.rows[1][1] != "bob" {
+		t.Errorf("expected the long row and bob, got %d rows", len(dw.rows))
+	}
+}
+
+func TestSQLDumpWriter_CopyLines(t *testing.T) {
+	var buf bytes.Buffer
+	dw := newSQLDumpWriter(&buf, DumpOptions{})
+
+	// Rows are written as the database dumped them
+	data := "1\t\\x41\\t\n2\t\\N\n"
+	err := writeRows(dw, strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != data {
+		t.Errorf("expected %q, got %q", data, buf.String())
+	}
+}
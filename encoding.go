@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	pg "github.com/go-pg/pg/v10"
+)
+
+const (
+	ENCODING_DUMP = "-- Encoding: %s; Collation: %s; Ctype: %s\n\n"
+
+	// The encoding has to match, or text is converted and may be mangled or
+	// fail to load. A different collation only changes the ordering of text.
+	ASSERT_ENCODING_DUMP = `DO $$
+DECLARE
+	db_collation text := (SELECT datcollate FROM pg_catalog.pg_database WHERE datname = current_database());
+BEGIN
+	IF current_setting('server_encoding') <> %[1]s THEN
+		RAISE EXCEPTION 'database encoding is %%, but the dump was taken from a %% database', current_setting('server_encoding'), %[1]s;
+	END IF;
+	IF db_collation <> %[2]s THEN
+		RAISE WARNING 'database collation is %%, but the dump was taken from a %% database', db_collation, %[2]s;
+	END IF;
+END
+$$;
+
+`
+)
+
+// Encoding is the encoding and locale of a database.
+type Encoding struct {
+	Encoding  string
+	Collation string
+	Ctype     string
+}
+
+func getEncoding(db *pg.DB) (*Encoding, error) {
+	var model struct {
+		Encoding  string
+		Collation string
+		Ctype     string
+	}
+	sql := `
+		SELECT
+			pg_encoding_to_char(encoding) AS encoding,
+			datcollate AS collation,
+			datctype AS ctype
+		FROM pg_catalog.pg_database
+		WHERE datname = current_database()
+	`
+	_, err := db.QueryOne(&model, sql)
+	if err != nil {
+		return nil, err
+	}
+	return &Encoding{Encoding: model.Encoding, Collation: model.Collation, Ctype: model.Ctype}, nil
+}
+
+// assertEncoding writes a check failing the restore if the database has a
+// different encoding than enc, and warning if it has a different collation.
+func assertEncoding(w io.Writer, enc *Encoding) {
+	fmt.Fprintf(w, ASSERT_ENCODING_DUMP, quoteLiteral(enc.Encoding), quoteLiteral(enc.Collation))
+}
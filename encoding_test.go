@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestAssertEncoding(t *testing.T) {
+	var buf bytes.Buffer
+	assertEncoding(&buf, &Encoding{Encoding: "UTF8", Collation: "en_US.utf8", Ctype: "en_US.utf8"})
+
+	out := buf.String()
+	for _, expected := range []string{
+		"IF current_setting('server_encoding') <> 'UTF8' THEN",
+		"RAISE EXCEPTION 'database encoding is %, but the dump was taken from a % database', current_setting('server_encoding'), 'UTF8';",
+		"IF db_collation <> 'en_US.utf8' THEN",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected %q in the assertion, got:\n%s", expected, out)
+		}
+	}
+}
+
+func TestGetEncoding(t *testing.T) {
+	db := requireDB(t)
+
+	enc, err := getEncoding(db)
+	if err != nil {
+		t.Fatalf("getEncoding error: %v", err)
+	}
+	if enc.Encoding == "" || enc.Collation == "" || enc.Ctype == "" {
+		t.Errorf("expected the encoding and locale of the database, got %+v", enc)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// newEncryptWriter returns a writer encrypting everything written to it into
+// w. The spec is `age:RECIPIENT`, where RECIPIENT is an age public key or a
+// path to a recipients file, or `gpg:RECIPIENT` for a key in the GPG keyring.
+// The returned writer must be closed to flush the encrypted output.
+func newEncryptWriter(w io.Writer, spec string) (io.WriteCloser, error) {
+	method, recipient, ok := strings.Cut(spec, ":")
+	if !ok || recipient == "" {
+		return nil, fmt.Errorf("invalid --encrypt %q, expected age:RECIPIENT or gpg:RECIPIENT", spec)
+	}
+	switch method {
+	case "age":
+		recipients, err := parseAgeRecipients(recipient)
+		if err != nil {
+			return nil, err
+		}
+		return age.Encrypt(w, recipients...)
+	case "gpg":
+		return newGPGWriter(w, recipient)
+	default:
+		return nil, fmt.Errorf("unknown encryption method %q", method)
+	}
+}
+
+func parseAgeRecipients(recipient string) ([]age.Recipient, error) {
+	if strings.HasPrefix(recipient, "age1") {
+		r, err := age.ParseX25519Recipient(recipient)
+		if err != nil {
+			return nil, err
+		}
+		return []age.Recipient{r}, nil
+	}
+	f, err := os.Open(recipient)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	recipients, err := age.ParseRecipients(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", recipient, err)
+	}
+	return recipients, nil
+}
+
+// gpgWriter pipes the dump through the gpg(1) binary.
+type gpgWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func newGPGWriter(w io.Writer, recipient string) (*gpgWriter, error) {
+	cmd := exec.Command("gpg", "--batch", "--yes", "--encrypt", "--recipient", recipient, "--output", "-")
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to run gpg: %v", err)
+	}
+	return &gpgWriter{stdin, cmd}, nil
+}
+
+// Close ends the input of gpg and waits for it to exit.
+func (g *gpgWriter) Close() error {
+	err := g.WriteCloser.Close()
+	if waitErr := g.cmd.Wait(); waitErr != nil {
+		return fmt.Errorf("gpg failed: %v", waitErr)
+	}
+	return err
+}
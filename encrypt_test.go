@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func TestNewEncryptWriter_Age(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("GenerateX25519Identity error: %v", err)
+	}
+
+	for _, recipient := range []string{
+		identity.Recipient().String(),
+		writeRecipientsFile(t, identity.Recipient().String()+"\n"),
+	} {
+		var buf bytes.Buffer
+		w, err := newEncryptWriter(&buf, "age:"+recipient)
+		if err != nil {
+			t.Fatalf("newEncryptWriter error: %v", err)
+		}
+		io.WriteString(w, "BEGIN;\n")
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close error: %v", err)
+		}
+		if bytes.Contains(buf.Bytes(), []byte("BEGIN;")) {
+			t.Fatal("output is not encrypted")
+		}
+
+		r, err := age.Decrypt(&buf, identity)
+		if err != nil {
+			t.Fatalf("Decrypt error: %v", err)
+		}
+		out, _ := io.ReadAll(r)
+		if string(out) != "BEGIN;\n" {
+			t.Errorf("expected the original dump, got %q", out)
+		}
+	}
+}
+
+func TestNewEncryptWriter_Invalid(t *testing.T) {
+	for _, spec := range []string{"", "age", "age:", "rot13:x", "age:age1invalid"} {
+		if _, err := newEncryptWriter(&bytes.Buffer{}, spec); err == nil {
+			t.Errorf("expected an error for %q", spec)
+		}
+	}
+}
+
+func writeRecipientsFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "recipients.txt")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	pg "github.com/go-pg/pg/v10"
+)
+
+// Exit codes telling classes of failures apart, for wrapper scripts
+const (
+	EXIT_ERROR            = 1
+	EXIT_MANIFEST_INVALID = 2
+	EXIT_TABLE_NOT_FOUND  = 3
+	EXIT_QUERY_FAILED     = 4
+	EXIT_EXPIRED          = 5
+)
+
+// ErrManifestInvalid is returned for manifests which can't be parsed or
+// have invalid entries.
+var ErrManifestInvalid = errors.New("invalid manifest")
+
+// TableNotFoundError is returned when a table to be dumped doesn't exist.
+type TableNotFoundError struct {
+	Table string
+}
+
+func (e *TableNotFoundError) Error() string {
+	return fmt.Sprintf("table %s not found", e.Table)
+}
+
+// QueryFailedError is returned when the database fails to run the query
+// dumping a table.
+type QueryFailedError struct {
+	Table string
+	SQL   string
+	Err   error
+}
+
+func (e *QueryFailedError) Error() string {
+	return fmt.Sprintf("dumping %s: %v", e.Table, e.Err)
+}
+
+func (e *QueryFailedError) Unwrap() error {
+	return e.Err
+}
+
+// isUndefinedTable tells whether err is the database reporting a missing
+// table.
+func isUndefinedTable(err error) bool {
+	var pgErr pg.Error
+	return errors.As(err, &pgErr) && pgErr.Field('C') == "42P01"
+}
+
+// exitCode returns the exit code for a failure with err.
+func exitCode(err error) int {
+	var tableErr *TableNotFoundError
+	var queryErr *QueryFailedError
+	switch {
+	case errors.Is(err, ErrManifestInvalid):
+		return EXIT_MANIFEST_INVALID
+	case errors.As(err, &tableErr):
+		return EXIT_TABLE_NOT_FOUND
+	case errors.As(err, &queryErr):
+		return EXIT_QUERY_FAILED
+	default:
+		return EXIT_ERROR
+	}
+}
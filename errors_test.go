@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	for _, tc := range []struct {
+		err      error
+		expected int
+	}{
+		{fmt.Errorf("%w: table users: unknown transform", ErrManifestInvalid), EXIT_MANIFEST_INVALID},
+		{&TableNotFoundError{Table: "nope"}, EXIT_TABLE_NOT_FOUND},
+		{fmt.Errorf("retrying: %w", &QueryFailedError{Table: "users", Err: errors.New("syntax error")}), EXIT_QUERY_FAILED},
+		{io.ErrUnexpectedEOF, EXIT_ERROR},
+	} {
+		if code := exitCode(tc.err); code != tc.expected {
+			t.Errorf("exitCode(%v) = %d, expected %d", tc.err, code, tc.expected)
+		}
+	}
+}
+
+func TestMakeDump_TableNotFound(t *testing.T) {
+	db := requireDB(t)
+
+	manifest := &Manifest{Tables: []ManifestItem{{Table: "no_such_table"}}}
+	err := makeDump(db, manifest, io.Discard, DumpOptions{})
+	var tableErr *TableNotFoundError
+	if !errors.As(err, &tableErr) || tableErr.Table != "no_such_table" {
+		t.Errorf("expected a TableNotFoundError, got %v", err)
+	}
+}
+
+func TestMakeDump_QueryFailed(t *testing.T) {
+	db := requireDB(t)
+
+	manifest := &Manifest{Tables: []ManifestItem{{Table: "users", Query: "SELECT * FROM users WHERE no_such_column"}}}
+	err := makeDump(db, manifest, io.Discard, DumpOptions{})
+	var queryErr *QueryFailedError
+	if !errors.As(err, &queryErr) || queryErr.Table != "users" {
+		t.Errorf("expected a QueryFailedError, got %v", err)
+	}
+}
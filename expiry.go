@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseRetention parses how long a dump is kept, as a Go duration or a
+// number of days (30d) or weeks (4w).
+func parseRetention(s string) (time.Duration, error) {
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+	if len(s) > 1 {
+		if unit, ok := units[s[len(s)-1:]]; ok {
+			n, err := strconv.Atoi(s[:len(s)-1])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("%q is neither a duration nor a number of days or weeks", s)
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%q is neither a duration nor a number of days or weeks", s)
+	}
+	return d, nil
+}
+
+// readExpiry reads the expiry time from the header of a plain dump. It
+// returns the zero time if the dump has none.
+func readExpiry(r io.Reader) (time.Time, error) {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if value, ok := strings.CutPrefix(line, "-- Expires: "); ok {
+			return time.Parse(time.RFC3339, strings.TrimSpace(value))
+		}
+		// The header ends with the first table
+		if err != nil || strings.HasPrefix(line, "COPY ") || strings.HasPrefix(line, "INSERT INTO ") || strings.HasPrefix(line, "\\i ") {
+			if err == io.EOF {
+				err = nil
+			}
+			return time.Time{}, err
+		}
+	}
+}
+
+// dumpExpiry returns the expiry time of the dump at path, a plain dump or a
+// dump in the directory format.
+func dumpExpiry(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if info.IsDir() {
+		path = filepath.Join(path, "restore.sql")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+	return readExpiry(f)
+}
+
+// checkExpiry reports the dumps at paths which expired by now to w, deleting
+// them if told to, and returns the number of expired dumps left in place.
+// Dumps without an expiry time never expire.
+func checkExpiry(w io.Writer, paths []string, now time.Time, remove bool) (int, error) {
+	expired := 0
+	for _, path := range paths {
+		expires, err := dumpExpiry(path)
+		if err != nil {
+			return expired, err
+		}
+		if expires.IsZero() || expires.After(now) {
+			continue
+		}
+		if !remove {
+			fmt.Fprintf(w, "%s: expired on %s\n", path, expires.Format(time.RFC3339))
+			expired++
+			continue
+		}
+		err = os.RemoveAll(path)
+		if err != nil {
+			return expired, err
+		}
+		fmt.Fprintf(w, "%s: expired on %s, deleted\n", path, expires.Format(time.RFC3339))
+	}
+	return expired, nil
+}
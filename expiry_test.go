@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRetention(t *testing.T) {
+	for _, tc := range []struct {
+		s        string
+		expected time.Duration
+	}{
+		{"30d", 30 * 24 * time.Hour},
+		{"2w", 14 * 24 * time.Hour},
+		{"36h", 36 * time.Hour},
+	} {
+		d, err := parseRetention(tc.s)
+		if err != nil || d != tc.expected {
+			t.Errorf("parseRetention(%q) = %v, %v, expected %v", tc.s, d, err, tc.expected)
+		}
+	}
+	for _, s := range []string{"", "d", "0d", "-1w", "xd", "0", "soon"} {
+		if _, err := parseRetention(s); err == nil {
+			t.Errorf("parseRetention(%q): expected an error", s)
+		}
+	}
+}
+
+func TestReadExpiry(t *testing.T) {
+	expires, err := readExpiry(strings.NewReader("BEGIN;\n\n-- Expires: 2026-11-16T10:00:00Z\n\nCOPY users FROM stdin;\n"))
+	if err != nil || !expires.Equal(time.Date(2026, 11, 16, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected expiry %v, %v", expires, err)
+	}
+
+	// Only the header is searched
+	expires, err = readExpiry(strings.NewReader("BEGIN;\nCOPY users FROM stdin;\n-- Expires: 2026-11-16T10:00:00Z\n"))
+	if err != nil || !expires.IsZero() {
+		t.Errorf("expected no expiry, got %v, %v", expires, err)
+	}
+}
+
+func TestCheckExpiry(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, header string) string {
+		path := filepath.Join(dir, name)
+		err := os.WriteFile(path, []byte(header+"COPY users FROM stdin;\n"), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	old := write("old.sql", "-- Expires: 2026-01-01T00:00:00Z\n")
+	recent := write("recent.sql", "-- Expires: 2027-01-01T00:00:00Z\n")
+	forever := write("forever.sql", "")
+	err := os.Mkdir(filepath.Join(dir, "old"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldDir := filepath.Join(dir, "old")
+	write("old/restore.sql", "-- Expires: 2026-01-01T00:00:00Z\n")
+
+	now := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	paths := []string{old, recent, forever, oldDir}
+	var buf bytes.Buffer
+	expired, err := checkExpiry(&buf, paths, now, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := old + ": expired on 2026-01-01T00:00:00Z\n" + oldDir + ": expired on 2026-01-01T00:00:00Z\n"
+	if expired != 2 || buf.String() != expected {
+		t.Errorf("expected 2 expired dumps, got %d:\n%s", expired, buf.String())
+	}
+
+	buf.Reset()
+	expired, err = checkExpiry(&buf, paths, now, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expired != 0 || !strings.Contains(buf.String(), "deleted") {
+		t.Errorf("expected the expired dumps to be deleted, got %d:\n%s", expired, buf.String())
+	}
+	for _, path := range paths {
+		_, err := os.Stat(path)
+		if deleted := os.IsNotExist(err); deleted != (path == old || path == oldDir) {
+			t.Errorf("%s: unexpected deletion %v", path, deleted)
+		}
+	}
+}
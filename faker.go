@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+)
+
+var (
+	fakeFirstNames = []string{
+		"Ada", "Alan", "Barbara", "Brian", "Carol", "Charles", "Diana", "Donald",
+		"Edith", "Edsger", "Frances", "Frank", "Grace", "Guido", "Hedy", "Ivan",
+		"Jean", "John", "Karen", "Ken", "Linus", "Lynn", "Margaret", "Niklaus",
+		"Olga", "Peter", "Radia", "Robert", "Sophie", "Tim", "Ursula", "Vint",
+	}
+	fakeLastNames = []string{
+		"Allen", "Babbage", "Backus", "Cerf", "Dijkstra", "Engelbart", "Floyd",
+		"Goldberg", "Hamilton", "Hopper", "Kahn", "Knuth", "Lamarr", "Liskov",
+		"Lovelace", "McCarthy", "Nygaard", "Perlman", "Ritchie", "Shannon",
+		"Stroustrup", "Thompson", "Torvalds", "Turing", "Wirth", "Wozniak",
+	}
+	fakeStreets = []string{
+		"Maple", "Oak", "Pine", "Cedar", "Elm", "Willow", "Birch", "Chestnut",
+		"Hill", "Lake", "River", "Park", "Church", "Mill", "Station", "Bridge",
+	}
+	fakeStreetSuffixes = []string{"Street", "Avenue", "Road", "Lane", "Drive", "Way"}
+	fakeCities         = []string{
+		"Springfield", "Riverside", "Fairview", "Greenville", "Franklin",
+		"Madison", "Clinton", "Georgetown", "Salem", "Ashland", "Dover", "Milton",
+	}
+)
+
+// fakeRand returns a random generator seeded by the keyed hash of v, so that
+// the same original value is always replaced by the same fake value.
+func fakeRand(v string) *rand.Rand {
+	sum := keyedHash(v)
+	return rand.New(rand.NewPCG(binary.LittleEndian.Uint64(sum[:8]), binary.LittleEndian.Uint64(sum[8:16])))
+}
+
+func pick(r *rand.Rand, list []string) string {
+	return list[r.IntN(len(list))]
+}
+
+// fakePerson is the made-up identity behind the name and e-mail transforms.
+// All of them draw the person first, so that the values generated from the
+// same key belong to the same person.
+type fakePerson struct {
+	First string
+	Last  string
+	// Tells apart people of the same name, 48 random bits so that a unique
+	// column of a million e-mail addresses has about one chance in 500,000
+	// of a duplicate
+	Tag uint64
+}
+
+func newFakePerson(r *rand.Rand) fakePerson {
+	return fakePerson{
+		First: pick(r, fakeFirstNames),
+		Last:  pick(r, fakeLastNames),
+		Tag:   r.Uint64() >> 16,
+	}
+}
+
+func fakeFirstName(r *rand.Rand) string {
+	return newFakePerson(r).First
+}
+
+func fakeLastName(r *rand.Rand) string {
+	return newFakePerson(r).Last
+}
+
+func fakeName(r *rand.Rand) string {
+	p := newFakePerson(r)
+	return p.First + " " + p.Last
+}
+
+// fakeEmail keeps the domain of the original address.
+func fakeEmail(r *rand.Rand, original string) string {
+	domain := "example.com"
+	if i := strings.LastIndex(original, "@"); i != -1 {
+		domain = original[i+1:]
+	}
+	p := newFakePerson(r)
+	local := strings.ToLower(p.First + "." + p.Last)
+	return fmt.Sprintf("%s.%012x@%s", local, p.Tag, domain)
+}
+
+// fakePhone returns a number from the 555-0100 - 555-0199 range reserved for
+// fictional use.
+func fakePhone(r *rand.Rand) string {
+	return fmt.Sprintf("(%d) 555-01%02d", 200+r.IntN(800), r.IntN(100))
+}
+
+func fakeAddress(r *rand.Rand) string {
+	return fmt.Sprintf("%d %s %s, %s", 1+r.IntN(9999), pick(r, fakeStreets), pick(r, fakeStreetSuffixes), pick(r, fakeCities))
+}
+
+// fakeCreditCard returns a 16 digit Visa-like number with a valid Luhn check
+// digit.
+func fakeCreditCard(r *rand.Rand) string {
+	digits := make([]byte, 15, 16)
+	digits[0] = '4'
+	for i := 1; i < len(digits); i++ {
+		digits[i] = byte('0' + r.IntN(10))
+	}
+	return string(append(digits, luhnCheckDigit(string(digits))))
+}
+
+func luhnCheckDigit(digits string) byte {
+	sum := 0
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		// Every second digit counting from the check digit is doubled
+		if (len(digits)-i)%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+func fakeUUID(r *rand.Rand) string {
+	b := make([]byte, 16)
+	for i := range b {
+		b[i] = byte(r.UintN(256))
+	}
+	// Version 4, RFC 4122 variant
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// preserveFormat replaces every digit of v with a random digit and every
+// letter with a random letter of the same case, leaving other characters and
+// the first prefix and last suffix characters as they are.
+func preserveFormat(r *rand.Rand, v string, prefix int, suffix int) string {
+	runes := []rune(v)
+	for i, c := range runes {
+		if i < prefix || i >= len(runes)-suffix {
+			continue
+		}
+		switch {
+		case c >= '0' && c <= '9':
+			runes[i] = rune('0' + r.IntN(10))
+		case c >= 'a' && c <= 'z':
+			runes[i] = rune('a' + r.IntN(26))
+		case c >= 'A' && c <= 'Z':
+			runes[i] = rune('A' + r.IntN(26))
+		}
+	}
+	return string(runes)
+}
+
+func fakeTransform(fake func(r *rand.Rand, original string) string) func(t Transform) (transformFunc, error) {
+	return func(t Transform) (transformFunc, error) {
+		return func(v *string, key string) *string {
+			if v == nil {
+				return nil
+			}
+			faked := fake(fakeRand(key), *v)
+			return &faked
+		}, nil
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func luhnValid(number string) bool {
+	return luhnCheckDigit(number[:len(number)-1]) == number[len(number)-1]
+}
+
+func TestLuhnCheckDigit(t *testing.T) {
+	// Well-known test card numbers
+	for _, number := range []string{"4111111111111111", "4012888888881881", "79927398713"} {
+		if !luhnValid(number) {
+			t.Errorf("expected %s to have a valid check digit", number)
+		}
+	}
+}
+
+func TestFakeCreditCard(t *testing.T) {
+	for _, v := range []string{"a", "b", "c", "d"} {
+		number := fakeCreditCard(fakeRand(v))
+		if len(number) != 16 || !luhnValid(number) {
+			t.Errorf("invalid fake credit card number %q", number)
+		}
+	}
+}
+
+func TestFakeEmail_KeepsDomain(t *testing.T) {
+	email := fakeEmail(fakeRand("alice@corp.example"), "alice@corp.example")
+
+	if !strings.HasSuffix(email, "@corp.example") {
+		t.Errorf("fake email should keep the domain, got %q", email)
+	}
+	if strings.HasPrefix(email, "alice@") {
+		t.Errorf("fake email should replace the local part, got %q", email)
+	}
+}
+
+func TestFakeEmail_Distinct(t *testing.T) {
+	// With names alone and 3 digits, addresses of unique columns repeated
+	// after about a thousand rows
+	seen := make(map[string]bool)
+	for i := range 100000 {
+		email := fakeEmail(fakeRand(strconv.Itoa(i)), "x@example.org")
+		if seen[email] {
+			t.Fatalf("fake email %q repeated after %d rows", email, i)
+		}
+		seen[email] = true
+	}
+}
+
+func TestFakeUUID(t *testing.T) {
+	re := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	if uuid := fakeUUID(fakeRand("x")); !re.MatchString(uuid) {
+		t.Errorf("invalid fake UUID %q", uuid)
+	}
+}
+
+func TestFakeTransforms_Deterministic(t *testing.T) {
+	for _, name := range []string{"fake_name", "fake_first_name", "fake_last_name", "fake_email", "fake_phone", "fake_address", "fake_credit_card", "fake_uuid"} {
+		f, err := newTransformFunc(Transform{Type: name})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		v1, v2, other := "alice", "alice", "bob"
+		a, b, c := f(&v1, v1), f(&v2, v2), f(&other, other)
+		if a == nil || *a == "" {
+			t.Errorf("%s: expected a fake value", name)
+			continue
+		}
+		if *a != *b {
+			t.Errorf("%s: equal values should be replaced by equal fakes, got %q and %q", name, *a, *b)
+		}
+		if *a == *c && name != "fake_first_name" && name != "fake_last_name" {
+			t.Errorf("%s: different values should usually be replaced by different fakes, got %q", name, *a)
+		}
+		if f(nil, "") != nil {
+			t.Errorf("%s: NULL should stay NULL", name)
+		}
+	}
+}
+
+func TestPreserveFormat(t *testing.T) {
+	original := "ACC-0012-3456-xy"
+	masked := preserveFormat(fakeRand(original), original, 4, 2)
+
+	if len(masked) != len(original) {
+		t.Fatalf("masked value should keep the length, got %q", masked)
+	}
+	if !strings.HasPrefix(masked, "ACC-") || !strings.HasSuffix(masked, "xy") {
+		t.Errorf("masked value should keep the prefix and suffix, got %q", masked)
+	}
+	if !regexp.MustCompile(`^ACC-[0-9]{4}-[0-9]{4}-xy$`).MatchString(masked) {
+		t.Errorf("masked value should keep digits as digits and separators, got %q", masked)
+	}
+	if masked == original {
+		t.Errorf("masked value should differ from the original, got %q", masked)
+	}
+}
+
+func TestPreserveFormat_Letters(t *testing.T) {
+	masked := preserveFormat(fakeRand("Ab1"), "Ab1", 0, 0)
+
+	if !regexp.MustCompile(`^[A-Z][a-z][0-9]$`).MatchString(masked) {
+		t.Errorf("masked value should keep letter case and digits, got %q", masked)
+	}
+}
+
+func TestPreserveFormat_Transform(t *testing.T) {
+	_, err := newTransformFunc(Transform{Type: "preserve_format", KeepPrefix: -1})
+	if err == nil {
+		t.Error("expected an error for a negative keep_prefix")
+	}
+
+	f, err := newTransformFunc(Transform{Type: "preserve_format", KeepPrefix: 2})
+	if err != nil {
+		t.Fatalf("newTransformFunc error: %v", err)
+	}
+	v := "DE89370400440532013000"
+	masked := f(&v, v)
+	if masked == nil || !strings.HasPrefix(*masked, "DE") || len(*masked) != len(v) {
+		t.Errorf("unexpected masked IBAN %v", masked)
+	}
+}
+
+func TestFakePerson_Consistent(t *testing.T) {
+	p := newFakePerson(fakeRand("row"))
+
+	if first := fakeFirstName(fakeRand("row")); first != p.First {
+		t.Errorf("expected first name %q, got %q", p.First, first)
+	}
+	if last := fakeLastName(fakeRand("row")); last != p.Last {
+		t.Errorf("expected last name %q, got %q", p.Last, last)
+	}
+	if name := fakeName(fakeRand("row")); name != p.First+" "+p.Last {
+		t.Errorf("expected name %q, got %q", p.First+" "+p.Last, name)
+	}
+	email := fakeEmail(fakeRand("row"), "x@example.org")
+	if !strings.HasPrefix(email, strings.ToLower(p.First+"."+p.Last)) {
+		t.Errorf("expected e-mail of %s %s, got %q", p.First, p.Last, email)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	pg "github.com/go-pg/pg/v10"
+)
+
+// fkCoverage records the keys of the dumped rows taking part in the foreign
+// keys among the dumped tables, to tell how many rows reference rows which
+// aren't in the dump.
+type fkCoverage struct {
+	// Foreign keys among the dumped tables, with Table and RefTable named
+	// as in the manifest
+	fks []ForeignKey
+	// Column lists recorded for every table
+	cols map[string][][]string
+
+	mu     sync.Mutex
+	tables map[string]*coverageTable
+}
+
+// coverageTable counts the rows of every value of the column lists of a
+// table in the COPY data passing through it.
+type coverageTable struct {
+	w    io.Writer
+	pos  [][]int
+	keys []map[string]int
+	line []byte
+}
+
+// newFKCoverage returns the coverage of the foreign keys among the tables of
+// items.
+func newFKCoverage(db *pg.DB, items []ManifestItem) (*fkCoverage, error) {
+	names := make(map[string]string, len(items))
+	for _, v := range items {
+		name, err := resolveTable(db, v.Table)
+		if err != nil {
+			return nil, err
+		}
+		names[name] = v.Table
+	}
+
+	c := &fkCoverage{cols: make(map[string][][]string), tables: make(map[string]*coverageTable)}
+	for _, v := range items {
+		fks, err := getTableForeignKeys(db, v.Table)
+		if err != nil {
+			return nil, err
+		}
+		for _, fk := range fks {
+			refTable, ok := names[fk.RefTable]
+			if !ok {
+				continue
+			}
+			fk.Table, fk.RefTable = v.Table, refTable
+			c.fks = append(c.fks, fk)
+			c.addColumns(fk.Table, fk.Columns)
+			c.addColumns(fk.RefTable, fk.RefColumns)
+		}
+	}
+	return c, nil
+}
+
+func (c *fkCoverage) addColumns(table string, cols []string) {
+	if !slices.ContainsFunc(c.cols[table], func(v []string) bool { return slices.Equal(v, cols) }) {
+		c.cols[table] = append(c.cols[table], cols)
+	}
+}
+
+// table returns a writer recording the keys of the rows of table, with the
+// columns cols, passing the COPY data on to w. The keys recorded before for
+// the same table, e.g. by an attempt which lost the connection, are
+// discarded.
+func (c *fkCoverage) table(table string, cols []string, w io.Writer) io.Writer {
+	lists := c.cols[table]
+	if len(lists) == 0 {
+		return w
+	}
+	t := &coverageTable{w: w, pos: make([][]int, len(lists)), keys: make([]map[string]int, len(lists))}
+	for i, list := range lists {
+		pos := make([]int, 0, len(list))
+		for _, col := range list {
+			pos = append(pos, slices.Index(cols, col))
+		}
+		if slices.Contains(pos, -1) {
+			// Keys of columns which aren't dumped can't be checked
+			continue
+		}
+		t.pos[i] = pos
+		t.keys[i] = make(map[string]int)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tables[table] = t
+	return t
+}
+
+func (t *coverageTable) Write(p []byte) (int, error) {
+	t.line = append(t.line, p...)
+	for {
+		end := bytes.IndexByte(t.line, '\n')
+		if end == -1 {
+			break
+		}
+		row := decodeCopyRow(string(t.line[:end]))
+		for i, pos := range t.pos {
+			if pos == nil {
+				continue
+			}
+			key := make([]*string, 0, len(pos))
+			for _, j := range pos {
+				key = append(key, row[j])
+			}
+			// Keys with NULL values don't reference anything
+			if !slices.Contains(key, nil) {
+				t.keys[i][encodeCopyRow(key)]++
+			}
+		}
+		t.line = t.line[end+1:]
+	}
+	return t.w.Write(p)
+}
+
+// keys returns the counts of the recorded keys of the columns cols of table,
+// or nil if they weren't recorded.
+func (c *fkCoverage) keys(table string, cols []string) map[string]int {
+	t, ok := c.tables[table]
+	if !ok {
+		return nil
+	}
+	i := slices.IndexFunc(c.cols[table], func(v []string) bool { return slices.Equal(v, cols) })
+	if i == -1 {
+		return nil
+	}
+	return t.keys[i]
+}
+
+// fkCount is the number of dumped rows referencing rows through a foreign
+// key, and of those referencing rows which aren't in the dump.
+type fkCount struct {
+	FK       ForeignKey
+	Rows     int
+	Dangling int
+	// Set if the columns of the foreign key aren't all dumped
+	Unchecked bool
+}
+
+// counts returns the counts of the foreign keys.
+func (c *fkCoverage) counts() []fkCount {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	counts := make([]fkCount, 0, len(c.fks))
+	for _, fk := range c.fks {
+		n := fkCount{FK: fk}
+		children := c.keys(fk.Table, fk.Columns)
+		parents := c.keys(fk.RefTable, fk.RefColumns)
+		if children == nil || parents == nil {
+			n.Unchecked = true
+			counts = append(counts, n)
+			continue
+		}
+		for key, rows := range children {
+			n.Rows += rows
+			if _, ok := parents[key]; !ok {
+				n.Dangling += rows
+			}
+		}
+		counts = append(counts, n)
+	}
+	return counts
+}
+
+// coverage formats the share of rows which don't dangle.
+func coverage(rows int, dangling int) string {
+	if rows == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(rows-dangling)/float64(rows))
+}
+
+// write writes the report of the foreign keys to w, with the totals of all
+// of them last.
+func (c *fkCoverage) write(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "FOREIGN KEY\tROWS\tDANGLING\tCOVERAGE")
+	rows, dangling := 0, 0
+	for _, n := range c.counts() {
+		name := fmt.Sprintf("%s (%s) -> %s (%s)", n.FK.Table, strings.Join(n.FK.Columns, ", "), n.FK.RefTable, strings.Join(n.FK.RefColumns, ", "))
+		if n.Unchecked {
+			fmt.Fprintf(tw, "%s\t-\t-\tcolumns not dumped\n", name)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\n", name, n.Rows, n.Dangling, coverage(n.Rows, n.Dangling))
+		rows += n.Rows
+		dangling += n.Dangling
+	}
+	fmt.Fprintf(tw, "TOTAL\t%d\t%d\t%s\n", rows, dangling, coverage(rows, dangling))
+	return tw.Flush()
+}
+
+// writeFKReport writes the report of the foreign keys to the file path.
+func writeFKReport(path string, c *fkCoverage) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	bw := bufio.NewWriter(f)
+	err = c.write(bw)
+	if err != nil {
+		return err
+	}
+	err = bw.Flush()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
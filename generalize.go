@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bucket replaces a number with the lower bound of the bucket of the given
+// size it falls into, e.g. 37 becomes 30 with buckets of size 10. Values which
+// are not numbers are returned unchanged.
+func bucket(v string, size float64) string {
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return v
+	}
+	lower := float64(int64(n/size)) * size
+	if lower > n {
+		lower -= size
+	}
+	return strconv.FormatFloat(lower, 'f', -1, 64)
+}
+
+// generalize keeps the first prefix characters of v and replaces the rest
+// with fill, e.g. the zip code 94107 becomes 94000 with a prefix of 2.
+func generalize(v string, prefix int, fill string) string {
+	runes := []rune(v)
+	if prefix >= len(runes) {
+		return v
+	}
+	return string(runes[:prefix]) + strings.Repeat(fill, len(runes)-prefix)
+}
+
+// Layouts of date and timestamp values in COPY output. Fractional seconds
+// are accepted by time.Parse even though the layouts don't mention them.
+var dateLayouts = []struct {
+	parse  string
+	format string
+}{
+	{"2006-01-02", "2006-01-02"},
+	{"2006-01-02 15:04:05", "2006-01-02 15:04:05.999999"},
+	{"2006-01-02 15:04:05-07", "2006-01-02 15:04:05.999999-07"},
+	{"2006-01-02 15:04:05-07:00", "2006-01-02 15:04:05.999999-07:00"},
+}
+
+// shiftDate moves a date or timestamp by the given number of days. Values
+// which are not dates are returned unchanged.
+func shiftDate(v string, days int) string {
+	for _, layout := range dateLayouts {
+		t, err := time.Parse(layout.parse, v)
+		if err != nil {
+			continue
+		}
+		return t.AddDate(0, 0, days).Format(layout.format)
+	}
+	return v
+}
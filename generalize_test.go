@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestBucket(t *testing.T) {
+	for _, tc := range []struct {
+		v        string
+		size     float64
+		expected string
+	}{
+		{"37", 10, "30"},
+		{"30", 10, "30"},
+		{"-3", 10, "-10"},
+		{"12.5", 5, "10"},
+		{"n/a", 10, "n/a"},
+	} {
+		if out := bucket(tc.v, tc.size); out != tc.expected {
+			t.Errorf("bucket(%q, %v): expected %q, got %q", tc.v, tc.size, tc.expected, out)
+		}
+	}
+}
+
+func TestGeneralize(t *testing.T) {
+	if out := generalize("94107", 2, "0"); out != "94000" {
+		t.Errorf("expected 94000, got %q", out)
+	}
+	if out := generalize("SW1A 1AA", 4, "*"); out != "SW1A****" {
+		t.Errorf("expected SW1A****, got %q", out)
+	}
+	if out := generalize("12", 3, "0"); out != "12" {
+		t.Errorf("short values should be left alone, got %q", out)
+	}
+}
+
+func TestShiftDate(t *testing.T) {
+	for _, tc := range []struct {
+		v        string
+		days     int
+		expected string
+	}{
+		{"2024-01-01", 3, "2024-01-04"},
+		{"2024-03-01 10:00:00", -1, "2024-02-29 10:00:00"},
+		{"2024-01-01 10:00:00.123456", 1, "2024-01-02 10:00:00.123456"},
+		{"2024-01-01 10:00:00+02", 1, "2024-01-02 10:00:00+02"},
+		{"2024-01-01 10:00:00+05:30", 1, "2024-01-02 10:00:00+05:30"},
+		{"infinity", 1, "infinity"},
+	} {
+		if out := shiftDate(tc.v, tc.days); out != tc.expected {
+			t.Errorf("shiftDate(%q, %d): expected %q, got %q", tc.v, tc.days, tc.expected, out)
+		}
+	}
+}
+
+func TestCopyTransformer_ShiftDateByKey(t *testing.T) {
+	var buf bytes.Buffer
+	cols := []string{"user_id", "created_at"}
+	specs := map[string]Transform{
+		"created_at": {Type: "shift_date", MaxDays: 30, Key: "user_id"},
+	}
+	tr, err := newCopyTransformer(&buf, cols, specs)
+	if err != nil {
+		t.Fatalf("newCopyTransformer error: %v", err)
+	}
+
+	_, err = tr.Write([]byte("1\t2024-01-01\n1\t2024-01-11\n"))
+	if err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+
+	// Both dates of the same user are shifted by the same offset
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	first := decodeCopyRow(lines[0])[1]
+	second := decodeCopyRow(lines[1])[1]
+	days := 0
+	for ; days <= 30; days++ {
+		if shiftDate("2024-01-01", days) == *first || shiftDate("2024-01-01", -days) == *first {
+			break
+		}
+	}
+	if shiftDate("2024-01-11", days) != *second && shiftDate("2024-01-11", -days) != *second {
+		t.Errorf("dates of the same user should be shifted equally, got %q and %q", *first, *second)
+	}
+}
+
+func TestGeneralizationTransforms_Validation(t *testing.T) {
+	for _, spec := range []Transform{
+		{Type: "bucket"},
+		{Type: "shift_date"},
+		{Type: "generalize", KeepPrefix: -1},
+	} {
+		if _, err := newTransformFunc(spec); err == nil {
+			t.Errorf("expected an error for %+v", spec)
+		}
+	}
+}
+
+func TestCopyTransformer_UnknownKey(t *testing.T) {
+	specs := map[string]Transform{"created_at": {Type: "shift_date", MaxDays: 1, Key: "user_id"}}
+	if _, err := newCopyTransformer(&bytes.Buffer{}, []string{"created_at"}, specs); err == nil {
+		t.Fatal("expected an error for an unknown key column")
+	}
+}
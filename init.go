@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	pg "github.com/go-pg/pg/v10"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// wizard asks the questions of the init command. With yes set it takes the
+// suggested answers without asking.
+type wizard struct {
+	in  *bufio.Reader
+	out io.Writer
+	yes bool
+}
+
+// ask returns the answer to question, or suggestion if the answer is empty.
+func (wz *wizard) ask(question string, suggestion string) string {
+	if wz.yes {
+		return suggestion
+	}
+	if suggestion != "" {
+		fmt.Fprintf(wz.out, "%s [%s]: ", question, suggestion)
+	} else {
+		fmt.Fprintf(wz.out, "%s: ", question)
+	}
+	answer, _ := wz.in.ReadString('\n')
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		return suggestion
+	}
+	return answer
+}
+
+func (wz *wizard) confirm(question string) bool {
+	for {
+		switch strings.ToLower(wz.ask(question+" (y/n)", "y")) {
+		case "y", "yes":
+			return true
+		case "n", "no":
+			return false
+		}
+	}
+}
+
+// suggestTransform returns the transform suggested for a column, judging by
+// its name, or an empty string if it looks harmless.
+func suggestTransform(col string, pattern *regexp.Regexp) string {
+	name := strings.ToLower(col)
+	switch {
+	case pattern != nil && pattern.MatchString(col):
+		return "null"
+	case strings.Contains(name, "email"):
+		return "fake_email"
+	case strings.Contains(name, "first_name"):
+		return "fake_first_name"
+	case strings.Contains(name, "last_name"):
+		return "fake_last_name"
+	case name == "full_name":
+		return "fake_name"
+	case strings.Contains(name, "phone"):
+		return "fake_phone"
+	case strings.Contains(name, "address"):
+		return "fake_address"
+	}
+	return ""
+}
+
+// tableItem asks how to dump table, returning nil if it's not to be dumped.
+func (wz *wizard) tableItem(table string, cols []string, pattern *regexp.Regexp) *ManifestItem {
+	if !wz.confirm(fmt.Sprintf("Dump table %s?", table)) {
+		return nil
+	}
+
+	item := ManifestItem{Table: table}
+	where := wz.ask(fmt.Sprintf("  Rows of %s to dump (SQL condition, empty for all)", table), "")
+	if where != "" {
+		item.Query = fmt.Sprintf("SELECT * FROM %s WHERE %s", table, where)
+	}
+
+	for _, col := range cols {
+		suggestion := suggestTransform(col, pattern)
+		if suggestion == "" {
+			continue
+		}
+		for {
+			answer := wz.ask(fmt.Sprintf("  Transform of %s.%s (\"none\" to keep it)", table, col), suggestion)
+			if answer == "none" {
+				break
+			}
+			_, err := newTransformFunc(Transform{Type: answer})
+			if err != nil {
+				fmt.Fprintf(wz.out, "  %v\n", err)
+				continue
+			}
+			if item.Transforms == nil {
+				item.Transforms = make(map[string]Transform)
+			}
+			item.Transforms[col] = Transform{Type: answer}
+			break
+		}
+	}
+	return &item
+}
+
+// listTables returns the canonical names of all tables of the database.
+func listTables(db *pg.DB) ([]string, error) {
+	var model []struct {
+		Name string
+	}
+	// Partitions are sampled through their partitioned table
+	partitions := ""
+	if serverVersion(db) >= PG10 {
+		partitions = "AND NOT c.relispartition"
+	}
+	sql := `
+		SELECT ` + relNameSQL("c.oid") + ` AS name
+		FROM pg_catalog.pg_class c
+		JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE
+			c.relkind IN ('r', 'p')
+			` + partitions + `
+			AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+			AND n.nspname NOT LIKE 'pg_toast%'
+		ORDER BY n.nspname <> 'public', n.nspname, c.relname
+	`
+	_, err := db.Query(&model, sql)
+	if err != nil {
+		return nil, err
+	}
+
+	tables := make([]string, 0, len(model))
+	for _, v := range model {
+		tables = append(tables, v.Name)
+	}
+	return tables, nil
+}
+
+// initManifest walks through the tables of the database and writes a
+// manifest dumping them as the wizard is told.
+func initManifest(db *pg.DB, w io.Writer, wz *wizard, pattern *regexp.Regexp) error {
+	tables, err := listTables(db)
+	if err != nil {
+		return err
+	}
+
+	manifest := Manifest{Tables: make([]ManifestItem, 0)}
+	for _, table := range tables {
+		cols, err := getTableCols(db, table)
+		if err != nil {
+			return err
+		}
+		if item := wz.tableItem(table, cols, pattern); item != nil {
+			manifest.Tables = append(manifest.Tables, *item)
+		}
+	}
+
+	return writeManifest(w, &manifest)
+}
+
+func writeManifest(w io.Writer, manifest *Manifest) error {
+	fmt.Fprintln(w, "---")
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	err := enc.Encode(manifest)
+	if err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func testWizard(input string) *wizard {
+	return &wizard{in: bufio.NewReader(strings.NewReader(input)), out: &bytes.Buffer{}}
+}
+
+func TestSuggestTransform(t *testing.T) {
+	pattern := regexp.MustCompile("(?i)password")
+	for col, expected := range map[string]string{
+		"id":            "",
+		"title":         "",
+		"password_hash": "null",
+		"Email":         "fake_email",
+		"first_name":    "fake_first_name",
+		"last_name":     "fake_last_name",
+		"full_name":     "fake_name",
+		"mobile_phone":  "fake_phone",
+		"home_address":  "fake_address",
+	} {
+		if suggestion := suggestTransform(col, pattern); suggestion != expected {
+			t.Errorf("suggestTransform(%q): expected %q, got %q", col, expected, suggestion)
+		}
+	}
+}
+
+func TestWizard_TableItem(t *testing.T) {
+	// Dump users, only active ones, keep the suggested transform of email
+	// and replace an invalid answer for password by a valid one
+	wz := testWizard("y\nactive\n\nbogus\nredact\n")
+	cols := []string{"id", "email", "password"}
+	item := wz.tableItem("users", cols, regexp.MustCompile("password"))
+	if item == nil {
+		t.Fatal("expected users to be dumped")
+	}
+	if item.Query != "SELECT * FROM users WHERE active" {
+		t.Errorf("unexpected query %q", item.Query)
+	}
+	if item.Transforms["email"].Type != "fake_email" || item.Transforms["password"].Type != "redact" {
+		t.Errorf("unexpected transforms %v", item.Transforms)
+	}
+	if _, ok := item.Transforms["id"]; ok {
+		t.Error("id should not be transformed")
+	}
+
+	wz = testWizard("n\n")
+	if item := wz.tableItem("audit_log", cols, nil); item != nil {
+		t.Errorf("expected audit_log to be skipped, got %v", item)
+	}
+
+	wz = testWizard("y\n\nnone\n")
+	item = wz.tableItem("users", []string{"id", "email"}, nil)
+	if item.Query != "" || len(item.Transforms) != 0 {
+		t.Errorf("expected all rows without transforms, got %+v", item)
+	}
+}
+
+func TestWriteManifest(t *testing.T) {
+	manifest := &Manifest{Tables: []ManifestItem{
+		{Table: "users", Transforms: map[string]Transform{"email": {Type: "fake_email"}}},
+		{Table: "posts", Query: "SELECT * FROM posts WHERE id < 10"},
+	}}
+
+	var buf bytes.Buffer
+	err := writeManifest(&buf, manifest)
+	if err != nil {
+		t.Fatalf("writeManifest error: %v", err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "email: fake_email") {
+		t.Errorf("simple transforms should be written by name, got:\n%s", out)
+	}
+	if strings.Contains(out, "post_actions") || strings.Contains(out, "vars") {
+		t.Errorf("empty keys should be omitted, got:\n%s", out)
+	}
+
+	m, err := readManifest(&buf)
+	if err != nil {
+		t.Fatalf("readManifest error: %v", err)
+	}
+	if len(m.Tables) != 2 || m.Tables[1].Query != manifest.Tables[1].Query || m.Tables[0].Transforms["email"].Type != "fake_email" {
+		t.Errorf("written manifest should read back the same, got %+v", m.Tables)
+	}
+}
+
+func TestInitManifest(t *testing.T) {
+	db := requireDB(t)
+
+	var buf bytes.Buffer
+	wz := &wizard{yes: true}
+	err := initManifest(db, &buf, wz, regexp.MustCompile("(?i)password"))
+	if err != nil {
+		t.Fatalf("initManifest error: %v", err)
+	}
+
+	m, err := readManifest(&buf)
+	if err != nil {
+		t.Fatalf("readManifest error: %v", err)
+	}
+	tables := make(map[string]ManifestItem)
+	for _, v := range m.Tables {
+		tables[v.Table] = v
+	}
+	if _, ok := tables["billing.invoices"]; !ok {
+		t.Errorf("expected billing.invoices in the manifest, got %v", m.Tables)
+	}
+	if tables["users"].Transforms["email"].Type != "fake_email" {
+		t.Errorf("expected the suggested transform of users.email, got %v", tables["users"].Transforms)
+	}
+}
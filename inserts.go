@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	pg "github.com/go-pg/pg/v10"
+)
+
+// INSERT_BATCH_SIZE is the number of rows inserted by each INSERT statement of
+// dumps in other dialects.
+const INSERT_BATCH_SIZE = 1000
+
+const (
+	BEGIN_INSERT_DUMP = `--
+-- %s data dump of a PostgreSQL database
+--
+
+`
+
+	BEGIN_INSERT_TABLE_DUMP = `
+--
+-- Data for Name: %s; Type: TABLE DATA
+%s--
+
+`
+)
+
+// dialect tells how a dump for a database other than PostgreSQL loads the
+// data, with INSERT statements.
+type dialect struct {
+	// Name of the database
+	name string
+	// Statements at the start and the end of the dump
+	begin string
+	end   string
+	// quoteIdent quotes an identifier
+	quoteIdent func(v string) string
+	// value returns the literal of a value of a PostgreSQL type, in COPY
+	// text format, or NULL. It fails on values the database can't store.
+	value func(pgType string, v *string) (string, error)
+	// columnType returns the column type storing values of a PostgreSQL
+	// type. Dumps create their tables if it's set, otherwise they have to
+	// exist already.
+	columnType func(pgType string) string
+}
+
+// dialects are the dialects of dumps other than PostgreSQL, by name.
+var dialects = map[string]*dialect{
+	"mysql": {
+		name: "MySQL",
+		begin: `SET NAMES utf8mb4;
+SET FOREIGN_KEY_CHECKS = 0;
+SET UNIQUE_CHECKS = 0;
+SET SQL_MODE = CONCAT(@@SQL_MODE, ',NO_AUTO_VALUE_ON_ZERO');
+START TRANSACTION;
+`,
+		end: `
+COMMIT;
+SET UNIQUE_CHECKS = 1;
+SET FOREIGN_KEY_CHECKS = 1;
+`,
+		quoteIdent: func(v string) string {
+			return "`" + strings.ReplaceAll(v, "`", "``") + "`"
+		},
+		value: mysqlValue,
+	},
+	"duckdb": {
+		name:       "DuckDB",
+		begin:      "BEGIN TRANSACTION;\n",
+		end:        "\nCOMMIT;\n",
+		quoteIdent: quoteIdent,
+		value:      duckdbValue,
+		columnType: duckdbType,
+	},
+}
+
+// insertDumpWriter writes the dump as an SQL script of another database,
+// inserting the rows into existing tables with INSERT statements.
+type insertDumpWriter struct {
+	w       io.Writer
+	db      *pg.DB
+	dialect *dialect
+	opts    DumpOptions
+
+	// Table being written, its columns and their types, the start of the
+	// statements inserting its rows and the number of rows of the current
+	// statement
+	table  string
+	cols   []string
+	types  []string
+	insert string
+	batch  int
+}
+
+func newInsertDumpWriter(w io.Writer, db *pg.DB, d *dialect, opts DumpOptions) *insertDumpWriter {
+	return &insertDumpWriter{w: w, db: db, dialect: d, opts: opts}
+}
+
+func (d *insertDumpWriter) BeginDump(info *DumpInfo) error {
+	fmt.Fprintf(d.w, BEGIN_INSERT_DUMP, d.dialect.name)
+	if info.Manifest.Hash != "" {
+		fmt.Fprintf(d.w, MANIFEST_HASH_DUMP, info.Manifest.Hash)
+	}
+	if !d.opts.Expires.IsZero() {
+		fmt.Fprintf(d.w, EXPIRES_DUMP, d.opts.Expires.UTC().Format(time.RFC3339))
+	}
+	writeAsOf(d.w, info.Manifest, d.opts)
+	_, err := io.WriteString(d.w, d.dialect.begin)
+	return err
+}
+
+func (d *insertDumpWriter) BeginTable(table string, query string, cols []string) error {
+	types, err := getColumnTypes(d.db, table)
+	if err != nil {
+		return err
+	}
+	pk, err := getPrimaryKey(d.db, table)
+	if err != nil {
+		return err
+	}
+	d.beginTable(table, query, cols, types, pk)
+	return nil
+}
+
+// beginTable starts the data of table, with the columns cols of the given
+// types and the primary key pk.
+func (d *insertDumpWriter) beginTable(table string, query string, cols []string, types map[string]string, pk []string) {
+	d.table = table
+	d.cols = cols
+	d.types = make([]string, 0, len(cols))
+	quoted := make([]string, 0, len(cols))
+	for _, col := range cols {
+		d.types = append(d.types, types[col])
+		quoted = append(quoted, d.dialect.quoteIdent(col))
+	}
+
+	// Tables outside the public schema are qualified with their schema
+	schema, name := splitTableName(table)
+	name = d.dialect.quoteIdent(name)
+	if schema != "public" {
+		name = d.dialect.quoteIdent(schema) + "." + name
+	}
+	d.insert = fmt.Sprintf("INSERT INTO %s (%s) VALUES\n", name, strings.Join(quoted, ", "))
+	d.batch = 0
+	fmt.Fprintf(d.w, BEGIN_INSERT_TABLE_DUMP, table, provenance(query))
+
+	if d.dialect.columnType == nil {
+		return
+	}
+	if schema != "public" {
+		fmt.Fprintf(d.w, "CREATE SCHEMA IF NOT EXISTS %s;\n", d.dialect.quoteIdent(schema))
+	}
+	defs := make([]string, 0, len(cols))
+	for i, col := range cols {
+		defs = append(defs, fmt.Sprintf("    %s %s", quoted[i], d.dialect.columnType(types[col])))
+	}
+	if len(pk) > 0 && containsAll(cols, pk) {
+		keys := make([]string, 0, len(pk))
+		for _, col := range pk {
+			keys = append(keys, d.dialect.quoteIdent(col))
+		}
+		defs = append(defs, fmt.Sprintf("    PRIMARY KEY (%s)", strings.Join(keys, ", ")))
+	}
+	fmt.Fprintf(d.w, "CREATE TABLE %s (\n%s\n);\n\n", name, strings.Join(defs, ",\n"))
+}
+
+func (d *insertDumpWriter) WriteRow(row []*string) error {
+	values := make([]string, 0, len(row))
+	for i, v := range row {
+		value, err := d.dialect.value(d.types[i], v)
+		if err != nil {
+			return fmt.Errorf("%s.%s: %w", d.table, d.cols[i], err)
+		}
+		values = append(values, value)
+	}
+
+	sep := ",\n"
+	if d.batch == 0 {
+		sep = d.insert
+	}
+	_, err := fmt.Fprintf(d.w, "%s(%s)", sep, strings.Join(values, ", "))
+	if err != nil {
+		return err
+	}
+	d.batch++
+	if d.batch == INSERT_BATCH_SIZE {
+		return d.endStatement()
+	}
+	return nil
+}
+
+// endStatement ends the current INSERT statement, if any.
+func (d *insertDumpWriter) endStatement() error {
+	if d.batch == 0 {
+		return nil
+	}
+	d.batch = 0
+	_, err := io.WriteString(d.w, ";\n")
+	return err
+}
+
+func (d *insertDumpWriter) EndTable(rows int, duration time.Duration) error {
+	err := d.endStatement()
+	if err != nil {
+		return err
+	}
+	tableStats(d.w, rows, duration)
+	return nil
+}
+
+func (d *insertDumpWriter) PostAction(sql string) error {
+	// Post actions are written for PostgreSQL
+	d.opts.warn("post action of %s skipped in the %s dump: %s", d.table, d.dialect.name, sql)
+	return nil
+}
+
+func (d *insertDumpWriter) EndDump() error {
+	_, err := io.WriteString(d.w, d.dialect.end)
+	return err
+}
+
+// numberLiteral matches the numbers MySQL reads as they are written by
+// PostgreSQL, with all their digits.
+var numberLiteral = regexp.MustCompile(`^[-+]?([0-9]+\.?[0-9]*|\.[0-9]+)([eE][-+]?[0-9]+)?$`)
+
+// mysqlValue returns the MySQL literal of a value of a PostgreSQL type.
+// Numbers MySQL can't store, like NaN, are an error.
+func mysqlValue(pgType string, v *string) (string, error) {
+	if v == nil {
+		return "NULL", nil
+	}
+	s := *v
+	switch pgType {
+	case "bool":
+		if s == "t" {
+			return "TRUE", nil
+		}
+		return "FALSE", nil
+	case "int2", "int4", "int8", "oid", "float4", "float8", "numeric":
+		if !numberLiteral.MatchString(s) {
+			return "", fmt.Errorf("MySQL can't store the number %s", s)
+		}
+		return s, nil
+	case "bytea":
+		b, err := hex.DecodeString(strings.TrimPrefix(s, `\x`))
+		if err == nil {
+			return fmt.Sprintf("X'%x'", b), nil
+		}
+	case "timestamptz":
+		// MySQL has no time zones in timestamps, they are stored in UTC
+		for _, layout := range timestamptzLayouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				s = t.UTC().Format("2006-01-02 15:04:05.999999")
+				break
+			}
+		}
+	}
+	return mysqlString(s), nil
+}
+
+// mysqlString quotes v as a MySQL string literal.
+func mysqlString(v string) string {
+	return "'" + strings.NewReplacer(
+		`\`, `\\`,
+		"'", "''",
+		"\x00", `\0`,
+		"\n", `\n`,
+		"\r", `\r`,
+		"\x1a", `\Z`,
+	).Replace(v) + "'"
+}
+
+// duckdbType returns the DuckDB column type storing values of a PostgreSQL
+// type. Types DuckDB can't parse from PostgreSQL's format, like intervals and
+// arrays, are stored as text, and numeric as double, lacking its precision.
+func duckdbType(pgType string) string {
+	switch pgType {
+	case "bool":
+		return "BOOLEAN"
+	case "int2":
+		return "SMALLINT"
+	case "int4":
+		return "INTEGER"
+	case "int8", "oid":
+		return "BIGINT"
+	case "float4":
+		return "REAL"
+	case "float8", "numeric":
+		return "DOUBLE"
+	case "date":
+		return "DATE"
+	case "time":
+		return "TIME"
+	case "timestamp":
+		return "TIMESTAMP"
+	case "timestamptz":
+		return "TIMESTAMPTZ"
+	case "uuid":
+		return "UUID"
+	case "json", "jsonb":
+		return "JSON"
+	case "bytea":
+		return "BLOB"
+	default:
+		return "VARCHAR"
+	}
+}
+
+// duckdbValue returns the DuckDB literal of a value of a PostgreSQL type.
+func duckdbValue(pgType string, v *string) (string, error) {
+	if v == nil {
+		return "NULL", nil
+	}
+	s := *v
+	switch pgType {
+	case "bool":
+		if s == "t" {
+			return "true", nil
+		}
+		return "false", nil
+	case "int2", "int4", "int8", "oid", "float4", "float8", "numeric":
+		// NaN and infinities are cast from strings
+		f, err := strconv.ParseFloat(s, 64)
+		if err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+			return s, nil
+		}
+	case "bytea":
+		b, err := hex.DecodeString(strings.TrimPrefix(s, `\x`))
+		if err == nil {
+			var escaped strings.Builder
+			for _, c := range b {
+				fmt.Fprintf(&escaped, `\x%02X`, c)
+			}
+			return fmt.Sprintf("'%s'::BLOB", escaped.String()), nil
+		}
+	}
+	return quoteLiteral(s), nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestInsertDumpWriter(t *testing.T) {
+	var buf bytes.Buffer
+	d := newInsertDumpWriter(&buf, nil, dialects["mysql"], DumpOptions{})
+	err := d.BeginDump(&DumpInfo{Manifest: &Manifest{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+
+	str := func(s string) *string { return &s }
+	d.beginTable("billing.users", "SELECT * FROM billing.users", []string{"id", "name", "active"},
+		map[string]string{"id": "int4", "name": "text", "active": "bool"}, []string{"id"})
+	for _, row := range [][]*string{
+		{str("1"), str("o'neil"), str("t")},
+		{str("2"), nil, str("f")},
+	} {
+		err := d.WriteRow(row)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = d.EndTable(2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "\n--\n-- Data for Name: billing.users; Type: TABLE DATA\n-- Query: SELECT * FROM billing.users\n--\n\n" +
+		"INSERT INTO `billing`.`users` (`id`, `name`, `active`) VALUES\n" +
+		"(1, 'o''neil', TRUE),\n" +
+		"(2, NULL, FALSE);\n" +
+		"-- Rows: 2\n"
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestInsertDumpWriter_CreateTable(t *testing.T) {
+	var buf bytes.Buffer
+	d := newInsertDumpWriter(&buf, nil, dialects["duckdb"], DumpOptions{})
+	str := func(s string) *string { return &s }
+	d.beginTable("billing.invoices", "", []string{"id", "total", "paid_at"},
+		map[string]string{"id": "int8", "total": "numeric", "paid_at": "timestamptz"}, []string{"id"})
+	err := d.WriteRow([]*string{str("7"), str("NaN"), nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.EndTable(1, 0)
+
+	expected := "\n--\n-- Data for Name: billing.invoices; Type: TABLE DATA\n--\n\n" +
+		"CREATE SCHEMA IF NOT EXISTS \"billing\";\n" +
+		"CREATE TABLE \"billing\".\"invoices\" (\n" +
+		"    \"id\" BIGINT,\n" +
+		"    \"total\" DOUBLE,\n" +
+		"    \"paid_at\" TIMESTAMPTZ,\n" +
+		"    PRIMARY KEY (\"id\")\n" +
+		");\n\n" +
+		"INSERT INTO \"billing\".\"invoices\" (\"id\", \"total\", \"paid_at\") VALUES\n" +
+		"(7, 'NaN', NULL);\n" +
+		"-- Rows: 1\n"
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestInsertDumpWriter_Batches(t *testing.T) {
+	var buf bytes.Buffer
+	d := newInsertDumpWriter(&buf, nil, dialects["mysql"], DumpOptions{})
+	d.beginTable("users", "", []string{"id"}, map[string]string{"id": "int4"}, nil)
+	one := "1"
+	for i := 0; i < INSERT_BATCH_SIZE+1; i++ {
+		err := d.WriteRow([]*string{&one})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.EndTable(INSERT_BATCH_SIZE+1, 0)
+	if n := bytes.Count(buf.Bytes(), []byte("INSERT INTO")); n != 2 {
+		t.Errorf("expected 2 statements, got %d", n)
+	}
+	if n := bytes.Count(buf.Bytes(), []byte(";\n")); n != 2 {
+		t.Errorf("expected 2 terminated statements, got %d", n)
+	}
+}
+
+func TestMySQLValue(t *testing.T) {
+	str := func(s string) *string { return &s }
+	for _, tc := range []struct {
+		pgType   string
+		v        *string
+		expected string
+	}{
+		{"int8", str("42"), "42"},
+		{"numeric", str("1.50"), "1.50"},
+		{"numeric", str("123456789012345678901234567890.123456789"), "123456789012345678901234567890.123456789"},
+		{"float8", str("-1.5e+308"), "-1.5e+308"},
+		{"bytea", str(`\x0aff`), "X'0aff'"},
+		{"bytea", str(`\x0a'); DROP TABLE users; --`), `'\\x0a''); DROP TABLE users; --'`},
+		{"timestamptz", str("2024-01-01 10:00:00+02"), "'2024-01-01 08:00:00'"},
+		{"text", str("a\\b\nc\x00"), `'a\\b\nc\0'`},
+		{"text", str("it's"), "'it''s'"},
+		{"_int4", str("{1,2}"), "'{1,2}'"},
+		{"text", nil, "NULL"},
+	} {
+		got, err := mysqlValue(tc.pgType, tc.v)
+		if err != nil || got != tc.expected {
+			t.Errorf("mysqlValue(%q, %v) = %s, %v, expected %s", tc.pgType, tc.v, got, err, tc.expected)
+		}
+	}
+
+	for _, v := range []string{"NaN", "-Infinity", "1); DROP TABLE users; --"} {
+		if got, err := mysqlValue("numeric", &v); err == nil {
+			t.Errorf("mysqlValue(%q) = %s, expected an error", v, got)
+		}
+	}
+}
+
+func TestDuckDBValue(t *testing.T) {
+	str := func(s string) *string { return &s }
+	for _, tc := range []struct {
+		pgType   string
+		v        *string
+		expected string
+	}{
+		{"bool", str("t"), "true"},
+		{"int4", str("42"), "42"},
+		{"float8", str("Infinity"), "'Infinity'"},
+		{"bytea", str(`\x0aff`), `'\x0A\xFF'::BLOB`},
+		{"timestamptz", str("2024-01-01 10:00:00+02"), "'2024-01-01 10:00:00+02'"},
+		{"text", str(`it's a\b`), `'it''s a\b'`},
+		{"text", nil, "NULL"},
+	} {
+		got, err := duckdbValue(tc.pgType, tc.v)
+		if err != nil || got != tc.expected {
+			t.Errorf("duckdbValue(%q, %v) = %s, %v, expected %s", tc.pgType, tc.v, got, err, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	pg "github.com/go-pg/pg/v10"
+)
+
+// KEYSET_PAGE_SIZE is the number of rows read by each page of a table read
+// page by page. Tables estimated to have fewer rows are read in one query.
+const KEYSET_PAGE_SIZE = 100000
+
+// keysetPages reads the rows of a query ordered by a unique key page by
+// page, every page starting after the key of the last row of the previous
+// one, so that no query has to sort all of the rows and every page can use
+// the index of the key.
+type keysetPages struct {
+	// Query returning the rows, unordered
+	query string
+	// Columns of the key, and their positions in the rows
+	key []string
+	pos []int
+	// Rows per page
+	size int
+	// Number of rows to read at most, 0 for all
+	limit int
+}
+
+// newKeysetPages returns the pages reading the rows of query, returning rows
+// of table with the columns cols, ordered by its primary key pk. It returns
+// nil if the table is small enough to be read at once, or if the key isn't
+// among the columns.
+func newKeysetPages(db *pg.DB, table string, query string, cols []string, pk []string, limit int) (*keysetPages, error) {
+	if limit > 0 && limit <= KEYSET_PAGE_SIZE {
+		return nil, nil
+	}
+	rows, err := estimateRows(db, table)
+	if err != nil {
+		return nil, err
+	}
+	if rows <= KEYSET_PAGE_SIZE {
+		return nil, nil
+	}
+
+	pos := make([]int, 0, len(pk))
+	for _, col := range pk {
+		i := slices.Index(cols, col)
+		if i == -1 {
+			return nil, nil
+		}
+		pos = append(pos, i)
+	}
+
+	return &keysetPages{query: query, key: pk, pos: pos, size: KEYSET_PAGE_SIZE, limit: limit}, nil
+}
+
+// page returns the query reading at most n rows following the row last,
+// or the first n rows if last is nil.
+func (p *keysetPages) page(last []*string, n int) string {
+	where := ""
+	if last != nil {
+		values := make([]string, 0, len(p.pos))
+		for _, i := range p.pos {
+			values = append(values, quoteLiteral(*last[i]))
+		}
+		where = fmt.Sprintf(" WHERE (%s) > (%s)", qualifiedIdents("k", p.key), strings.Join(values, ", "))
+	}
+	return fmt.Sprintf("SELECT * FROM (%s) AS k%s ORDER BY %s LIMIT %d", p.query, where, quoteIdents(p.key), n)
+}
+
+// copyPages copies the rows of table read page by page to w.
+func copyPages(ctx context.Context, w io.Writer, db *pg.DB, table string, p *keysetPages) (int, error) {
+	total := 0
+	var last []*string
+	for {
+		n := p.size
+		if p.limit > 0 && p.limit-total < n {
+			n = p.limit - total
+		}
+		if n == 0 {
+			return total, nil
+		}
+
+		lw := &lastRowWriter{w: w}
+		rows, err := copyQuery(ctx, lw, db, table, p.page(last, n))
+		if err != nil {
+			return 0, err
+		}
+		total += rows
+		if rows < n {
+			return total, nil
+		}
+		last = decodeCopyRow(string(lw.last))
+	}
+}
+
+// lastRowWriter passes COPY data to w, keeping the last row written.
+type lastRowWriter struct {
+	w    io.Writer
+	line []byte
+	last []byte
+}
+
+func (l *lastRowWriter) Write(p []byte) (int, error) {
+	l.line = append(l.line, p...)
+	if end := bytes.LastIndexByte(l.line, '\n'); end != -1 {
+		start := bytes.LastIndexByte(l.line[:end], '\n') + 1
+		l.last = append(l.last[:0], l.line[start:end]...)
+		l.line = append(l.line[:0], l.line[end+1:]...)
+	}
+	return l.w.Write(p)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKeysetPages_Page(t *testing.T) {
+	p := &keysetPages{query: "SELECT * FROM orders", key: []string{"tenant", "id"}, pos: []int{2, 0}, size: 100}
+
+	first := p.page(nil, 100)
+	if first != `SELECT * FROM (SELECT * FROM orders) AS k ORDER BY "tenant", "id" LIMIT 100` {
+		t.Errorf("unexpected first page %q", first)
+	}
+
+	id, total, tenant := "42", "9.99", "o'hara"
+	next := p.page([]*string{&id, &total, &tenant}, 10)
+	expected := `SELECT * FROM (SELECT * FROM orders) AS k WHERE (k."tenant", k."id") > ('o''hara', '42') ORDER BY "tenant", "id" LIMIT 10`
+	if next != expected {
+		t.Errorf("expected %q, got %q", expected, next)
+	}
+}
+
+func TestLastRowWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := &lastRowWriter{w: &buf}
+	for _, chunk := range []string{"1\ta\n2\t", "b\n3", "\tc\n"} {
+		_, err := w.Write([]byte(chunk))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if string(w.last) != "3\tc" {
+		t.Errorf("expected the last row to be %q, got %q", "3\tc", w.last)
+	}
+	if buf.String() != "1\ta\n2\tb\n3\tc\n" {
+		t.Errorf("expected the data to be passed on unchanged, got %q", buf.String())
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	pg "github.com/go-pg/pg/v10"
+)
+
+// lintPrivacy reports columns with names matching pattern which are dumped
+// as they are, without any transform.
+func lintPrivacy(db *pg.DB, items []ManifestItem, pattern *regexp.Regexp) ([]string, error) {
+	findings := make([]string, 0)
+	for _, v := range items {
+		cols := v.Columns
+		if len(cols) == 0 {
+			var err error
+			cols, err = getTableCols(db, v.Table)
+			if err != nil {
+				return nil, err
+			}
+		}
+		findings = append(findings, lintColumns(v, cols, pattern)...)
+	}
+	return findings, nil
+}
+
+func lintColumns(v ManifestItem, cols []string, pattern *regexp.Regexp) []string {
+	findings := make([]string, 0)
+	for _, col := range cols {
+		// Truncated values are still there, if shorter
+		if t, ok := v.Transforms[col]; (ok && t.Type != "truncate") || !pattern.MatchString(col) {
+			continue
+		}
+		findings = append(findings, fmt.Sprintf("sensitive column %s.%s is dumped without a transform", v.Table, col))
+	}
+	return findings
+}
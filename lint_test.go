@@ -0,0 +1,27 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestLintColumns(t *testing.T) {
+	pattern := regexp.MustCompile("(?i)password|token")
+	item := ManifestItem{
+		Table:      "users",
+		Transforms: map[string]Transform{"password_hash": {Type: "null"}, "reset_token": {Type: "truncate", Length: 4}},
+	}
+
+	findings := lintColumns(item, []string{"id", "password_hash", "API_TOKEN", "email", "reset_token"}, pattern)
+
+	if len(findings) != 2 {
+		t.Fatalf("expected 2 findings, got %v", findings)
+	}
+	if !strings.Contains(findings[0], "users.API_TOKEN") {
+		t.Errorf("expected finding for users.API_TOKEN, got %q", findings[0])
+	}
+	if !strings.Contains(findings[1], "users.reset_token") {
+		t.Errorf("expected truncated users.reset_token to be reported, got %q", findings[1])
+	}
+}
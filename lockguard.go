@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pg "github.com/go-pg/pg/v10"
+)
+
+// LOCK_GUARD_INTERVAL is the time between checks of the locks of a dump with
+// `--fail-on-lock-wait`.
+const LOCK_GUARD_INTERVAL = time.Second
+
+// applicationName is the application_name of the sessions of this process,
+// which tells them apart from those of other clients.
+var applicationName = fmt.Sprintf("pg_dump_sample %d", os.Getpid())
+
+// dumpSessions numbers the pools of connectDumpSessions.
+var dumpSessions atomic.Int64
+
+// connectDumpSessions opens a pool of connections to the database of db with
+// an application_name of their own, e.g. "pg_dump_sample 1234-2", which tells
+// the sessions of a dump apart from those of other dumps of this process.
+// The pool is closed with closeDumpSessions.
+func connectDumpSessions(db *pg.DB) (*pg.DB, string, error) {
+	opts := *db.Options()
+	opts.ApplicationName = fmt.Sprintf("%s-%d", applicationName, dumpSessions.Add(1))
+	sessions, err := connectDB(&opts)
+	if err != nil {
+		return nil, "", err
+	}
+	return sessions, opts.ApplicationName, nil
+}
+
+func closeDumpSessions(sessions *pg.DB) {
+	forgetCatalog(sessions)
+	serverVersions.Delete(sessions)
+	sessions.Close()
+}
+
+// setLockTimeout makes the sessions of pgOpts give up waiting for a lock
+// after timeout, so that a dump doesn't queue behind DDL waiting for an ACCESS
+// EXCLUSIVE lock, holding up every other query of the table along with it.
+// A zero timeout waits forever.
+func setLockTimeout(pgOpts *pg.Options, timeout time.Duration) {
+	onConnect := pgOpts.OnConnect
+	pgOpts.OnConnect = func(ctx context.Context, cn *pg.Conn) error {
+		if onConnect != nil {
+			err := onConnect(ctx, cn)
+			if err != nil {
+				return err
+			}
+		}
+		_, err := cn.ExecContext(ctx, fmt.Sprintf("SET lock_timeout = %d", timeout.Milliseconds()))
+		return err
+	}
+}
+
+// LockWaitError is returned when a dump with `--fail-on-lock-wait` held a
+// lock another session waited for.
+type LockWaitError struct {
+	PID   int
+	Query string
+}
+
+func (e *LockWaitError) Error() string {
+	return fmt.Sprintf("stopped the dump as session %d waited for its locks: %s", e.PID, sanitizeComment(e.Query))
+}
+
+// lockGuard watches the sessions of a dump, stopping it as soon as another
+// session waits for a lock it holds, e.g. DDL of a migration, or it holds a
+// lock stronger than ACCESS SHARE, which only SELECT takes. The sessions of
+// the dump are those with its application_name.
+type lockGuard struct {
+	db   *pg.DB
+	name string
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	mu      sync.Mutex
+	failure error
+}
+
+// startLockGuard starts watching the sessions named name every interval,
+// through db.
+func startLockGuard(db *pg.DB, name string, interval time.Duration) *lockGuard {
+	g := &lockGuard{db: db, name: name, done: make(chan struct{})}
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-g.done:
+				return
+			case <-ticker.C:
+			}
+			failure := checkLocks(db, name)
+			if failure != nil {
+				g.mu.Lock()
+				g.failure = failure
+				g.mu.Unlock()
+				// Ending the sessions releases their locks right away,
+				// instead of once the running query notices
+				terminateSessions(db, name)
+				return
+			}
+		}
+	}()
+	return g
+}
+
+// err returns why the dump was stopped, if it was.
+func (g *lockGuard) err() error {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.failure
+}
+
+// check returns why the dump was stopped, if it was, instead of err, which
+// is then only the lost connection.
+func (g *lockGuard) check(err error) error {
+	if failure := g.err(); failure != nil && err != nil {
+		return failure
+	}
+	return err
+}
+
+func (g *lockGuard) stop() {
+	close(g.done)
+	g.wg.Wait()
+}
+
+// checkLocks returns an error if another session waits for a lock of the
+// sessions named name on the database of db, or if they hold a lock stronger
+// than ACCESS SHARE.
+func checkLocks(db *pg.DB, name string) error {
+	var waiting []struct {
+		PID   int
+		Query string
+	}
+	_, err := db.Query(&waiting, `
+		SELECT w.pid, w.query
+		FROM pg_catalog.pg_stat_activity w
+		WHERE
+			w.wait_event_type = 'Lock'
+			AND w.application_name IS DISTINCT FROM ?0
+			AND EXISTS (
+				SELECT 1 FROM pg_catalog.pg_stat_activity b
+				WHERE
+					b.application_name = ?0
+					AND b.datname = pg_catalog.current_database()
+					AND b.pid = ANY (pg_catalog.pg_blocking_pids(w.pid))
+			)
+		LIMIT 1
+	`, name)
+	if err != nil {
+		return err
+	}
+	if len(waiting) > 0 {
+		return &LockWaitError{PID: waiting[0].PID, Query: waiting[0].Query}
+	}
+
+	var strong []struct {
+		Relation string
+		Mode     string
+	}
+	_, err = db.Query(&strong, `
+		SELECT l.relation::regclass::text AS relation, l.mode
+		FROM pg_catalog.pg_locks l
+		JOIN pg_catalog.pg_stat_activity a ON a.pid = l.pid
+		WHERE
+			a.application_name = ?
+			AND a.datname = pg_catalog.current_database()
+			AND l.locktype = 'relation'
+			AND l.mode <> 'AccessShareLock'
+		LIMIT 1
+	`, name)
+	if err != nil {
+		return err
+	}
+	if len(strong) > 0 {
+		return fmt.Errorf("stopped the dump as it took a %s on %s, stronger than ACCESS SHARE", strong[0].Mode, strong[0].Relation)
+	}
+	return nil
+}
+
+// terminateSessions ends the other sessions named name on the database of
+// db.
+func terminateSessions(db *pg.DB, name string) error {
+	_, err := db.Exec(`
+		SELECT pg_catalog.pg_terminate_backend(pid)
+		FROM pg_catalog.pg_stat_activity
+		WHERE
+			application_name = ?
+			AND datname = pg_catalog.current_database()
+			AND pid <> pg_catalog.pg_backend_pid()
+	`, name)
+	return err
+}
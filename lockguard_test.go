@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	pg "github.com/go-pg/pg/v10"
+)
+
+func TestLockGuard_Check(t *testing.T) {
+	var g *lockGuard
+	if g.err() != nil || g.check(io.EOF) != io.EOF {
+		t.Error("expected no guard to leave errors alone")
+	}
+
+	failure := &LockWaitError{PID: 42, Query: "ALTER TABLE users\n  ADD COLUMN age int"}
+	g = &lockGuard{failure: failure}
+	if g.check(nil) != nil {
+		t.Error("expected a complete dump to succeed")
+	}
+	if err := g.check(io.EOF); err != failure {
+		t.Errorf("expected the lost connection to be explained, got %v", err)
+	}
+	if msg := failure.Error(); msg != "stopped the dump as session 42 waited for its locks: ALTER TABLE users ADD COLUMN age int" {
+		t.Errorf("unexpected message: %s", msg)
+	}
+}
+
+func TestRetry_LockGuard(t *testing.T) {
+	opts := DumpOptions{Retries: 3, locks: &lockGuard{failure: errors.New("stopped")}}
+	attempts := 0
+	err := retry(opts, "users", func() error {
+		attempts++
+		return io.EOF
+	})
+	if err != io.EOF || attempts != 1 {
+		t.Errorf("expected connections ended by the guard not to be retried, got %d attempts: %v", attempts, err)
+	}
+}
+
+// connectGuardedDB connects to the test database as a session of this
+// process, with lock_timeout set.
+func connectGuardedDB(t *testing.T) *pg.DB {
+	t.Helper()
+	opts := testDBOpts()
+	opts.ApplicationName = applicationName
+	setLockTimeout(opts, 5*time.Second)
+	db, err := connectDB(opts)
+	if err != nil {
+		t.Skipf("skipping: test database not available: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestSetLockTimeout(t *testing.T) {
+	db := connectGuardedDB(t)
+	var timeout string
+	_, err := db.QueryOne(pg.Scan(&timeout), "SHOW lock_timeout")
+	if err != nil || timeout != "5s" {
+		t.Errorf("expected lock_timeout of 5s, got %q, %v", timeout, err)
+	}
+}
+
+// writerFunc is an io.Writer calling a function with the data written.
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestMakeDump_AccessShareLocksOnly(t *testing.T) {
+	db := connectGuardedDB(t)
+	other := requireDB(t)
+
+	manifest := &Manifest{Tables: []ManifestItem{{Table: "users"}, {Table: "posts"}}}
+	modes := make(map[string]bool)
+	// The locks are checked as the dump is written
+	err := makeDump(db, manifest, writerFunc(func(p []byte) (int, error) {
+		var held []string
+		_, err := other.Query(pg.Scan(&held), `
+			SELECT DISTINCT l.mode
+			FROM pg_catalog.pg_locks l
+			JOIN pg_catalog.pg_stat_activity a ON a.pid = l.pid
+			WHERE a.application_name = ? AND l.locktype = 'relation'
+		`, applicationName)
+		for _, mode := range held {
+			modes[mode] = true
+		}
+		return len(p), err
+	}), DumpOptions{})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+	for mode := range modes {
+		if mode != "AccessShareLock" {
+			t.Errorf("expected only ACCESS SHARE locks, got %s", mode)
+		}
+	}
+}
+
+func TestCheckLocks(t *testing.T) {
+	db := connectGuardedDB(t)
+	other := requireDB(t)
+
+	err := checkLocks(db, applicationName)
+	if err != nil {
+		t.Fatalf("expected no lock waits, got %v", err)
+	}
+
+	// A strong lock of the dump's sessions
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tx.Exec("LOCK TABLE users IN SHARE MODE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkLocks(db, applicationName)
+	if err == nil || !strings.Contains(err.Error(), "ShareLock on users") {
+		t.Errorf("expected the SHARE lock to be reported, got %v", err)
+	}
+	tx.Rollback()
+
+	// DDL waiting for a lock of the dump's sessions
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("SELECT * FROM users LIMIT 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ddl := make(chan error, 1)
+	go func() {
+		_, err := other.Exec("SET lock_timeout = '5s'; LOCK TABLE users IN ACCESS EXCLUSIVE MODE")
+		ddl <- err
+	}()
+	var lockErr *LockWaitError
+	for i := 0; i < 50 && !errors.As(err, &lockErr); i++ {
+		time.Sleep(100 * time.Millisecond)
+		err = checkLocks(db, applicationName)
+	}
+	if lockErr == nil || !strings.Contains(lockErr.Query, "LOCK TABLE users") {
+		t.Errorf("expected the waiting DDL to be reported, got %v", err)
+	}
+	tx.Rollback()
+	<-ddl
+}
+
+func TestConnectDumpSessions(t *testing.T) {
+	db := connectGuardedDB(t)
+
+	// Every dump has sessions of its own
+	var names []string
+	for i := 0; i < 2; i++ {
+		sessions, name, err := connectDumpSessions(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer closeDumpSessions(sessions)
+		var current string
+		_, err = sessions.QueryOne(pg.Scan(&current), "SELECT current_setting('application_name')")
+		if err != nil || current != name || !strings.HasPrefix(name, applicationName+"-") {
+			t.Errorf("expected sessions named %q, got %q, %v", name, current, err)
+		}
+		names = append(names, name)
+	}
+	if names[0] == names[1] {
+		t.Errorf("expected dumps to have different names, got %q twice", names[0])
+	}
+}
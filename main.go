@@ -1,13 +1,30 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"net"
+	"net/url"
 	"os"
+	"os/signal"
 	"os/user"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/cbroglie/mustache"
 	pg "github.com/go-pg/pg/v10"
@@ -24,7 +41,9 @@ const (
 
 BEGIN;
 
-SET statement_timeout = 0;
+` + SESSION_DUMP
+
+	SESSION_DUMP = `SET statement_timeout = 0;
 SET lock_timeout = 0;
 SET client_encoding = 'UTF8';
 SET standard_conforming_strings = on;
@@ -35,6 +54,21 @@ SET search_path = public, pg_catalog;
 
 `
 
+	MANIFEST_HASH_DUMP = "-- Manifest: sha256:%s\n\n"
+
+	EXPIRES_DUMP = "-- Expires: %s\n\n"
+
+	AS_OF_DUMP = "-- As of: %s\n\n"
+
+	FAST_RESTORE_DUMP = `SET synchronous_commit = off;
+SET maintenance_work_mem = '512MB';
+
+`
+
+	REPLICA_ROLE_DUMP = "SET session_replication_role = replica;\n\n"
+
+	RESET_REPLICA_ROLE_DUMP = "RESET session_replication_role;\n"
+
 	END_DUMP = `
 COMMIT;
 
@@ -46,14 +80,22 @@ COMMIT;
 	BEGIN_TABLE_DUMP = `
 --
 -- Data for Name: %s; Type: TABLE DATA
---
+%s--
 
-COPY %s (%s) FROM stdin;
+COPY %s (%s) FROM stdin%s;
 `
 
+	COPY_FREEZE_DUMP = " WITH (FREEZE)"
+
+	TABLE_QUERY_DUMP = "-- Query: %s\n"
+
 	END_TABLE_DUMP = `\.
 `
 
+	TABLE_STATS_DUMP = "-- Rows: %d; Duration: %s\n"
+
+	TABLE_ROWS_DUMP = "-- Rows: %d\n"
+
 	SQL_CMD_DUMP = "\n%s;\n"
 )
 
@@ -64,21 +106,269 @@ type Options struct {
 	NoPasswordPrompt bool
 	Password         string
 	ManifestFile     string
+	Manifest         []byte
 	OutputFile       string
+	Encrypt          string
+	Format           string
+	Dialect          string
+	Command          string
+	PreviewTable     string
+	PreviewRows      int
+	InitYes          bool
+	ExpiryPaths      []string
+	ExpiryDelete     bool
+	SelftestSeed     uint64
+	FollowSlot       string
+	FollowInterval   time.Duration
+	FollowForce      bool
+	ServeListen      string
+	ServeTokenFile   string
+	ServeProfiles    string
 	Database         string
+	Databases        []string
+	DatabaseJobs     int
+	Shards           []string
 	UseTls           bool
+	TlsRootCert      string
+	AwsIamAuth       bool
+	DropConstraints  bool
+	RebuildIndexes   bool
+	Analyze          bool
+	ResetSequences   bool
+	Comments         bool
+	Extensions       bool
+	AssertEncoding   bool
+	FastRestore      bool
+	ReplicaRole      bool
+	Freeze           bool
+	Deterministic    bool
+	KeepAlive        time.Duration
+	Retries          int
+	Jobs             int
+	MaxMemory        int64
+	NoKeyset         bool
+	RequireReplica   bool
+	MaxLag           time.Duration
+	LockTimeout      time.Duration
+	FailOnLockWait   bool
+	ProgressInterval time.Duration
+	MaxTxAge         time.Duration
+	PerTableTx       bool
+	SensitivePattern *regexp.Regexp
+	StrictPrivacy    bool
+	TransformKeyFile string
+	AuditLog         string
+	FKReport         string
+	ExcludeSubjects  string
+	NotifyURL        string
+	NotifyFormat     string
+	Expires          time.Duration
+	CheckTargetDSN   string
+	MatchTarget      bool
+	Vars             map[string]string
+	Schedules        []ScheduledJob
+}
+
+type DumpOptions struct {
+	DropConstraints bool
+	RebuildIndexes  bool
+	Analyze         bool
+	ResetSequences  bool
+	Comments        bool
+	Extensions      bool
+	AssertEncoding  bool
+	FastRestore     bool
+
+	// ReplicaRole restores the dump with session_replication_role set to
+	// replica, so that triggers and foreign key checks don't fire
+	ReplicaRole bool
+
+	// Number of times a table is dumped again if the connection is lost
+	Retries int
+
+	// Number of tables dumped in parallel, on connections reading the same
+	// snapshot
+	Jobs int
+
+	// Bytes of data tables dumped in parallel may buffer in memory, after
+	// which they are buffered in temporary files, 0 for no limit
+	MaxMemory int64
+
+	// Big tables are read page by page by primary key unless NoKeyset is set
+	NoKeyset bool
+
+	// Freeze loads rows frozen with COPY FREEZE, after truncating all dumped
+	// tables in the same transaction
+	Freeze bool
+
+	// Deterministic dumps are identical for the same data, regardless of
+	// the order of tables in the manifest and the time the dump took
+	Deterministic bool
+
+	// Columns matching SensitivePattern are reported unless they are
+	// transformed, with StrictPrivacy the dump fails instead
+	SensitivePattern *regexp.Regexp
+	StrictPrivacy    bool
+
+	// With Directory set, the data of every table is written to a file of
+	// its own in the directory, organized by schema, and the dump only
+	// includes these files
+	Directory string
+
+	// With AuditLog set, the primary keys of the dumped rows are written to
+	// the file as JSON lines
+	AuditLog string
+	audit    *auditLog
+
+	// With FKReport set, how many dumped rows reference rows which aren't
+	// in the dump is written to the file for every foreign key among the
+	// dumped tables
+	FKReport string
+	coverage *fkCoverage
+
+	// With ExcludeSubjects set, the subjects listed in the CSV file, and the
+	// rows referencing them, are left out of every table
+	ExcludeSubjects string
+	exclusions      *subjectExclusions
+
+	// Expiry time recorded in the header of the dump, if not zero
+	Expires time.Time
+
+	// With CheckTargetDSN set, the dump fails before writing anything if the
+	// dumped columns don't match the schema of the database at this URL.
+	// With MatchTarget, only the columns the target can load are dumped,
+	// in its order.
+	CheckTargetDSN string
+	MatchTarget    bool
+
+	// With summary set, the rows dumped of every table are recorded in it
+	summary *dumpSummary
+
+	// Tables taking longer than ProgressInterval report the rows copied so
+	// far every ProgressInterval. With MaxTransactionAge set, the dump fails
+	// once the transaction a table is read in is older than that. Parallel
+	// dumps read all tables in a transaction sharing the snapshot taken at
+	// snapshotStart, unless PerTableTransactions is set.
+	ProgressInterval     time.Duration
+	MaxTransactionAge    time.Duration
+	PerTableTransactions bool
+	snapshotStart        time.Time
+
+	// With FailOnLockWait set, the dump stops as soon as another session
+	// waits for one of its locks, or it holds a lock stronger than ACCESS
+	// SHARE
+	FailOnLockWait bool
+	locks          *lockGuard
+	targetColumns  map[string][]string
+
+	// With SQLite set, the tables are written to a SQLite database at this
+	// path instead of the SQL script
+	SQLite string
+
+	// With Parquet set, every table is written to a parquet file of its own
+	// in this directory instead of the SQL script
+	Parquet string
+
+	// With a Dialect other than postgresql, the SQL script inserts the rows
+	// into existing tables of another database with INSERT statements
+	Dialect string
+
+	// With Shards set, every table is also sampled from these databases,
+	// after the dumped database, so that the dump is the union of the
+	// samples of all shards
+	Shards []*pg.DB
+
+	// warnFunc receives the warnings about the dump, which are written to the
+	// standard error output when it's nil
+	warnFunc func(msg string)
+}
+
+// warn reports a warning about the dump.
+func (opts DumpOptions) warn(format string, args ...interface{}) {
+	msg := redact(fmt.Sprintf(format, args...))
+	if opts.warnFunc != nil {
+		opts.warnFunc(msg)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Warning: %s\n", msg)
+}
+
+type Index struct {
+	Name       string
+	Definition string
+}
+
+// Extension is an extension and the schema it is installed in, both quoted.
+type Extension struct {
+	Name   string
+	Schema string
+}
+
+// Comment is the comment on a table or column, with Object as in
+// COMMENT ON, e.g. "COLUMN users.email".
+type Comment struct {
+	Object string
+	Text   string
 }
 
 type ManifestItem struct {
-	Table       string   `yaml:"table"`
-	Query       string   `yaml:"query"`
-	Columns     []string `yaml:"columns,flow"`
-	PostActions []string `yaml:"post_actions,flow"`
+	Table       string               `yaml:"table"`
+	Query       string               `yaml:"query,omitempty"`
+	Sample      *Sample              `yaml:"sample,omitempty"`
+	SampleHash  *SampleHash          `yaml:"sample_hash,omitempty"`
+	PerParent   *PerParent           `yaml:"per_parent,omitempty"`
+	Limit       int                  `yaml:"limit,omitempty"`
+	OrderBy     string               `yaml:"order_by,omitempty"`
+	ChunkBy     string               `yaml:"chunk_by,omitempty"`
+	ChunkSize   int                  `yaml:"chunk_size,omitempty"`
+	MaxDuration time.Duration        `yaml:"max_duration,omitempty"`
+	OnTimeout   string               `yaml:"on_timeout,omitempty"`
+	Columns     []string             `yaml:"columns,flow,omitempty"`
+	Casts       map[string]string    `yaml:"casts,omitempty"`
+	Transforms  map[string]Transform `yaml:"transforms,omitempty"`
+	Truncate    map[string]int       `yaml:"truncate,omitempty"`
+	PostActions []string             `yaml:"post_actions,flow,omitempty"`
+
+	// SQL condition every dumped row has to match, what to do with the rows
+	// which don't, and the transforms fixing them with the fix policy
+	Validate  string               `yaml:"validate,omitempty"`
+	OnInvalid string               `yaml:"on_invalid,omitempty"`
+	Fix       map[string]Transform `yaml:"fix,omitempty"`
+
+	// Vars of the table's query and post actions, overriding the manifest's
+	Vars Vars `yaml:"vars,omitempty"`
+
+	// Compression of the table's data file in the directory format
+	Compress string `yaml:"compress,omitempty"`
+
+	// Sampler choosing the rows to dump, overriding query and sample. Set
+	// for tables added by the seed subset.
+	Sampler Sampler `yaml:"-"`
 }
 
 type Manifest struct {
-	Vars   map[string]string `yaml:"vars"`
-	Tables []ManifestItem    `yaml:"tables"`
+	Vars   Vars           `yaml:"vars,omitempty"`
+	Header string         `yaml:"header,omitempty"`
+	Footer string         `yaml:"footer,omitempty"`
+	Seed   *Seed          `yaml:"seed,omitempty"`
+	Tables []ManifestItem `yaml:"tables"`
+
+	// Queries computing vars when the dump starts, by var
+	VarsSQL map[string]string `yaml:"vars_sql,omitempty"`
+
+	// Boolean queries which must all be true for the dump to start
+	Preconditions []string `yaml:"preconditions,omitempty"`
+
+	// Instant the dump is as of, the as_of var of every query. The time the
+	// dump starts if not set.
+	AsOf string `yaml:"as_of,omitempty"`
+
+	// Instant the dump is as of, set when the dump starts
+	asOf time.Time
+
+	// SHA-256 of the manifest file, identifying the configuration a dump
+	// was made with
+	Hash string `yaml:"-"`
 }
 
 type ManifestIterator struct {
@@ -89,7 +379,7 @@ type ManifestIterator struct {
 	stack    []string
 }
 
-func NewManifestIterator(db *pg.DB, manifest *Manifest) *ManifestIterator {
+func NewManifestIterator(db *pg.DB, manifest *Manifest) (*ManifestIterator, error) {
 	m := ManifestIterator{
 		db,
 		manifest,
@@ -99,11 +389,17 @@ func NewManifestIterator(db *pg.DB, manifest *Manifest) *ManifestIterator {
 	}
 
 	for _, item := range m.manifest.Tables {
-		m.stack = append(m.stack, item.Table)
-		m.todo[item.Table] = item
+		// Tables are tracked by their canonical names, the same names
+		// dependencies are reported with
+		table, err := resolveTable(db, item.Table)
+		if err != nil {
+			return nil, err
+		}
+		m.stack = append(m.stack, table)
+		m.todo[table] = item
 	}
 
-	return &m
+	return &m, nil
 }
 
 func (m *ManifestIterator) Next() (*ManifestItem, error) {
@@ -151,20 +447,146 @@ func (m *ManifestIterator) Next() (*ManifestItem, error) {
 
 func parseArgs() (*Options, error) {
 	var opts struct {
-		Host             string `short:"h" long:"host" default:"/tmp" default-mask:"local socket" env:"PGHOST" description:"Database server host or socket directory"`
+		Host             string `short:"h" long:"host" default-mask:"local socket" env:"PGHOST" description:"Database server host or socket directory"`
 		Port             string `short:"p" long:"port" default:"5432" env:"PGPORT" description:"Database server port"`
 		Username         string `short:"U" long:"username" default-mask:"current user" env:"PGUSER" description:"Database user name"`
 		NoPasswordPrompt bool   `short:"w" long:"no-password" description:"Don't prompt for password"`
-		ManifestFile     string `short:"f" long:"manifest-file" description:"Path to manifest file"`
-		OutputFile       string `short:"o" long:"output-file" description:"Path to the output file"`
+		ManifestFile     string `short:"f" long:"manifest-file" env:"MANIFEST_PATH" description:"Path to manifest file"`
+		ManifestB64      string `long:"manifest-b64" env:"MANIFEST_B64" description:"Base64-encoded manifest, instead of a manifest file"`
+		OutputFile       string `short:"o" long:"output-file" env:"OUTPUT_URI" description:"Path or file:// URI of the output file"`
+		Format           string `short:"F" long:"format" choice:"plain" choice:"directory" choice:"sqlite" choice:"parquet" default:"plain" description:"Output format, a single SQL file, a directory with a file per table, a SQLite database or a directory with a parquet file per table"`
+		Dialect          string `long:"dialect" choice:"postgresql" choice:"mysql" choice:"duckdb" default:"postgresql" description:"SQL dialect of plain dumps, PostgreSQL loading rows with COPY or another database with INSERT statements"`
+		Encrypt          string `long:"encrypt" value-name:"METHOD:RECIPIENT" description:"Encrypt the dump with age (age:KEY or age:FILE) or GPG (gpg:RECIPIENT)"`
 		UseTls           bool   `short:"s" long:"tls" description:"Use SSL/TLS database connection"`
+		TlsRootCert      string `long:"tls-root-cert" value-name:"FILE" env:"PGSSLROOTCERT" description:"CA certificates the server's certificate is verified against, e.g. the RDS CA bundle"`
+		AwsIamAuth       bool   `long:"aws-iam-auth" description:"Authenticate to Amazon RDS with an IAM token instead of a password"`
+		DropConstraints  bool   `long:"drop-constraints" description:"Drop foreign keys before loading data and recreate them afterwards"`
+		RebuildIndexes   bool   `long:"rebuild-indexes" description:"Drop indexes before loading data and recreate them afterwards"`
+		Analyze          bool   `long:"analyze" description:"Analyze dumped tables after loading data"`
+		ResetSequences   bool   `long:"reset-sequences" description:"Set the sequences of dumped serial and identity columns past their loaded values"`
+		Comments         bool   `long:"comments" description:"Include the comments on dumped tables and their columns"`
+		Extensions       bool   `long:"extensions" description:"Create the extensions providing types of dumped columns"`
+		AssertEncoding   bool   `long:"assert-encoding" description:"Fail the restore if the database encoding differs from the dumped one"`
+		FastRestore      bool   `long:"fast-restore" description:"Tune the restoring session for speed over durability"`
+		ReplicaRole      bool   `long:"replica-role" description:"Skip triggers and foreign key checks when restoring, which requires a superuser"`
+		Freeze           bool   `long:"freeze" description:"Truncate dumped tables and load rows frozen with COPY FREEZE"`
+		Deterministic    bool   `long:"deterministic" description:"Produce identical dumps of identical data, e.g. for fixtures"`
+		SensitiveColumns string `long:"sensitive-columns" default:"(?i)password|passwd|ssn|token|secret" description:"Regular expression matching names of sensitive columns"`
+		StrictPrivacy    bool   `long:"strict-privacy" description:"Fail if sensitive columns are dumped without a transform"`
+		TransformKeyFile string `long:"transform-key-file" value-name:"FILE" description:"File with the key of the hash and fake transforms, instead of $PG_DUMP_SAMPLE_TRANSFORM_KEY, random if neither is set"`
+		AuditLog         string `long:"audit-log" value-name:"FILE" description:"Write the primary keys of the dumped rows to this file"`
+		FKReport         string `long:"fk-report" value-name:"FILE" description:"Write how many dumped rows reference rows left out of the dump to this file"`
+		ExcludeSubjects  string `long:"exclude-subjects" value-name:"FILE" description:"CSV file of table, column and value of subjects to leave out of the dump"`
+		Expires          string `long:"expires" value-name:"DURATION" description:"Record in the dump that it expires after this long, e.g. 30d"`
+		CheckTargetDSN   string `long:"check-target-dsn" value-name:"URL" description:"Fail if the dumped columns don't match the schema of this database"`
+		MatchTarget      bool   `long:"match-target" description:"Dump only the columns of the target database, in its order"`
+		NotifyURL        string `long:"notify-url" value-name:"URL" description:"Post a JSON summary of the dump to this URL when it completes or fails"`
+		NotifyFormat     string `long:"notify-format" choice:"json" choice:"slack" default:"json" description:"Payload posted to --notify-url, the summary or a message for Slack incoming webhooks"`
+		Config           string `long:"config" default-mask:"~/.pg_dump_sample.yaml" description:"Path to a config file with default options"`
 		Help             bool   `long:"help" description:"Show help"`
+
+		KeepAlive time.Duration `long:"keepalive" default:"30s" description:"Period of TCP keepalives, 0 to disable them"`
+		Retries   int           `long:"retries" default:"0" description:"Dump a table again up to this many times if the connection is lost"`
+		Jobs      int           `short:"j" long:"jobs" default:"1" description:"Number of tables to dump in parallel"`
+		MaxMemory string        `long:"max-memory" value-name:"SIZE" description:"Memory tables dumped in parallel may be buffered in before spilling to temporary files, e.g. 512MB"`
+		DBJobs    int           `long:"database-jobs" default:"1" description:"Number of databases dumped in parallel when several are given"`
+		Merge     string        `long:"merge" choice:"per-shard-files" choice:"union" default:"per-shard-files" description:"Dump several databases into a file each, or shards of the same data into a single dump"`
+		NoKeyset  bool          `long:"no-keyset" description:"Read big tables in a single query instead of page by page"`
+
+		ProgressInterval     time.Duration `long:"progress-interval" value-name:"DURATION" default:"1m" description:"Report the rows copied so far of tables taking longer than this, every this long, 0 to never report them"`
+		MaxTransactionAge    time.Duration `long:"max-transaction-age" value-name:"DURATION" description:"Fail if a table is still being read once its transaction is older than this, 0 for no limit"`
+		PerTableTransactions bool          `long:"per-table-transactions" description:"With --jobs, read every table in a transaction of its own instead of a snapshot shared by all tables"`
+
+		RequireReplica    bool          `long:"require-replica" description:"Fail unless the server is a read replica"`
+		MaxReplicationLag time.Duration `long:"max-replication-lag" value-name:"DURATION" description:"Fail if the replica lags behind its primary by more than this, 0 for no limit"`
+		LockTimeout       time.Duration `long:"lock-timeout" value-name:"DURATION" default:"10s" description:"Fail if a lock is waited for longer than this, 0 to wait forever"`
+		FailOnLockWait    bool          `long:"fail-on-lock-wait" description:"Stop the dump as soon as another session waits for one of its locks"`
+
+		Preview struct {
+			Table string `short:"t" long:"table" description:"Table to preview"`
+			Rows  int    `short:"n" long:"rows" default:"10" description:"Number of rows to preview"`
+		} `group:"Preview Options"`
+
+		Init struct {
+			Yes bool `long:"yes" description:"Take the suggested answers without asking"`
+		} `group:"Init Options"`
+
+		CheckExpiry struct {
+			Delete bool `long:"delete" description:"Delete expired dumps instead of failing"`
+		} `group:"Check-expiry Options"`
+
+		Selftest struct {
+			Seed uint64 `long:"seed" description:"Seed of the generated values, random by default"`
+		} `group:"Selftest Options"`
+
+		Follow struct {
+			Slot     string        `long:"slot" default:"pg_dump_sample" description:"Logical replication slot the changes are read from"`
+			Interval time.Duration `long:"interval" default:"10s" description:"Time between files of changes"`
+			Force    bool          `long:"force" description:"Resume following with another manifest than the sample was dumped with"`
+		} `group:"Follow Options"`
+
+		Serve struct {
+			Listen    string `long:"listen" value-name:"ADDR" default:"localhost:8080" description:"Address dumps are served on"`
+			TokenFile string `long:"token-file" value-name:"FILE" description:"File with the token clients authenticate with, instead of $PG_DUMP_SAMPLE_TOKEN"`
+			Profiles  string `long:"profiles" value-name:"DIR" description:"Directory of the manifests clients may name as profiles"`
+		} `group:"Serve Options"`
 	}
 
 	parser := flags.NewParser(&opts, flags.None)
-	parser.Usage = "[options] database"
+	parser.Usage = "[options] database\n  pg_dump_sample -o dumps/{{database}}.sql [options] database...\n  pg_dump_sample init [--yes] [options] database\n  pg_dump_sample preview -t table [-n rows] [options] database\n  pg_dump_sample check-expiry [--delete] dump...\n  pg_dump_sample selftest [--seed=N] [options] database\n  pg_dump_sample follow -o dir [--slot=NAME] [--interval=DURATION] [--force] [options] database\n  pg_dump_sample serve [--listen=ADDR] [--profiles=DIR] [options] database\n  pg_dump_sample schema\n  pg_dump_sample completion bash|zsh|fish"
+
+	// Shell completion
+	if len(os.Args) > 1 && os.Args[1] == "completion" {
+		if len(os.Args) != 3 {
+			return nil, fmt.Errorf("usage: pg_dump_sample completion %s", strings.Join(completionShells, "|"))
+		}
+		err := writeCompletion(os.Stdout, parser, os.Args[2])
+		if err != nil {
+			return nil, err
+		}
+		os.Exit(0)
+	}
+
+	// Schema of manifests
+	if len(os.Args) > 1 && os.Args[1] == "schema" {
+		if len(os.Args) != 2 {
+			return nil, fmt.Errorf("usage: pg_dump_sample schema")
+		}
+		err := writeManifestSchema(os.Stdout)
+		if err != nil {
+			return nil, err
+		}
+		os.Exit(0)
+	}
+
+	// Config file, read before the command line so that it only provides
+	// defaults
+	var configOpts struct {
+		Config string `long:"config"`
+	}
+	flags.NewParser(&configOpts, flags.IgnoreUnknown).Parse()
+	configPath := configOpts.Config
+	if configPath == "" {
+		configPath = defaultConfigPath()
+	}
+	config, err := loadConfig(configPath, configOpts.Config != "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+	err = applyConfig(parser, config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Commands
+	command := ""
+	cmdArgs := os.Args[1:]
+	if len(cmdArgs) > 0 && slices.Contains(commands, cmdArgs[0]) && cmdArgs[0] != "completion" {
+		command = cmdArgs[0]
+		cmdArgs = cmdArgs[1:]
+	}
 
-	args, err := parser.Parse()
+	args, err := parser.ParseArgs(cmdArgs)
 	if err != nil {
 		parser.WriteHelp(os.Stderr)
 		return nil, err
@@ -176,11 +598,79 @@ func parseArgs() (*Options, error) {
 	}
 
 	// Manifest file
-	if opts.ManifestFile == "" {
+	var manifest []byte
+	if opts.ManifestB64 != "" {
+		if opts.ManifestFile != "" {
+			parser.WriteHelp(os.Stderr)
+			return nil, fmt.Errorf("only one of `-f, --manifest-file` and `--manifest-b64` may be specified")
+		}
+		manifest, err = base64.StdEncoding.DecodeString(strings.TrimSpace(opts.ManifestB64))
+		if err != nil {
+			return nil, fmt.Errorf("invalid --manifest-b64: %v", err)
+		}
+	} else if opts.ManifestFile == "" && command != "init" && command != "check-expiry" && command != "selftest" && command != "serve" {
 		parser.WriteHelp(os.Stderr)
 		return nil, fmt.Errorf("required flag `-f, --manifest-file` not specified")
 	}
 
+	// Output file
+	outputFile, err := outputPath(opts.OutputFile)
+	if err != nil {
+		parser.WriteHelp(os.Stderr)
+		return nil, err
+	}
+	if opts.Format != "plain" && outputFile == "" {
+		parser.WriteHelp(os.Stderr)
+		return nil, fmt.Errorf("%s format requires `-o, --output-file`", opts.Format)
+	}
+	if opts.Format != "plain" && opts.Freeze {
+		parser.WriteHelp(os.Stderr)
+		return nil, fmt.Errorf("`--freeze` is not supported with the %s format", opts.Format)
+	}
+	if opts.Format != "plain" && opts.Encrypt != "" {
+		parser.WriteHelp(os.Stderr)
+		return nil, fmt.Errorf("`--encrypt` is not supported with the %s format", opts.Format)
+	}
+
+	if opts.Dialect != "postgresql" && opts.Format != "plain" {
+		parser.WriteHelp(os.Stderr)
+		return nil, fmt.Errorf("`--dialect` is only supported with the plain format")
+	}
+	if opts.Dialect != "postgresql" && opts.Freeze {
+		parser.WriteHelp(os.Stderr)
+		return nil, fmt.Errorf("`--freeze` is only supported with the postgresql dialect")
+	}
+	if (opts.Dialect != "postgresql" || opts.Format == "sqlite" || opts.Format == "parquet") && opts.ResetSequences {
+		parser.WriteHelp(os.Stderr)
+		return nil, fmt.Errorf("`--reset-sequences` is only supported with PostgreSQL dumps")
+	}
+	if (opts.Dialect != "postgresql" || opts.Format == "sqlite" || opts.Format == "parquet") && opts.ReplicaRole {
+		parser.WriteHelp(os.Stderr)
+		return nil, fmt.Errorf("`--replica-role` is only supported with PostgreSQL dumps")
+	}
+
+	// Follow
+	if command == "follow" && outputFile == "" {
+		parser.WriteHelp(os.Stderr)
+		return nil, fmt.Errorf("follow requires `-o, --output-file`, the directory of the changes")
+	}
+	if command == "follow" && (opts.Format != "plain" || opts.Dialect != "postgresql" || opts.Encrypt != "" || opts.Freeze) {
+		parser.WriteHelp(os.Stderr)
+		return nil, fmt.Errorf("follow only writes plain PostgreSQL dumps, without `--encrypt` or `--freeze`")
+	}
+
+	// Serve
+	if command == "serve" && (outputFile != "" || opts.Format != "plain" || opts.AuditLog != "" || opts.FKReport != "") {
+		parser.WriteHelp(os.Stderr)
+		return nil, fmt.Errorf("serve only streams plain dumps, without `-o, --output-file`, `--audit-log` or `--fk-report`")
+	}
+
+	// Preview
+	if command == "preview" && opts.Preview.Table == "" {
+		parser.WriteHelp(os.Stderr)
+		return nil, fmt.Errorf("preview requires `-t, --table`")
+	}
+
 	// Username
 	if opts.Username == "" {
 		currentUser, err := user.Current()
@@ -197,15 +687,115 @@ func parseArgs() (*Options, error) {
 		return nil, fmt.Errorf("port must be a number 0-65535")
 	}
 
-	// Database
+	// Host
+	if opts.Host == "" {
+		opts.Host = defaultHost(runtime.GOOS, port)
+	}
+
+	// Parallel jobs
+	if opts.Jobs < 1 {
+		parser.WriteHelp(os.Stderr)
+		return nil, fmt.Errorf("--jobs must be at least 1")
+	}
+	var maxMemory int64
+	if opts.MaxMemory != "" {
+		var err error
+		maxMemory, err = parseSize(opts.MaxMemory)
+		if err != nil || maxMemory < 1 {
+			parser.WriteHelp(os.Stderr)
+			return nil, fmt.Errorf("`--max-memory` must be a positive size like 512MB, got %q", opts.MaxMemory)
+		}
+	}
+
+	if opts.NotifyURL != "" {
+		err := checkNotifyURL(opts.NotifyURL)
+		if err != nil {
+			parser.WriteHelp(os.Stderr)
+			return nil, err
+		}
+		// Webhook URLs are secrets of their own
+		addSecret(opts.NotifyURL)
+	}
+
+	if opts.ProgressInterval < 0 || opts.MaxTransactionAge < 0 {
+		parser.WriteHelp(os.Stderr)
+		return nil, fmt.Errorf("`--progress-interval` and `--max-transaction-age` must not be negative")
+	}
+
+	if opts.PerTableTransactions && opts.Jobs == 1 {
+		parser.WriteHelp(os.Stderr)
+		return nil, fmt.Errorf("`--per-table-transactions` requires `--jobs`, as tables are read one at a time otherwise")
+	}
+
+	if opts.LockTimeout < 0 {
+		parser.WriteHelp(os.Stderr)
+		return nil, fmt.Errorf("`--lock-timeout` must not be negative")
+	}
+
+	if opts.MatchTarget && opts.CheckTargetDSN == "" {
+		parser.WriteHelp(os.Stderr)
+		return nil, fmt.Errorf("`--match-target` requires `--check-target-dsn`")
+	}
+
+	// Retention
+	var expires time.Duration
+	if opts.Expires != "" {
+		expires, err = parseRetention(opts.Expires)
+		if err != nil {
+			parser.WriteHelp(os.Stderr)
+			return nil, fmt.Errorf("invalid --expires: %v", err)
+		}
+	}
+
+	// Sensitive columns
+	sensitivePattern, err := regexp.Compile(opts.SensitiveColumns)
+	if err != nil {
+		parser.WriteHelp(os.Stderr)
+		return nil, fmt.Errorf("invalid --sensitive-columns: %v", err)
+	}
+
+	// Dumps to check, instead of a database
+	var expiryPaths []string
+	if command == "check-expiry" {
+		if len(args) == 0 {
+			parser.WriteHelp(os.Stderr)
+			return nil, fmt.Errorf("check-expiry requires the dumps to check")
+		}
+		expiryPaths, args = args, nil
+	}
+
+	// Database, or several dumped with the same manifest
+	if len(args) == 0 && command == "" {
+		args = config.Databases
+	}
 	Database := ""
+	var databases, shards []string
 	if len(args) == 0 {
 		Database = os.Getenv("PGDATABASE")
 	} else if len(args) == 1 {
 		Database = args[0]
-	} else if len(args) > 1 {
+	} else if command != "" {
 		parser.WriteHelp(os.Stderr)
-		return nil, fmt.Errorf("only one database may be specified at a time")
+		return nil, fmt.Errorf("only one database may be specified at a time with %s", command)
+	} else if opts.Merge == "union" {
+		Database, shards = args[0], args[1:]
+	} else {
+		databases = args
+		if !strings.Contains(outputFile, DATABASE_PLACEHOLDER) {
+			parser.WriteHelp(os.Stderr)
+			return nil, fmt.Errorf("several databases require `-o, --output-file` with %s in it", DATABASE_PLACEHOLDER)
+		}
+		// Every database gets reports of its own too
+		if opts.AuditLog != "" && !strings.Contains(opts.AuditLog, DATABASE_PLACEHOLDER) {
+			return nil, fmt.Errorf("several databases require `--audit-log` with %s in it", DATABASE_PLACEHOLDER)
+		}
+		if opts.FKReport != "" && !strings.Contains(opts.FKReport, DATABASE_PLACEHOLDER) {
+			return nil, fmt.Errorf("several databases require `--fk-report` with %s in it", DATABASE_PLACEHOLDER)
+		}
+		if opts.DBJobs < 1 {
+			parser.WriteHelp(os.Stderr)
+			return nil, fmt.Errorf("--database-jobs must be at least 1")
+		}
 	}
 
 	// Password
@@ -218,21 +808,212 @@ func parseArgs() (*Options, error) {
 		NoPasswordPrompt: opts.NoPasswordPrompt,
 		Password:         Password,
 		ManifestFile:     opts.ManifestFile,
-		OutputFile:       opts.OutputFile,
+		Manifest:         manifest,
+		OutputFile:       outputFile,
+		Encrypt:          opts.Encrypt,
+		Format:           opts.Format,
+		Dialect:          opts.Dialect,
+		Command:          command,
+		PreviewTable:     opts.Preview.Table,
+		PreviewRows:      opts.Preview.Rows,
+		InitYes:          opts.Init.Yes,
+		ExpiryPaths:      expiryPaths,
+		ExpiryDelete:     opts.CheckExpiry.Delete,
+		SelftestSeed:     opts.Selftest.Seed,
+		FollowSlot:       opts.Follow.Slot,
+		FollowInterval:   opts.Follow.Interval,
+		FollowForce:      opts.Follow.Force,
+		ServeListen:      opts.Serve.Listen,
+		ServeTokenFile:   opts.Serve.TokenFile,
+		ServeProfiles:    opts.Serve.Profiles,
 		UseTls:           opts.UseTls,
+		TlsRootCert:      opts.TlsRootCert,
+		AwsIamAuth:       opts.AwsIamAuth,
+		DropConstraints:  opts.DropConstraints,
+		RebuildIndexes:   opts.RebuildIndexes,
+		Analyze:          opts.Analyze,
+		ResetSequences:   opts.ResetSequences,
+		Comments:         opts.Comments,
+		Extensions:       opts.Extensions,
+		AssertEncoding:   opts.AssertEncoding,
+		FastRestore:      opts.FastRestore,
+		ReplicaRole:      opts.ReplicaRole,
+		Freeze:           opts.Freeze,
+		Deterministic:    opts.Deterministic,
+		KeepAlive:        opts.KeepAlive,
+		Retries:          opts.Retries,
+		Jobs:             opts.Jobs,
+		MaxMemory:        maxMemory,
+		NoKeyset:         opts.NoKeyset,
+		RequireReplica:   opts.RequireReplica,
+		MaxLag:           opts.MaxReplicationLag,
+		LockTimeout:      opts.LockTimeout,
+		FailOnLockWait:   opts.FailOnLockWait,
+		ProgressInterval: opts.ProgressInterval,
+		MaxTxAge:         opts.MaxTransactionAge,
+		PerTableTx:       opts.PerTableTransactions,
+		SensitivePattern: sensitivePattern,
+		StrictPrivacy:    opts.StrictPrivacy,
+		TransformKeyFile: opts.TransformKeyFile,
+		AuditLog:         opts.AuditLog,
+		FKReport:         opts.FKReport,
+		ExcludeSubjects:  opts.ExcludeSubjects,
+		NotifyURL:        opts.NotifyURL,
+		NotifyFormat:     opts.NotifyFormat,
+		Expires:          expires,
+		CheckTargetDSN:   opts.CheckTargetDSN,
+		MatchTarget:      opts.MatchTarget,
+		Vars:             config.Vars,
+		Schedules:        config.Schedules,
 		Database:         Database,
+		Databases:        databases,
+		DatabaseJobs:     opts.DBJobs,
+		Shards:           shards,
 	}, nil
 }
 
+// outputPath returns the path of the output file given as a path or a
+// file:// URI. An empty path means the standard output.
+func outputPath(uri string) (string, error) {
+	if !strings.Contains(uri, "://") {
+		return uri, nil
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", fmt.Errorf("invalid output URI: %v", err)
+	}
+	if u.Scheme != "file" {
+		return "", fmt.Errorf("unsupported output URI scheme %q", u.Scheme)
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return "", fmt.Errorf("output URI must refer to a local file")
+	}
+	return uriPath(u.Path, runtime.GOOS), nil
+}
+
+// uriPath converts the path of a file:// URI to a local path. On Windows
+// file:///C:/dumps/dump.sql refers to C:\dumps\dump.sql.
+func uriPath(path string, goos string) string {
+	if goos != "windows" {
+		return path
+	}
+	if len(path) >= 3 && path[0] == '/' && path[2] == ':' {
+		path = path[1:]
+	}
+	return strings.ReplaceAll(path, "/", `\`)
+}
+
+// Socket directories of common PostgreSQL builds, the upstream default first
+var socketDirs = []string{"/tmp", "/var/run/postgresql"}
+
+// defaultHost returns the host used unless one is given: the first socket
+// directory holding a socket for port, or localhost on Windows which has no
+// Unix sockets.
+func defaultHost(goos string, port int) string {
+	if goos == "windows" {
+		return "localhost"
+	}
+	for _, dir := range socketDirs {
+		_, addr := dbAddr(dir, port)
+		if _, err := os.Stat(addr); err == nil {
+			return dir
+		}
+	}
+	return socketDirs[0]
+}
+
+// dbAddr returns the network and address to connect to. Like in libpq, a
+// host starting with a slash is a socket directory and one starting with @ is
+// a directory in the abstract namespace.
+func dbAddr(host string, port int) (string, string) {
+	if strings.HasPrefix(host, "/") || strings.HasPrefix(host, "@") {
+		return "unix", fmt.Sprintf("%s/.s.PGSQL.%d", strings.TrimRight(host, "/"), port)
+	}
+	return "tcp", net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// setOutputFormats makes the sessions of pgOpts dump bytea values in hex and
+// dates in ISO format, whatever the defaults of the server or role, as the
+// values are parsed when converted to other formats than SQL.
+func setOutputFormats(pgOpts *pg.Options) {
+	onConnect := pgOpts.OnConnect
+	pgOpts.OnConnect = func(ctx context.Context, cn *pg.Conn) error {
+		if onConnect != nil {
+			err := onConnect(ctx, cn)
+			if err != nil {
+				return err
+			}
+		}
+		_, err := cn.ExecContext(ctx, "SET bytea_output = hex; SET DateStyle = ISO")
+		return err
+	}
+}
+
+// pgOptions returns the options of the database connection.
+func pgOptions(opts *Options, password string) (*pg.Options, error) {
+	network, addr := dbAddr(opts.Host, opts.Port)
+	pgOpts := &pg.Options{
+		Network:  network,
+		Addr:     addr,
+		Database: opts.Database,
+		User:     opts.Username,
+		Password: password,
+		Dialer:   keepAliveDialer(opts.KeepAlive),
+
+		ApplicationName: applicationName,
+	}
+	addSecret(password)
+	setOutputFormats(pgOpts)
+	if opts.LockTimeout > 0 {
+		setLockTimeout(pgOpts, opts.LockTimeout)
+	}
+	if opts.UseTls && opts.TlsRootCert != "" {
+		tlsConfig, err := verifiedTLSConfig(opts.Host, opts.TlsRootCert)
+		if err != nil {
+			return nil, err
+		}
+		pgOpts.TLSConfig = tlsConfig
+	} else if opts.UseTls {
+		pgOpts.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	if opts.AwsIamAuth {
+		err := useAwsIamAuth(pgOpts, opts.Host, opts.TlsRootCert)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pgOpts, nil
+}
+
+// verifiedTLSConfig returns the TLS configuration verifying that the server
+// is host, with a certificate issued by the CAs of the PEM file rootCert.
+func verifiedTLSConfig(host string, rootCert string) (*tls.Config, error) {
+	data, err := os.ReadFile(rootCert)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no certificates found", rootCert)
+	}
+	return &tls.Config{ServerName: host, RootCAs: roots}, nil
+}
+
+// connectDB connects to the database and detects the server version, which
+// the catalog queries adapt to.
 func connectDB(opts *pg.Options) (*pg.DB, error) {
 	db := pg.Connect(opts)
-	var model []struct {
-		X string
+	num, version, err := detectServerVersion(db)
+	if err != nil {
+		db.Close()
+		return nil, checkAuthError(err)
 	}
-	_, err := db.Query(&model, `SELECT 1 AS x`)
+	err = checkServerVersion(num, version)
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
+	serverVersions.Store(db, num)
 	return db, nil
 }
 
@@ -240,42 +1021,148 @@ func beginDump(w io.Writer) {
 	fmt.Fprintf(w, BEGIN_DUMP)
 }
 
+func fastRestore(w io.Writer) {
+	fmt.Fprintf(w, FAST_RESTORE_DUMP)
+}
+
+// replicaRole makes the restoring session skip triggers, including the ones
+// checking foreign keys, until resetReplicaRole.
+func replicaRole(w io.Writer) {
+	fmt.Fprintf(w, REPLICA_ROLE_DUMP)
+}
+
+func resetReplicaRole(w io.Writer) {
+	fmt.Fprintf(w, RESET_REPLICA_ROLE_DUMP)
+}
+
+func dumpTemplate(w io.Writer, tmpl string, vars map[string]string) error {
+	text, err := mustache.RenderRaw(tmpl, true, vars)
+	if err != nil {
+		return err
+	}
+	// Vars may come from the environment, which may have credentials
+	fmt.Fprintf(w, "%s\n", redact(strings.TrimRight(normalizeNewlines(text), "\n")))
+	return nil
+}
+
 func endDump(w io.Writer) {
 	fmt.Fprintf(w, END_DUMP)
 }
 
-func beginTable(w io.Writer, table string, columns []string) {
-	quoted := make([]string, 0)
-	for _, v := range columns {
-		quoted = append(quoted, strconv.Quote(v))
+func beginTable(w io.Writer, table string, query string, columns []string, freeze bool) {
+	with := ""
+	if freeze {
+		with = COPY_FREEZE_DUMP
+	}
+	fmt.Fprintf(w, BEGIN_TABLE_DUMP, table, provenance(query), table, columnList(columns), with)
+}
+
+// columnList quotes columns as SQL identifiers, leaving non-ASCII names as
+// they are, since the dump is in UTF-8.
+func columnList(columns []string) string {
+	return quoteIdents(columns)
+}
+
+func provenance(query string) string {
+	if query == "" {
+		return ""
 	}
-	colstr := strings.Join(quoted, ", ")
-	fmt.Fprintf(w, BEGIN_TABLE_DUMP, table, table, colstr)
+	return fmt.Sprintf(TABLE_QUERY_DUMP, sanitizeComment(query))
 }
 
 func endTable(w io.Writer) {
 	fmt.Fprintf(w, END_TABLE_DUMP)
 }
 
+// tableStats writes the number of rows dumped and the time it took. A zero
+// duration is left out, as in deterministic dumps.
+func tableStats(w io.Writer, rows int, duration time.Duration) {
+	if duration == 0 {
+		fmt.Fprintf(w, TABLE_ROWS_DUMP, rows)
+		return
+	}
+	fmt.Fprintf(w, TABLE_STATS_DUMP, rows, duration.Round(time.Millisecond))
+}
+
+// sanitizeComment collapses v into a single line, so that it can't escape
+// from an SQL comment.
+func sanitizeComment(v string) string {
+	return strings.Join(strings.Fields(v), " ")
+}
+
 func dumpSqlCmd(w io.Writer, v string) {
-	fmt.Fprintf(w, SQL_CMD_DUMP, v)
+	fmt.Fprintf(w, SQL_CMD_DUMP, normalizeNewlines(v))
+}
+
+// normalizeNewlines converts CRLF line endings, e.g. from a manifest edited on
+// Windows, so that the dump always uses LF.
+func normalizeNewlines(v string) string {
+	return strings.ReplaceAll(v, "\r\n", "\n")
 }
 
-func dumpTable(w io.Writer, db *pg.DB, table string) error {
+func dumpTable(w io.Writer, db *pg.DB, table string) (int, error) {
 	sql := fmt.Sprintf(`COPY %s TO STDOUT`, table)
 
-	_, err := db.CopyTo(w, sql)
+	res, err := db.CopyTo(w, sql)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	return nil
+	return res.RowsAffected(), nil
+}
+
+// orderParentsFirst orders the rows returned by query, selecting rows of a
+// table with the self-referencing foreign key fk, so that every row comes
+// after the row it references. Rows which are part of a reference cycle come
+// last. Rows at the same level are ordered by orderBy, if given.
+func orderParentsFirst(query string, fk ForeignKey, orderBy string) string {
+	if orderBy != "" {
+		orderBy = ", " + orderBy
+	}
+	return fmt.Sprintf(`WITH RECURSIVE r AS (%s),
+l AS (
+	SELECT %s, 0 AS level FROM r
+	WHERE NOT EXISTS (SELECT 1 FROM r AS p WHERE (%s) = (%s))
+	UNION ALL
+	SELECT %s, l.level + 1 FROM r JOIN l ON (%s) = (%s)
+)
+SELECT r.* FROM r LEFT JOIN l ON (%s) = (%s) ORDER BY l.level%s`,
+		query,
+		qualifiedIdents("r", fk.RefColumns),
+		qualifiedIdents("p", fk.RefColumns), qualifiedIdents("r", fk.Columns),
+		qualifiedIdents("r", fk.RefColumns), qualifiedIdents("r", fk.Columns), qualifiedIdents("l", fk.RefColumns),
+		qualifiedIdents("l", fk.RefColumns), qualifiedIdents("r", fk.RefColumns),
+		orderBy)
+}
+
+// selfReferenceWarning returns a warning for a table with several
+// self-referencing foreign keys, e.g. `manager_id` and `mentor_id`, whose rows
+// are only ordered parents first along the first of them, unless foreign keys
+// aren't checked while restoring.
+func selfReferenceWarning(table string, selfRefs []ForeignKey, opts DumpOptions) string {
+	if len(selfRefs) < 2 || opts.DropConstraints || opts.ReplicaRole {
+		return ""
+	}
+	var names []string
+	for _, fk := range selfRefs[1:] {
+		names = append(names, fk.Name)
+	}
+	return fmt.Sprintf("rows of %s are ordered along its foreign key %s only, so they may fail to restore because of %s; use --drop-constraints or --replica-role", table, selfRefs[0].Name, strings.Join(names, ", "))
+}
+
+func hasColumns(cols []string, fk ForeignKey) bool {
+	for _, col := range slices.Concat(fk.Columns, fk.RefColumns) {
+		if !slices.Contains(cols, col) {
+			return false
+		}
+	}
+	return true
 }
 
 func readPassword(username string) (string, error) {
 	fmt.Fprintf(os.Stderr, "Password for %s: ", username)
 	password, err := term.ReadPassword(int(os.Stdin.Fd()))
-	fmt.Print("\n")
+	fmt.Fprint(os.Stderr, "\n")
 	return string(password), err
 }
 
@@ -286,186 +1173,1463 @@ func readManifest(r io.Reader) (*Manifest, error) {
 	}
 
 	manifest := Manifest{}
-	yaml.Unmarshal(data, &manifest)
-
-	return &manifest, nil
-}
-
-func getTableCols(db *pg.DB, table string) ([]string, error) {
-	var model []struct {
-		Colname string
-	}
-	sql := `
-		SELECT attname as colname
-		FROM pg_catalog.pg_attribute
-		WHERE
-			attrelid = ?::regclass
-			AND attnum > 0
-			AND attisdropped = FALSE
-			ORDER BY attnum
-	`
-	_, err := db.Query(&model, sql, table)
+	err = yaml.Unmarshal(data, &manifest)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", ErrManifestInvalid, err)
 	}
 
-	var cols = make([]string, 0)
-	for _, v := range model {
-		cols = append(cols, v.Colname)
+	// Fields are checked against the schema too, so that misspelled ones
+	// aren't silently ignored
+	var doc any
+	err = yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrManifestInvalid, err)
 	}
+	if doc != nil {
+		errs := validateSchema(manifestSchema(), doc, "")
+		if len(errs) > 0 {
+			return nil, fmt.Errorf("%w: %s", ErrManifestInvalid, strings.Join(errs, "; "))
+		}
+	}
+	for name := range manifest.VarsSQL {
+		if _, ok := manifest.Vars[name]; ok {
+			return nil, fmt.Errorf("%w: var %s is in both vars and vars_sql", ErrManifestInvalid, name)
+		}
+	}
+	_, inVars := manifest.Vars[AS_OF_VAR]
+	_, inVarsSQL := manifest.VarsSQL[AS_OF_VAR]
+	if inVars || inVarsSQL {
+		return nil, fmt.Errorf("%w: var %s is reserved, set the instant the dump is as of with as_of", ErrManifestInvalid, AS_OF_VAR)
+	}
+	tables := make([]string, 0, len(manifest.Tables)+1)
+	for _, v := range manifest.Tables {
+		tables = append(tables, v.Table)
+	}
+	if manifest.Seed != nil && manifest.Seed.Table != "" {
+		tables = append(tables, manifest.Seed.Table)
+	}
+	for _, table := range tables {
+		_, err := parseTableName(table)
+		if err != nil {
+			return nil, fmt.Errorf("%w: table %s: %v", ErrManifestInvalid, table, err)
+		}
+	}
+	manifest.Hash = fmt.Sprintf("%x", sha256.Sum256(data))
 
-	return cols, nil
+	return &manifest, nil
 }
 
-func getTableDeps(db *pg.DB, table string) ([]string, error) {
-	var model []struct {
-		Tablename string
+// itemVars returns the vars of a manifest item: its own vars, and the vars of
+// the manifest it doesn't override.
+func itemVars(manifest *Manifest, v ManifestItem) Vars {
+	if len(v.Vars) == 0 {
+		return manifest.Vars
 	}
-	sql := `
-		SELECT confrelid::regclass AS tablename
-		FROM pg_catalog.pg_constraint
+	vars := maps.Clone(manifest.Vars)
+	if vars == nil {
+		vars = make(Vars, len(v.Vars))
+	}
+	maps.Copy(vars, v.Vars)
+	return vars
+}
+
+// evalVarsSQL runs the queries of the manifest's vars_sql and sets the vars
+// to their results, overriding vars from the config file. Each query must
+// return a single row with a single non-NULL value.
+func evalVarsSQL(db *pg.DB, manifest *Manifest) error {
+	for _, name := range slices.Sorted(maps.Keys(manifest.VarsSQL)) {
+		var value *string
+		_, err := db.QueryOne(pg.Scan(&value), manifest.VarsSQL[name])
+		if err != nil {
+			return fmt.Errorf("vars_sql %s: %w", name, err)
+		}
+		if value == nil {
+			return fmt.Errorf("vars_sql %s: the query returned NULL", name)
+		}
+		if manifest.Vars == nil {
+			manifest.Vars = make(Vars)
+		}
+		manifest.Vars[name] = *value
+	}
+	return nil
+}
+
+// checkPreconditions runs the preconditions of the manifest, rendered with
+// its vars, and fails with the ones which aren't true.
+func checkPreconditions(db *pg.DB, manifest *Manifest) error {
+	failed := make([]string, 0)
+	for _, tmpl := range manifest.Preconditions {
+		sql, err := mustache.RenderRaw(tmpl, true, manifest.Vars)
+		if err != nil {
+			return fmt.Errorf("%w: precondition %q: %v", ErrManifestInvalid, tmpl, err)
+		}
+		var ok *bool
+		_, err = db.QueryOne(pg.Scan(&ok), sql)
+		if err != nil {
+			return fmt.Errorf("precondition %s: %w", sql, err)
+		}
+		if ok == nil || !*ok {
+			failed = append(failed, sql)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("precondition(s) failed: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func getTableCols(db *pg.DB, table string) ([]string, error) {
+	if c := cachedCatalog(db, table); c != nil {
+		return slices.Clone(c.columns[table]), nil
+	}
+
+	var model []struct {
+		Colname string
+	}
+	// Generated columns can't be loaded, they are computed again on restore
+	generated := ""
+	if serverVersion(db) >= PG12 {
+		generated = "AND attgenerated = ''"
+	}
+	sql := `
+		SELECT attname as colname
+		FROM pg_catalog.pg_attribute
+		WHERE
+			attrelid = ?::regclass
+			AND attnum > 0
+			AND attisdropped = FALSE
+			` + generated + `
+			ORDER BY attnum
+	`
+	_, err := db.Query(&model, sql, table)
+	if err != nil {
+		return nil, err
+	}
+
+	var cols = make([]string, 0)
+	for _, v := range model {
+		cols = append(cols, v.Colname)
+	}
+
+	return cols, nil
+}
+
+// relNameSQL returns an SQL expression rendering the name of the relation
+// with the given oid the way the dump refers to it. Since the dump sets
+// search_path to public, only relations in other schemas are qualified.
+func relNameSQL(oid string) string {
+	return fmt.Sprintf(`(
+		SELECT CASE
+			WHEN rel_n.nspname = 'public' THEN quote_ident(rel_c.relname)
+			ELSE quote_ident(rel_n.nspname) || '.' || quote_ident(rel_c.relname)
+		END
+		FROM pg_catalog.pg_class rel_c
+		JOIN pg_catalog.pg_namespace rel_n ON rel_n.oid = rel_c.relnamespace
+		WHERE rel_c.oid = %s
+	)`, oid)
+}
+
+// resolveTable returns the canonical name of table, as used in foreign key
+// metadata, so that "users" and "public.users" refer to the same table.
+func resolveTable(db *pg.DB, table string) (string, error) {
+	if cachedCatalog(db, table) != nil {
+		return table, nil
+	}
+
+	var model []struct {
+		Tablename string
+	}
+	_, err := db.Query(&model, `SELECT `+relNameSQL("?::regclass")+` AS tablename`, table)
+	if isUndefinedTable(err) {
+		return "", &TableNotFoundError{Table: table}
+	}
+	if err != nil {
+		return "", err
+	}
+	return model[0].Tablename, nil
+}
+
+// deterministicOrder returns an ORDER BY list for the rows of a manifest item
+// in a deterministic dump: the primary key or else all the dumped columns,
+// compared as text so that columns of types without ordering can be sorted.
+func deterministicOrder(db *pg.DB, v ManifestItem) (string, error) {
+	pk, err := getPrimaryKey(db, v.Table)
+	if err != nil || len(pk) > 0 {
+		return quoteIdents(pk), err
+	}
+
+	cols := v.Columns
+	if len(cols) == 0 {
+		cols, err = getTableCols(db, v.Table)
+		if err != nil {
+			return "", err
+		}
+	}
+	order := make([]string, 0, len(cols))
+	for _, col := range cols {
+		order = append(order, quoteIdent(col)+"::text")
+	}
+	return strings.Join(order, ", "), nil
+}
+
+// getPrimaryKey returns the columns of the table's primary key, if any.
+func getPrimaryKey(db *pg.DB, table string) ([]string, error) {
+	if c := cachedCatalog(db, table); c != nil {
+		return slices.Clone(c.primaryKeys[table]), nil
+	}
+
+	var model []struct {
+		Columns []string `pg:",array"`
+	}
+	sql := `
+		SELECT
+			ARRAY(
+				SELECT a.attname
+				FROM unnest(c.conkey) WITH ORDINALITY AS k(attnum, n)
+				JOIN pg_catalog.pg_attribute a
+					ON a.attrelid = c.conrelid AND a.attnum = k.attnum
+				ORDER BY k.n
+			)::text[] AS columns
+		FROM pg_catalog.pg_constraint c
+		WHERE c.contype = 'p' AND c.conrelid = ?::regclass
+	`
+	_, err := db.Query(&model, sql, table)
+	if err != nil {
+		return nil, err
+	}
+	if len(model) == 0 {
+		return nil, nil
+	}
+	return model[0].Columns, nil
+}
+
+func getTableDeps(db *pg.DB, table string) ([]string, error) {
+	fks, err := getTableForeignKeys(db, table)
+	if err != nil {
+		return nil, err
+	}
+
+	var tables = make([]string, 0)
+	for _, fk := range fks {
+		// The same table may be referenced by several foreign keys, each of
+		// them possibly spanning multiple columns
+		if !slices.Contains(tables, fk.RefTable) {
+			tables = append(tables, fk.RefTable)
+		}
+	}
+
+	return tables, nil
+}
+
+func getForeignKeys(db *pg.DB) ([]ForeignKey, error) {
+	return queryForeignKeys(db, "")
+}
+
+func getTableForeignKeys(db *pg.DB, table string) ([]ForeignKey, error) {
+	if c := cachedCatalog(db, table); c != nil {
+		return c.tableForeignKeys(table, ""), nil
+	}
+	return queryForeignKeys(db, "AND c.conrelid = ?::regclass", table)
+}
+
+func getSelfReferences(db *pg.DB, table string) ([]ForeignKey, error) {
+	if c := cachedCatalog(db, table); c != nil {
+		return c.tableForeignKeys(table, table), nil
+	}
+	return queryForeignKeys(db, "AND c.conrelid = ?::regclass AND c.confrelid = c.conrelid", table)
+}
+
+func queryForeignKeys(db *pg.DB, cond string, params ...interface{}) ([]ForeignKey, error) {
+	var model []struct {
+		Conname      string
+		Tablename    string
+		Columns      []string `pg:",array"`
+		Reftablename string
+		Refcolumns   []string `pg:",array"`
+		Definition   string
+	}
+	sql := `
+		SELECT
+			c.conname,
+			` + relNameSQL("c.conrelid") + ` AS tablename,
+			ARRAY(
+				SELECT a.attname
+				FROM unnest(c.conkey) WITH ORDINALITY AS k(attnum, n)
+				JOIN pg_catalog.pg_attribute a
+					ON a.attrelid = c.conrelid AND a.attnum = k.attnum
+				ORDER BY k.n
+			)::text[] AS columns,
+			` + relNameSQL("c.confrelid") + ` AS reftablename,
+			ARRAY(
+				SELECT a.attname
+				FROM unnest(c.confkey) WITH ORDINALITY AS k(attnum, n)
+				JOIN pg_catalog.pg_attribute a
+					ON a.attrelid = c.confrelid AND a.attnum = k.attnum
+				ORDER BY k.n
+			)::text[] AS refcolumns,
+			pg_catalog.pg_get_constraintdef(c.oid) AS definition
+		FROM pg_catalog.pg_constraint c
+		WHERE c.contype = 'f' ` + cond + `
+		ORDER BY tablename, c.conname
+	`
+	_, err := db.Query(&model, sql, params...)
+	if err != nil {
+		return nil, err
+	}
+
+	var fks = make([]ForeignKey, 0)
+	for _, v := range model {
+		fks = append(fks, ForeignKey{
+			Name:       v.Conname,
+			Table:      v.Tablename,
+			Columns:    v.Columns,
+			RefTable:   v.Reftablename,
+			RefColumns: v.Refcolumns,
+			Definition: v.Definition,
+		})
+	}
+
+	return fks, nil
+}
+
+// itemQuery describes how the data of a manifest item is read.
+type itemQuery struct {
+	// Columns in the dump
+	Cols []string
+	// Sampling query as written in the manifest, empty for the whole table
+	Source string
+	// Query actually run, empty for the whole table
+	Query string
+	// Queries of the chunks of Query run instead of it, in order, if the
+	// table is read in chunks
+	Chunks []string
+	// Pages read instead of Query, if the table is read page by page
+	Pages *keysetPages
+	// Time reading the data may take, and what to do when it's exceeded
+	MaxDuration time.Duration
+	OnTimeout   string
+	// Reports warnings about the data
+	warn func(format string, args ...interface{})
+	// Writer receiving the COPY data, rewriting it if there are transforms
+	Data io.Writer
+	// Highest primary key of the dumped rows, if post actions use it
+	maxKey *maxKeyWriter
+	// Checks the rows against the validate condition of the table, if any
+	validator *rowValidator
+	// Other shards the same query reads rows from, after the database
+	shards []*pg.DB
+	// Time between reports of the rows copied so far, and the age the
+	// transaction the data is read in may reach, which started at
+	// transactionStart, or else when the data started to be copied
+	progressInterval  time.Duration
+	maxTransactionAge time.Duration
+	transactionStart  time.Time
+}
+
+func prepareItem(w io.Writer, db *pg.DB, manifest *Manifest, v ManifestItem, opts DumpOptions) (*itemQuery, error) {
+	err := opts.locks.err()
+	if err != nil {
+		return nil, err
+	}
+
+	cols := v.Columns
+	if len(cols) == 0 {
+		cols, err = getTableCols(db, v.Table)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pk, err := getPrimaryKey(db, v.Table)
+	if err != nil {
+		return nil, err
+	}
+
+	// Columns the target can't load are dropped from the rows on their way
+	// out, so that the query can still order and filter by them
+	dumped := cols
+	if matched, ok := opts.targetColumns[v.Table]; ok {
+		dumped = matched
+	}
+
+	if opts.coverage != nil {
+		w = opts.coverage.table(v.Table, dumped, w)
+	}
+	if !slices.Equal(dumped, cols) {
+		w = newColumnMapper(w, cols, dumped)
+	}
+	var maxKey *maxKeyWriter
+	if usesVar(v.PostActions, MAX_ID_VAR) {
+		if len(pk) != 1 || !slices.Contains(dumped, pk[0]) {
+			return nil, fmt.Errorf("%w: table %s: post actions use %s, but the table has no single-column primary key which is dumped", ErrManifestInvalid, v.Table, MAX_ID_VAR)
+		}
+		maxKey = &maxKeyWriter{w: w, pos: slices.Index(dumped, pk[0])}
+		w = maxKey
+	}
+
+	sampler, err := samplerFor(manifest, v)
+	if err != nil {
+		return nil, fmt.Errorf("%w: table %s: %v", ErrManifestInvalid, v.Table, err)
+	}
+	query, err := sampler.Query(db, v.Table)
+	if err != nil {
+		return nil, err
+	}
+	source := query
+
+	if opts.exclusions != nil {
+		query = opts.exclusions.filter(v.Table, query)
+	}
+
+	// Casts apply before anything else, so that rows are ordered and
+	// transformed by their converted values
+	query, err = castColumns(query, v.Table, cols, v.Casts)
+	if err != nil {
+		return nil, fmt.Errorf("%w: table %s: %v", ErrManifestInvalid, v.Table, err)
+	}
+
+	err = checkValidate(v)
+	if err != nil {
+		return nil, fmt.Errorf("%w: table %s: %v", ErrManifestInvalid, v.Table, err)
+	}
+	transforms, err := itemTransforms(v)
+	if err != nil {
+		return nil, fmt.Errorf("%w: table %s: %v", ErrManifestInvalid, v.Table, err)
+	}
+	err = typePlaceholders(db, v.Table, transforms, v.Casts)
+	if err != nil {
+		return nil, err
+	}
+
+	data := w
+	if len(transforms) > 0 {
+		t, err := newCopyTransformer(w, cols, transforms)
+		if err != nil {
+			return nil, fmt.Errorf("%w: table %s: %v", ErrManifestInvalid, v.Table, err)
+		}
+		// Conditions of conditional transforms are evaluated by the
+		// database, as extra columns following the dumped ones
+		if conds := t.Conditions(); len(conds) > 0 {
+			if query == "" {
+				query = fmt.Sprintf("SELECT * FROM %s", v.Table)
+			}
+			query = fmt.Sprintf("SELECT q.*, %s FROM (%s) AS q", strings.Join(conds, ", "), query)
+		}
+		data = t
+	}
+
+	// The audit log records the keys of the rows in the source, before they
+	// are transformed, and only if the target gets the key too
+	if opts.audit != nil {
+		key := pk
+		if !containsAll(dumped, pk) {
+			key = nil
+		}
+		data = opts.audit.table(v.Table, cols, key, data)
+	}
+
+	// The validate condition is evaluated by the database too, as a column
+	// following those of conditional transforms
+	var validator *rowValidator
+	if v.Validate != "" {
+		validator = newRowValidator(data, v, cols, pk)
+		if query == "" {
+			query = fmt.Sprintf("SELECT * FROM %s", v.Table)
+		}
+		query = fmt.Sprintf("SELECT q.*, %s FROM (%s) AS q", validator.Condition(), query)
+		data = validator
+	}
+
+	// Rows are ordered by the primary key unless told otherwise, so that
+	// dumps of the same data are identical
+	orderBy := v.OrderBy
+	if orderBy == "" {
+		orderBy = quoteIdents(pk)
+	}
+
+	// Chunks filter the rows before they are ordered
+	unordered := query
+	if unordered == "" {
+		unordered = fmt.Sprintf("SELECT * FROM %s", v.Table)
+	}
+
+	// Rows of self-referencing tables are ordered so that referenced
+	// rows are loaded before the rows referencing them
+	selfRefs, err := getSelfReferences(db, v.Table)
+	if err != nil {
+		return nil, err
+	}
+	selfRefs = slices.DeleteFunc(selfRefs, func(fk ForeignKey) bool { return !hasColumns(cols, fk) })
+	selfReferencing := len(selfRefs) > 0
+	if warning := selfReferenceWarning(v.Table, selfRefs, opts); warning != "" {
+		opts.warn("%s", warning)
+	}
+	if selfReferencing {
+		if query == "" {
+			query = fmt.Sprintf("SELECT * FROM %s", v.Table)
+		}
+		query = orderParentsFirst(query, selfRefs[0], orderBy)
+	} else if orderBy != "" {
+		if query == "" {
+			query = fmt.Sprintf("SELECT * FROM %s ORDER BY %s", v.Table, orderBy)
+		} else {
+			query = fmt.Sprintf("SELECT * FROM (%s) AS o ORDER BY %s", query, orderBy)
+		}
+	}
+
+	// Huge tables are read in ranges of the chunk column, so that no single
+	// query has to go through all of their rows
+	var chunks []string
+	if v.ChunkBy != "" {
+		if selfReferencing {
+			return nil, fmt.Errorf("%w: table %s: chunk_by can't be used on a self-referencing table", ErrManifestInvalid, v.Table)
+		}
+		size := v.ChunkSize
+		if size == 0 {
+			size = DEFAULT_CHUNK_SIZE
+		}
+		if size < 0 {
+			return nil, fmt.Errorf("%w: table %s: chunk_size must be positive", ErrManifestInvalid, v.Table)
+		}
+		chunks, err = chunkQueries(db, unordered, v.ChunkBy, size, orderBy)
+		if err != nil {
+			return nil, err
+		}
+	} else if v.ChunkSize != 0 {
+		return nil, fmt.Errorf("%w: table %s: chunk_size requires chunk_by", ErrManifestInvalid, v.Table)
+	}
+
+	// The limit keeps the first rows in the order they are dumped in
+	if v.Limit < 0 {
+		return nil, fmt.Errorf("%w: table %s: limit must not be negative", ErrManifestInvalid, v.Table)
+	}
+	if v.Limit > 0 {
+		if v.ChunkBy != "" {
+			return nil, fmt.Errorf("%w: table %s: limit can't be used with chunk_by", ErrManifestInvalid, v.Table)
+		}
+		if selfReferencing || orderBy != "" {
+			query = fmt.Sprintf("%s LIMIT %d", query, v.Limit)
+		} else if query == "" {
+			query = fmt.Sprintf("SELECT * FROM %s LIMIT %d", v.Table, v.Limit)
+		} else {
+			query = fmt.Sprintf("SELECT * FROM (%s) AS l LIMIT %d", query, v.Limit)
+		}
+	}
+
+	// Big tables ordered by their primary key are read page by page,
+	// instead of sorting all of their rows in a single query
+	var pages *keysetPages
+	if !opts.NoKeyset && !selfReferencing && v.ChunkBy == "" && len(pk) > 0 && orderBy == quoteIdents(pk) {
+		pages, err = newKeysetPages(db, v.Table, unordered, cols, pk, v.Limit)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = checkOnTimeout(v)
+	if err != nil {
+		return nil, fmt.Errorf("%w: table %s: %v", ErrManifestInvalid, v.Table, err)
+	}
+
+	return &itemQuery{
+		Cols:        dumped,
+		Source:      source,
+		Query:       query,
+		Chunks:      chunks,
+		Pages:       pages,
+		MaxDuration: v.MaxDuration,
+		OnTimeout:   v.OnTimeout,
+		Data:        data,
+		warn:        opts.warn,
+		maxKey:      maxKey,
+		validator:   validator,
+		shards:      opts.Shards,
+
+		progressInterval:  opts.ProgressInterval,
+		maxTransactionAge: opts.MaxTransactionAge,
+		transactionStart:  opts.snapshotStart,
+	}, nil
+}
+
+// copyItem copies the data of table as prepared by prepareItem.
+func copyItem(db *pg.DB, table string, q *itemQuery) (int, error) {
+	return copyWithin(table, q, func(ctx context.Context, w io.Writer) (int, error) {
+		total := 0
+		for _, db := range append([]*pg.DB{db}, q.shards...) {
+			rows, err := copyData(ctx, w, db, table, q)
+			if err != nil {
+				return 0, err
+			}
+			total += rows
+		}
+		return total, nil
+	})
+}
+
+// copyData copies the data of table as prepared by prepareItem from db.
+func copyData(ctx context.Context, w io.Writer, db *pg.DB, table string, q *itemQuery) (int, error) {
+	if q.Pages != nil {
+		return copyPages(ctx, w, db, table, q.Pages)
+	}
+	if len(q.Chunks) == 0 {
+		return copyQuery(ctx, w, db, table, q.Query)
+	}
+
+	total := 0
+	for _, chunk := range q.Chunks {
+		rows, err := copyQuery(ctx, w, db, table, chunk)
+		if err != nil {
+			return 0, err
+		}
+		total += rows
+	}
+	return total, nil
+}
+
+// copyQuery copies the rows of table returned by query, or all of them if
+// query is empty, to w.
+func copyQuery(ctx context.Context, w io.Writer, db *pg.DB, table string, query string) (int, error) {
+	source := table
+	if query != "" {
+		source = fmt.Sprintf("(%s)", query)
+	}
+	rows, err := dumpTable(w, db.WithContext(ctx), source)
+	var pgErr pg.Error
+	if errors.As(err, &pgErr) {
+		err = &QueryFailedError{Table: table, SQL: fmt.Sprintf("COPY %s TO STDOUT", source), Err: err}
+	}
+	return rows, err
+}
+
+func dumpItem(dw DumpWriter, db *pg.DB, manifest *Manifest, v ManifestItem, opts DumpOptions) error {
+	q, err := prepareItem(&rowWriter{dw: dw}, db, manifest, v, opts)
+	if err != nil {
+		return err
+	}
+
+	err = dw.BeginTable(v.Table, q.Source, q.Cols)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	rows, err := copyItem(db, v.Table, q)
+	if err != nil {
+		return err
+	}
+	return endItem(dw, v, q, rows, time.Since(start), opts)
+}
+
+// endItem ends the table of a manifest item and writes its post actions.
+func endItem(dw DumpWriter, v ManifestItem, q *itemQuery, rows int, duration time.Duration, opts DumpOptions) error {
+	if opts.Deterministic {
+		duration = 0
+	}
+	err := dw.EndTable(rows, duration)
+	if err != nil {
+		return err
+	}
+	if opts.summary != nil {
+		opts.summary.addTable(v.Table, rows)
+	}
+
+	actions, err := renderPostActions(v, q, rows)
+	if err != nil {
+		return err
+	}
+	for _, sql := range actions {
+		err := dw.PostAction(sql)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func getTableIndexes(db *pg.DB, table string) ([]Index, error) {
+	var model []struct {
+		Indexname  string
+		Definition string
+	}
+	// Indexes backing constraints (primary keys, unique constraints,
+	// referenced keys of foreign keys) can't be dropped on their own
+	sql := `
+		SELECT
+			` + relNameSQL("i.indexrelid") + ` AS indexname,
+			pg_catalog.pg_get_indexdef(i.indexrelid) AS definition
+		FROM pg_catalog.pg_index i
 		WHERE
-			conrelid = ?::regclass
-			AND contype = 'f'
+			i.indrelid = ?::regclass
+			AND NOT EXISTS (
+				SELECT 1 FROM pg_catalog.pg_constraint c
+				WHERE c.conindid = i.indexrelid
+			)
+		ORDER BY indexname
 	`
 	_, err := db.Query(&model, sql, table)
 	if err != nil {
 		return nil, err
 	}
 
-	var tables = make([]string, 0)
-	for _, v := range model {
-		tables = append(tables, v.Tablename)
+	var indexes = make([]Index, 0)
+	for _, v := range model {
+		indexes = append(indexes, Index{Name: v.Indexname, Definition: v.Definition})
+	}
+
+	return indexes, nil
+}
+
+func makeDump(db *pg.DB, manifest *Manifest, w io.Writer, opts DumpOptions) error {
+	if opts.Freeze && opts.Directory != "" {
+		return fmt.Errorf("COPY FREEZE is not supported with the directory format")
+	}
+	err := checkTransformKey(manifest, opts)
+	if err != nil {
+		return err
+	}
+
+	if opts.AuditLog != "" && opts.audit == nil {
+		opts.audit = newAuditLog()
+	}
+
+	if opts.FailOnLockWait && opts.locks == nil {
+		// The guard only stops the sessions of this dump
+		sessions, name, err := connectDumpSessions(db)
+		if err != nil {
+			return err
+		}
+		defer closeDumpSessions(sessions)
+		opts.locks = startLockGuard(sessions, name, LOCK_GUARD_INTERVAL)
+		defer opts.locks.stop()
+		return opts.locks.check(makeDump(sessions, manifest, w, opts))
+	}
+
+	// Metadata of all tables is loaded at once, instead of querying it
+	// table by table
+	err = loadCatalog(db)
+	if err != nil {
+		return err
+	}
+	defer forgetCatalog(db)
+
+	err = setAsOf(db, manifest)
+	if err != nil {
+		return err
+	}
+	err = evalVarsSQL(db, manifest)
+	if err != nil {
+		return err
+	}
+	err = checkPreconditions(db, manifest)
+	if err != nil {
+		return err
+	}
+
+	if opts.ExcludeSubjects != "" {
+		opts.exclusions, err = loadSubjectExclusions(db, opts.ExcludeSubjects)
+		if err != nil {
+			return err
+		}
+	}
+
+	if manifest.Seed != nil {
+		err := expandSeed(db, manifest)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Tables are dumped in alphabetical order, apart from dependencies,
+	// instead of the order of the manifest
+	if opts.Deterministic {
+		sorted := *manifest
+		sorted.Tables = slices.Clone(manifest.Tables)
+		slices.SortStableFunc(sorted.Tables, func(a, b ManifestItem) int {
+			return strings.Compare(a.Table, b.Table)
+		})
+		manifest = &sorted
+	}
+
+	iterator, err := NewManifestIterator(db, manifest)
+	if err != nil {
+		return err
+	}
+	items := make([]ManifestItem, 0)
+	for {
+		v, err := iterator.Next()
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			break
+		}
+		if opts.Deterministic && v.OrderBy == "" {
+			v.OrderBy, err = deterministicOrder(db, *v)
+			if err != nil {
+				return err
+			}
+		}
+		// Post actions are rendered once the rows are dumped, with the
+		// vars of the item
+		v.Vars = itemVars(manifest, *v)
+		err = checkPostActions(*v)
+		if err != nil {
+			return fmt.Errorf("%w: table %s: %v", ErrManifestInvalid, v.Table, err)
+		}
+		if opts.ResetSequences {
+			// Post actions of the manifest come last, so that they can
+			// still set sequences differently
+			resets, err := resetSequences(db, *v)
+			if err != nil {
+				return err
+			}
+			v.PostActions = append(resets, v.PostActions...)
+		}
+		items = append(items, *v)
+	}
+
+	// Tables which can't be read are all reported at once, instead of
+	// failing halfway through the dump on the first one
+	denied, err := checkPrivileges(db, items)
+	if err != nil {
+		return err
+	}
+	for _, finding := range denied {
+		opts.warn("%s", finding)
+	}
+	if len(denied) > 0 {
+		return fmt.Errorf("%d table(s) can't be read by the current role", len(denied))
 	}
 
-	return tables, nil
-}
-
-func makeDump(db *pg.DB, manifest *Manifest, w io.Writer) error {
-	beginDump(w)
+	if opts.SensitivePattern != nil {
+		findings, err := lintPrivacy(db, items, opts.SensitivePattern)
+		if err != nil {
+			return err
+		}
+		for _, finding := range findings {
+			opts.warn("%s", finding)
+		}
+		if opts.StrictPrivacy && len(findings) > 0 {
+			return fmt.Errorf("%d sensitive column(s) dumped without a transform", len(findings))
+		}
+	}
 
-	iterator := NewManifestIterator(db, manifest)
-	for {
-		v, err := iterator.Next()
+	if opts.CheckTargetDSN != "" {
+		target, err := connectTarget(opts.CheckTargetDSN)
 		if err != nil {
 			return err
 		}
-		if v == nil {
-			break
+		findings, matched, err := checkTarget(db, target, items, opts.MatchTarget)
+		target.Close()
+		if err != nil {
+			return err
+		}
+		for _, finding := range findings {
+			opts.warn("%s", finding)
 		}
+		if len(findings) > 0 {
+			return fmt.Errorf("%d mismatch(es) with the schema of the target", len(findings))
+		}
+		opts.targetColumns = matched
+	}
 
-		cols := v.Columns
-		if len(cols) == 0 {
-			cols, err = getTableCols(db, v.Table)
+	extensions := make([]Extension, 0)
+	if opts.Extensions {
+		for _, v := range items {
+			tableExtensions, err := getTableExtensions(db, v.Table)
 			if err != nil {
 				return err
 			}
+			for _, ext := range tableExtensions {
+				if !slices.Contains(extensions, ext) {
+					extensions = append(extensions, ext)
+				}
+			}
 		}
+	}
 
-		beginTable(w, v.Table, cols)
-		if v.Query == "" {
-			err := dumpTable(w, db, v.Table)
+	fks := make([]ForeignKey, 0)
+	if opts.DropConstraints {
+		for _, v := range items {
+			tableFks, err := getTableForeignKeys(db, v.Table)
 			if err != nil {
 				return err
 			}
-		} else {
-			query, err := mustache.Render(v.Query, manifest.Vars)
+			fks = append(fks, tableFks...)
+		}
+	}
+
+	if opts.FKReport != "" {
+		c, err := newFKCoverage(db, items)
+		if err != nil {
+			return err
+		}
+		opts.coverage = c
+	}
+
+	indexes := make([]Index, 0)
+	if opts.RebuildIndexes {
+		for _, v := range items {
+			tableIndexes, err := getTableIndexes(db, v.Table)
+			if err != nil {
+				return err
+			}
+			indexes = append(indexes, tableIndexes...)
+		}
+	}
+
+	comments := make([]Comment, 0)
+	if opts.Comments {
+		for _, v := range items {
+			tableComments, err := getTableComments(db, v.Table)
 			if err != nil {
 				return err
 			}
+			comments = append(comments, tableComments...)
+		}
+	}
+
+	enc, err := getEncoding(db)
+	if err != nil {
+		return err
+	}
+
+	var dw DumpWriter = newSQLDumpWriter(w, opts)
+	if opts.SQLite != "" {
+		sw, err := newSQLiteDumpWriter(opts.SQLite, db, opts)
+		if err != nil {
+			return err
+		}
+		defer sw.Close()
+		dw = sw
+	}
+	if opts.Parquet != "" {
+		dw = newParquetDumpWriter(opts.Parquet, db, opts)
+	}
+	if d, ok := dialects[opts.Dialect]; ok {
+		dw = newInsertDumpWriter(w, db, d, opts)
+	}
+	err = dw.BeginDump(&DumpInfo{
+		Manifest:    manifest,
+		Items:       items,
+		Encoding:    enc,
+		Extensions:  extensions,
+		ForeignKeys: fks,
+		Indexes:     indexes,
+		Comments:    comments,
+	})
+	if err != nil {
+		return err
+	}
+
+	if opts.Jobs > 1 {
+		err = dumpItemsParallel(dw, w, db, manifest, items, opts)
+	} else {
+		err = dumpItems(dw, w, db, manifest, items, opts)
+	}
+	if err != nil {
+		return err
+	}
+	if opts.Directory != "" {
+		err := writeSchemaScripts(opts.Directory, items, opts)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = dw.EndDump()
+	if err != nil {
+		return err
+	}
+
+	if opts.AuditLog != "" {
+		err := writeAuditLog(opts.AuditLog, opts.audit, items)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.FKReport != "" {
+		err := writeFKReport(opts.FKReport, opts.coverage)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.Directory != "" {
+		err := writeParallelRestore(opts.Directory, db, manifest, opts, items, enc, extensions, fks, indexes, comments)
+		if err != nil {
+			return err
+		}
+	}
 
-			err = dumpTable(w, db, fmt.Sprintf("(%s)", query))
+	return nil
+}
+
+// dumpItems dumps the manifest items one by one.
+func dumpItems(dw DumpWriter, w io.Writer, db *pg.DB, manifest *Manifest, items []ManifestItem, opts DumpOptions) error {
+	for _, v := range items {
+		if opts.Directory != "" {
+			err := retry(opts, v.Table, func() error {
+				return dumpItemFile(opts.Directory, db, manifest, v, opts)
+			})
 			if err != nil {
 				return err
 			}
+			fmt.Fprintf(w, INCLUDE_DUMP, tableFile(v.Table))
+			continue
+		}
+		err := dumpItemRetrying(dw, db, manifest, v, opts)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getTableExtensions returns the extensions providing the types of the
+// table's columns, including element types of arrays and base types of
+// domains.
+func getTableExtensions(db *pg.DB, table string) ([]Extension, error) {
+	var model []struct {
+		Name   string
+		Schema string
+	}
+	sql := `
+		SELECT DISTINCT
+			quote_ident(e.extname) AS name,
+			quote_ident(n.nspname) AS schema
+		FROM pg_catalog.pg_attribute a
+		JOIN pg_catalog.pg_type t ON t.oid = a.atttypid
+		JOIN pg_catalog.pg_depend d
+			ON d.classid = 'pg_catalog.pg_type'::regclass
+			AND d.objid IN (t.oid, t.typelem, t.typbasetype)
+			AND d.deptype = 'e'
+		JOIN pg_catalog.pg_extension e ON e.oid = d.refobjid
+		JOIN pg_catalog.pg_namespace n ON n.oid = e.extnamespace
+		WHERE
+			a.attrelid = ?::regclass
+			AND a.attnum > 0
+			AND NOT a.attisdropped
+		ORDER BY name
+	`
+	_, err := db.Query(&model, sql, table)
+	if err != nil {
+		return nil, err
+	}
+
+	var extensions = make([]Extension, 0)
+	for _, v := range model {
+		extensions = append(extensions, Extension{Name: v.Name, Schema: v.Schema})
+	}
+
+	return extensions, nil
+}
+
+func getTableComments(db *pg.DB, table string) ([]Comment, error) {
+	var model []struct {
+		Object      string
+		Description string
+	}
+	sql := `
+		SELECT
+			CASE
+				WHEN d.objsubid = 0 THEN 'TABLE ' || ` + relNameSQL("d.objoid") + `
+				ELSE 'COLUMN ' || ` + relNameSQL("d.objoid") + ` || '.' || quote_ident(a.attname)
+			END AS object,
+			d.description
+		FROM pg_catalog.pg_description d
+		LEFT JOIN pg_catalog.pg_attribute a
+			ON a.attrelid = d.objoid AND a.attnum = d.objsubid
+		WHERE
+			d.classoid = 'pg_catalog.pg_class'::regclass
+			AND d.objoid = ?::regclass
+			AND (d.objsubid = 0 OR NOT a.attisdropped)
+		ORDER BY d.objsubid
+	`
+	_, err := db.Query(&model, sql, table)
+	if err != nil {
+		return nil, err
+	}
+
+	var comments = make([]Comment, 0)
+	for _, v := range model {
+		comments = append(comments, Comment{Object: v.Object, Text: v.Description})
+	}
+
+	return comments, nil
+}
+
+// dumpPreamble writes the statements preceding the data of the tables.
+func dumpPreamble(w io.Writer, manifest *Manifest, opts DumpOptions, items []ManifestItem, extensions []Extension, fks []ForeignKey, indexes []Index) error {
+	if opts.FastRestore {
+		fastRestore(w)
+	}
+	for _, ext := range extensions {
+		dumpSqlCmd(w, fmt.Sprintf("CREATE EXTENSION IF NOT EXISTS %s WITH SCHEMA %s", ext.Name, ext.Schema))
+	}
+	if manifest.Header != "" {
+		err := dumpTemplate(w, manifest.Header, manifest.Vars)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, fk := range fks {
+		dumpSqlCmd(w, fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT %s", fk.Table, quoteIdent(fk.Name)))
+	}
+	for _, index := range indexes {
+		dumpSqlCmd(w, fmt.Sprintf("DROP INDEX %s", index.Name))
+	}
+
+	// COPY FREEZE requires the table to be truncated in the same
+	// transaction. Truncating all tables at once allows tables referenced
+	// by foreign keys of other dumped tables.
+	if opts.Freeze && len(items) > 0 {
+		tables := make([]string, 0, len(items))
+		for _, v := range items {
+			tables = append(tables, v.Table)
 		}
-		endTable(w)
+		dumpSqlCmd(w, fmt.Sprintf("TRUNCATE %s", strings.Join(tables, ", ")))
+	}
+
+	return nil
+}
+
+// dumpPostamble writes the statements following the data of the tables.
+func dumpPostamble(w io.Writer, manifest *Manifest, opts DumpOptions, items []ManifestItem, fks []ForeignKey, indexes []Index, comments []Comment) error {
+	for _, index := range indexes {
+		dumpSqlCmd(w, index.Definition)
+	}
+	for _, fk := range fks {
+		dumpSqlCmd(w, fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s %s", fk.Table, quoteIdent(fk.Name), fk.Definition))
+	}
+	for _, comment := range comments {
+		dumpSqlCmd(w, fmt.Sprintf("COMMENT ON %s IS %s", comment.Object, quoteLiteral(comment.Text)))
+	}
 
-		for _, sql := range v.PostActions {
-			dumpSqlCmd(w, sql)
+	if opts.Analyze {
+		for _, v := range items {
+			dumpSqlCmd(w, fmt.Sprintf("ANALYZE %s", v.Table))
 		}
 	}
 
-	endDump(w)
+	if manifest.Footer != "" {
+		err := dumpTemplate(w, manifest.Footer, manifest.Vars)
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
+// loadManifest reads the manifest given by the options.
+func loadManifest(opts *Options) (*Manifest, error) {
+	var manifestFile io.Reader = bytes.NewReader(opts.Manifest)
+	if opts.Manifest == nil {
+		f, err := os.Open(opts.ManifestFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		manifestFile = f
+	}
+
+	manifest, err := readManifest(manifestFile)
+	if err != nil {
+		return nil, err
+	}
+
+	mergeVars(manifest, opts.Vars)
+	return manifest, nil
+}
+
+// mergeVars adds vars, e.g. from the config file, to those of manifest
+// which it doesn't set.
+func mergeVars(manifest *Manifest, vars map[string]string) {
+	for name, value := range vars {
+		if _, ok := manifest.Vars[name]; !ok {
+			if manifest.Vars == nil {
+				manifest.Vars = make(Vars)
+			}
+			manifest.Vars[name] = value
+		}
+	}
+}
+
 func main() {
 	// Parse command-line arguments
 	opts, err := parseArgs()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error: %s\n", redact(err.Error()))
 		os.Exit(1)
 	}
 
-	// Open manifest file
-	manifestFile, err := os.Open(opts.ManifestFile)
+	// Check the expiry of dumps, which needs no database
+	if opts.Command == "check-expiry" {
+		expired, err := checkExpiry(os.Stdout, opts.ExpiryPaths, time.Now(), opts.ExpiryDelete)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", redact(err.Error()))
+			os.Exit(1)
+		}
+		if expired > 0 {
+			os.Exit(EXIT_EXPIRED)
+		}
+		return
+	}
+
+	// Dump every database of a batch
+	if len(opts.Databases) > 0 {
+		err = dumpDatabases(opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", redact(err.Error()))
+			os.Exit(exitCode(err))
+		}
+		return
+	}
+
+	err = run(opts)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		fmt.Fprintf(os.Stderr, "Error: %s\n", redact(err.Error()))
+		os.Exit(exitCode(err))
 	}
+}
 
-	// Read manifest
-	manifest, err := readManifest(manifestFile)
+// run runs the command of the options against their database, and posts
+// how a dump went to the notify URL.
+func run(opts *Options) error {
+	if opts.NotifyURL == "" || opts.Command != "" {
+		return runCommand(opts, nil)
+	}
+	summary := newDumpSummary(opts.Database, opts.OutputFile)
+	err := runCommand(opts, summary)
+	summary.finish(err)
+	return errors.Join(err, notify(opts.NotifyURL, opts.NotifyFormat, summary))
+}
+
+// runCommand runs the command of the options against their database,
+// recording the dumped tables in summary if not nil.
+func runCommand(opts *Options, summary *dumpSummary) error {
+	err := setTransformKey(opts.TransformKeyFile)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		return err
 	}
 
-	// Open output file
-	output := os.Stdout
-	if opts.OutputFile != "" {
-		output, err = os.OpenFile(opts.OutputFile, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0666)
+	// Read manifest, unless it is to be written or there is none
+	manifest := &Manifest{}
+	if opts.Command != "init" && opts.Command != "selftest" && opts.Command != "serve" {
+		manifest, err = loadManifest(opts)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			os.Exit(1)
+			return err
 		}
 	}
 
 	// Connect to the DB
-	pgOpts := &pg.Options{
-		Addr:     fmt.Sprintf("%s:%d", opts.Host, opts.Port),
-		Database: opts.Database,
-		User:     opts.Username,
-		Password: opts.Password,
-	}
-	if opts.UseTls {
-		pgOpts.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	pgOpts, err := pgOptions(opts, opts.Password)
+	if err != nil {
+		return err
 	}
 	db, err := connectDB(pgOpts)
+	err = explainAuthError(err, opts)
+	var authErr *unsupportedAuthError
+	var failure *authFailureError
+	if errors.As(err, &authErr) || (errors.As(err, &failure) && !failure.Password) || (err != nil && opts.AwsIamAuth) {
+		// Asking for a password won't help
+		return err
+	}
 	if err != nil {
 		password := opts.Password
 		if !opts.NoPasswordPrompt {
 			// Read database password from the terminal
 			password, err = readPassword(opts.Username)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-				os.Exit(1)
+				return err
 			}
 		}
 
 		// Try again, this time with password
-		pgOpts = &pg.Options{
-			Addr:     fmt.Sprintf("%s:%d", opts.Host, opts.Port),
-			Database: opts.Database,
-			User:     opts.Username,
-			Password: password,
+		pgOpts, err = pgOptions(opts, password)
+		if err == nil {
+			db, err = connectDB(pgOpts)
+			err = explainAuthError(err, opts)
+		}
+		if err != nil {
+			return err
 		}
-		if opts.UseTls {
-			pgOpts.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	defer db.Close()
+
+	// Shards of the same data are sampled into the same dump
+	shards := make([]*pg.DB, 0, len(opts.Shards))
+	for _, name := range opts.Shards {
+		shardOpts := *opts
+		shardOpts.Database = name
+		o, err := pgOptions(&shardOpts, pgOpts.Password)
+		if err != nil {
+			return err
 		}
-		db, err = connectDB(pgOpts)
+		shard, err := connectDB(o)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			os.Exit(1)
+			return fmt.Errorf("shard %s: %w", name, explainAuthError(err, &shardOpts))
+		}
+		defer shard.Close()
+		shards = append(shards, shard)
+	}
+
+	// Keep sampling queries away from the primary
+	if opts.RequireReplica || opts.MaxLag > 0 {
+		inRecovery, lag, err := replicaStatus(db)
+		if err == nil {
+			err = checkReplica(inRecovery, lag, opts.RequireReplica, opts.MaxLag)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Preview a table instead of dumping
+	if opts.Command == "preview" {
+		return previewTable(os.Stdout, db, manifest, opts.PreviewTable, opts.PreviewRows)
+	}
+
+	// Check that dumps restore identically instead of dumping
+	if opts.Command == "selftest" {
+		return runSelftest(os.Stdout, db, opts, pgOpts.Password, opts.SelftestSeed)
+	}
+
+	// The output file of follow is the directory of the changes
+	followDir := ""
+	if opts.Command == "follow" {
+		followDir = opts.OutputFile
+		opts.OutputFile = ""
+	}
+
+	// Open output file
+	output := os.Stdout
+	directory := ""
+	if opts.Format == "directory" {
+		// The output file is a directory holding the restore script
+		directory = opts.OutputFile
+		err = os.MkdirAll(directory, 0777)
+		if err != nil {
+			return err
+		}
+		opts.OutputFile = filepath.Join(directory, "restore.sql")
+	}
+	sqlite, parquetDir := "", ""
+	if opts.Format == "sqlite" && opts.Command != "init" {
+		// The output file is the SQLite database, nothing else is written
+		sqlite = opts.OutputFile
+		opts.OutputFile = ""
+	}
+	if opts.Format == "parquet" && opts.Command != "init" {
+		// The output file is the directory of the parquet files
+		parquetDir = opts.OutputFile
+		opts.OutputFile = ""
+	}
+	if opts.OutputFile != "" {
+		output, err = os.OpenFile(opts.OutputFile, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0666)
+		if err != nil {
+			return err
 		}
+		defer output.Close()
+	}
+
+	// Write a manifest instead of dumping
+	if opts.Command == "init" {
+		wz := &wizard{in: bufio.NewReader(os.Stdin), out: os.Stderr, yes: opts.InitYes}
+		return initManifest(db, output, wz, opts.SensitivePattern)
 	}
 
 	// Make the dump
-	err = makeDump(db, manifest, output)
+	dumpOpts := DumpOptions{
+		DropConstraints:  opts.DropConstraints,
+		RebuildIndexes:   opts.RebuildIndexes,
+		Analyze:          opts.Analyze,
+		ResetSequences:   opts.ResetSequences,
+		Comments:         opts.Comments,
+		Extensions:       opts.Extensions,
+		AssertEncoding:   opts.AssertEncoding,
+		FastRestore:      opts.FastRestore,
+		ReplicaRole:      opts.ReplicaRole,
+		Freeze:           opts.Freeze,
+		Deterministic:    opts.Deterministic,
+		Retries:          opts.Retries,
+		Jobs:             opts.Jobs,
+		MaxMemory:        opts.MaxMemory,
+		NoKeyset:         opts.NoKeyset,
+		SensitivePattern: opts.SensitivePattern,
+		StrictPrivacy:    opts.StrictPrivacy,
+		AuditLog:         opts.AuditLog,
+		FKReport:         opts.FKReport,
+		ExcludeSubjects:  opts.ExcludeSubjects,
+		Directory:        directory,
+		SQLite:           sqlite,
+		Parquet:          parquetDir,
+		Dialect:          opts.Dialect,
+		Shards:           shards,
+		CheckTargetDSN:   opts.CheckTargetDSN,
+		MatchTarget:      opts.MatchTarget,
+		FailOnLockWait:   opts.FailOnLockWait,
+		summary:          summary,
+
+		ProgressInterval:     opts.ProgressInterval,
+		MaxTransactionAge:    opts.MaxTxAge,
+		PerTableTransactions: opts.PerTableTx,
+	}
+	if opts.Expires > 0 {
+		dumpOpts.Expires = time.Now().Add(opts.Expires).Truncate(time.Second)
+	}
+
+	// Serve dumps of manifests posted by clients until interrupted
+	if opts.Command == "serve" {
+		token, err := readServeToken(opts.ServeTokenFile)
+		if err != nil {
+			return err
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		dumpOpts.Expires = time.Time{}
+		server := &dumpServer{
+			db:       db,
+			database: opts.Database,
+			token:    token,
+			profiles: opts.ServeProfiles,
+			vars:     opts.Vars,
+			encrypt:  opts.Encrypt,
+			expires:  opts.Expires,
+			notify:   opts.NotifyURL,
+			format:   opts.NotifyFormat,
+			opts:     dumpOpts,
+			log:      os.Stderr,
+		}
+		for _, job := range opts.Schedules {
+			server.jobs = append(server.jobs, &jobState{job: job})
+		}
+		return serveDumps(ctx, opts.ServeListen, server)
+	}
+
+	// Follow the changes to the sample until interrupted
+	if opts.Command == "follow" {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		return followChanges(ctx, os.Stderr, db, manifest, followDir, opts.FollowSlot, opts.FollowInterval, opts.FollowForce, dumpOpts)
+	}
+
+	var w io.WriteCloser = output
+	if opts.Encrypt != "" {
+		w, err = newEncryptWriter(output, opts.Encrypt)
+		if err != nil {
+			return err
+		}
+	}
+	err = makeDump(db, manifest, w, dumpOpts)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		// Still wait for the encryption, e.g. gpg to exit
+		w.Close()
+		return err
 	}
+
+	// Flush the encrypted output
+	return w.Close()
 }
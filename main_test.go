@@ -2,15 +2,25 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	pg "github.com/go-pg/pg/v10"
+	"github.com/parquet-go/parquet-go"
 )
 
 // testDBOpts returns pg.Options for the test database.
@@ -133,6 +143,56 @@ func TestReadManifest_PostActions(t *testing.T) {
 	}
 }
 
+func TestReadManifest_VarsSQL(t *testing.T) {
+	m, err := readManifest(strings.NewReader("vars_sql:\n  max_id: SELECT max(id) FROM users\ntables:\n  - table: users\n"))
+	if err != nil {
+		t.Fatalf("readManifest error: %v", err)
+	}
+	if m.VarsSQL["max_id"] != "SELECT max(id) FROM users" {
+		t.Errorf("unexpected vars_sql %v", m.VarsSQL)
+	}
+
+	_, err = readManifest(strings.NewReader("vars:\n  max_id: 1\nvars_sql:\n  max_id: SELECT 2\n"))
+	if !errors.Is(err, ErrManifestInvalid) {
+		t.Errorf("expected ErrManifestInvalid for a var in both vars and vars_sql, got %v", err)
+	}
+}
+
+func TestReadManifest_AsOf(t *testing.T) {
+	m, err := readManifest(strings.NewReader("as_of: 2024-06-01\ntables:\n  - table: users\n"))
+	if err != nil {
+		t.Fatalf("readManifest error: %v", err)
+	}
+	if m.AsOf != "2024-06-01" {
+		t.Errorf("unexpected as_of %q", m.AsOf)
+	}
+
+	for _, manifest := range []string{"vars:\n  as_of: now()\n", "vars_sql:\n  as_of: SELECT now()\n"} {
+		_, err = readManifest(strings.NewReader(manifest))
+		if !errors.Is(err, ErrManifestInvalid) {
+			t.Errorf("expected ErrManifestInvalid for an as_of var, got %v", err)
+		}
+	}
+}
+
+func TestReadManifest_TableNames(t *testing.T) {
+	_, err := readManifest(strings.NewReader("tables:\n  - table: '\"Billing\".\"Invoice.Lines\"'\n  - table: billing.invoices\n"))
+	if err != nil {
+		t.Fatalf("readManifest error: %v", err)
+	}
+
+	for _, manifest := range []string{
+		"tables:\n  - table: 'billing.\"invoices'\n",
+		"tables:\n  - table: billing..invoices\n",
+		"seed:\n  table: users.\n  where: id = 1\n",
+	} {
+		_, err = readManifest(strings.NewReader(manifest))
+		if !errors.Is(err, ErrManifestInvalid) {
+			t.Errorf("%s: expected ErrManifestInvalid, got %v", manifest, err)
+		}
+	}
+}
+
 func TestReadManifest_Columns(t *testing.T) {
 	f, err := os.Open("testdata/manifest_columns.yaml")
 	if err != nil {
@@ -160,21 +220,52 @@ func TestReadManifest_Columns(t *testing.T) {
 	}
 }
 
+func TestReadManifest_HeaderFooter(t *testing.T) {
+	f, err := os.Open("testdata/manifest_header.yaml")
+	if err != nil {
+		t.Fatalf("failed to open manifest: %v", err)
+	}
+	defer f.Close()
+
+	m, err := readManifest(f)
+	if err != nil {
+		t.Fatalf("readManifest error: %v", err)
+	}
+
+	if !strings.Contains(m.Header, "SET ROLE {{owner}};") {
+		t.Errorf("unexpected header %q", m.Header)
+	}
+	if m.Footer != "RESET ROLE;\n" {
+		t.Errorf("unexpected footer %q", m.Footer)
+	}
+}
+
+func TestReadManifest_Hash(t *testing.T) {
+	a, _ := readManifest(strings.NewReader("tables:\n  - table: users\n"))
+	b, _ := readManifest(strings.NewReader("tables:\n  - table: users\n"))
+	c, _ := readManifest(strings.NewReader("tables:\n  - table: posts\n"))
+	if len(a.Hash) != 64 {
+		t.Fatalf("expected a SHA-256 hex digest, got %q", a.Hash)
+	}
+	if a.Hash != b.Hash {
+		t.Error("equal manifests should have equal hashes")
+	}
+	if a.Hash == c.Hash {
+		t.Error("different manifests should have different hashes")
+	}
+}
+
 // TestReadManifest_InvalidYAML verifies that readManifest returns an error
 // when given malformed YAML input.
-//
-// Currently skipped: readManifest silently discards the error from
-// yaml.Unmarshal (main.go:290), so malformed YAML produces an empty
-// Manifest with a nil error. Unskip once readManifest propagates the
-// parse error.
 func TestReadManifest_InvalidYAML(t *testing.T) {
-	t.Skip("known bug: readManifest discards yaml.Unmarshal error")
-
 	r := strings.NewReader("{{{{invalid yaml!!")
 	m, err := readManifest(r)
 	if err == nil {
 		t.Fatalf("expected error for invalid YAML, got nil (manifest: %+v)", m)
 	}
+	if !errors.Is(err, ErrManifestInvalid) {
+		t.Errorf("expected ErrManifestInvalid, got %v", err)
+	}
 }
 
 // TestConnectDB_CloseOnError verifies that connectDB does not leak a
@@ -212,6 +303,31 @@ func TestBeginDump(t *testing.T) {
 	}
 }
 
+func TestFastRestore(t *testing.T) {
+	var buf bytes.Buffer
+	fastRestore(&buf)
+	out := buf.String()
+
+	if !strings.Contains(out, "SET synchronous_commit = off;") {
+		t.Error("fastRestore output should turn off synchronous_commit")
+	}
+	if !strings.Contains(out, "SET maintenance_work_mem") {
+		t.Error("fastRestore output should raise maintenance_work_mem")
+	}
+}
+
+func TestDumpTemplate(t *testing.T) {
+	var buf bytes.Buffer
+	err := dumpTemplate(&buf, "SET ROLE {{owner}};\n\n", map[string]string{"owner": "qa"})
+	if err != nil {
+		t.Fatalf("dumpTemplate error: %v", err)
+	}
+
+	if out := buf.String(); out != "SET ROLE qa;\n" {
+		t.Errorf("unexpected template output %q", out)
+	}
+}
+
 func TestEndDump(t *testing.T) {
 	var buf bytes.Buffer
 	endDump(&buf)
@@ -227,7 +343,7 @@ func TestEndDump(t *testing.T) {
 
 func TestBeginTable(t *testing.T) {
 	var buf bytes.Buffer
-	beginTable(&buf, "users", []string{"id", "username", "email"})
+	beginTable(&buf, "users", "", []string{"id", "username", "email"}, false)
 	out := buf.String()
 
 	if !strings.Contains(out, "Data for Name: users") {
@@ -241,6 +357,91 @@ func TestBeginTable(t *testing.T) {
 	}
 }
 
+func TestColumnList(t *testing.T) {
+	cols := []string{"id", "имя", "名前", `say "hi"`, "tab\tname"}
+	expected := "\"id\", \"имя\", \"名前\", \"say \"\"hi\"\"\", \"tab\tname\""
+	if list := columnList(cols); list != expected {
+		t.Errorf("expected %s, got %s", expected, list)
+	}
+}
+
+func TestBeginTable_Query(t *testing.T) {
+	var buf bytes.Buffer
+	beginTable(&buf, "users", "SELECT *\nFROM users\n  WHERE id <= 2", []string{"id"}, false)
+	out := buf.String()
+
+	if !strings.Contains(out, "-- Query: SELECT * FROM users WHERE id <= 2\n--\n") {
+		t.Errorf("beginTable output should contain the query on a single comment line, got %q", out)
+	}
+}
+
+func TestBeginTable_Freeze(t *testing.T) {
+	var buf bytes.Buffer
+	beginTable(&buf, "users", "", []string{"id"}, true)
+	if !strings.Contains(buf.String(), `COPY users ("id") FROM stdin WITH (FREEZE);`) {
+		t.Errorf("expected COPY FREEZE, got:\n%s", buf.String())
+	}
+}
+
+func TestDumpPreamble_Freeze(t *testing.T) {
+	var buf bytes.Buffer
+	items := []ManifestItem{{Table: "users"}, {Table: "posts"}}
+	err := dumpPreamble(&buf, &Manifest{}, DumpOptions{Freeze: true}, items, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("dumpPreamble error: %v", err)
+	}
+	if !strings.Contains(buf.String(), "TRUNCATE users, posts;") {
+		t.Errorf("expected all tables to be truncated at once, got:\n%s", buf.String())
+	}
+}
+
+func TestDumpPreamble_Extensions(t *testing.T) {
+	var buf bytes.Buffer
+	extensions := []Extension{{Name: "citext", Schema: "public"}, {Name: `"uuid-ossp"`, Schema: "ext"}}
+	err := dumpPreamble(&buf, &Manifest{Header: "CREATE TABLE t (id uuid)"}, DumpOptions{}, nil, extensions, nil, nil)
+	if err != nil {
+		t.Fatalf("dumpPreamble error: %v", err)
+	}
+	expected := "\nCREATE EXTENSION IF NOT EXISTS citext WITH SCHEMA public;\n" +
+		"\nCREATE EXTENSION IF NOT EXISTS \"uuid-ossp\" WITH SCHEMA ext;\n" +
+		"CREATE TABLE t (id uuid)"
+	if !strings.HasPrefix(buf.String(), expected) {
+		t.Errorf("expected the extensions to be created before the header, got:\n%s", buf.String())
+	}
+}
+
+func TestDumpPostamble_Comments(t *testing.T) {
+	var buf bytes.Buffer
+	comments := []Comment{
+		{Object: "TABLE users", Text: "People signed up"},
+		{Object: `COLUMN users."e-mail"`, Text: "User's address"},
+	}
+	err := dumpPostamble(&buf, &Manifest{}, DumpOptions{}, nil, nil, nil, comments)
+	if err != nil {
+		t.Fatalf("dumpPostamble error: %v", err)
+	}
+	expected := "COMMENT ON TABLE users IS 'People signed up';\n\n" +
+		"COMMENT ON COLUMN users.\"e-mail\" IS 'User''s address';\n"
+	if !strings.Contains(buf.String(), expected) {
+		t.Errorf("expected the comments to be dumped, got:\n%s", buf.String())
+	}
+}
+
+func TestTableStats(t *testing.T) {
+	var buf bytes.Buffer
+	tableStats(&buf, 42, 1500*time.Microsecond)
+
+	if out := buf.String(); out != "-- Rows: 42; Duration: 2ms\n" {
+		t.Errorf("unexpected table stats %q", out)
+	}
+
+	buf.Reset()
+	tableStats(&buf, 42, 0)
+	if out := buf.String(); out != "-- Rows: 42\n" {
+		t.Errorf("unexpected table stats without duration %q", out)
+	}
+}
+
 func TestEndTable(t *testing.T) {
 	var buf bytes.Buffer
 	endTable(&buf)
@@ -264,6 +465,141 @@ func TestDumpSqlCmd(t *testing.T) {
 	}
 }
 
+func TestOrderParentsFirst(t *testing.T) {
+	fk := ForeignKey{Table: "employees", Columns: []string{"manager_id"}, RefTable: "employees", RefColumns: []string{"id"}}
+	query := orderParentsFirst("SELECT * FROM employees", fk, "")
+
+	if !strings.HasPrefix(query, "WITH RECURSIVE r AS (SELECT * FROM employees)") {
+		t.Errorf("ordered query should wrap the original query, got %q", query)
+	}
+	if !strings.Contains(query, `JOIN l ON (r."manager_id") = (l."id")`) {
+		t.Errorf("ordered query should walk from referenced to referencing rows, got %q", query)
+	}
+	if !strings.HasSuffix(query, "ORDER BY l.level") {
+		t.Errorf("ordered query should order by level, got %q", query)
+	}
+
+	query = orderParentsFirst("SELECT * FROM employees", fk, `"id"`)
+	if !strings.HasSuffix(query, `ORDER BY l.level, "id"`) {
+		t.Errorf("ordered query should order rows of the same level, got %q", query)
+	}
+}
+
+func TestSelfReferenceWarning(t *testing.T) {
+	manager := ForeignKey{Name: "employees_manager_id_fkey", Table: "employees", Columns: []string{"manager_id"}, RefTable: "employees", RefColumns: []string{"id"}}
+	mentor := ForeignKey{Name: "employees_mentor_id_fkey", Table: "employees", Columns: []string{"mentor_id"}, RefTable: "employees", RefColumns: []string{"id"}}
+
+	if warning := selfReferenceWarning("employees", []ForeignKey{manager}, DumpOptions{}); warning != "" {
+		t.Errorf("expected no warning for a single self reference, got %q", warning)
+	}
+	warning := selfReferenceWarning("employees", []ForeignKey{manager, mentor}, DumpOptions{})
+	if !strings.Contains(warning, "employees_manager_id_fkey only") || !strings.Contains(warning, "employees_mentor_id_fkey") {
+		t.Errorf("expected the warning to name the foreign keys, got %q", warning)
+	}
+	if warning := selfReferenceWarning("employees", []ForeignKey{manager, mentor}, DumpOptions{DropConstraints: true}); warning != "" {
+		t.Errorf("expected no warning with --drop-constraints, got %q", warning)
+	}
+	if warning := selfReferenceWarning("employees", []ForeignKey{manager, mentor}, DumpOptions{ReplicaRole: true}); warning != "" {
+		t.Errorf("expected no warning with --replica-role, got %q", warning)
+	}
+}
+
+func TestHasColumns(t *testing.T) {
+	fk := ForeignKey{Table: "employees", Columns: []string{"manager_id"}, RefTable: "employees", RefColumns: []string{"id"}}
+
+	if !hasColumns([]string{"id", "name", "manager_id"}, fk) {
+		t.Error("expected all foreign key columns to be found")
+	}
+	if hasColumns([]string{"id", "name"}, fk) {
+		t.Error("expected missing manager_id to be detected")
+	}
+}
+
+func TestOutputPath(t *testing.T) {
+	for _, tc := range []struct {
+		uri      string
+		expected string
+	}{
+		{"", ""},
+		{"dump.sql", "dump.sql"},
+		{"/tmp/dump.sql", "/tmp/dump.sql"},
+		{"file:///tmp/dump.sql", "/tmp/dump.sql"},
+		{"file://localhost/tmp/dump.sql", "/tmp/dump.sql"},
+	} {
+		path, err := outputPath(tc.uri)
+		if err != nil {
+			t.Errorf("outputPath(%q) error: %v", tc.uri, err)
+		}
+		if path != tc.expected {
+			t.Errorf("outputPath(%q): expected %q, got %q", tc.uri, tc.expected, path)
+		}
+	}
+
+	for _, uri := range []string{"s3://bucket/dump.sql", "file://remote/tmp/dump.sql"} {
+		if _, err := outputPath(uri); err == nil {
+			t.Errorf("outputPath(%q): expected an error", uri)
+		}
+	}
+}
+
+func TestUriPath(t *testing.T) {
+	if p := uriPath("/tmp/dump.sql", "linux"); p != "/tmp/dump.sql" {
+		t.Errorf("expected /tmp/dump.sql, got %q", p)
+	}
+	if p := uriPath("/C:/dumps/dump.sql", "windows"); p != `C:\dumps\dump.sql` {
+		t.Errorf(`expected C:\dumps\dump.sql, got %q`, p)
+	}
+}
+
+func TestDbAddr(t *testing.T) {
+	for _, tc := range []struct {
+		host    string
+		network string
+		addr    string
+	}{
+		{"/tmp", "unix", "/tmp/.s.PGSQL.5432"},
+		{"/var/run/postgresql/", "unix", "/var/run/postgresql/.s.PGSQL.5432"},
+		{"localhost", "tcp", "localhost:5432"},
+		{"::1", "tcp", "[::1]:5432"},
+	} {
+		network, addr := dbAddr(tc.host, 5432)
+		if network != tc.network || addr != tc.addr {
+			t.Errorf("dbAddr(%q): expected %s %s, got %s %s", tc.host, tc.network, tc.addr, network, addr)
+		}
+	}
+
+	network, addr := dbAddr("@pg", 5432)
+	if network != "unix" || addr != "@pg/.s.PGSQL.5432" {
+		t.Errorf("expected the abstract socket @pg/.s.PGSQL.5432, got %s %s", network, addr)
+	}
+}
+
+func TestDefaultHost(t *testing.T) {
+	if host := defaultHost("windows", 5432); host != "localhost" {
+		t.Errorf("expected localhost on Windows, got %q", host)
+	}
+
+	dir := t.TempDir()
+	defer func(dirs []string) { socketDirs = dirs }(socketDirs)
+	socketDirs = []string{filepath.Join(dir, "missing"), dir}
+	if host := defaultHost("linux", 5432); host != socketDirs[0] {
+		t.Errorf("expected the first socket directory without any sockets, got %q", host)
+	}
+	os.WriteFile(filepath.Join(dir, ".s.PGSQL.5432"), nil, 0666)
+	if host := defaultHost("linux", 5432); host != dir {
+		t.Errorf("expected the directory holding the socket, got %q", host)
+	}
+}
+
+func TestNormalizeNewlines(t *testing.T) {
+	var buf bytes.Buffer
+	dumpTemplate(&buf, "-- Banner\r\nSET ROLE qa;\r\n", nil)
+	dumpSqlCmd(&buf, "SELECT 1\r\nFROM users")
+	if strings.Contains(buf.String(), "\r") {
+		t.Errorf("dump should only use LF line endings, got %q", buf.String())
+	}
+}
+
 // --------------------------------------------------------------------------
 // Integration tests (require database)
 // --------------------------------------------------------------------------
@@ -272,6 +608,46 @@ func TestConnectDB(t *testing.T) {
 	requireDB(t)
 }
 
+func TestConnectDB_SCRAM(t *testing.T) {
+	db := requireDB(t)
+
+	var method string
+	_, err := db.QueryOne(pg.Scan(&method), `
+		SELECT CASE WHEN rolpassword LIKE 'SCRAM-SHA-256$%' THEN 'scram-sha-256' ELSE 'md5' END
+		FROM pg_catalog.pg_authid WHERE rolname = current_user
+	`)
+	if err != nil {
+		t.Skipf("skipping: can't read the password of the test user: %v", err)
+	}
+	if method != "scram-sha-256" {
+		t.Skipf("skipping: the password of the test user is %s", method)
+	}
+
+	// requireDB authenticated with the password, so SCRAM works
+	_, err = db.Exec("SELECT 1")
+	if err != nil {
+		t.Fatalf("query error: %v", err)
+	}
+}
+
+func TestConnectDB_UnixSocket(t *testing.T) {
+	opts := testDBOpts()
+	port, _ := strconv.Atoi(opts.Addr[strings.LastIndex(opts.Addr, ":")+1:])
+	host := defaultHost(runtime.GOOS, port)
+	network, addr := dbAddr(host, port)
+	if _, err := os.Stat(addr); err != nil {
+		t.Skipf("skipping: no socket at %s", addr)
+	}
+
+	opts.Network = network
+	opts.Addr = addr
+	db, err := connectDB(opts)
+	if err != nil {
+		t.Fatalf("connectDB error: %v", err)
+	}
+	db.Close()
+}
+
 func TestGetTableCols_Users(t *testing.T) {
 	db := requireDB(t)
 
@@ -376,6 +752,85 @@ func TestGetTableDeps_Comments(t *testing.T) {
 	}
 }
 
+func TestGetTableDeps_UniqueColumn(t *testing.T) {
+	db := requireDB(t)
+
+	deps, err := getTableDeps(db, "profiles")
+	if err != nil {
+		t.Fatalf("getTableDeps error: %v", err)
+	}
+
+	// Two foreign keys reference users(username)
+	if len(deps) != 1 || deps[0] != "users" {
+		t.Errorf("profiles should depend on [users], got %v", deps)
+	}
+}
+
+func TestGetTableDeps_MultiColumn(t *testing.T) {
+	db := requireDB(t)
+
+	deps, err := getTableDeps(db, "revision_notes")
+	if err != nil {
+		t.Fatalf("getTableDeps error: %v", err)
+	}
+
+	if len(deps) != 1 || deps[0] != "post_revisions" {
+		t.Errorf("revision_notes should depend on [post_revisions], got %v", deps)
+	}
+}
+
+func TestGetTableDeps_CrossSchema(t *testing.T) {
+	db := requireDB(t)
+
+	deps, err := getTableDeps(db, "billing.invoices")
+	if err != nil {
+		t.Fatalf("getTableDeps error: %v", err)
+	}
+
+	if len(deps) != 1 || deps[0] != "users" {
+		t.Errorf("billing.invoices should depend on [users], got %v", deps)
+	}
+}
+
+func TestResolveTable(t *testing.T) {
+	db := requireDB(t)
+
+	for input, expected := range map[string]string{
+		"users":            "users",
+		"public.users":     "users",
+		"billing.invoices": "billing.invoices",
+	} {
+		table, err := resolveTable(db, input)
+		if err != nil {
+			t.Fatalf("resolveTable(%q) error: %v", input, err)
+		}
+		if table != expected {
+			t.Errorf("resolveTable(%q): expected %q, got %q", input, expected, table)
+		}
+	}
+}
+
+func TestGetForeignKeys_MultiColumn(t *testing.T) {
+	db := requireDB(t)
+
+	fks, err := getForeignKeys(db)
+	if err != nil {
+		t.Fatalf("getForeignKeys error: %v", err)
+	}
+
+	for _, fk := range fks {
+		if fk.Table != "revision_notes" {
+			continue
+		}
+		expected := []string{"post_id", "revision"}
+		if strings.Join(fk.Columns, ",") != "post_id,revision" || strings.Join(fk.RefColumns, ",") != "post_id,revision" {
+			t.Errorf("expected columns %v referencing %v, got %v referencing %v", expected, expected, fk.Columns, fk.RefColumns)
+		}
+		return
+	}
+	t.Error("foreign key of revision_notes not found")
+}
+
 func TestMakeDump_FullDump(t *testing.T) {
 	db := requireDB(t)
 
@@ -391,7 +846,7 @@ func TestMakeDump_FullDump(t *testing.T) {
 	}
 
 	var buf bytes.Buffer
-	err = makeDump(db, manifest, &buf)
+	err = makeDump(db, manifest, &buf, DumpOptions{})
 	if err != nil {
 		t.Fatalf("makeDump error: %v", err)
 	}
@@ -445,7 +900,7 @@ func TestMakeDump_SampledDump(t *testing.T) {
 	}
 
 	var buf bytes.Buffer
-	err = makeDump(db, manifest, &buf)
+	err = makeDump(db, manifest, &buf, DumpOptions{})
 	if err != nil {
 		t.Fatalf("makeDump error: %v", err)
 	}
@@ -472,60 +927,168 @@ func TestMakeDump_SampledDump(t *testing.T) {
 	}
 }
 
-func TestMakeDump_PostActions(t *testing.T) {
+func TestMakeDump_PerParent(t *testing.T) {
 	db := requireDB(t)
 
-	f, err := os.Open("testdata/manifest_post_actions.yaml")
+	// The latest two posts of every user, the posts of Alice but the first
+	item := ManifestItem{Table: "posts", PerParent: &PerParent{Key: "user_id", Limit: 2, OrderBy: "created_at DESC"}}
+	var buf bytes.Buffer
+	err := makeDump(db, &Manifest{Tables: []ManifestItem{item}}, &buf, DumpOptions{})
 	if err != nil {
-		t.Fatalf("failed to open manifest: %v", err)
+		t.Fatalf("makeDump error: %v", err)
 	}
-	defer f.Close()
-
-	manifest, err := readManifest(f)
-	if err != nil {
-		t.Fatalf("readManifest error: %v", err)
+	out := buf.String()
+	if strings.Contains(out, "First Post") || !strings.Contains(out, "Alice Again") || !strings.Contains(out, "-- Rows: 7") {
+		t.Errorf("expected all posts but the first one of Alice, got:\n%s", out)
 	}
 
-	var buf bytes.Buffer
-	err = makeDump(db, manifest, &buf)
+	// Among the rows of the query, ordered by the primary key by default
+	item = ManifestItem{Table: "posts", Query: "SELECT * FROM posts WHERE id > 1", PerParent: &PerParent{Key: "user_id", Limit: 1}}
+	buf.Reset()
+	err = makeDump(db, &Manifest{Tables: []ManifestItem{item}}, &buf, DumpOptions{})
 	if err != nil {
 		t.Fatalf("makeDump error: %v", err)
 	}
+	out = buf.String()
+	if !strings.Contains(out, "Second Post") || strings.Contains(out, "Alice Again") || strings.Contains(out, "Bob Returns") || !strings.Contains(out, "-- Rows: 5") {
+		t.Errorf("expected the first queried post of every user, got:\n%s", out)
+	}
+}
 
-	out := buf.String()
+func TestMakeDump_WeightedSample(t *testing.T) {
+	db := requireDB(t)
 
-	// The post_action setval statement should appear in the output
-	if !strings.Contains(out, "setval") {
-		t.Error("dump with post_actions should contain setval statement")
-	}
-	if !strings.Contains(out, "users_id_seq") {
-		t.Error("dump should reference users_id_seq in post_action")
+	// alice has all the weight, and the average weight is a fifth of hers,
+	// so a sample of 20% always has her and nobody else
+	seed := 7
+	for _, repeatable := range []*int{nil, &seed} {
+		sample := &Sample{Percent: 20, WeightBy: "CASE WHEN username = 'alice' THEN 1 END", Repeatable: repeatable}
+		manifest := &Manifest{Tables: []ManifestItem{{Table: "users", Sample: sample}}}
+		var buf bytes.Buffer
+		err := makeDump(db, manifest, &buf, DumpOptions{})
+		if err != nil {
+			t.Fatalf("makeDump error: %v", err)
+		}
+		out := buf.String()
+		if !strings.Contains(out, "alice@example.com") || strings.Contains(out, "bob@example.com") || !strings.Contains(out, "-- Rows: 1") {
+			t.Errorf("expected only alice to be sampled, got:\n%s", out)
+		}
 	}
 }
 
-func TestMakeDump_DependencyOrdering(t *testing.T) {
+func TestMakeDump_SampleHash(t *testing.T) {
 	db := requireDB(t)
 
-	f, err := os.Open("testdata/manifest_deps.yaml")
-	if err != nil {
-		t.Fatalf("failed to open manifest: %v", err)
+	// Users 1 and 3 hash into the first of two buckets, and so do their
+	// posts, on every run
+	manifest := &Manifest{Tables: []ManifestItem{
+		{Table: "users", SampleHash: &SampleHash{Column: "id", Buckets: 2, Keep: 1}},
+		{Table: "posts", SampleHash: &SampleHash{Column: "user_id", Buckets: 2, Keep: 1}},
+	}}
+	var first string
+	for range 2 {
+		var buf bytes.Buffer
+		err := makeDump(db, manifest, &buf, DumpOptions{Deterministic: true})
+		if err != nil {
+			t.Fatalf("makeDump error: %v", err)
+		}
+		out := buf.String()
+		if !strings.Contains(out, "alice@example.com") || !strings.Contains(out, "charlie@example.com") || strings.Contains(out, "bob@example.com") {
+			t.Errorf("expected alice and charlie to be sampled, got:\n%s", out)
+		}
+		if !strings.Contains(out, "Charlie's Post") || !strings.Contains(out, "Alice Again") || strings.Contains(out, "Bob Returns") || !strings.Contains(out, "-- Rows: 4") {
+			t.Errorf("expected the posts of the sampled users, got:\n%s", out)
+		}
+		if first != "" && out != first {
+			t.Errorf("expected the same sample on every run")
+		}
+		first = out
 	}
-	defer f.Close()
+}
 
-	manifest, err := readManifest(f)
-	if err != nil {
-		t.Fatalf("readManifest error: %v", err)
-	}
+func TestMakeDump_SampleHashParent(t *testing.T) {
+	db := requireDB(t)
 
+	// The posts of users 1 and 3, and the comments on them
+	manifest := &Manifest{Tables: []ManifestItem{
+		{Table: "users", SampleHash: &SampleHash{Column: "id", Buckets: 2, Keep: 1}},
+		{Table: "posts", SampleHash: &SampleHash{Parent: "users"}},
+		{Table: "comments", SampleHash: &SampleHash{Parent: "posts", Column: "post_id"}},
+	}}
 	var buf bytes.Buffer
-	err = makeDump(db, manifest, &buf)
+	err := makeDump(db, manifest, &buf, DumpOptions{})
 	if err != nil {
 		t.Fatalf("makeDump error: %v", err)
 	}
-
 	out := buf.String()
+	if !strings.Contains(out, "Alice, great post again!") || !strings.Contains(out, "Hey Charlie!") || strings.Contains(out, "Welcome, Bob!") {
+		t.Errorf("expected the comments on the posts of the sampled users, got:\n%s", out)
+	}
+	if n := strings.Count(out, "-- Rows: 4") + strings.Count(out, "-- Rows: 5"); n != 2 {
+		t.Errorf("expected 4 posts and 5 comments, got:\n%s", out)
+	}
 
-	// Extract the order of COPY statements
+	manifest.Tables[2].SampleHash = &SampleHash{Parent: "users", Column: "post_id"}
+	err = makeDump(db, manifest, io.Discard, DumpOptions{})
+	if !errors.Is(err, ErrManifestInvalid) {
+		t.Errorf("expected a column not referencing the parent to be invalid, got %v", err)
+	}
+}
+
+func TestMakeDump_PostActions(t *testing.T) {
+	db := requireDB(t)
+
+	f, err := os.Open("testdata/manifest_post_actions.yaml")
+	if err != nil {
+		t.Fatalf("failed to open manifest: %v", err)
+	}
+	defer f.Close()
+
+	manifest, err := readManifest(f)
+	if err != nil {
+		t.Fatalf("readManifest error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	err = makeDump(db, manifest, &buf, DumpOptions{})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+
+	out := buf.String()
+
+	// The post_action setval statement should appear in the output
+	if !strings.Contains(out, "setval") {
+		t.Error("dump with post_actions should contain setval statement")
+	}
+	if !strings.Contains(out, "users_id_seq") {
+		t.Error("dump should reference users_id_seq in post_action")
+	}
+}
+
+func TestMakeDump_DependencyOrdering(t *testing.T) {
+	db := requireDB(t)
+
+	f, err := os.Open("testdata/manifest_deps.yaml")
+	if err != nil {
+		t.Fatalf("failed to open manifest: %v", err)
+	}
+	defer f.Close()
+
+	manifest, err := readManifest(f)
+	if err != nil {
+		t.Fatalf("readManifest error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	err = makeDump(db, manifest, &buf, DumpOptions{})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+
+	out := buf.String()
+
+	// Extract the order of COPY statements
 	re := regexp.MustCompile(`COPY (\w+) `)
 	matches := re.FindAllStringSubmatch(out, -1)
 
@@ -574,7 +1137,7 @@ func TestMakeDump_SingleTable(t *testing.T) {
 	}
 
 	var buf bytes.Buffer
-	err = makeDump(db, manifest, &buf)
+	err = makeDump(db, manifest, &buf, DumpOptions{})
 	if err != nil {
 		t.Fatalf("makeDump error: %v", err)
 	}
@@ -616,7 +1179,7 @@ func TestMakeDump_ExplicitColumns(t *testing.T) {
 	}
 
 	var buf bytes.Buffer
-	err = makeDump(db, manifest, &buf)
+	err = makeDump(db, manifest, &buf, DumpOptions{})
 	if err != nil {
 		t.Fatalf("makeDump error: %v", err)
 	}
@@ -661,7 +1224,7 @@ func TestMakeDump_OutputIsValidSQL(t *testing.T) {
 	}
 
 	var buf bytes.Buffer
-	err = makeDump(db, manifest, &buf)
+	err = makeDump(db, manifest, &buf, DumpOptions{})
 	if err != nil {
 		t.Fatalf("makeDump error: %v", err)
 	}
@@ -688,6 +1251,258 @@ func TestMakeDump_OutputIsValidSQL(t *testing.T) {
 	}
 }
 
+func TestMakeDump_SelfReference(t *testing.T) {
+	db := requireDB(t)
+
+	f, err := os.Open("testdata/manifest_self_ref.yaml")
+	if err != nil {
+		t.Fatalf("failed to open manifest: %v", err)
+	}
+	defer f.Close()
+
+	manifest, err := readManifest(f)
+	if err != nil {
+		t.Fatalf("readManifest error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	err = makeDump(db, manifest, &buf, DumpOptions{})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+
+	out := buf.String()
+
+	// Managers must be loaded before their subordinates
+	agnes := strings.Index(out, "Agnes")
+	brian := strings.Index(out, "Brian")
+	carol := strings.Index(out, "Carol")
+	if agnes == -1 || brian == -1 || carol == -1 {
+		t.Fatalf("expected all employees in dump, got:\n%s", out)
+	}
+	if agnes > brian || brian > carol {
+		t.Errorf("employees should be ordered managers first, got:\n%s", out)
+	}
+}
+
+func TestMakeDump_MultiColumnDependencyOrdering(t *testing.T) {
+	db := requireDB(t)
+
+	f, err := os.Open("testdata/manifest_multi_column.yaml")
+	if err != nil {
+		t.Fatalf("failed to open manifest: %v", err)
+	}
+	defer f.Close()
+
+	manifest, err := readManifest(f)
+	if err != nil {
+		t.Fatalf("readManifest error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	err = makeDump(db, manifest, &buf, DumpOptions{})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+
+	out := buf.String()
+
+	revisions := strings.Index(out, "COPY post_revisions")
+	notes := strings.Index(out, "COPY revision_notes")
+	users := strings.Index(out, "COPY users")
+	profiles := strings.Index(out, "COPY profiles")
+	if revisions == -1 || notes == -1 || users == -1 || profiles == -1 {
+		t.Fatalf("expected post_revisions, revision_notes, users and profiles in dump, got:\n%s", out)
+	}
+	if revisions > notes {
+		t.Error("post_revisions should be dumped before revision_notes")
+	}
+	if users > profiles {
+		t.Error("users should be dumped before profiles")
+	}
+}
+
+func TestMakeDump_CrossSchema(t *testing.T) {
+	db := requireDB(t)
+
+	f, err := os.Open("testdata/manifest_cross_schema.yaml")
+	if err != nil {
+		t.Fatalf("failed to open manifest: %v", err)
+	}
+	defer f.Close()
+
+	manifest, err := readManifest(f)
+	if err != nil {
+		t.Fatalf("readManifest error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	err = makeDump(db, manifest, &buf, DumpOptions{})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+
+	out := buf.String()
+
+	// users must be dumped exactly once, before the invoices referencing it
+	if n := strings.Count(out, "COPY "); n != 2 {
+		t.Errorf("expected 2 COPY statements, got %d:\n%s", n, out)
+	}
+	users := strings.Index(out, "COPY public.users")
+	invoices := strings.Index(out, "COPY billing.invoices")
+	if users == -1 || invoices == -1 {
+		t.Fatalf("expected public.users and billing.invoices in dump, got:\n%s", out)
+	}
+	if users > invoices {
+		t.Error("public.users should be dumped before billing.invoices")
+	}
+}
+
+func TestMakeDump_DropConstraints(t *testing.T) {
+	db := requireDB(t)
+
+	f, err := os.Open("testdata/manifest_full.yaml")
+	if err != nil {
+		t.Fatalf("failed to open manifest: %v", err)
+	}
+	defer f.Close()
+
+	manifest, err := readManifest(f)
+	if err != nil {
+		t.Fatalf("readManifest error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	err = makeDump(db, manifest, &buf, DumpOptions{DropConstraints: true})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+
+	out := buf.String()
+
+	drop := strings.Index(out, `ALTER TABLE comments DROP CONSTRAINT "comments_post_id_fkey";`)
+	add := strings.Index(out, `ALTER TABLE comments ADD CONSTRAINT "comments_post_id_fkey" FOREIGN KEY (post_id) REFERENCES posts(id);`)
+	if drop == -1 || add == -1 {
+		t.Fatalf("expected comments_post_id_fkey to be dropped and recreated, got:\n%s", out)
+	}
+	if drop > strings.Index(out, "COPY ") {
+		t.Error("constraints should be dropped before any data is loaded")
+	}
+	if add < strings.LastIndex(out, `\.`) {
+		t.Error("constraints should be recreated after all data is loaded")
+	}
+	if n := strings.Count(out, "DROP CONSTRAINT"); n != 3 {
+		t.Errorf("expected 3 foreign keys to be dropped, got %d", n)
+	}
+}
+
+func TestMakeDump_RebuildIndexes(t *testing.T) {
+	db := requireDB(t)
+
+	f, err := os.Open("testdata/manifest_full.yaml")
+	if err != nil {
+		t.Fatalf("failed to open manifest: %v", err)
+	}
+	defer f.Close()
+
+	manifest, err := readManifest(f)
+	if err != nil {
+		t.Fatalf("readManifest error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	err = makeDump(db, manifest, &buf, DumpOptions{RebuildIndexes: true})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+
+	out := buf.String()
+
+	drop := strings.Index(out, "DROP INDEX posts_created_at_idx;")
+	create := strings.Index(out, "CREATE INDEX posts_created_at_idx ON ")
+	if drop == -1 || create == -1 {
+		t.Fatalf("expected posts_created_at_idx to be dropped and recreated, got:\n%s", out)
+	}
+	if drop > strings.Index(out, "COPY ") {
+		t.Error("indexes should be dropped before any data is loaded")
+	}
+	if create < strings.LastIndex(out, `\.`) {
+		t.Error("indexes should be recreated after all data is loaded")
+	}
+
+	// Indexes backing constraints must be left alone
+	if strings.Contains(out, "users_pkey") || strings.Contains(out, "users_username_key") {
+		t.Error("indexes backing constraints should not be dropped")
+	}
+}
+
+func TestMakeDump_Analyze(t *testing.T) {
+	db := requireDB(t)
+
+	f, err := os.Open("testdata/manifest_full.yaml")
+	if err != nil {
+		t.Fatalf("failed to open manifest: %v", err)
+	}
+	defer f.Close()
+
+	manifest, err := readManifest(f)
+	if err != nil {
+		t.Fatalf("readManifest error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	err = makeDump(db, manifest, &buf, DumpOptions{Analyze: true})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+
+	out := buf.String()
+
+	for _, table := range []string{"users", "posts", "comments"} {
+		i := strings.Index(out, fmt.Sprintf("ANALYZE %s;", table))
+		if i == -1 {
+			t.Errorf("dump should analyze %s", table)
+		} else if i < strings.LastIndex(out, `\.`) {
+			t.Errorf("%s should be analyzed after all data is loaded", table)
+		}
+	}
+}
+
+func TestMakeDump_HeaderFooter(t *testing.T) {
+	db := requireDB(t)
+
+	f, err := os.Open("testdata/manifest_header.yaml")
+	if err != nil {
+		t.Fatalf("failed to open manifest: %v", err)
+	}
+	defer f.Close()
+
+	manifest, err := readManifest(f)
+	if err != nil {
+		t.Fatalf("readManifest error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	err = makeDump(db, manifest, &buf, DumpOptions{})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+
+	out := buf.String()
+
+	header := strings.Index(out, "SET ROLE qa_team;")
+	footer := strings.Index(out, "RESET ROLE;")
+	if header == -1 || footer == -1 {
+		t.Fatalf("expected rendered header and footer, got:\n%s", out)
+	}
+	if header < strings.Index(out, "BEGIN;") || header > strings.Index(out, "COPY ") {
+		t.Error("header should come after BEGIN and before any data")
+	}
+	if footer < strings.LastIndex(out, `\.`) || footer > strings.Index(out, "COMMIT;") {
+		t.Error("footer should come after all data and before COMMIT")
+	}
+}
+
 // buildTestBinary builds the binary into a temp directory and returns its path.
 func buildTestBinary(t *testing.T) string {
 	t.Helper()
@@ -799,28 +1614,649 @@ func TestEndToEnd_OutputFile(t *testing.T) {
 	}
 }
 
-// TestMakeDump_EmptyManifest verifies that a manifest with no tables produces
-// a valid but empty dump (just BEGIN/COMMIT wrapper).
-func TestMakeDump_EmptyManifest(t *testing.T) {
+func TestMakeDump_Freeze(t *testing.T) {
 	db := requireDB(t)
 
-	manifest := &Manifest{Tables: []ManifestItem{}}
+	manifest := &Manifest{Tables: []ManifestItem{{Table: "users"}, {Table: "posts"}}}
 
 	var buf bytes.Buffer
-	err := makeDump(db, manifest, &buf)
+	err := makeDump(db, manifest, &buf, DumpOptions{Freeze: true})
 	if err != nil {
 		t.Fatalf("makeDump error: %v", err)
 	}
 
 	out := buf.String()
+	truncate := strings.Index(out, "TRUNCATE users, posts;")
+	copyUsers := strings.Index(out, "FROM stdin WITH (FREEZE);")
+	if truncate == -1 || copyUsers == -1 || truncate > copyUsers {
+		t.Errorf("tables should be truncated before being loaded with COPY FREEZE, got:\n%s", out)
+	}
 
-	if !strings.Contains(out, "BEGIN;") {
-		t.Error("empty dump should contain BEGIN;")
+	err = makeDump(db, manifest, &bytes.Buffer{}, DumpOptions{Freeze: true, Directory: t.TempDir()})
+	if err == nil {
+		t.Error("expected an error for COPY FREEZE with the directory format")
 	}
-	if !strings.Contains(out, "COMMIT;") {
-		t.Error("empty dump should contain COMMIT;")
+}
+
+func TestGetTableExtensions(t *testing.T) {
+	db := requireDB(t)
+
+	_, err := db.Exec(`CREATE EXTENSION IF NOT EXISTS citext`)
+	if err != nil {
+		t.Skipf("skipping: can't create the citext extension: %v", err)
 	}
-	if strings.Contains(out, "COPY") {
-		t.Error("empty dump should not contain any COPY statements")
+	_, err = db.Exec(`CREATE TABLE extensions_test (id int, emails citext[])`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec(`DROP TABLE extensions_test`) })
+
+	extensions, err := getTableExtensions(db, "extensions_test")
+	if err != nil {
+		t.Fatalf("getTableExtensions error: %v", err)
+	}
+	if !slices.Contains(extensions, Extension{Name: "citext", Schema: "public"}) {
+		t.Errorf("expected citext to be required, got %v", extensions)
+	}
+
+	extensions, err = getTableExtensions(db, "users")
+	if err != nil {
+		t.Fatalf("getTableExtensions error: %v", err)
+	}
+	if len(extensions) != 0 {
+		t.Errorf("expected no extensions for users, got %v", extensions)
+	}
+}
+
+func TestMakeDump_NonASCIIIdentifiers(t *testing.T) {
+	db := requireDB(t)
+
+	_, err := db.Exec(`
+		CREATE SCHEMA "склад";
+		CREATE TABLE "склад"."商品" (id int PRIMARY KEY, "名前" text, "Цена" int);
+		CREATE TABLE "склад"."заказы" (id int PRIMARY KEY, "商品_id" int REFERENCES "склад"."商品", "количество" int);
+		INSERT INTO "склад"."商品" VALUES (1, 'りんご', 120), (2, 'みかん', 80);
+		INSERT INTO "склад"."заказы" VALUES (1, 1, 3), (2, 2, 5);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec(`DROP SCHEMA "склад" CASCADE`) })
+
+	manifest, err := readManifest(strings.NewReader(`
+tables:
+  - table: '"склад"."заказы"'
+    query: 'SELECT * FROM "склад"."заказы" WHERE "количество" > 4'
+  - table: склад.商品
+    columns: [id, 名前]
+    transforms:
+      名前:
+        type: redact
+`))
+	if err != nil {
+		t.Fatalf("readManifest error: %v", err)
+	}
+	var buf bytes.Buffer
+	err = makeDump(db, manifest, &buf, DumpOptions{})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+	out := buf.String()
+
+	products := strings.Index(out, `COPY склад.商品 ("id", "名前") FROM stdin;`)
+	orders := strings.Index(out, `COPY "склад"."заказы" ("id", "商品_id", "количество") FROM stdin;`)
+	if products == -1 || orders == -1 {
+		t.Fatalf("expected COPY statements with the names as they are, got:\n%s", out)
+	}
+	if products > orders {
+		t.Error("products should be dumped before the orders referencing them")
+	}
+	if !strings.Contains(out, "2\t2\t5\n") || strings.Contains(out, "1\t1\t3\n") {
+		t.Errorf("expected only the order matching the query, got:\n%s", out)
+	}
+	if strings.Contains(out, "みかん") || strings.Contains(out, "Цена") {
+		t.Errorf("expected names to be redacted and prices left out, got:\n%s", out)
+	}
+}
+
+func TestGetTableComments(t *testing.T) {
+	db := requireDB(t)
+
+	_, err := db.Exec(`COMMENT ON TABLE users IS 'People signed up'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec(`COMMENT ON TABLE users IS NULL`) })
+
+	comments, err := getTableComments(db, "users")
+	if err != nil {
+		t.Fatalf("getTableComments error: %v", err)
+	}
+	if !slices.Contains(comments, Comment{Object: "TABLE users", Text: "People signed up"}) {
+		t.Errorf("expected the comment on users, got %v", comments)
+	}
+}
+
+func TestMakeDump_Deterministic(t *testing.T) {
+	db := requireDB(t)
+
+	dump := func(tables ...string) string {
+		manifest := &Manifest{}
+		for _, table := range tables {
+			manifest.Tables = append(manifest.Tables, ManifestItem{Table: table})
+		}
+		var buf bytes.Buffer
+		err := makeDump(db, manifest, &buf, DumpOptions{Deterministic: true})
+		if err != nil {
+			t.Fatalf("makeDump error: %v", err)
+		}
+		return buf.String()
+	}
+
+	first := dump("users", "posts")
+	if strings.Contains(first, "Duration:") {
+		t.Errorf("deterministic dumps shouldn't contain durations, got:\n%s", first)
+	}
+	if second := dump("posts", "users"); second != first {
+		t.Errorf("expected identical dumps regardless of the manifest order, got:\n%s\nand:\n%s", first, second)
+	}
+}
+
+func TestMakeDump_Parallel(t *testing.T) {
+	db := requireDB(t)
+
+	dump := func(jobs int) string {
+		manifest := &Manifest{Tables: []ManifestItem{{Table: "users"}, {Table: "posts"}, {Table: "comments"}}}
+		var buf bytes.Buffer
+		err := makeDump(db, manifest, &buf, DumpOptions{Deterministic: true, Jobs: jobs})
+		if err != nil {
+			t.Fatalf("makeDump error: %v", err)
+		}
+		return buf.String()
+	}
+
+	if serial, parallel := dump(1), dump(3); parallel != serial {
+		t.Errorf("expected the parallel dump to equal the serial one, got:\n%s\nand:\n%s", parallel, serial)
+	}
+}
+
+func TestMakeDump_Chunked(t *testing.T) {
+	db := requireDB(t)
+
+	dump := func(chunkBy string, chunkSize int, jobs int) string {
+		manifest := &Manifest{Tables: []ManifestItem{{Table: "users", ChunkBy: chunkBy, ChunkSize: chunkSize}}}
+		var buf bytes.Buffer
+		err := makeDump(db, manifest, &buf, DumpOptions{Deterministic: true, Jobs: jobs})
+		if err != nil {
+			t.Fatalf("makeDump error: %v", err)
+		}
+		return buf.String()
+	}
+
+	whole := dump("", 0, 1)
+	if chunked := dump("id", 1, 1); chunked != whole {
+		t.Errorf("expected the chunked dump to equal the whole one, got:\n%s\nand:\n%s", chunked, whole)
+	}
+	if chunked := dump("id", 1, 3); chunked != whole {
+		t.Errorf("expected the parallel chunked dump to equal the whole one, got:\n%s\nand:\n%s", chunked, whole)
+	}
+}
+
+func TestMakeDump_ExcludeSubjects(t *testing.T) {
+	db := requireDB(t)
+
+	path := filepath.Join(t.TempDir(), "subjects.csv")
+	err := os.WriteFile(path, []byte("table,column,value\nusers,username,alice\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := &Manifest{Tables: []ManifestItem{{Table: "users"}, {Table: "posts"}, {Table: "comments"}}}
+	var buf bytes.Buffer
+	err = makeDump(db, manifest, &buf, DumpOptions{ExcludeSubjects: path})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+
+	// Alice's user, her posts, and all comments on them are left out
+	dump := buf.String()
+	for _, s := range []string{"alice@example.com", "First Post", "Alice Again"} {
+		if strings.Contains(dump, s) {
+			t.Errorf("expected the dump not to contain %q", s)
+		}
+	}
+	if !strings.Contains(dump, "bob@example.com") || !strings.Contains(dump, "Bob Returns") {
+		t.Errorf("expected the dump to contain the other users and posts, got:\n%s", dump)
+	}
+}
+
+func TestMakeDump_SQLite(t *testing.T) {
+	db := requireDB(t)
+
+	path := filepath.Join(t.TempDir(), "sample.db")
+	manifest := &Manifest{Tables: []ManifestItem{{Table: "users"}, {Table: "posts"}}}
+	err := makeDump(db, manifest, io.Discard, DumpOptions{SQLite: path})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+
+	conn, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var title string
+	var userID int64
+	err = conn.QueryRow(`SELECT p.title, u.id FROM posts p JOIN users u ON u.id = p.user_id WHERE u.username = 'bob' ORDER BY p.id LIMIT 1`).Scan(&title, &userID)
+	if err != nil {
+		t.Fatalf("query error: %v", err)
+	}
+	if title != "Bob's Post" || userID != 2 {
+		t.Errorf("unexpected row %q, %d", title, userID)
+	}
+}
+
+func TestMakeDump_Parquet(t *testing.T) {
+	db := requireDB(t)
+
+	dir := t.TempDir()
+	manifest := &Manifest{Tables: []ManifestItem{{Table: "users"}}}
+	err := makeDump(db, manifest, io.Discard, DumpOptions{Parquet: dir})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+
+	type user struct {
+		ID       int32  `parquet:"id"`
+		Username string `parquet:"username"`
+	}
+	rows, err := parquet.ReadFile[user](filepath.Join(dir, "public", "users.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 5 || rows[1].ID != 2 || rows[1].Username != "bob" {
+		t.Errorf("unexpected rows %+v", rows)
+	}
+}
+
+func TestMakeDump_MySQL(t *testing.T) {
+	db := requireDB(t)
+
+	manifest := &Manifest{Tables: []ManifestItem{{Table: "users"}}}
+	var buf bytes.Buffer
+	err := makeDump(db, manifest, &buf, DumpOptions{Dialect: "mysql"})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+	dump := buf.String()
+	if strings.Contains(dump, "COPY ") || !strings.Contains(dump, "INSERT INTO `users`") || !strings.Contains(dump, "(2, 'bob', 'bob@example.com', '2024-01-02 11:00:00')") {
+		t.Errorf("unexpected dump:\n%s", dump)
+	}
+}
+
+func TestMakeDump_DuckDB(t *testing.T) {
+	db := requireDB(t)
+
+	manifest := &Manifest{Tables: []ManifestItem{{Table: "users"}}}
+	var buf bytes.Buffer
+	err := makeDump(db, manifest, &buf, DumpOptions{Dialect: "duckdb"})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+	dump := buf.String()
+	if !strings.Contains(dump, `CREATE TABLE "users" (`) || !strings.Contains(dump, `"id" INTEGER,`) || !strings.Contains(dump, "(2, 'bob', 'bob@example.com', '2024-01-02 11:00:00')") {
+		t.Errorf("unexpected dump:\n%s", dump)
+	}
+}
+
+func TestMakeDump_VarsSQL(t *testing.T) {
+	db := requireDB(t)
+
+	manifest := &Manifest{
+		Vars:    map[string]string{"unused": "1"},
+		VarsSQL: map[string]string{"max_id": "SELECT max(id) - 1 FROM users"},
+		Tables:  []ManifestItem{{Table: "users", Query: "SELECT * FROM users WHERE id > {{max_id}}"}},
+	}
+	var buf bytes.Buffer
+	err := makeDump(db, manifest, &buf, DumpOptions{})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+	if !strings.Contains(buf.String(), "WHERE id > 4") || manifest.Vars["max_id"] != "4" {
+		t.Errorf("expected max_id to be computed, got vars %v and dump:\n%s", manifest.Vars, buf.String())
+	}
+
+	manifest.VarsSQL = map[string]string{"max_id": "SELECT NULL"}
+	err = makeDump(db, manifest, &buf, DumpOptions{})
+	if err == nil || !strings.Contains(err.Error(), "vars_sql max_id") {
+		t.Errorf("expected an error for a NULL var, got %v", err)
+	}
+}
+
+func TestMakeDump_AsOf(t *testing.T) {
+	db := requireDB(t)
+
+	manifest := &Manifest{
+		AsOf:          "2024-06-01 12:00:00+02",
+		Preconditions: []string{"SELECT {{as_of}} = '2024-06-01T10:00:00Z'"},
+		Tables: []ManifestItem{
+			{Table: "users", Query: "SELECT * FROM users WHERE {{as_of}} > '2024-01-01'"},
+			{Table: "posts", Query: "SELECT * FROM posts WHERE {{as_of}} < '2024-01-01'"},
+		},
+	}
+	var buf bytes.Buffer
+	err := makeDump(db, manifest, &buf, DumpOptions{Deterministic: true})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "-- As of: 2024-06-01T10:00:00Z\n") {
+		t.Errorf("expected the instant in the header, got:\n%s", out)
+	}
+	if !strings.Contains(out, "alice@example.com") || strings.Contains(out, "First Post") {
+		t.Errorf("expected the queries to use the instant, got:\n%s", out)
+	}
+
+	// Without as_of the dump is as of when it starts, which isn't
+	// deterministic
+	manifest = &Manifest{Tables: []ManifestItem{{Table: "users", Query: "SELECT * FROM users WHERE {{as_of}} <= now()"}}}
+	buf.Reset()
+	err = makeDump(db, manifest, &buf, DumpOptions{Deterministic: true})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+	if strings.Contains(buf.String(), "-- As of:") || !strings.Contains(buf.String(), "alice@example.com") {
+		t.Errorf("expected all users and no instant in the header, got:\n%s", buf.String())
+	}
+}
+
+func TestMakeDump_PostActionsMaxID(t *testing.T) {
+	db := requireDB(t)
+
+	manifest := &Manifest{Tables: []ManifestItem{{
+		Table:       "users",
+		Query:       "SELECT * FROM users WHERE id <= 2",
+		PostActions: []string{"SELECT setval('users_id_seq', {{max_id}}) -- {{rows}} rows"},
+	}}}
+	var buf bytes.Buffer
+	err := makeDump(db, manifest, &buf, DumpOptions{})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+	if !strings.Contains(buf.String(), "SELECT setval('users_id_seq', 2) -- 2 rows") {
+		t.Errorf("expected the post action to use the dumped rows, got:\n%s", buf.String())
+	}
+}
+
+func TestMakeDump_Preconditions(t *testing.T) {
+	db := requireDB(t)
+
+	manifest := &Manifest{
+		Vars:          Vars{"max_users": "10"},
+		Preconditions: []string{"SELECT count(*) < {{max_users}} FROM users", "SELECT true"},
+		Tables:        []ManifestItem{{Table: "users"}},
+	}
+	var buf bytes.Buffer
+	err := makeDump(db, manifest, &buf, DumpOptions{})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+
+	manifest.Vars["max_users"] = "1"
+	buf.Reset()
+	err = makeDump(db, manifest, &buf, DumpOptions{})
+	if err == nil || !strings.Contains(err.Error(), "SELECT count(*) < 1 FROM users") {
+		t.Errorf("expected the failed precondition in the error, got %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected nothing to be dumped, got:\n%s", buf.String())
+	}
+}
+
+func TestMakeDump_ResetSequences(t *testing.T) {
+	db := requireDB(t)
+
+	manifest := &Manifest{Tables: []ManifestItem{
+		{Table: "users", PostActions: []string{"SELECT 1"}},
+		{Table: "posts", Columns: []string{"title"}},
+	}}
+	var buf bytes.Buffer
+	err := makeDump(db, manifest, &buf, DumpOptions{ResetSequences: true})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+	dump := buf.String()
+	reset := `SELECT pg_catalog.setval('users_id_seq', COALESCE(max("id"), 1), max("id") IS NOT NULL) FROM users;`
+	if !strings.Contains(dump, reset) || strings.Index(dump, reset) > strings.Index(dump, "SELECT 1;") {
+		t.Errorf("expected the sequence of users to be reset before its post actions, got:\n%s", dump)
+	}
+	if strings.Contains(dump, "posts_id_seq") {
+		t.Errorf("expected the sequence of a column which isn't dumped to be left alone, got:\n%s", dump)
+	}
+}
+
+func TestMakeDump_Validate(t *testing.T) {
+	db := requireDB(t)
+
+	item := ManifestItem{Table: "users", Validate: "username <> 'bob'", OnInvalid: ON_INVALID_SKIP}
+	var buf bytes.Buffer
+	err := makeDump(db, &Manifest{Tables: []ManifestItem{item}}, &buf, DumpOptions{})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+	dump := buf.String()
+	if strings.Contains(dump, "bob") || !strings.Contains(dump, "alice@example.com\t") || !strings.Contains(dump, "-- Rows: 4") {
+		t.Errorf("expected bob to be skipped, got:\n%s", dump)
+	}
+
+	item.OnInvalid = ON_INVALID_FIX
+	item.Fix = map[string]Transform{"email": {Type: "null"}}
+	buf.Reset()
+	err = makeDump(db, &Manifest{Tables: []ManifestItem{item}}, &buf, DumpOptions{})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+	dump = buf.String()
+	if !strings.Contains(dump, "2\tbob\t\\N\t") || !strings.Contains(dump, "alice@example.com") || !strings.Contains(dump, "-- Rows: 5") {
+		t.Errorf("expected the e-mail address of bob to be removed, got:\n%s", dump)
+	}
+
+	item.OnInvalid, item.Fix = "", nil
+	err = makeDump(db, &Manifest{Tables: []ManifestItem{item}}, io.Discard, DumpOptions{})
+	if err == nil || !strings.Contains(err.Error(), "row of users with id=2 doesn't match validate") {
+		t.Errorf("expected bob to fail the dump, got %v", err)
+	}
+}
+
+func TestSelftest(t *testing.T) {
+	db := requireDB(t)
+	if _, err := exec.LookPath("psql"); err != nil {
+		t.Skip("skipping: psql not available")
+	}
+
+	dbOpts := testDBOpts()
+	host, port, _ := strings.Cut(dbOpts.Addr, ":")
+	portNum, _ := strconv.Atoi(port)
+	opts := &Options{Host: host, Port: portNum, Username: dbOpts.User, Database: dbOpts.Database}
+	var buf bytes.Buffer
+	err := runSelftest(&buf, db, opts, dbOpts.Password, 1)
+	if err != nil {
+		t.Fatalf("runSelftest error: %v", err)
+	}
+	if buf.String() != fmt.Sprintf("%d rows dumped and restored identically (seed 1)\n", 2*len(selftestFragments)+SELFTEST_ROWS+1) {
+		t.Errorf("unexpected output %q", buf.String())
+	}
+
+	var exists bool
+	_, err = db.QueryOne(pg.Scan(&exists), `SELECT EXISTS (SELECT FROM pg_namespace WHERE nspname = ?)`, SELFTEST_SCHEMA)
+	if err != nil {
+		t.Fatalf("query error: %v", err)
+	}
+	if exists {
+		t.Errorf("expected the schema of the self-test to be dropped")
+	}
+}
+
+func TestCheckTarget(t *testing.T) {
+	db := requireDB(t)
+
+	// A database matches itself
+	items := []ManifestItem{{Table: "users"}, {Table: "posts"}, {Table: "no_such_table"}}
+	findings, matched, err := checkTarget(db, db, items[:2], true)
+	if err != nil {
+		t.Fatalf("checkTarget error: %v", err)
+	}
+	if len(findings) != 0 || len(matched) != 0 {
+		t.Errorf("expected no findings nor matched columns, got %q, %v", findings, matched)
+	}
+
+	defs, err := getColumnDefs(db, items[2].Table)
+	if err != nil || defs != nil {
+		t.Errorf("expected no columns of a missing table, got %v, %v", defs, err)
+	}
+}
+
+func TestCheckPrivileges(t *testing.T) {
+	db := requireDB(t)
+
+	_, err := db.Exec(`DROP ROLE IF EXISTS sampler_readonly`)
+	if err == nil {
+		_, err = db.Exec(`CREATE ROLE sampler_readonly LOGIN PASSWORD 'sampler'; GRANT SELECT (id, username) ON users TO sampler_readonly`)
+	}
+	if err != nil {
+		t.Fatalf("creating role: %v", err)
+	}
+	defer db.Exec(`DROP OWNED BY sampler_readonly; DROP ROLE sampler_readonly`)
+
+	items := []ManifestItem{{Table: "users"}, {Table: "posts"}}
+	findings, err := checkPrivileges(db, items)
+	if err != nil {
+		t.Fatalf("checkPrivileges error: %v", err)
+	}
+	if len(findings) != 0 {
+		t.Errorf("expected no findings, got %q", findings)
+	}
+
+	opts := testDBOpts()
+	opts.User, opts.Password = "sampler_readonly", "sampler"
+	readonly, err := connectDB(opts)
+	if err != nil {
+		t.Fatalf("connectDB error: %v", err)
+	}
+	defer readonly.Close()
+	findings, err = checkPrivileges(readonly, items)
+	if err != nil {
+		t.Fatalf("checkPrivileges error: %v", err)
+	}
+	if len(findings) != 2 || !strings.HasPrefix(findings[0], "table users can't be read without SELECT on it or on columns") {
+		t.Errorf("expected both tables to be reported, got %q", findings)
+	}
+}
+
+func TestCopyPages(t *testing.T) {
+	db := requireDB(t)
+
+	var expected bytes.Buffer
+	_, err := dumpTable(&expected, db, `(SELECT * FROM users ORDER BY "id" LIMIT 2)`)
+	if err != nil {
+		t.Fatalf("dumpTable error: %v", err)
+	}
+
+	cols, err := getTableCols(db, "users")
+	if err != nil {
+		t.Fatalf("getTableCols error: %v", err)
+	}
+	var buf bytes.Buffer
+	p := &keysetPages{query: "SELECT * FROM users", key: []string{"id"}, pos: []int{slices.Index(cols, "id")}, size: 1, limit: 2}
+	rows, err := copyPages(context.Background(), &buf, db, "users", p)
+	if err != nil {
+		t.Fatalf("copyPages error: %v", err)
+	}
+	if rows != 2 || buf.String() != expected.String() {
+		t.Errorf("expected %q, got %d rows %q", expected.String(), rows, buf.String())
+	}
+}
+
+// TestEndToEnd_EnvOnly runs the binary without arguments, configured only
+// through environment variables as in a container.
+func TestEndToEnd_EnvOnly(t *testing.T) {
+	binPath := buildTestBinary(t)
+
+	opts := testDBOpts()
+	db, err := connectDB(opts)
+	if err != nil {
+		t.Skipf("skipping: test database not available: %v", err)
+	}
+	db.Close()
+
+	manifest, err := os.ReadFile("testdata/manifest_single_table.yaml")
+	if err != nil {
+		t.Fatalf("failed to read manifest: %v", err)
+	}
+	outFile := filepath.Join(t.TempDir(), "test_output.sql")
+
+	parts := strings.SplitN(opts.Addr, ":", 2)
+	cmd := exec.Command(binPath)
+	cmd.Env = append(os.Environ(),
+		"PGHOST="+parts[0],
+		"PGPORT="+parts[1],
+		"PGUSER="+opts.User,
+		"PGPASSWORD="+opts.Password,
+		"PGDATABASE="+opts.Database,
+		"MANIFEST_B64="+base64.StdEncoding.EncodeToString(manifest),
+		"OUTPUT_URI=file://"+outFile,
+	)
+
+	runOut, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("binary execution failed: %v\n%s", err, runOut)
+	}
+
+	data, err := os.ReadFile(outFile)
+	if err != nil {
+		t.Fatalf("failed to read output file: %v", err)
+	}
+	if !strings.Contains(string(data), "COPY users") {
+		t.Error("output file should contain COPY users")
+	}
+}
+
+// TestMakeDump_EmptyManifest verifies that a manifest with no tables produces
+// a valid but empty dump (just BEGIN/COMMIT wrapper).
+func TestMakeDump_EmptyManifest(t *testing.T) {
+	db := requireDB(t)
+
+	manifest := &Manifest{Tables: []ManifestItem{}}
+
+	var buf bytes.Buffer
+	err := makeDump(db, manifest, &buf, DumpOptions{})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+
+	out := buf.String()
+
+	if !strings.Contains(out, "BEGIN;") {
+		t.Error("empty dump should contain BEGIN;")
+	}
+	if !strings.Contains(out, "COMMIT;") {
+		t.Error("empty dump should contain COMMIT;")
+	}
+	if strings.Contains(out, "COPY") {
+		t.Error("empty dump should not contain any COPY statements")
+	}
+}
+
+func TestSetOutputFormats(t *testing.T) {
+	opts := testDBOpts()
+	setOutputFormats(opts)
+	db, err := connectDB(opts)
+	if err != nil {
+		t.Skipf("skipping: test database not available: %v", err)
+	}
+	defer db.Close()
+	var bytea, dateStyle string
+	_, err = db.QueryOne(pg.Scan(&bytea, &dateStyle), "SELECT current_setting('bytea_output'), current_setting('DateStyle')")
+	if err != nil || bytea != "hex" || !strings.HasPrefix(dateStyle, "ISO") {
+		t.Errorf("expected hex and ISO, got %q and %q, %v", bytea, dateStyle, err)
 	}
 }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// NOTIFY_TIMEOUT is how long posting a notification may take.
+const NOTIFY_TIMEOUT = 30 * time.Second
+
+// dumpSummary is how a dump went, posted to `--notify-url`.
+type dumpSummary struct {
+	// Name of the scheduled job of serve which made the dump, if any
+	Job      string         `json:"job,omitempty"`
+	Database string         `json:"database"`
+	Output   string         `json:"output,omitempty"`
+	Status   string         `json:"status"`
+	Error    string         `json:"error,omitempty"`
+	Started  time.Time      `json:"started"`
+	Finished time.Time      `json:"finished"`
+	Seconds  float64        `json:"duration_seconds"`
+	Rows     int            `json:"rows"`
+	Tables   []tableSummary `json:"tables"`
+
+	mu sync.Mutex
+}
+
+// tableSummary is the number of rows dumped of a table.
+type tableSummary struct {
+	Table string `json:"table"`
+	Rows  int    `json:"rows"`
+}
+
+func newDumpSummary(database string, output string) *dumpSummary {
+	return &dumpSummary{Database: database, Output: output, Started: time.Now(), Tables: []tableSummary{}}
+}
+
+// addTable records the rows dumped of table.
+func (s *dumpSummary) addTable(table string, rows int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Tables = append(s.Tables, tableSummary{Table: table, Rows: rows})
+	s.Rows += rows
+}
+
+// finish records the end of the dump, which failed with err if not nil.
+func (s *dumpSummary) finish(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Finished = time.Now()
+	s.Seconds = s.Finished.Sub(s.Started).Round(time.Millisecond).Seconds()
+	s.Status = "succeeded"
+	if err != nil {
+		s.Status = "failed"
+		s.Error = redact(err.Error())
+	}
+}
+
+// text returns the summary as a sentence, e.g. for chat messages.
+func (s *dumpSummary) text() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := s.Database
+	if s.Job != "" {
+		name = fmt.Sprintf("%s (job %s)", s.Database, s.Job)
+	}
+	duration := s.Finished.Sub(s.Started).Round(time.Second)
+	if s.Status == "failed" {
+		return fmt.Sprintf("pg_dump_sample failed to dump %s after %s: %s", name, duration, s.Error)
+	}
+	to := ""
+	if s.Output != "" {
+		to = " to " + s.Output
+	}
+	return fmt.Sprintf("pg_dump_sample dumped %s%s: %d rows of %d tables in %s", name, to, s.Rows, len(s.Tables), duration)
+}
+
+// notificationPayload returns the body posted to the notify URL: the summary
+// as JSON, or a message Slack's incoming webhooks take with the slack format.
+func notificationPayload(s *dumpSummary, format string) ([]byte, error) {
+	if format == "slack" {
+		return json.Marshal(map[string]string{"text": s.text()})
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return json.Marshal(s)
+}
+
+// checkNotifyURL checks that u is an HTTP URL to post notifications to.
+func checkNotifyURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("`--notify-url` must be an http or https URL")
+	}
+	return nil
+}
+
+// notify posts the summary of a dump to the URL u in format.
+func notify(u string, format string, s *dumpSummary) error {
+	body, err := notificationPayload(s, format)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: NOTIFY_TIMEOUT}
+	resp, err := client.Post(u, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to notify: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("failed to notify: the notify URL answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDumpSummary_Payload(t *testing.T) {
+	s := newDumpSummary("mydb", "mydb_dump.sql")
+	s.Started = time.Date(2026, 10, 17, 3, 0, 0, 0, time.UTC)
+	s.addTable("users", 5)
+	s.addTable("posts", 8)
+	s.finish(nil)
+	s.Finished = s.Started.Add(12 * time.Second)
+
+	body, err := notificationPayload(s, "json")
+	if err != nil {
+		t.Fatalf("notificationPayload error: %v", err)
+	}
+	var summary map[string]any
+	err = json.Unmarshal(body, &summary)
+	if err != nil || summary["database"] != "mydb" || summary["status"] != "succeeded" || summary["rows"] != float64(13) || len(summary["tables"].([]any)) != 2 {
+		t.Errorf("unexpected summary: %s", body)
+	}
+
+	body, _ = notificationPayload(s, "slack")
+	if string(body) != `{"text":"pg_dump_sample dumped mydb to mydb_dump.sql: 13 rows of 2 tables in 12s"}` {
+		t.Errorf("unexpected Slack message: %s", body)
+	}
+
+	s = newDumpSummary("mydb", "")
+	s.Job = "nightly"
+	s.finish(errors.New("connecting to postgres://reader:s3cr3t@db/mydb: refused"))
+	if text := s.text(); !strings.HasPrefix(text, "pg_dump_sample failed to dump mydb (job nightly) after 0s: ") || strings.Contains(text, "s3cr3t") {
+		t.Errorf("unexpected text: %s", text)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	var received []byte
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected request %s %s", r.Method, r.Header.Get("Content-Type"))
+		}
+		received, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	s := newDumpSummary("mydb", "")
+	s.finish(nil)
+	err := notify(server.URL+"/hooks/T000/B000/XXXX", "slack", s)
+	if err != nil || !strings.Contains(string(received), `"text":"pg_dump_sample dumped mydb: 0 rows of 0 tables`) {
+		t.Errorf("expected the message to be posted, got %s, %v", received, err)
+	}
+
+	status = http.StatusNotFound
+	err = notify(server.URL+"/hooks/T000/B000/XXXX", "json", s)
+	if err == nil || strings.Contains(err.Error(), "XXXX") {
+		t.Errorf("expected an error without the URL, got %v", err)
+	}
+}
+
+func TestCheckNotifyURL(t *testing.T) {
+	for _, u := range []string{"https://hooks.slack.com/services/T/B/X", "http://localhost:8080/notify"} {
+		if err := checkNotifyURL(u); err != nil {
+			t.Errorf("%s: unexpected error %v", u, err)
+		}
+	}
+	for _, u := range []string{"", "hooks.slack.com/services", "ftp://example.com", "https://", "http://exa mple.com"} {
+		if err := checkNotifyURL(u); err == nil {
+			t.Errorf("%s: expected an error", u)
+		}
+	}
+}
+
+func TestRun_NotifyFailure(t *testing.T) {
+	var summary dumpSummary
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&summary)
+	}))
+	defer server.Close()
+
+	opts := &Options{
+		Host:             "127.0.0.1",
+		Port:             1,
+		Username:         "reader",
+		NoPasswordPrompt: true,
+		Database:         "mydb",
+		Manifest:         []byte("tables:\n  - table: users\n"),
+		NotifyURL:        server.URL,
+		NotifyFormat:     "json",
+	}
+	err := run(opts)
+	if err == nil {
+		t.Fatal("expected an error connecting to a closed port")
+	}
+	if summary.Database != "mydb" || summary.Status != "failed" || summary.Error == "" {
+		t.Errorf("expected the failure to be posted, got %s %s: %s", summary.Database, summary.Status, summary.Error)
+	}
+}
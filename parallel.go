@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pg "github.com/go-pg/pg/v10"
+)
+
+// workerPool is a bounded pool of connections for dumping tables in parallel.
+// All connections read the same snapshot, exported by a transaction of the
+// main connection, so the tables are consistent with each other as if they
+// were dumped in a single transaction. With per-table transactions there is
+// no shared snapshot, and every table is read in a transaction of its own.
+type workerPool struct {
+	tx      *pg.Tx
+	workers []*pg.DB
+	idle    chan *pg.DB
+	// Memory the buffered data may take before spilling to disk
+	budget *memoryBudget
+}
+
+func newWorkerPool(db *pg.DB, size int, budget *memoryBudget, perTable bool) (*workerPool, error) {
+	p := &workerPool{idle: make(chan *pg.DB, size), budget: budget}
+	snapshot := ""
+	if !perTable {
+		tx, err := db.Begin()
+		if err != nil {
+			return nil, err
+		}
+		p.tx = tx
+
+		_, err = tx.Exec("SET TRANSACTION ISOLATION LEVEL REPEATABLE READ, READ ONLY")
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		_, err = tx.QueryOne(pg.Scan(&snapshot), "SELECT pg_catalog.pg_export_snapshot()")
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+	}
+
+	for i := 0; i < size; i++ {
+		worker, err := connectWorker(db, snapshot)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.workers = append(p.workers, worker)
+		p.idle <- worker
+	}
+
+	return p, nil
+}
+
+// connectWorker opens a single connection to the database of db, reading the
+// exported snapshot, if any. Connections replacing lost ones read it again.
+func connectWorker(db *pg.DB, snapshot string) (*pg.DB, error) {
+	opts := *db.Options()
+	opts.PoolSize = 1
+	opts.MinIdleConns = 0
+	onConnect := opts.OnConnect
+	opts.OnConnect = func(ctx context.Context, cn *pg.Conn) error {
+		if snapshot == "" {
+			if onConnect != nil {
+				return onConnect(ctx, cn)
+			}
+			return nil
+		}
+		if onConnect != nil {
+			err := onConnect(ctx, cn)
+			if err != nil {
+				return err
+			}
+		}
+		_, err := cn.ExecContext(ctx, "BEGIN ISOLATION LEVEL REPEATABLE READ, READ ONLY")
+		if err != nil {
+			return err
+		}
+		_, err = cn.ExecContext(ctx, "SET TRANSACTION SNAPSHOT ?", snapshot)
+		return err
+	}
+
+	worker, err := connectDB(&opts)
+	if err != nil {
+		return nil, err
+	}
+	// Workers share the metadata loaded by the main connection
+	if c, ok := catalogs.Load(db); ok {
+		catalogs.Store(worker, c)
+	}
+	return worker, nil
+}
+
+// acquire waits for an idle worker and checks its connection, which the
+// worker replaces if it was lost. It returns nil if done is closed first.
+func (p *workerPool) acquire(done <-chan struct{}) (*pg.DB, error) {
+	select {
+	case worker := <-p.idle:
+		_, err := worker.Exec("SELECT 1")
+		if isConnectionError(err) {
+			// The lost connection was dropped, the next query opens a new
+			// one
+			_, err = worker.Exec("SELECT 1")
+		}
+		if err != nil {
+			p.release(worker)
+			return nil, fmt.Errorf("worker connection: %w", err)
+		}
+		return worker, nil
+	case <-done:
+		return nil, nil
+	}
+}
+
+// tryAcquire returns an idle worker, or nil if there is none.
+func (p *workerPool) tryAcquire() *pg.DB {
+	select {
+	case worker := <-p.idle:
+		_, err := worker.Exec("SELECT 1")
+		if err != nil {
+			p.release(worker)
+			return nil
+		}
+		return worker
+	default:
+		return nil
+	}
+}
+
+func (p *workerPool) release(worker *pg.DB) {
+	p.idle <- worker
+}
+
+// copyItem copies the data of a table like copyItem, sharing its chunks, if
+// any, with the workers which are idle. The chunks are buffered until all
+// chunks before them have been copied.
+func (p *workerPool) copyItem(db *pg.DB, table string, q *itemQuery) (int, error) {
+	workers := []*pg.DB{db}
+	for len(workers) < len(q.Chunks) {
+		worker := p.tryAcquire()
+		if worker == nil {
+			break
+		}
+		defer p.release(worker)
+		workers = append(workers, worker)
+	}
+	if len(workers) == 1 {
+		return copyItem(db, table, q)
+	}
+
+	return copyWithin(table, q, func(ctx context.Context, w io.Writer) (int, error) {
+		data := make([]spillBuffer, len(q.Chunks))
+		for i := range data {
+			data[i].budget = p.budget
+		}
+		defer func() {
+			for i := range data {
+				data[i].Reset()
+			}
+		}()
+		rows := make([]int, len(q.Chunks))
+		errs := make([]error, len(q.Chunks))
+		var next atomic.Int64
+		var wg sync.WaitGroup
+		for _, worker := range workers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					i := int(next.Add(1) - 1)
+					if i >= len(q.Chunks) {
+						return
+					}
+					rows[i], errs[i] = copyQuery(ctx, &data[i], worker, table, q.Chunks[i])
+					if errs[i] != nil {
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		total := 0
+		for i := range q.Chunks {
+			// The rows of a chunk interrupted by max_duration are
+			// kept with the partial policy
+			_, err := io.Copy(w, &data[i])
+			if err != nil {
+				return 0, err
+			}
+			data[i].Reset()
+			if errs[i] != nil {
+				return 0, errs[i]
+			}
+			total += rows[i]
+		}
+		return total, nil
+	})
+}
+
+// Close closes the workers and ends the transaction exporting the snapshot.
+func (p *workerPool) Close() {
+	for _, worker := range p.workers {
+		catalogs.Delete(worker)
+		serverVersions.Delete(worker)
+		worker.Close()
+	}
+	if p.tx != nil {
+		p.tx.Rollback()
+	}
+}
+
+// dumpItemsParallel dumps the manifest items with opts.Jobs workers, in the
+// order of scheduleItems. Tables are buffered until all tables before them
+// have been written, so the dump is the same as when dumped one by one, in
+// memory up to opts.MaxMemory and in temporary files after that.
+func dumpItemsParallel(dw DumpWriter, w io.Writer, db *pg.DB, manifest *Manifest, items []ManifestItem, opts DumpOptions) error {
+	budget := newMemoryBudget(opts.MaxMemory)
+	if !opts.PerTableTransactions {
+		opts.snapshotStart = time.Now()
+	}
+	pool, err := newWorkerPool(db, opts.Jobs, budget, opts.PerTableTransactions)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	// Warnings are reported one at a time
+	var mu sync.Mutex
+	parent := opts
+	opts.warnFunc = func(msg string) {
+		mu.Lock()
+		defer mu.Unlock()
+		parent.warn("%s", msg)
+	}
+
+	order, err := scheduleItems(db, items)
+	if err != nil {
+		return err
+	}
+
+	type result struct {
+		b    *bufferedItem
+		data spillBuffer
+		err  error
+	}
+	results := make([]chan *result, len(items))
+	for i := range results {
+		results[i] = make(chan *result, 1)
+	}
+	defer func() {
+		// Tables left unwritten by a failure remove their temporary files
+		for _, c := range results {
+			select {
+			case r := <-c:
+				r.data.Reset()
+			default:
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	defer wg.Wait()
+	defer close(done)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for _, i := range order {
+			v := items[i]
+			worker, err := pool.acquire(done)
+			if err != nil {
+				results[i] <- &result{err: err}
+				return
+			}
+			if worker == nil {
+				return
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer pool.release(worker)
+
+				r := &result{data: spillBuffer{budget: budget}}
+				if opts.Directory != "" {
+					r.err = retry(opts, v.Table, func() error {
+						return inTableTransaction(worker, opts, func() error {
+							return dumpItemFile(opts.Directory, worker, manifest, v, opts)
+						})
+					})
+				} else {
+					r.err = retry(opts, v.Table, func() error {
+						r.data.Reset()
+						return inTableTransaction(worker, opts, func() error {
+							var err error
+							r.b, err = bufferItem(&r.data, worker, manifest, v, opts, pool.copyItem)
+							return err
+						})
+					})
+				}
+				results[i] <- r
+			}()
+		}
+	}()
+
+	for i, v := range items {
+		r := <-results[i]
+		if r.err != nil {
+			return r.err
+		}
+		if opts.Directory != "" {
+			fmt.Fprintf(w, INCLUDE_DUMP, tableFile(v.Table))
+			continue
+		}
+		err := writeItem(dw, v, r.b, &r.data, opts)
+		r.data.Reset()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// inTableTransaction runs f, which reads a table on worker, in a transaction
+// of its own with per-table transactions, or else in a savepoint of the
+// transaction of the shared snapshot.
+func inTableTransaction(worker *pg.DB, opts DumpOptions, f func() error) error {
+	if !opts.PerTableTransactions {
+		return inSavepoint(worker, f)
+	}
+	_, err := worker.Exec("BEGIN ISOLATION LEVEL REPEATABLE READ, READ ONLY")
+	if err != nil {
+		return err
+	}
+	err = f()
+	if isConnectionError(err) {
+		// The transaction ended with the connection
+		return err
+	}
+	_, rollbackErr := worker.Exec("ROLLBACK")
+	if err != nil {
+		return err
+	}
+	return rollbackErr
+}
+
+// inSavepoint runs f on worker in a savepoint, which is rolled back after it,
+// as a query canceled by max_duration aborts the transaction, and with it the
+// tables read after it, even when the rows copied so far are kept.
+func inSavepoint(worker *pg.DB, f func() error) error {
+	_, err := worker.Exec("SAVEPOINT pg_dump_sample_table")
+	if err != nil {
+		return err
+	}
+	err = f()
+	if isConnectionError(err) {
+		// The transaction ended with the connection
+		return err
+	}
+	_, rollbackErr := worker.Exec("ROLLBACK TO SAVEPOINT pg_dump_sample_table; RELEASE SAVEPOINT pg_dump_sample_table")
+	if err != nil {
+		return err
+	}
+	return rollbackErr
+}
+
+// scheduleItems returns the order the items are dumped in by workers: the
+// largest tables first, so that they don't keep the dump going alone at the
+// end, but after the tables they depend on.
+func scheduleItems(db *pg.DB, items []ManifestItem) ([]int, error) {
+	index := make(map[string]int, len(items))
+	for i, v := range items {
+		name, err := resolveTable(db, v.Table)
+		if err != nil {
+			return nil, err
+		}
+		index[name] = i
+	}
+
+	sizes := make([]int64, len(items))
+	deps := make([][]int, len(items))
+	for i, v := range items {
+		var err error
+		sizes[i], err = getTableSize(db, v.Table)
+		if err != nil {
+			return nil, err
+		}
+		tables, err := getTableDeps(db, v.Table)
+		if err != nil {
+			return nil, err
+		}
+		for _, table := range tables {
+			if j, ok := index[table]; ok && j != i {
+				deps[i] = append(deps[i], j)
+			}
+		}
+	}
+	return scheduleOrder(sizes, deps), nil
+}
+
+// scheduleOrder orders items of the given sizes, each after the items of
+// its deps, largest first. Items count as large as the largest item depending
+// on them, so that small tables holding up large ones come early. Items are
+// otherwise kept in their order, which lists dependencies first, and items
+// depending on each other are taken in that order.
+func scheduleOrder(sizes []int64, deps [][]int) []int {
+	priority := slices.Clone(sizes)
+	for i := len(deps) - 1; i >= 0; i-- {
+		for _, j := range deps[i] {
+			priority[j] = max(priority[j], priority[i])
+		}
+	}
+
+	order := make([]int, 0, len(sizes))
+	scheduled := make([]bool, len(sizes))
+	for len(order) < len(sizes) {
+		next := -1
+		for i := range sizes {
+			ready := !scheduled[i] && !slices.ContainsFunc(deps[i], func(j int) bool { return !scheduled[j] })
+			if ready && (next == -1 || priority[i] > priority[next]) {
+				next = i
+			}
+		}
+		if next == -1 {
+			// Only items depending on each other are left
+			next = slices.Index(scheduled, false)
+		}
+		scheduled[next] = true
+		order = append(order, next)
+	}
+	return order
+}
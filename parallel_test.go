@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	pg "github.com/go-pg/pg/v10"
+)
+
+func TestScheduleOrder(t *testing.T) {
+	for _, tc := range []struct {
+		sizes    []int64
+		deps     [][]int
+		expected []int
+	}{
+		// Largest first, ties in their order
+		{[]int64{10, 30, 20, 30}, [][]int{nil, nil, nil, nil}, []int{1, 3, 2, 0}},
+		// The small users hold up the large posts, so they come before
+		// the medium events
+		{[]int64{1, 100, 50}, [][]int{nil, {0}, nil}, []int{0, 1, 2}},
+		// Comments wait for posts and users, whatever their size
+		{[]int64{1, 5, 100, 10}, [][]int{nil, {0}, {0, 1}, nil}, []int{0, 1, 2, 3}},
+		// Tables referencing each other are taken in their order
+		{[]int64{1, 5, 100}, [][]int{{1}, {0}, nil}, []int{2, 0, 1}},
+	} {
+		if order := scheduleOrder(tc.sizes, tc.deps); !slices.Equal(order, tc.expected) {
+			t.Errorf("sizes %v, deps %v: expected %v, got %v", tc.sizes, tc.deps, tc.expected, order)
+		}
+	}
+}
+
+func TestScheduleItems(t *testing.T) {
+	db := requireDB(t)
+
+	_, err := db.Exec(`CREATE TABLE schedule_test AS SELECT g AS id, repeat('x', 100) AS padding FROM generate_series(1, 10000) AS g`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec(`DROP TABLE schedule_test`) })
+
+	items := []ManifestItem{{Table: "users"}, {Table: "posts"}, {Table: "comments"}, {Table: "schedule_test"}}
+	order, err := scheduleItems(db, items)
+	if err != nil {
+		t.Fatalf("scheduleItems error: %v", err)
+	}
+	if !slices.Equal(order, []int{3, 0, 1, 2}) {
+		t.Errorf("expected the large table first, then the others after their dependencies, got %v", order)
+	}
+}
+
+func TestInTableTransaction_AfterTimeout(t *testing.T) {
+	db := requireDB(t)
+	pool, err := newWorkerPool(db, 1, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	worker := pool.workers[0]
+
+	// The first table is cut short by max_duration, keeping its rows
+	err = inTableTransaction(worker, DumpOptions{}, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := worker.ExecContext(ctx, "SELECT pg_sleep(10) FROM users")
+		if err == nil {
+			t.Error("expected the query to be canceled")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("inTableTransaction error: %v", err)
+	}
+
+	// The next table on the same worker still reads the snapshot
+	err = inTableTransaction(worker, DumpOptions{}, func() error {
+		var n int
+		_, err := worker.QueryOne(pg.Scan(&n), "SELECT count(*) FROM users")
+		return err
+	})
+	if err != nil {
+		t.Errorf("expected the next table to be read, got %v", err)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	pg "github.com/go-pg/pg/v10"
+	"github.com/parquet-go/parquet-go"
+)
+
+// parquetDumpWriter writes every dumped table to a parquet file of its own,
+// organized by schema like the directory format, with the logical types of
+// its columns.
+type parquetDumpWriter struct {
+	dir  string
+	db   *pg.DB
+	opts DumpOptions
+
+	// Table being written, its file, its column types and the positions of
+	// its columns in the parquet schema
+	table string
+	file  *os.File
+	w     *parquet.Writer
+	types []string
+	index []int
+}
+
+func newParquetDumpWriter(dir string, db *pg.DB, opts DumpOptions) *parquetDumpWriter {
+	return &parquetDumpWriter{dir: dir, db: db, opts: opts}
+}
+
+func (p *parquetDumpWriter) BeginDump(info *DumpInfo) error {
+	return os.MkdirAll(p.dir, 0777)
+}
+
+func (p *parquetDumpWriter) BeginTable(table string, query string, cols []string) error {
+	types, err := getColumnTypes(p.db, table)
+	if err != nil {
+		return err
+	}
+	return p.openTable(table, cols, types)
+}
+
+// openTable creates the parquet file of table, with the columns cols of the
+// given types.
+func (p *parquetDumpWriter) openTable(table string, cols []string, types map[string]string) error {
+	group := make(parquet.Group, len(cols))
+	p.types = make([]string, 0, len(cols))
+	for _, col := range cols {
+		p.types = append(p.types, types[col])
+		group[col] = parquet.Optional(parquetNode(types[col]))
+	}
+	_, name := splitTableName(table)
+	schema := parquet.NewSchema(name, group)
+	// Columns of the schema are sorted by name
+	p.index = make([]int, 0, len(cols))
+	for _, col := range cols {
+		leaf, _ := schema.Lookup(col)
+		p.index = append(p.index, leaf.ColumnIndex)
+	}
+
+	path := filepath.Join(p.dir, filepath.FromSlash(strings.TrimSuffix(tableFile(table), ".sql")+".parquet"))
+	err := os.MkdirAll(filepath.Dir(path), 0777)
+	if err != nil {
+		return err
+	}
+	p.file, err = os.Create(path)
+	if err != nil {
+		return err
+	}
+	p.table = table
+	p.w = parquet.NewWriter(p.file, schema, parquet.Compression(&parquet.Snappy))
+	return nil
+}
+
+func (p *parquetDumpWriter) WriteRow(row []*string) error {
+	values := make(parquet.Row, len(row))
+	for i, v := range row {
+		value := parquetValue(p.types[i], v)
+		if value.IsNull() {
+			values[p.index[i]] = value.Level(0, 0, p.index[i])
+		} else {
+			values[p.index[i]] = value.Level(0, 1, p.index[i])
+		}
+	}
+	_, err := p.w.WriteRows([]parquet.Row{values})
+	if err != nil {
+		return fmt.Errorf("table %s: %w", p.table, err)
+	}
+	return nil
+}
+
+func (p *parquetDumpWriter) EndTable(rows int, duration time.Duration) error {
+	err := p.w.Close()
+	if err != nil {
+		p.file.Close()
+		return err
+	}
+	return p.file.Close()
+}
+
+func (p *parquetDumpWriter) PostAction(sql string) error {
+	// Post actions are written for PostgreSQL
+	p.opts.warn("post action of %s skipped in the parquet files: %s", p.table, sql)
+	return nil
+}
+
+func (p *parquetDumpWriter) EndDump() error {
+	return nil
+}
+
+// parquetNode returns the parquet column storing values of a PostgreSQL type.
+// Types without a parquet counterpart, like numeric and arrays, are stored as
+// strings.
+func parquetNode(pgType string) parquet.Node {
+	switch pgType {
+	case "bool":
+		return parquet.Leaf(parquet.BooleanType)
+	case "int2":
+		return parquet.Int(16)
+	case "int4":
+		return parquet.Int(32)
+	case "int8", "oid":
+		return parquet.Int(64)
+	case "float4":
+		return parquet.Leaf(parquet.FloatType)
+	case "float8":
+		return parquet.Leaf(parquet.DoubleType)
+	case "date":
+		return parquet.Date()
+	case "time":
+		return parquet.TimeAdjusted(parquet.Microsecond, false)
+	case "timestamp":
+		return parquet.TimestampAdjusted(parquet.Microsecond, false)
+	case "timestamptz":
+		return parquet.Timestamp(parquet.Microsecond)
+	case "uuid":
+		return parquet.UUID()
+	case "json", "jsonb":
+		return parquet.JSON()
+	case "bytea":
+		return parquet.Leaf(parquet.ByteArrayType)
+	default:
+		return parquet.String()
+	}
+}
+
+// Layouts of timestamps with time zone in COPY text format, by precision of
+// the offset
+var timestamptzLayouts = []string{
+	"2006-01-02 15:04:05.999999-07",
+	"2006-01-02 15:04:05.999999-07:00",
+	"2006-01-02 15:04:05.999999-07:00:00",
+}
+
+// parquetValue converts a value of a PostgreSQL type, in COPY text format, to
+// the value of its parquet column. Values which can't be represented, like
+// infinite timestamps, are null.
+func parquetValue(pgType string, v *string) parquet.Value {
+	if v == nil {
+		return parquet.NullValue()
+	}
+	s := *v
+	switch pgType {
+	case "bool":
+		return parquet.BooleanValue(s == "t")
+	case "int2", "int4":
+		if n, err := strconv.ParseInt(s, 10, 32); err == nil {
+			return parquet.Int32Value(int32(n))
+		}
+	case "int8", "oid":
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return parquet.Int64Value(n)
+		}
+	case "float4":
+		if f, err := strconv.ParseFloat(s, 32); err == nil {
+			return parquet.FloatValue(float32(f))
+		}
+	case "float8":
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return parquet.DoubleValue(f)
+		}
+	case "date":
+		if t, err := time.Parse(time.DateOnly, s); err == nil {
+			return parquet.Int32Value(int32(t.Unix() / (24 * 60 * 60)))
+		}
+	case "time":
+		if t, err := time.Parse("15:04:05.999999", s); err == nil {
+			midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+			return parquet.Int64Value(t.Sub(midnight).Microseconds())
+		}
+	case "timestamp":
+		if t, err := time.Parse("2006-01-02 15:04:05.999999", s); err == nil {
+			return parquet.Int64Value(t.UnixMicro())
+		}
+	case "timestamptz":
+		for _, layout := range timestamptzLayouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				return parquet.Int64Value(t.UnixMicro())
+			}
+		}
+	case "uuid":
+		if b, err := hex.DecodeString(strings.ReplaceAll(s, "-", "")); err == nil && len(b) == 16 {
+			return parquet.FixedLenByteArrayValue(b)
+		}
+	case "bytea":
+		if b, err := hex.DecodeString(strings.TrimPrefix(s, `\x`)); err == nil {
+			return parquet.ByteArrayValue(b)
+		}
+	default:
+		return parquet.ByteArrayValue([]byte(s))
+	}
+	return parquet.NullValue()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestParquetDumpWriter(t *testing.T) {
+	dir := t.TempDir()
+	p := newParquetDumpWriter(dir, nil, DumpOptions{})
+	err := p.BeginDump(&DumpInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cols := []string{"id", "name", "active", "created_at"}
+	types := map[string]string{"id": "int4", "name": "varchar", "active": "bool", "created_at": "timestamp"}
+	err = p.openTable("billing.users", cols, types)
+	if err != nil {
+		t.Fatal(err)
+	}
+	str := func(s string) *string { return &s }
+	for _, row := range [][]*string{
+		{str("1"), str("alice"), str("t"), str("2024-01-01 10:00:00")},
+		{str("2"), nil, str("f"), str("infinity")},
+	} {
+		err := p.WriteRow(row)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = p.EndTable(2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type user struct {
+		ID        int32   `parquet:"id"`
+		Name      *string `parquet:"name,optional"`
+		Active    bool    `parquet:"active"`
+		CreatedAt *int64  `parquet:"created_at,optional"`
+	}
+	rows, err := parquet.ReadFile[user](filepath.Join(dir, "billing", "users.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := int64(1704103200000000)
+	expected := []user{{1, str("alice"), true, &created}, {2, nil, false, nil}}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("expected %+v, got %+v", expected, rows)
+	}
+}
+
+func TestParquetValue(t *testing.T) {
+	str := func(s string) *string { return &s }
+	for _, tc := range []struct {
+		pgType   string
+		v        *string
+		expected parquet.Value
+	}{
+		{"int8", str("9000000000"), parquet.Int64Value(9000000000)},
+		{"float8", str("1.5"), parquet.DoubleValue(1.5)},
+		{"date", str("1970-01-03"), parquet.Int32Value(2)},
+		{"date", str("infinity"), parquet.NullValue()},
+		{"time", str("01:00:00.5"), parquet.Int64Value(3600500000)},
+		{"timestamptz", str("1970-01-01 01:00:00+01"), parquet.Int64Value(0)},
+		{"timestamptz", str("1970-01-01 05:30:00+05:30"), parquet.Int64Value(0)},
+		{"uuid", str("00000000-0000-0000-0000-0000000000ff"), parquet.FixedLenByteArrayValue(append(make([]byte, 15), 0xff))},
+		{"numeric", str("1.50"), parquet.ByteArrayValue([]byte("1.50"))},
+		{"text", nil, parquet.NullValue()},
+	} {
+		if got := parquetValue(tc.pgType, tc.v); !parquet.Equal(got, tc.expected) || got.IsNull() != tc.expected.IsNull() {
+			t.Errorf("parquetValue(%q, %v) = %v, expected %v", tc.pgType, tc.v, got, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	pg "github.com/go-pg/pg/v10"
+)
+
+// placeholders make the placeholder replacing a value, in COPY text format,
+// by the type of its column. Placeholders tell the size of the original
+// value, which is what matters when it's missing.
+var placeholders = map[string]func(v string) string{
+	"bytea": func(v string) string {
+		size := len(v)
+		if strings.HasPrefix(v, `\x`) {
+			size = (len(v) - 2) / 2
+		}
+		return `\x` + hex.EncodeToString([]byte(placeholderText(size)))
+	},
+	"text":    textPlaceholder,
+	"varchar": textPlaceholder,
+	"bpchar":  textPlaceholder,
+	"xml":     textPlaceholder,
+	"json":    jsonPlaceholder,
+	"jsonb":   jsonPlaceholder,
+}
+
+func placeholderText(size int) string {
+	return fmt.Sprintf("placeholder of %d bytes", size)
+}
+
+func textPlaceholder(v string) string {
+	return placeholderText(len(v))
+}
+
+// jsonPlaceholder keeps objects and arrays what they are, empty, and replaces
+// other values with a string.
+func jsonPlaceholder(v string) string {
+	v = strings.TrimSpace(v)
+	switch {
+	case strings.HasPrefix(v, "{"):
+		return "{}"
+	case strings.HasPrefix(v, "["):
+		return "[]"
+	default:
+		return strconv.Quote(placeholderText(len(v)))
+	}
+}
+
+// typePlaceholders sets the column types of the placeholder transforms among
+// transforms of the columns of table, taking casts into account.
+func typePlaceholders(db *pg.DB, table string, transforms map[string]Transform, casts map[string]string) error {
+	var types map[string]string
+	for col, t := range transforms {
+		if t.Type != "placeholder" {
+			continue
+		}
+		if types == nil {
+			var err error
+			types, err = getColumnTypes(db, table)
+			if err != nil {
+				return err
+			}
+		}
+		t.columnType = types[col]
+		if typ, ok := casts[col]; ok {
+			t.columnType = strings.ToLower(strings.TrimSpace(typ))
+		}
+		transforms[col] = t
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPlaceholders(t *testing.T) {
+	for _, tc := range []struct {
+		typ      string
+		value    string
+		expected string
+	}{
+		{"text", strings.Repeat("a", 5000), "placeholder of 5000 bytes"},
+		{"varchar", "héllo", "placeholder of 6 bytes"},
+		{"bytea", `\x` + strings.Repeat("ff", 1024), `\x706c616365686f6c646572206f662031303234206279746573`},
+		{"bytea", "raw", `\x706c616365686f6c646572206f662033206279746573`},
+		{"jsonb", `{"a": [1, 2]}`, "{}"},
+		{"json", ` [1, 2]`, "[]"},
+		{"jsonb", `"long string"`, `"placeholder of 13 bytes"`},
+	} {
+		if out := placeholders[tc.typ](tc.value); out != tc.expected {
+			t.Errorf("%s %q: expected %q, got %q", tc.typ, tc.value, tc.expected, out)
+		}
+	}
+}
+
+func TestCopyTransformer_Placeholder(t *testing.T) {
+	var buf bytes.Buffer
+	cols := []string{"id", "content", "meta"}
+	specs := map[string]Transform{
+		"content": {Type: "placeholder", columnType: "bytea"},
+		"meta":    {Type: "placeholder", columnType: "jsonb"},
+	}
+	tr, err := newCopyTransformer(&buf, cols, specs)
+	if err != nil {
+		t.Fatalf("newCopyTransformer error: %v", err)
+	}
+	_, err = tr.Write([]byte("1\t\\\\x0102\t{\"size\": 2}\n2\t\\N\t\\N\n"))
+	if err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+	expected := "1\t\\\\x706c616365686f6c646572206f662032206279746573\t{}\n2\t\\N\t\\N\n"
+	if out := buf.String(); out != expected {
+		t.Errorf("unexpected output:\n got: %q\nwant: %q", out, expected)
+	}
+
+	_, err = newCopyTransformer(&buf, cols, map[string]Transform{"id": {Type: "placeholder", columnType: "int4"}})
+	if err == nil || !strings.Contains(err.Error(), `placeholder doesn't support columns of type "int4"`) {
+		t.Errorf("expected integer columns to be rejected, got %v", err)
+	}
+}
+
+func TestMakeDump_Placeholder(t *testing.T) {
+	db := requireDB(t)
+
+	manifest := &Manifest{Tables: []ManifestItem{{
+		Table:      "posts",
+		Columns:    []string{"id", "title", "body"},
+		Casts:      map[string]string{"title": "bytea"},
+		Transforms: map[string]Transform{"title": {Type: "placeholder"}, "body": {Type: "placeholder"}},
+	}}}
+	var buf bytes.Buffer
+	err := makeDump(db, manifest, &buf, DumpOptions{})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "\t\\\\x706c616365686f6c646572206f66") || !strings.Contains(out, "\tplaceholder of ") {
+		t.Errorf("expected titles and bodies to be replaced with placeholders, got:\n%s", out)
+	}
+}
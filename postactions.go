@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"maps"
+	"math/big"
+	"slices"
+	"strconv"
+
+	"github.com/cbroglie/mustache"
+	pg "github.com/go-pg/pg/v10"
+)
+
+// Vars of post actions computed from the dumped rows of their table
+const (
+	ROWS_VAR   = "rows"
+	MAX_ID_VAR = "max_id"
+)
+
+// checkPostActions checks that the post actions of a manifest item are valid
+// templates.
+func checkPostActions(v ManifestItem) error {
+	for _, sql := range v.PostActions {
+		_, err := mustache.ParseStringRaw(sql, true)
+		if err != nil {
+			return fmt.Errorf("post action %q: %v", sql, err)
+		}
+	}
+	return nil
+}
+
+// usesVar tells whether any of the templates has a placeholder of the var.
+func usesVar(templates []string, name string) bool {
+	for _, text := range templates {
+		tmpl, err := mustache.ParseStringRaw(text, true)
+		if err != nil {
+			continue
+		}
+		for _, tag := range tmpl.Tags() {
+			if tag.Type() == mustache.Variable && tag.Name() == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// renderPostActions returns the post actions of a manifest item whose rows
+// were dumped as prepared by q, with the placeholders of its vars replaced.
+// Besides its vars, post actions may use the number of dumped rows and the
+// highest dumped primary key, NULL if no row was dumped.
+func renderPostActions(v ManifestItem, q *itemQuery, rows int) ([]string, error) {
+	if len(v.PostActions) == 0 {
+		return v.PostActions, nil
+	}
+	vars := maps.Clone(v.Vars)
+	if vars == nil {
+		vars = make(Vars)
+	}
+	vars[ROWS_VAR] = strconv.Itoa(rows)
+	if q.maxKey != nil {
+		if q.maxKey.err != nil {
+			return nil, fmt.Errorf("table %s: %s: %v", v.Table, MAX_ID_VAR, q.maxKey.err)
+		}
+		vars[MAX_ID_VAR] = "NULL"
+		if q.maxKey.max != nil {
+			vars[MAX_ID_VAR] = q.maxKey.max.String()
+		}
+	}
+
+	actions := make([]string, 0, len(v.PostActions))
+	for _, sql := range v.PostActions {
+		action, err := mustache.RenderRaw(sql, true, vars)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, action)
+	}
+	return actions, nil
+}
+
+// maxKeyWriter records the highest integer key of the rows in the COPY data
+// passing through it, the column at pos.
+type maxKeyWriter struct {
+	w    io.Writer
+	pos  int
+	max  *big.Int
+	err  error
+	line []byte
+}
+
+func (m *maxKeyWriter) Write(p []byte) (int, error) {
+	m.line = append(m.line, p...)
+	for {
+		end := bytes.IndexByte(m.line, '\n')
+		if end == -1 {
+			break
+		}
+		key := decodeCopyRow(string(m.line[:end]))[m.pos]
+		m.line = m.line[end+1:]
+		if key == nil || m.err != nil {
+			continue
+		}
+		n, ok := new(big.Int).SetString(*key, 10)
+		if !ok {
+			m.err = fmt.Errorf("key %q isn't an integer", *key)
+			continue
+		}
+		if m.max == nil || n.Cmp(m.max) > 0 {
+			m.max = n
+		}
+	}
+	return m.w.Write(p)
+}
+
+// resetSequences returns post actions setting the sequences owned by the
+// dumped columns of a manifest item past the highest loaded value, or back
+// to their start if the table is empty.
+func resetSequences(db *pg.DB, v ManifestItem) ([]string, error) {
+	sequences, err := getOwnedSequences(db, v.Table)
+	if err != nil {
+		return nil, err
+	}
+	actions := make([]string, 0, len(sequences))
+	for _, seq := range sequences {
+		if len(v.Columns) > 0 && !slices.Contains(v.Columns, seq.Column) {
+			continue
+		}
+		start, err := getSequenceStart(db, seq.Name)
+		if err != nil {
+			return nil, err
+		}
+		col := quoteIdent(seq.Column)
+		actions = append(actions, fmt.Sprintf("SELECT pg_catalog.setval(%s, COALESCE(max(%s), %d), max(%s) IS NOT NULL) FROM %s",
+			quoteLiteral(seq.Name), col, start, col, v.Table))
+	}
+	return actions, nil
+}
+
+// getSequenceStart returns the start value of a sequence.
+func getSequenceStart(db *pg.DB, seq string) (int64, error) {
+	var start int64
+	// Before PostgreSQL 10 sequences were read like tables
+	if serverVersion(db) < PG10 {
+		_, err := db.QueryOne(pg.Scan(&start), `SELECT start_value FROM `+seq)
+		return start, err
+	}
+	_, err := db.QueryOne(pg.Scan(&start), `SELECT seqstart FROM pg_catalog.pg_sequence WHERE seqrelid = ?::regclass`, seq)
+	return start, err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+)
+
+func TestRenderPostActions(t *testing.T) {
+	manifest := &Manifest{Vars: Vars{"cutoff": "2024-01-01", "role": "qa"}}
+	v := ManifestItem{
+		Table:       "events",
+		Vars:        Vars{"cutoff": "2024-06-01"},
+		PostActions: []string{"DELETE FROM events WHERE created_at < '{{cutoff}}'", "ALTER TABLE events OWNER TO {{role}}"},
+	}
+	v.Vars = itemVars(manifest, v)
+	actions, err := renderPostActions(v, &itemQuery{}, 0)
+	if err != nil {
+		t.Fatalf("renderPostActions error: %v", err)
+	}
+	expected := []string{"DELETE FROM events WHERE created_at < '2024-06-01'", "ALTER TABLE events OWNER TO qa"}
+	if !slices.Equal(actions, expected) {
+		t.Errorf("expected %q, got %q", expected, actions)
+	}
+	if manifest.Vars["cutoff"] != "2024-01-01" {
+		t.Errorf("the vars of the manifest were changed: %v", manifest.Vars)
+	}
+}
+
+func TestRenderPostActions_Computed(t *testing.T) {
+	v := ManifestItem{
+		Table:       "users",
+		PostActions: []string{"SELECT setval('users_id_seq', {{max_id}})", "-- {{rows}} rows"},
+	}
+	if !usesVar(v.PostActions, MAX_ID_VAR) || usesVar(v.PostActions[1:], MAX_ID_VAR) {
+		t.Errorf("expected only the first post action to use %s", MAX_ID_VAR)
+	}
+
+	var buf bytes.Buffer
+	q := &itemQuery{maxKey: &maxKeyWriter{w: &buf, pos: 1}}
+	actions, err := renderPostActions(v, q, 0)
+	if err != nil {
+		t.Fatalf("renderPostActions error: %v", err)
+	}
+	expected := []string{"SELECT setval('users_id_seq', NULL)", "-- 0 rows"}
+	if !slices.Equal(actions, expected) {
+		t.Errorf("expected %q, got %q", expected, actions)
+	}
+
+	for _, p := range []string{"alice\t9\n", "bob\t12", "\ncarol\t\\N\ndave\t10\n"} {
+		q.maxKey.Write([]byte(p))
+	}
+	actions, err = renderPostActions(v, q, 4)
+	if err != nil {
+		t.Fatalf("renderPostActions error: %v", err)
+	}
+	expected = []string{"SELECT setval('users_id_seq', 12)", "-- 4 rows"}
+	if !slices.Equal(actions, expected) {
+		t.Errorf("expected %q, got %q", expected, actions)
+	}
+	if buf.String() != "alice\t9\nbob\t12\ncarol\t\\N\ndave\t10\n" {
+		t.Errorf("unexpected COPY data %q", buf.String())
+	}
+
+	q.maxKey.Write([]byte("erin\tabc\n"))
+	_, err = renderPostActions(v, q, 5)
+	if err == nil {
+		t.Error("expected an error for a key which isn't an integer")
+	}
+}
+
+func TestCheckPostActions(t *testing.T) {
+	err := checkPostActions(ManifestItem{PostActions: []string{"SELECT {{#unclosed}}"}})
+	if err == nil {
+		t.Error("expected an error for an invalid template")
+	}
+}
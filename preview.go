@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	pg "github.com/go-pg/pg/v10"
+)
+
+// previewTable prints the first n rows the manifest would dump for table,
+// with transforms applied, as a table.
+func previewTable(w io.Writer, db *pg.DB, manifest *Manifest, table string, n int) error {
+	err := setAsOf(db, manifest)
+	if err != nil {
+		return err
+	}
+	err = evalVarsSQL(db, manifest)
+	if err != nil {
+		return err
+	}
+	if manifest.Seed != nil {
+		err := expandSeed(db, manifest)
+		if err != nil {
+			return err
+		}
+	}
+
+	resolved, err := resolveTable(db, table)
+	if err != nil {
+		return err
+	}
+	var item *ManifestItem
+	for i, v := range manifest.Tables {
+		name, err := resolveTable(db, v.Table)
+		if err != nil {
+			return err
+		}
+		if name == resolved {
+			item = &manifest.Tables[i]
+			break
+		}
+	}
+	if item == nil {
+		return fmt.Errorf("table %s is not in the manifest", table)
+	}
+
+	var buf bytes.Buffer
+	q, err := prepareItem(&buf, db, manifest, *item, DumpOptions{})
+	if err != nil {
+		return err
+	}
+	query := q.Query
+	if query == "" {
+		query = fmt.Sprintf("SELECT * FROM %s", item.Table)
+	}
+	_, err = dumpTable(q.Data, db, fmt.Sprintf("(SELECT * FROM (%s) AS p LIMIT %d)", query, n))
+	if err != nil {
+		return err
+	}
+
+	writePreview(w, q.Cols, buf.String())
+	return nil
+}
+
+// writePreview formats COPY text format data as an aligned table.
+func writePreview(w io.Writer, cols []string, data string) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(cols, "\t"))
+	separators := make([]string, 0, len(cols))
+	for _, col := range cols {
+		separators = append(separators, strings.Repeat("-", len(col)))
+	}
+	fmt.Fprintln(tw, strings.Join(separators, "\t"))
+
+	rows := 0
+	for _, line := range strings.Split(data, "\n") {
+		if line == "" {
+			continue
+		}
+		values := make([]string, 0, len(cols))
+		for _, v := range decodeCopyRow(line) {
+			if v == nil {
+				values = append(values, "NULL")
+				continue
+			}
+			// Keep every row on a single line
+			values = append(values, encodeCopyValue(*v))
+		}
+		fmt.Fprintln(tw, strings.Join(values, "\t"))
+		rows++
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "(%d rows)\n", rows)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWritePreview(t *testing.T) {
+	var buf bytes.Buffer
+	writePreview(&buf, []string{"id", "name", "bio"}, "1\tAlice\t\\N\n2\tBob\tline\\none\n")
+
+	lines := strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("expected header, separator, 2 rows and a count, got:\n%s", buf.String())
+	}
+	if strings.Fields(lines[0])[1] != "name" || !strings.HasPrefix(lines[1], "--") {
+		t.Errorf("unexpected header:\n%s", buf.String())
+	}
+	if !strings.Contains(lines[2], "NULL") {
+		t.Errorf("NULL should be shown as NULL, got %q", lines[2])
+	}
+	if !strings.Contains(lines[3], `line\none`) {
+		t.Errorf("newlines should be escaped, got %q", lines[3])
+	}
+	// Columns are aligned
+	if strings.Index(lines[2], "Alice") != strings.Index(lines[0], "name") {
+		t.Errorf("columns should be aligned, got:\n%s", buf.String())
+	}
+	if lines[4] != "(2 rows)" {
+		t.Errorf("expected a row count, got %q", lines[4])
+	}
+}
+
+func TestPreviewTable(t *testing.T) {
+	db := requireDB(t)
+
+	manifest := &Manifest{Tables: []ManifestItem{{
+		Table:      "users",
+		Query:      "SELECT * FROM users ORDER BY id",
+		Transforms: map[string]Transform{"email": {Type: "redact"}},
+	}}}
+
+	var buf bytes.Buffer
+	err := previewTable(&buf, db, manifest, "public.users", 2)
+	if err != nil {
+		t.Fatalf("previewTable error: %v", err)
+	}
+
+	out := buf.String()
+	if !strings.Contains(out, "REDACTED") || strings.Contains(out, "alice@example.com") {
+		t.Errorf("preview should apply transforms, got:\n%s", out)
+	}
+	if !strings.Contains(out, "(2 rows)") {
+		t.Errorf("preview should be limited to 2 rows, got:\n%s", out)
+	}
+
+	err = previewTable(&buf, db, manifest, "posts", 2)
+	if err == nil {
+		t.Error("expected an error for a table not in the manifest")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	pg "github.com/go-pg/pg/v10"
+)
+
+// tablePrivileges tells what the role connected to the database may read of
+// a table.
+type tablePrivileges struct {
+	Schema     string
+	Usage      bool
+	Select     bool
+	DeniedCols []string `pg:",array"`
+}
+
+// getTablePrivileges returns the privileges of the current role on table,
+// and the columns of cols it can't select if it can't select the whole table.
+func getTablePrivileges(db *pg.DB, table string, cols []string) (*tablePrivileges, error) {
+	var priv tablePrivileges
+	sql := `
+		SELECT
+			n.nspname AS schema,
+			has_schema_privilege(n.oid, 'USAGE') AS usage,
+			has_table_privilege(c.oid, 'SELECT') AS "select",
+			ARRAY(
+				SELECT col
+				FROM unnest(?::text[]) AS col
+				WHERE NOT has_column_privilege(c.oid, col, 'SELECT')
+			) AS denied_cols
+		FROM pg_catalog.pg_class c
+		JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.oid = ?::regclass
+	`
+	_, err := db.QueryOne(&priv, sql, pg.Array(cols), table)
+	if err != nil {
+		return nil, err
+	}
+	return &priv, nil
+}
+
+// checkPrivileges reports the tables of items the role connected to db
+// can't read, before the dump fails on the first of them.
+func checkPrivileges(db *pg.DB, items []ManifestItem) ([]string, error) {
+	findings := make([]string, 0)
+	for _, v := range items {
+		// Sampling queries select all the columns
+		cols, err := getTableCols(db, v.Table)
+		if err != nil {
+			return nil, err
+		}
+		priv, err := getTablePrivileges(db, v.Table, cols)
+		if err != nil {
+			return nil, err
+		}
+		if finding := privilegeFinding(v.Table, priv); finding != "" {
+			findings = append(findings, finding)
+		}
+	}
+	return findings, nil
+}
+
+// privilegeFinding describes why the table can't be read with priv, or
+// returns an empty string if it can.
+func privilegeFinding(table string, priv *tablePrivileges) string {
+	switch {
+	case !priv.Usage:
+		return fmt.Sprintf("table %s can't be read without USAGE on schema %s", table, priv.Schema)
+	case priv.Select:
+		return ""
+	case len(priv.DeniedCols) > 0:
+		return fmt.Sprintf("table %s can't be read without SELECT on it or on columns %s", table, strings.Join(priv.DeniedCols, ", "))
+	default:
+		// All the columns are granted one by one
+		return ""
+	}
+}
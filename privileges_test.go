@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestPrivilegeFinding(t *testing.T) {
+	tests := []struct {
+		priv     tablePrivileges
+		expected string
+	}{
+		{tablePrivileges{Schema: "public", Usage: true, Select: true}, ""},
+		{tablePrivileges{Schema: "billing", Select: true}, "table billing.invoices can't be read without USAGE on schema billing"},
+		{tablePrivileges{Schema: "billing", Usage: true, DeniedCols: []string{"total", "notes"}}, "table billing.invoices can't be read without SELECT on it or on columns total, notes"},
+		{tablePrivileges{Schema: "billing", Usage: true}, ""},
+	}
+	for _, tt := range tests {
+		if got := privilegeFinding("billing.invoices", &tt.priv); got != tt.expected {
+			t.Errorf("privilegeFinding(%+v) = %q, want %q", tt.priv, got, tt.expected)
+		}
+	}
+}
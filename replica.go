@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	pg "github.com/go-pg/pg/v10"
+)
+
+// replicaStatus tells whether the server is a standby and how far behind its
+// primary it is. A standby that has replayed all the WAL it received has no
+// lag, even if the last replayed transaction is old because the primary is
+// idle.
+func replicaStatus(db *pg.DB) (bool, time.Duration, error) {
+	var model struct {
+		InRecovery bool
+		Lag        float64
+	}
+	receive, replay := "pg_last_wal_receive_lsn()", "pg_last_wal_replay_lsn()"
+	if serverVersion(db) < PG10 {
+		receive, replay = "pg_last_xlog_receive_location()", "pg_last_xlog_replay_location()"
+	}
+	sql := `
+		SELECT
+			pg_is_in_recovery() AS in_recovery,
+			CASE
+				WHEN NOT pg_is_in_recovery() THEN 0
+				WHEN ` + receive + ` = ` + replay + ` THEN 0
+				ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+			END AS lag
+	`
+	_, err := db.QueryOne(&model, sql)
+	if err != nil {
+		return false, 0, err
+	}
+	return model.InRecovery, time.Duration(model.Lag * float64(time.Second)), nil
+}
+
+// checkReplica enforces the replica policy: with requireReplica the server
+// must be a standby, and a standby mustn't lag behind its primary by more
+// than maxLag, if given.
+func checkReplica(inRecovery bool, lag time.Duration, requireReplica bool, maxLag time.Duration) error {
+	if requireReplica && !inRecovery {
+		return fmt.Errorf("the server is a primary, not a read replica")
+	}
+	if inRecovery && maxLag > 0 && lag > maxLag {
+		return fmt.Errorf("the replica is %v behind its primary, more than the maximum of %v", lag.Round(time.Second), maxLag)
+	}
+	return nil
+}
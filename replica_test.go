@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckReplica(t *testing.T) {
+	for _, tc := range []struct {
+		inRecovery     bool
+		lag            time.Duration
+		requireReplica bool
+		maxLag         time.Duration
+		ok             bool
+	}{
+		{false, 0, false, 0, true},
+		{false, 0, true, 0, false},
+		{true, 0, true, 0, true},
+		{true, time.Minute, true, 0, true},
+		{true, 10 * time.Second, true, 30 * time.Second, true},
+		{true, time.Minute, true, 30 * time.Second, false},
+		{true, time.Minute, false, 30 * time.Second, false},
+		{false, 0, false, 30 * time.Second, true},
+	} {
+		err := checkReplica(tc.inRecovery, tc.lag, tc.requireReplica, tc.maxLag)
+		if (err == nil) != tc.ok {
+			t.Errorf("checkReplica(%v, %v, %v, %v) = %v, expected ok=%v", tc.inRecovery, tc.lag, tc.requireReplica, tc.maxLag, err, tc.ok)
+		}
+	}
+}
+
+func TestReplicaStatus(t *testing.T) {
+	db := requireDB(t)
+
+	inRecovery, lag, err := replicaStatus(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inRecovery || lag != 0 {
+		t.Errorf("expected a primary without lag, got inRecovery=%v lag=%v", inRecovery, lag)
+	}
+}
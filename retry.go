@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	pg "github.com/go-pg/pg/v10"
+)
+
+// keepAliveDialer returns a dialer enabling TCP keepalives with the given
+// period, so that idle connections waiting for a slow query aren't dropped by
+// firewalls or load balancers. A zero period disables keepalives.
+func keepAliveDialer(period time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if period == 0 {
+		period = -1
+	}
+	dialer := net.Dialer{Timeout: 5 * time.Second, KeepAlive: period}
+	return dialer.DialContext
+}
+
+// isConnectionError tells whether err is a lost connection, as opposed to an
+// error reported by the server.
+func isConnectionError(err error) bool {
+	var pgErr pg.Error
+	if errors.As(err, &pgErr) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// retry calls f until it succeeds, fails with an error other than a lost
+// connection or has been retried opts.Retries times. The pool replaces lost
+// connections, so every retry runs on a new one.
+func retry(opts DumpOptions, table string, f func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := f()
+		// Connections ended by the lock guard aren't retried
+		if err == nil || attempt >= opts.Retries || !isConnectionError(err) || opts.locks.err() != nil {
+			return err
+		}
+		opts.warn("connection lost while dumping %s, retrying (%d/%d): %v", table, attempt+1, opts.Retries, err)
+	}
+}
+
+// dumpItemRetrying dumps a manifest item like dumpItem, retrying it if the
+// connection is lost. The data is buffered in an encrypted temporary file, so
+// that only complete tables are written to dw.
+func dumpItemRetrying(dw DumpWriter, db *pg.DB, manifest *Manifest, v ManifestItem, opts DumpOptions) error {
+	if opts.Retries == 0 {
+		return dumpItem(dw, db, manifest, v, opts)
+	}
+
+	tmp, err := createTempFile("pg_dump_sample-*.sql")
+	if err != nil {
+		return err
+	}
+	defer tmp.Close()
+
+	var b *bufferedItem
+	err = retry(opts, v.Table, func() error {
+		err := tmp.Truncate()
+		if err != nil {
+			return err
+		}
+		b, err = bufferItem(tmp, db, manifest, v, opts, copyItem)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = tmp.Rewind()
+	if err != nil {
+		return err
+	}
+	return writeItem(dw, v, b, tmp, opts)
+}
+
+// bufferedItem describes the data of a manifest item buffered before being
+// written to the dump.
+type bufferedItem struct {
+	q        *itemQuery
+	rows     int
+	duration time.Duration
+}
+
+// bufferItem writes the COPY data of a manifest item to w, copying it with
+// copy.
+func bufferItem(w io.Writer, db *pg.DB, manifest *Manifest, v ManifestItem, opts DumpOptions, copy func(db *pg.DB, table string, q *itemQuery) (int, error)) (*bufferedItem, error) {
+	q, err := prepareItem(w, db, manifest, v, opts)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	rows, err := copy(db, v.Table, q)
+	if err != nil {
+		return nil, err
+	}
+	return &bufferedItem{q, rows, time.Since(start)}, nil
+}
+
+// writeItem writes a manifest item whose data was buffered by bufferItem in r
+// to dw.
+func writeItem(dw DumpWriter, v ManifestItem, b *bufferedItem, r io.Reader, opts DumpOptions) error {
+	err := dw.BeginTable(v.Table, b.q.Source, b.q.Cols)
+	if err != nil {
+		return err
+	}
+	err = writeRows(dw, r)
+	if err != nil {
+		return err
+	}
+	return endItem(dw, v, b.q, b.rows, b.duration, opts)
+}
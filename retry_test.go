@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestIsConnectionError(t *testing.T) {
+	for _, tc := range []struct {
+		err      error
+		expected bool
+	}{
+		{io.EOF, true},
+		{fmt.Errorf("copy: %w", io.ErrUnexpectedEOF), true},
+		{syscall.ECONNRESET, true},
+		{&net.OpError{Op: "read", Err: errors.New("i/o timeout")}, true},
+		{errors.New(`relation "nope" does not exist`), false},
+	} {
+		if isConnectionError(tc.err) != tc.expected {
+			t.Errorf("isConnectionError(%v): expected %v", tc.err, tc.expected)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var warnings []string
+	opts := DumpOptions{Retries: 2, warnFunc: func(msg string) { warnings = append(warnings, msg) }}
+
+	calls := 0
+	err := retry(opts, "users", func() error {
+		calls++
+		if calls < 3 {
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("expected success on the third attempt, got %v after %d calls", err, calls)
+	}
+	if len(warnings) != 2 || !strings.HasPrefix(warnings[0], "connection lost while dumping users, retrying (1/2)") {
+		t.Errorf("expected a warning for every retry, got %q", warnings)
+	}
+
+	calls = 0
+	err = retry(opts, "users", func() error {
+		calls++
+		return io.ErrUnexpectedEOF
+	})
+	if err == nil || calls != 3 {
+		t.Errorf("expected failure after 3 attempts, got %v after %d calls", err, calls)
+	}
+
+	calls = 0
+	err = retry(opts, "users", func() error {
+		calls++
+		return errors.New("syntax error")
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("errors other than lost connections should not be retried, got %d calls", calls)
+	}
+}
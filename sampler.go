@@ -0,0 +1,341 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cbroglie/mustache"
+	pg "github.com/go-pg/pg/v10"
+)
+
+// Sampler chooses the rows of a table to be dumped. It returns the SELECT
+// statement producing them, or an empty string to dump the whole table.
+type Sampler interface {
+	Query(db *pg.DB, table string) (string, error)
+}
+
+// Sample selects a random sample of a table's rows with TABLESAMPLE.
+type Sample struct {
+	// Percentage of the rows to sample
+	Percent float64 `yaml:"percent"`
+	// Sampling method, bernoulli (default) or system
+	Method string `yaml:"method,omitempty"`
+	// Seed making the sample the same on every run
+	Repeatable *int `yaml:"repeatable,omitempty"`
+	// SQL expression, e.g. a column, the chance of rows to be sampled is
+	// proportional to
+	WeightBy string `yaml:"weight_by,omitempty"`
+}
+
+// SampleHash keeps the rows whose key falls into the first buckets of a hash,
+// the same rows on every run and, across tables sharing the key, the rows of
+// the same keys.
+type SampleHash struct {
+	// Column hashed or, with Parent, the column referencing the parent
+	Column string `yaml:"column,omitempty"`
+	// Number of buckets the values of the column are hashed into
+	Buckets int `yaml:"buckets,omitempty"`
+	// Number of buckets whose rows are kept
+	Keep int `yaml:"keep,omitempty"`
+	// Table of the manifest with a sample_hash the rows follow, keeping
+	// the rows referencing the kept rows of the parent
+	Parent string `yaml:"parent,omitempty"`
+}
+
+// PerParent keeps the first rows of every parent, e.g. the latest orders of
+// every customer.
+type PerParent struct {
+	// Columns referencing the parent, an SQL PARTITION BY list
+	Key string `yaml:"key"`
+	// Number of rows kept for every parent
+	Limit int `yaml:"limit"`
+	// SQL ORDER BY list telling which rows come first, the primary key by
+	// default
+	OrderBy string `yaml:"order_by,omitempty"`
+}
+
+// samplerFor returns the sampler of a manifest item: the one set on the item,
+// if any, otherwise the one described by its manifest entry.
+func samplerFor(manifest *Manifest, v ManifestItem) (Sampler, error) {
+	var sampler Sampler = wholeTableSampler{}
+	switch {
+	case v.Sampler != nil:
+		sampler = v.Sampler
+	case v.Query != "" && v.Sample != nil:
+		return nil, fmt.Errorf("`query` and `sample` can't be used together")
+	case v.Query != "":
+		sampler = querySampler{v.Query, itemVars(manifest, v)}
+	case v.Sample != nil:
+		method := strings.ToUpper(v.Sample.Method)
+		if method == "" {
+			method = "BERNOULLI"
+		}
+		if method != "BERNOULLI" && method != "SYSTEM" {
+			return nil, fmt.Errorf("unknown sample method %q", v.Sample.Method)
+		}
+		if v.Sample.Percent <= 0 || v.Sample.Percent > 100 {
+			return nil, fmt.Errorf("sample percent must be between 0 and 100")
+		}
+		if v.Sample.WeightBy != "" {
+			if method != "BERNOULLI" {
+				return nil, fmt.Errorf("weight_by can't be used with the %s method", v.Sample.Method)
+			}
+			sampler = weightedSampler{v.Sample.WeightBy, v.Sample.Percent, v.Sample.Repeatable}
+			break
+		}
+		sampler = tableSampler{method, v.Sample.Percent, v.Sample.Repeatable}
+	}
+
+	if v.SampleHash != nil {
+		path, spec, err := hashPath(manifest, v)
+		if err != nil {
+			return nil, err
+		}
+		if spec.Column == "" {
+			return nil, fmt.Errorf("sample_hash requires a column")
+		}
+		if spec.Buckets < 1 {
+			return nil, fmt.Errorf("sample_hash buckets must be at least 1")
+		}
+		if spec.Keep < 1 || spec.Keep > spec.Buckets {
+			return nil, fmt.Errorf("sample_hash keep must be between 1 and the number of buckets")
+		}
+		sampler = hashSampler{sampler, path, spec.Buckets, spec.Keep}
+	}
+
+	if v.PerParent != nil {
+		if v.PerParent.Key == "" {
+			return nil, fmt.Errorf("per_parent requires a key")
+		}
+		if v.PerParent.Limit < 1 {
+			return nil, fmt.Errorf("per_parent limit must be at least 1")
+		}
+		sampler = perParentSampler{sampler, *v.PerParent, v.Columns}
+	}
+
+	return sampler, nil
+}
+
+// wholeTableSampler dumps every row of the table.
+type wholeTableSampler struct{}
+
+func (wholeTableSampler) Query(db *pg.DB, table string) (string, error) {
+	return "", nil
+}
+
+// querySampler dumps the rows returned by a manifest query, after replacing
+// the vars placeholders.
+type querySampler struct {
+	query string
+	vars  map[string]string
+}
+
+func (s querySampler) Query(db *pg.DB, table string) (string, error) {
+	return mustache.RenderRaw(s.query, true, s.vars)
+}
+
+// tableSampler dumps a random sample of the table.
+type tableSampler struct {
+	method     string
+	percent    float64
+	repeatable *int
+}
+
+func (s tableSampler) Query(db *pg.DB, table string) (string, error) {
+	query := fmt.Sprintf("SELECT * FROM %s TABLESAMPLE %s (%g)", table, s.method, s.percent)
+	if s.repeatable != nil {
+		query += fmt.Sprintf(" REPEATABLE (%d)", *s.repeatable)
+	}
+	return query, nil
+}
+
+// weightedSampler dumps a random sample of the table in which the chance of
+// every row to be sampled is proportional to its weight. Rows of average
+// weight are sampled with the sample's percentage, heavier rows more often, up
+// to always, and rows without a positive weight never.
+type weightedSampler struct {
+	weightBy   string
+	percent    float64
+	repeatable *int
+}
+
+func (s weightedSampler) Query(db *pg.DB, table string) (string, error) {
+	weight := fmt.Sprintf("greatest(coalesce(%s, 0), 0)", s.weightBy)
+	random := "random()"
+	if s.repeatable != nil {
+		// Rows draw the same number on every run, derived from their
+		// contents and the seed
+		random = fmt.Sprintf("(('x' || left(md5(w::text || ':%d'), 8))::bit(32)::bigint / 4294967296.0)", *s.repeatable)
+	}
+	return fmt.Sprintf("SELECT * FROM %s AS w WHERE %s * (SELECT avg(%s) FROM %s AS w) < %g / 100 * %s",
+		table, random, weight, table, s.percent, weight), nil
+}
+
+// hashSampler keeps the rows chosen by another sampler whose key hashes into
+// the kept buckets. The hash is taken from the MD5 of the key as text, which
+// is the same on every server and for keys of different integer types.
+type hashSampler struct {
+	sampler Sampler
+	// Tables from the sampled table to the one whose column is hashed,
+	// each referencing the next
+	path    []hashLink
+	buckets int
+	keep    int
+}
+
+// hashLink is a table of the path of a hashSampler with its column: the
+// column referencing the next table, if there is a choice, or the column
+// hashed for the last table.
+type hashLink struct {
+	table  string
+	column string
+}
+
+// hashPath returns the path from the table of v to the table whose
+// sample_hash its rows follow, by way of the parents of the sample_hash,
+// and that sample_hash.
+func hashPath(manifest *Manifest, v ManifestItem) ([]hashLink, *SampleHash, error) {
+	path := make([]hashLink, 0, 1)
+	table, spec := v.Table, v.SampleHash
+	for spec.Parent != "" {
+		if spec.Buckets != 0 || spec.Keep != 0 {
+			return nil, nil, fmt.Errorf("sample_hash of %s takes buckets and keep from its parent", table)
+		}
+		path = append(path, hashLink{table, spec.Column})
+		parent := findItem(manifest, spec.Parent)
+		if parent == nil || parent.SampleHash == nil {
+			return nil, nil, fmt.Errorf("sample_hash parent %s isn't in the manifest with a sample_hash", spec.Parent)
+		}
+		for _, link := range path {
+			if link.table == parent.Table {
+				return nil, nil, fmt.Errorf("sample_hash parents of %s reference each other", v.Table)
+			}
+		}
+		table, spec = parent.Table, parent.SampleHash
+	}
+	return append(path, hashLink{table, spec.Column}), spec, nil
+}
+
+func (s hashSampler) Query(db *pg.DB, table string) (string, error) {
+	source, err := s.sampler.Query(db, table)
+	if err != nil {
+		return "", err
+	}
+	if source == "" {
+		source = fmt.Sprintf("SELECT * FROM %s", table)
+	}
+	key, err := s.key(db, 0, "h")
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("SELECT * FROM (%s) AS h WHERE %s %% %d < %d",
+		source, keyHash(key), s.buckets, s.keep), nil
+}
+
+// key returns the SQL expression of the value hashed for the row alias of
+// the i-th table of the path, looking it up in the tables after it.
+func (s hashSampler) key(db *pg.DB, i int, alias string) (string, error) {
+	link := s.path[i]
+	if i == len(s.path)-1 {
+		return alias + "." + quoteIdent(link.column), nil
+	}
+
+	parent := s.path[i+1].table
+	fk, err := parentForeignKey(db, link.table, parent, link.column)
+	if err != nil {
+		return "", err
+	}
+	parentAlias := fmt.Sprintf("h%d", i+1)
+	key, err := s.key(db, i+1, parentAlias)
+	if err != nil {
+		return "", err
+	}
+	// The referenced value is the referencing one, no need to look it up
+	if key == parentAlias+"."+quoteIdent(fk.RefColumns[0]) {
+		return alias + "." + quoteIdent(fk.Columns[0]), nil
+	}
+	return fmt.Sprintf("(SELECT %s FROM %s AS %s WHERE %s.%s = %s.%s)",
+		key, parent, parentAlias, parentAlias, quoteIdent(fk.RefColumns[0]), alias, quoteIdent(fk.Columns[0])), nil
+}
+
+// parentForeignKey returns the single-column foreign key of table referencing
+// parent, the one of column if given.
+func parentForeignKey(db *pg.DB, table string, parent string, column string) (ForeignKey, error) {
+	refTable, err := resolveTable(db, parent)
+	if err != nil {
+		return ForeignKey{}, err
+	}
+	fks, err := getTableForeignKeys(db, table)
+	if err != nil {
+		return ForeignKey{}, err
+	}
+	found := make([]ForeignKey, 0, 1)
+	for _, fk := range fks {
+		if fk.RefTable == refTable && len(fk.Columns) == 1 && (column == "" || fk.Columns[0] == column) {
+			found = append(found, fk)
+		}
+	}
+	switch {
+	case len(found) == 0:
+		return ForeignKey{}, fmt.Errorf("%w: sample_hash of %s: no single-column foreign key references %s", ErrManifestInvalid, table, parent)
+	case len(found) > 1:
+		return ForeignKey{}, fmt.Errorf("%w: sample_hash of %s: several foreign keys reference %s, choose one with column", ErrManifestInvalid, table, parent)
+	}
+	return found[0], nil
+}
+
+// keyHash returns the SQL expression hashing the value of expr to a number
+// between 0 and 2^32 - 1. NULL values hash to NULL.
+func keyHash(expr string) string {
+	return fmt.Sprintf("('x' || left(md5((%s)::text), 8))::bit(32)::bigint", expr)
+}
+
+// perParentSampler dumps the first rows of every parent among the rows
+// chosen by another sampler, ranking them with a window function.
+type perParentSampler struct {
+	sampler Sampler
+	spec    PerParent
+	// Columns of the rows, all of the table's by default
+	cols []string
+}
+
+func (s perParentSampler) Query(db *pg.DB, table string) (string, error) {
+	source, err := s.sampler.Query(db, table)
+	if err != nil {
+		return "", err
+	}
+	if source == "" {
+		source = fmt.Sprintf("SELECT * FROM %s", table)
+	}
+
+	cols := s.cols
+	if len(cols) == 0 {
+		cols, err = getTableCols(db, table)
+		if err != nil {
+			return "", err
+		}
+	}
+	orderBy := s.spec.OrderBy
+	if orderBy == "" {
+		pk, err := getPrimaryKey(db, table)
+		if err != nil {
+			return "", err
+		}
+		orderBy = quoteIdents(pk)
+	}
+	window := "PARTITION BY " + s.spec.Key
+	if orderBy != "" {
+		window += " ORDER BY " + orderBy
+	}
+	return fmt.Sprintf("SELECT %s FROM (SELECT *, row_number() OVER (%s) AS pg_dump_sample_rank FROM (%s) AS r) AS r WHERE pg_dump_sample_rank <= %d",
+		quoteIdents(cols), window, source, s.spec.Limit), nil
+}
+
+// subsetSampler dumps the rows of the table belonging to a seed subset.
+type subsetSampler struct {
+	subsetter *subsetter
+}
+
+func (s subsetSampler) Query(db *pg.DB, table string) (string, error) {
+	return s.subsetter.Query(table), nil
+}
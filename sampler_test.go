@@ -0,0 +1,115 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestSamplerFor(t *testing.T) {
+	manifest := &Manifest{Vars: map[string]string{"min_id": "10"}}
+	seed := 42
+
+	for _, tc := range []struct {
+		item     ManifestItem
+		expected string
+	}{
+		{ManifestItem{Table: "users"}, ""},
+		{ManifestItem{Table: "users", Query: "SELECT * FROM users WHERE id > {{min_id}}"}, "SELECT * FROM users WHERE id > 10"},
+		{ManifestItem{Table: "users", Sample: &Sample{Percent: 2.5}}, "SELECT * FROM users TABLESAMPLE BERNOULLI (2.5)"},
+		{ManifestItem{Table: "users", Sample: &Sample{Percent: 10, Method: "system", Repeatable: &seed}}, "SELECT * FROM users TABLESAMPLE SYSTEM (10) REPEATABLE (42)"},
+		{ManifestItem{Table: "users", Sample: &Sample{Percent: 5, WeightBy: "views"}}, "SELECT * FROM users AS w WHERE random() * (SELECT avg(greatest(coalesce(views, 0), 0)) FROM users AS w) < 5 / 100 * greatest(coalesce(views, 0), 0)"},
+		{ManifestItem{Table: "users", Sample: &Sample{Percent: 5, WeightBy: "views", Repeatable: &seed}}, "SELECT * FROM users AS w WHERE (('x' || left(md5(w::text || ':42'), 8))::bit(32)::bigint / 4294967296.0) * (SELECT avg(greatest(coalesce(views, 0), 0)) FROM users AS w) < 5 / 100 * greatest(coalesce(views, 0), 0)"},
+		{ManifestItem{Table: "users", Query: "ignored", Sampler: querySampler{query: "SELECT 1"}}, "SELECT 1"},
+		{
+			ManifestItem{Table: "posts", Columns: []string{"id", "user_id"}, PerParent: &PerParent{Key: "user_id", Limit: 2, OrderBy: "created_at DESC"}},
+			`SELECT "id", "user_id" FROM (SELECT *, row_number() OVER (PARTITION BY user_id ORDER BY created_at DESC) AS pg_dump_sample_rank FROM (SELECT * FROM posts) AS r) AS r WHERE pg_dump_sample_rank <= 2`,
+		},
+		{
+			ManifestItem{Table: "posts", Columns: []string{"id"}, Query: "SELECT id FROM posts WHERE id > {{min_id}}", PerParent: &PerParent{Key: "user_id", Limit: 1, OrderBy: "id"}},
+			`SELECT "id" FROM (SELECT *, row_number() OVER (PARTITION BY user_id ORDER BY id) AS pg_dump_sample_rank FROM (SELECT id FROM posts WHERE id > 10) AS r) AS r WHERE pg_dump_sample_rank <= 1`,
+		},
+		{ManifestItem{Table: "users", Query: "SELECT * FROM users WHERE id > {{min_id}}", Vars: map[string]string{"min_id": "500"}}, "SELECT * FROM users WHERE id > 500"},
+		{
+			ManifestItem{Table: "users", SampleHash: &SampleHash{Column: "id", Buckets: 100, Keep: 5}},
+			`SELECT * FROM (SELECT * FROM users) AS h WHERE ('x' || left(md5((h."id")::text), 8))::bit(32)::bigint % 100 < 5`,
+		},
+		{
+			ManifestItem{Table: "posts", Query: "SELECT * FROM posts WHERE id > {{min_id}}", SampleHash: &SampleHash{Column: "user_id", Buckets: 10, Keep: 1}},
+			`SELECT * FROM (SELECT * FROM posts WHERE id > 10) AS h WHERE ('x' || left(md5((h."user_id")::text), 8))::bit(32)::bigint % 10 < 1`,
+		},
+	} {
+		sampler, err := samplerFor(manifest, tc.item)
+		if err != nil {
+			t.Fatalf("%+v: %v", tc.item, err)
+		}
+		query, err := sampler.Query(nil, tc.item.Table)
+		if err != nil {
+			t.Fatalf("%+v: %v", tc.item, err)
+		}
+		if query != tc.expected {
+			t.Errorf("expected %q, got %q", tc.expected, query)
+		}
+	}
+}
+
+func TestSamplerFor_Invalid(t *testing.T) {
+	for _, item := range []ManifestItem{
+		{Table: "users", Query: "SELECT * FROM users", Sample: &Sample{Percent: 1}},
+		{Table: "users", Sample: &Sample{Percent: 0}},
+		{Table: "users", Sample: &Sample{Percent: 150}},
+		{Table: "users", Sample: &Sample{Percent: 1, Method: "reservoir"}},
+		{Table: "users", Sample: &Sample{Percent: 1, Method: "system", WeightBy: "views"}},
+		{Table: "posts", PerParent: &PerParent{Limit: 1}},
+		{Table: "posts", PerParent: &PerParent{Key: "user_id"}},
+		{Table: "users", SampleHash: &SampleHash{Buckets: 100, Keep: 5}},
+		{Table: "users", SampleHash: &SampleHash{Column: "id", Keep: 5}},
+		{Table: "users", SampleHash: &SampleHash{Column: "id", Buckets: 10, Keep: 11}},
+		{Table: "users", SampleHash: &SampleHash{Column: "id", Buckets: 10}},
+		{Table: "posts", SampleHash: &SampleHash{Parent: "users"}},
+	} {
+		_, err := samplerFor(&Manifest{}, item)
+		if err == nil {
+			t.Errorf("%+v: expected an error", item)
+		}
+	}
+}
+
+func TestSamplerFor_HashParent(t *testing.T) {
+	manifest := &Manifest{Tables: []ManifestItem{
+		{Table: "users", SampleHash: &SampleHash{Column: "id", Buckets: 100, Keep: 5}},
+		{Table: "posts", SampleHash: &SampleHash{Parent: "users"}},
+		{Table: "comments", SampleHash: &SampleHash{Parent: "posts", Column: "post_id"}},
+		{Table: "a", SampleHash: &SampleHash{Parent: "b"}},
+		{Table: "b", SampleHash: &SampleHash{Parent: "a"}},
+	}}
+	sampler, err := samplerFor(manifest, manifest.Tables[2])
+	if err != nil {
+		t.Fatalf("samplerFor error: %v", err)
+	}
+	expected := []hashLink{{"comments", "post_id"}, {"posts", ""}, {"users", "id"}}
+	if s := sampler.(hashSampler); !slices.Equal(s.path, expected) || s.buckets != 100 || s.keep != 5 {
+		t.Errorf("expected the path %v to the sample_hash of users, got %+v", expected, s)
+	}
+
+	for _, item := range []ManifestItem{
+		manifest.Tables[3],
+		{Table: "posts", SampleHash: &SampleHash{Parent: "users", Buckets: 10, Keep: 1}},
+		{Table: "posts", SampleHash: &SampleHash{Parent: "comments"}},
+	} {
+		_, err := samplerFor(manifest, item)
+		if err == nil {
+			t.Errorf("%+v: expected an error", item)
+		}
+	}
+}
+
+func TestSubsetSampler(t *testing.T) {
+	s := newSubsetter(Seed{Table: "users", Where: "id = 1"}, nil)
+	query, err := subsetSampler{s}.Query(nil, "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if query != s.Query("users") {
+		t.Errorf("expected the subset query, got %q", query)
+	}
+}
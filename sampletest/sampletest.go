@@ -0,0 +1,331 @@
+// Package sampletest loads dumps made by pg_dump_sample into test databases,
+// so that Go tests can use sampled data as fixtures:
+//
+//	func TestOrders(t *testing.T) {
+//		db := sampletest.Open(t, &pg.Options{User: "test", Database: "postgres"}, "myapp_schema", "testdata/orders.sql")
+//		...
+//	}
+//
+// Dumps only contain data, so they are loaded into copies of a template
+// database which already has the schema, e.g. a database the application's
+// migrations were run on.
+package sampletest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	pg "github.com/go-pg/pg/v10"
+)
+
+// END_OF_DATA ends the data of a COPY statement
+const END_OF_DATA = `\.`
+
+var copyFromStdin = regexp.MustCompile(`(?is)^COPY\s.*\sFROM\s+stdin\b`)
+
+// execer runs the statements of a dump, implemented by *pg.Conn
+type execer interface {
+	Exec(query interface{}, params ...interface{}) (pg.Result, error)
+	CopyFrom(r io.Reader, query interface{}, params ...interface{}) (pg.Result, error)
+}
+
+// Load loads the dump at path into db. Dumps in the directory format are
+// loaded through their restore.sql, as long as their data files aren't
+// compressed.
+func Load(db *pg.DB, path string) error {
+	conn := db.Conn()
+	defer conn.Close()
+
+	err := loadFile(conn, path)
+	if err != nil {
+		// Leave no transaction open on the connection
+		conn.Exec(`ROLLBACK`)
+		return err
+	}
+	return nil
+}
+
+func loadFile(db execer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = loadScript(db, f, filepath.Dir(path))
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// loadScript runs the statements of the SQL script read from r, as psql
+// would. Files included with \ir are relative to dir.
+func loadScript(db execer, r io.Reader, dir string) error {
+	reader := bufio.NewReader(r)
+	var s scanner
+	for {
+		line, err := reader.ReadString('\n')
+		if line == "" && err == io.EOF {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		// psql meta-commands take the whole line
+		if s.empty() && strings.HasPrefix(strings.TrimSpace(line), `\`) {
+			err := metaCommand(db, strings.TrimSpace(line), dir)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		for _, stmt := range s.scan(line) {
+			if !copyFromStdin.MatchString(stmt) {
+				_, err := db.Exec(stmt)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			data, err := readData(reader)
+			if err != nil {
+				return err
+			}
+			_, err = db.CopyFrom(data, stmt)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if !s.empty() {
+		return fmt.Errorf("unterminated statement: %s", strings.TrimSpace(s.stmt.String()))
+	}
+	return nil
+}
+
+func metaCommand(db execer, line string, dir string) error {
+	command, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+	switch command {
+	case `\ir`, `\include_relative`:
+		return loadFile(db, filepath.Join(dir, filepath.FromSlash(arg)))
+	case `\i`, `\include`:
+		return loadFile(db, arg)
+	case `\copy`:
+		return fmt.Errorf("compressed data files aren't supported")
+	default:
+		return fmt.Errorf("unsupported psql command %s", command)
+	}
+}
+
+// readData reads the data of a COPY statement, up to the end of data marker.
+func readData(reader *bufio.Reader) (io.Reader, error) {
+	var data bytes.Buffer
+	for {
+		line, err := reader.ReadString('\n')
+		if strings.TrimRight(line, "\r\n") == END_OF_DATA {
+			return &data, nil
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		data.WriteString(line)
+	}
+}
+
+// scanner splits SQL into statements, keeping track of quotes so that
+// semicolons within strings, quoted identifiers and dollar-quoted bodies
+// don't end statements.
+type scanner struct {
+	stmt      strings.Builder
+	quote     byte
+	dollarTag string
+}
+
+func (s *scanner) empty() bool {
+	return strings.TrimSpace(s.stmt.String()) == ""
+}
+
+// scan adds a line to the current statement and returns the statements it
+// completes.
+func (s *scanner) scan(line string) []string {
+	var stmts []string
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case s.dollarTag != "":
+			if strings.HasPrefix(line[i:], s.dollarTag) {
+				s.stmt.WriteString(s.dollarTag)
+				i += len(s.dollarTag) - 1
+				s.dollarTag = ""
+				continue
+			}
+		case s.quote != 0:
+			if c == s.quote {
+				s.quote = 0
+			}
+		case c == '\'' || c == '"':
+			s.quote = c
+		case c == '$':
+			if tag := dollarTag(line[i:]); tag != "" {
+				s.stmt.WriteString(tag)
+				i += len(tag) - 1
+				s.dollarTag = tag
+				continue
+			}
+		case c == '-' && strings.HasPrefix(line[i:], "--"):
+			// Comments run to the end of the line
+			s.stmt.WriteByte('\n')
+			i = len(line)
+			continue
+		case c == ';':
+			if stmt := strings.TrimSpace(s.stmt.String()); stmt != "" {
+				stmts = append(stmts, stmt)
+			}
+			s.stmt.Reset()
+			continue
+		}
+		s.stmt.WriteByte(c)
+	}
+	return stmts
+}
+
+var dollarTagPattern = regexp.MustCompile(`^\$([A-Za-z_][A-Za-z0-9_]*)?\$`)
+
+// dollarTag returns the dollar quote tag at the start of v, e.g. $$ or
+// $body$, if any.
+func dollarTag(v string) string {
+	return dollarTagPattern.FindString(v)
+}
+
+var (
+	databases atomic.Int64
+
+	// Fixture databases created by this process, by name
+	fixtures   = make(map[string]bool)
+	fixturesMu sync.Mutex
+)
+
+// NewDatabase creates a database for the test as a copy of template and
+// returns a connection to it. opts connect to any database of the server, as
+// a user allowed to create databases. The database is dropped when the test
+// finishes.
+func NewDatabase(t testing.TB, opts *pg.Options, template string) *pg.DB {
+	t.Helper()
+
+	name := fmt.Sprintf("sampletest_%d_%d", os.Getpid(), databases.Add(1))
+	err := createDatabase(opts, name, template)
+	if err != nil {
+		t.Fatalf("sampletest: %v", err)
+	}
+
+	dbOpts := *opts
+	dbOpts.Database = name
+	db := pg.Connect(&dbOpts)
+	t.Cleanup(func() {
+		db.Close()
+		err := dropDatabase(opts, name)
+		if err != nil {
+			t.Errorf("sampletest: %v", err)
+		}
+	})
+	return db
+}
+
+// Open returns a connection to a database for the test, a copy of template
+// with the dump at path loaded into it. The dump is loaded only once, into a
+// database named after template and the dump's contents, which every test
+// using the same dump gets a copy of. This database is kept for later runs.
+func Open(t testing.TB, opts *pg.Options, template, path string) *pg.DB {
+	t.Helper()
+
+	fixture, err := fixtureDatabase(opts, template, path)
+	if err != nil {
+		t.Fatalf("sampletest: %v", err)
+	}
+	return NewDatabase(t, opts, fixture)
+}
+
+// fixtureDatabase returns the name of a copy of template with the dump at
+// path loaded into it, creating it if it doesn't exist yet.
+func fixtureDatabase(opts *pg.Options, template, path string) (string, error) {
+	dump, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(dump)
+	name := fmt.Sprintf("%.46s_%x", template, sum[:8])
+
+	fixturesMu.Lock()
+	defer fixturesMu.Unlock()
+	if fixtures[name] {
+		return name, nil
+	}
+
+	err = createDatabase(opts, name, template)
+	var pgErr pg.Error
+	if errors.As(err, &pgErr) && pgErr.Field('C') == "42P04" {
+		// Created by an earlier run
+		fixtures[name] = true
+		return name, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	dbOpts := *opts
+	dbOpts.Database = name
+	db := pg.Connect(&dbOpts)
+	err = Load(db, path)
+	db.Close()
+	if err != nil {
+		dropDatabase(opts, name)
+		return "", err
+	}
+
+	fixtures[name] = true
+	return name, nil
+}
+
+func createDatabase(opts *pg.Options, name, template string) error {
+	db := pg.Connect(opts)
+	defer db.Close()
+
+	sql := fmt.Sprintf(`CREATE DATABASE %s`, quoteIdent(name))
+	if template != "" {
+		sql += fmt.Sprintf(` TEMPLATE %s`, quoteIdent(template))
+	}
+	_, err := db.Exec(sql)
+	return err
+}
+
+func dropDatabase(opts *pg.Options, name string) error {
+	db := pg.Connect(opts)
+	defer db.Close()
+
+	_, err := db.Exec(fmt.Sprintf(`DROP DATABASE IF EXISTS %s`, quoteIdent(name)))
+	return err
+}
+
+func quoteIdent(v string) string {
+	return `"` + strings.ReplaceAll(v, `"`, `""`) + `"`
+}
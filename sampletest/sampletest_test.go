@@ -0,0 +1,182 @@
+package sampletest
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	pg "github.com/go-pg/pg/v10"
+)
+
+// recorder records the statements of a dump instead of running them
+type recorder struct {
+	stmts []string
+}
+
+func (r *recorder) Exec(query interface{}, params ...interface{}) (pg.Result, error) {
+	r.stmts = append(r.stmts, query.(string))
+	return nil, nil
+}
+
+func (r *recorder) CopyFrom(data io.Reader, query interface{}, params ...interface{}) (pg.Result, error) {
+	b, err := io.ReadAll(data)
+	r.stmts = append(r.stmts, fmt.Sprintf("%s <- %q", query, b))
+	return nil, err
+}
+
+func TestLoadScript(t *testing.T) {
+	script := `
+--
+-- PostgreSQL database dump
+--
+
+BEGIN;
+
+SET search_path = public, pg_catalog;
+
+DO $$
+BEGIN
+	RAISE NOTICE 'a; b';
+END
+$$;
+
+COPY users (id, name) FROM stdin;
+1	Alice; Bob
+2	\N
+\.
+-- Rows: 2
+
+COMMENT ON TABLE users IS 'People;
+signed up';
+
+COMMIT;
+`
+	var r recorder
+	err := loadScript(&r, strings.NewReader(script), ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"BEGIN",
+		"SET search_path = public, pg_catalog",
+		"DO $$\nBEGIN\n\tRAISE NOTICE 'a; b';\nEND\n$$",
+		`COPY users (id, name) FROM stdin <- "1\tAlice; Bob\n2\t\\N\n"`,
+		"COMMENT ON TABLE users IS 'People;\nsigned up'",
+		"COMMIT",
+	}
+	if !reflect.DeepEqual(r.stmts, expected) {
+		t.Errorf("unexpected statements:\n%q\nexpected:\n%q", r.stmts, expected)
+	}
+}
+
+func TestLoadScript_Include(t *testing.T) {
+	dir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(dir, "public"), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "public", "users.sql"), []byte("COPY users (id) FROM stdin;\n1\n\\.\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r recorder
+	err = loadScript(&r, strings.NewReader("BEGIN;\n\n\\ir public/users.sql\n\nCOMMIT;\n"), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"BEGIN", `COPY users (id) FROM stdin <- "1\n"`, "COMMIT"}
+	if !reflect.DeepEqual(r.stmts, expected) {
+		t.Errorf("unexpected statements:\n%q\nexpected:\n%q", r.stmts, expected)
+	}
+
+	err = loadScript(&r, strings.NewReader("\\copy users (id) FROM PROGRAM 'gzip -dc users.copy.gz'\n"), dir)
+	if err == nil {
+		t.Error("expected an error for compressed data files")
+	}
+}
+
+func TestLoadScript_Unterminated(t *testing.T) {
+	var r recorder
+	if err := loadScript(&r, strings.NewReader("COPY users (id) FROM stdin;\n1\n"), "."); err == nil {
+		t.Error("expected an error for data without an end marker")
+	}
+	if err := loadScript(&r, strings.NewReader("SELECT 'oops;\n"), "."); err == nil {
+		t.Error("expected an error for an unterminated statement")
+	}
+}
+
+// testDBOpts returns pg.Options for a database of the test server, as in the
+// tests of pg_dump_sample.
+func testDBOpts() *pg.Options {
+	env := func(name, value string) string {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+		return value
+	}
+	return &pg.Options{
+		Addr:     fmt.Sprintf("%s:%s", env("PGHOST", "localhost"), env("PGPORT", "15432")),
+		User:     env("PGUSER", "test"),
+		Password: env("PGPASSWORD", "test"),
+		Database: env("PGDATABASE", "pg_dump_sample_test"),
+	}
+}
+
+func TestOpen(t *testing.T) {
+	opts := testDBOpts()
+	db := pg.Connect(opts)
+	_, err := db.Exec(`SELECT 1`)
+	db.Close()
+	if err != nil {
+		t.Skipf("skipping: test database not available: %v", err)
+	}
+
+	// The template has the schema the dump is loaded into
+	schema := NewDatabase(t, opts, "template0")
+	_, err = schema.Exec(`CREATE TABLE users (id int PRIMARY KEY, name text)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := schema.Options().Database
+	schema.Close()
+
+	path := filepath.Join(t.TempDir(), "users.sql")
+	dump := "BEGIN;\n\nCOPY users (id, name) FROM stdin;\n1\tAlice\n2\tBob\n\\.\n\nCOMMIT;\n"
+	err = os.WriteFile(path, []byte(dump), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		db := Open(t, opts, template, path)
+		var count int
+		_, err = db.QueryOne(pg.Scan(&count), `SELECT count(*) FROM users`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 2 {
+			t.Errorf("expected the 2 rows of the dump, got %d", count)
+		}
+
+		// Changes are local to the test's database
+		_, err = db.Exec(`DELETE FROM users`)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fixture, err := fixtureDatabase(opts, template, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dropDatabase(opts, fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// JOB_TIME_FORMAT is the format of the start times in the names of the dumps
+// of scheduled jobs, which sort by it.
+const JOB_TIME_FORMAT = "20060102T150405Z"
+
+// jobState is a scheduled job of serve and how it went.
+type jobState struct {
+	job     ScheduledJob
+	next    time.Time
+	running bool
+	last    *jobRun
+}
+
+// jobRun is a run of a scheduled job.
+type jobRun struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Status   string    `json:"status"`
+	Error    string    `json:"error,omitempty"`
+	Output   string    `json:"output,omitempty"`
+}
+
+// jobStatus is the status of a scheduled job served by `GET /jobs`.
+type jobStatus struct {
+	Name    string     `json:"name"`
+	Cron    string     `json:"cron"`
+	Next    *time.Time `json:"next,omitempty"`
+	Running bool       `json:"running"`
+	LastRun *jobRun    `json:"last_run,omitempty"`
+	Outputs []string   `json:"outputs"`
+}
+
+// runSchedule runs the job of state on its schedule until ctx is done.
+func (s *dumpServer) runSchedule(ctx context.Context, state *jobState) {
+	for {
+		next := state.job.schedule.next(time.Now())
+		s.jobsMu.Lock()
+		state.next = next
+		s.jobsMu.Unlock()
+		if next.IsZero() {
+			s.logf("job %s: no next run of %s\n", state.job.Name, state.job.Cron)
+			return
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		s.runJob(state)
+	}
+}
+
+// runJob runs the job of state, recording how it went.
+func (s *dumpServer) runJob(state *jobState) {
+	s.jobsMu.Lock()
+	state.running = true
+	s.jobsMu.Unlock()
+
+	run := &jobRun{Started: time.Now().UTC().Truncate(time.Second)}
+	var summary *dumpSummary
+	if s.notify != "" {
+		summary = newDumpSummary(s.database, "")
+		summary.Job = state.job.Name
+	}
+	output, err := s.dumpJob(state.job, run.Started, summary)
+	if summary != nil {
+		summary.Output = output
+		summary.finish(err)
+		notifyErr := notify(s.notify, s.format, summary)
+		if notifyErr != nil {
+			s.logf("job %s: %s\n", state.job.Name, redact(notifyErr.Error()))
+		}
+	}
+	run.Finished = time.Now().UTC().Truncate(time.Second)
+	run.Status = "succeeded"
+	run.Output = output
+	if err != nil {
+		run.Status = "failed"
+		run.Error = redact(err.Error())
+		s.logf("job %s failed: %s\n", state.job.Name, run.Error)
+	} else {
+		s.logf("job %s: %s written in %s\n", state.job.Name, output, run.Finished.Sub(run.Started))
+	}
+
+	s.jobsMu.Lock()
+	state.running = false
+	state.last = run
+	s.jobsMu.Unlock()
+}
+
+// dumpJob writes a dump of job started at start into its output directory,
+// and removes the dumps beyond those it keeps. The dumped tables are recorded
+// in summary if not nil. The path of the dump is returned.
+func (s *dumpServer) dumpJob(job ScheduledJob, start time.Time, summary *dumpSummary) (string, error) {
+	f, err := os.Open(job.Manifest)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	manifest, err := readManifest(f)
+	if err != nil {
+		return "", err
+	}
+	mergeVars(manifest, s.vars)
+
+	err = os.MkdirAll(job.Output, 0777)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(job.Output, fmt.Sprintf("%s-%s.sql", job.Name, start.UTC().Format(JOB_TIME_FORMAT)))
+	// The dump only takes its name once complete, so that failed dumps
+	// don't replace good ones
+	partial := path + ".partial"
+	err = s.writeJobDump(manifest, partial, start, summary)
+	if err == nil {
+		err = os.Rename(partial, path)
+	}
+	if err != nil {
+		os.Remove(partial)
+		return "", err
+	}
+
+	return path, pruneJobOutputs(job)
+}
+
+func (s *dumpServer) writeJobDump(manifest *Manifest, path string, start time.Time, summary *dumpSummary) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var w io.WriteCloser = f
+	if s.encrypt != "" {
+		w, err = newEncryptWriter(f, s.encrypt)
+		if err != nil {
+			return err
+		}
+	}
+	opts := s.opts
+	opts.summary = summary
+	if s.expires > 0 {
+		opts.Expires = start.Add(s.expires).Truncate(time.Second)
+	}
+	err = s.makeDump(manifest, w, opts)
+	if err != nil {
+		// Still wait for the encryption, e.g. gpg to exit
+		w.Close()
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// jobOutputs returns the dumps of job in its output directory, oldest first.
+func jobOutputs(job ScheduledJob) ([]string, error) {
+	entries, err := os.ReadDir(job.Output)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var outputs []string
+	for _, entry := range entries {
+		// Dumps of other jobs sharing the directory are left alone
+		stamp, ok := strings.CutPrefix(entry.Name(), job.Name+"-")
+		stamp, isDump := strings.CutSuffix(stamp, ".sql")
+		if !ok || !isDump || entry.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(JOB_TIME_FORMAT, stamp); err != nil {
+			continue
+		}
+		outputs = append(outputs, filepath.Join(job.Output, entry.Name()))
+	}
+	sort.Strings(outputs)
+	return outputs, nil
+}
+
+// pruneJobOutputs removes the oldest dumps of job beyond those it keeps.
+func pruneJobOutputs(job ScheduledJob) error {
+	if job.Keep == 0 {
+		return nil
+	}
+	outputs, err := jobOutputs(job)
+	if err != nil {
+		return err
+	}
+	for len(outputs) > job.Keep {
+		err = os.Remove(outputs[0])
+		if err != nil {
+			return err
+		}
+		outputs = outputs[1:]
+	}
+	return nil
+}
+
+// serveJobs answers `GET /jobs` with the status of all scheduled jobs, and
+// `GET /jobs/NAME` with that of a single one.
+func (s *dumpServer) serveJobs(w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return http.StatusMethodNotAllowed, nil
+	}
+	name, single := strings.CutPrefix(r.URL.Path, "/jobs/")
+
+	statuses := make([]jobStatus, 0, len(s.jobs))
+	for _, state := range s.jobs {
+		if single && state.job.Name != name {
+			continue
+		}
+		status, err := s.jobStatus(state)
+		if err != nil {
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return http.StatusInternalServerError, err
+		}
+		statuses = append(statuses, status)
+	}
+
+	var body any = statuses
+	if single {
+		if len(statuses) == 0 {
+			http.Error(w, fmt.Sprintf("job %s not found", name), http.StatusNotFound)
+			return http.StatusNotFound, nil
+		}
+		body = statuses[0]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return http.StatusOK, json.NewEncoder(w).Encode(body)
+}
+
+func (s *dumpServer) jobStatus(state *jobState) (jobStatus, error) {
+	outputs, err := jobOutputs(state.job)
+	if err != nil {
+		return jobStatus{}, err
+	}
+
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+	status := jobStatus{
+		Name:    state.job.Name,
+		Cron:    state.job.Cron,
+		Running: state.running,
+		LastRun: state.last,
+		Outputs: outputs,
+	}
+	if !state.next.IsZero() {
+		next := state.next
+		status.Next = &next
+	}
+	if status.Outputs == nil {
+		status.Outputs = []string{}
+	}
+	return status, nil
+}
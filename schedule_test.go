@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJobOutputs(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"nightly-20261015T030000Z.sql",
+		"nightly-20261017T030000Z.sql",
+		"nightly-20261016T030000Z.sql",
+		"nightly-20261018T030000Z.sql.partial",
+		"nightly-extra-20261014T030000Z.sql",
+		"nightly-latest.sql",
+		"notes.txt",
+	} {
+		err := os.WriteFile(filepath.Join(dir, name), nil, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	job := ScheduledJob{Name: "nightly", Output: dir, Keep: 2}
+
+	outputs, err := jobOutputs(job)
+	if err != nil {
+		t.Fatalf("jobOutputs error: %v", err)
+	}
+	expected := []string{
+		filepath.Join(dir, "nightly-20261015T030000Z.sql"),
+		filepath.Join(dir, "nightly-20261016T030000Z.sql"),
+		filepath.Join(dir, "nightly-20261017T030000Z.sql"),
+	}
+	if strings.Join(outputs, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v, got %v", expected, outputs)
+	}
+
+	err = pruneJobOutputs(job)
+	if err != nil {
+		t.Fatalf("pruneJobOutputs error: %v", err)
+	}
+	outputs, _ = jobOutputs(job)
+	if strings.Join(outputs, ",") != strings.Join(expected[1:], ",") {
+		t.Errorf("expected the 2 latest dumps to be kept, got %v", outputs)
+	}
+	// Files which aren't dumps of the job are left alone
+	for _, name := range []string{"nightly-extra-20261014T030000Z.sql", "nightly-latest.sql", "notes.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("expected %s to be kept: %v", name, err)
+		}
+	}
+
+	outputs, err = jobOutputs(ScheduledJob{Name: "nightly", Output: filepath.Join(dir, "missing")})
+	if err != nil || len(outputs) != 0 {
+		t.Errorf("expected no dumps in a missing directory, got %v, %v", outputs, err)
+	}
+}
+
+func TestRunJob_Failed(t *testing.T) {
+	dir := t.TempDir()
+	job := ScheduledJob{Name: "nightly", Manifest: filepath.Join(dir, "missing.yaml"), Output: dir}
+	s := &dumpServer{log: io.Discard}
+	state := &jobState{job: job}
+	s.runJob(state)
+	if state.running || state.last == nil || state.last.Status != "failed" || state.last.Error == "" {
+		t.Errorf("expected a failed run, got %+v", state.last)
+	}
+}
+
+func TestDumpServer_Jobs(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "nightly-20261017T030000Z.sql"), nil, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := time.Date(2026, 10, 18, 3, 0, 0, 0, time.UTC)
+	s := &dumpServer{token: "s3cr3t-token", log: io.Discard, jobs: []*jobState{
+		{
+			job:  ScheduledJob{Name: "nightly", Cron: "0 3 * * *", Output: dir},
+			next: next,
+			last: &jobRun{Status: "succeeded", Output: filepath.Join(dir, "nightly-20261017T030000Z.sql")},
+		},
+		{job: ScheduledJob{Name: "weekly", Cron: "@weekly", Output: filepath.Join(dir, "weekly")}, running: true},
+	}}
+
+	w := serveRequest(s, "GET", "/jobs", "s3cr3t-token", "")
+	var statuses []jobStatus
+	err = json.Unmarshal(w.Body.Bytes(), &statuses)
+	if w.Code != http.StatusOK || err != nil || len(statuses) != 2 {
+		t.Fatalf("expected the status of 2 jobs, got %d: %s", w.Code, w.Body.String())
+	}
+	nightly := statuses[0]
+	if nightly.Name != "nightly" || nightly.Next == nil || !nightly.Next.Equal(next) || nightly.LastRun == nil || nightly.LastRun.Status != "succeeded" || len(nightly.Outputs) != 1 {
+		t.Errorf("unexpected status of nightly: %s", w.Body.String())
+	}
+	if weekly := statuses[1]; !weekly.Running || weekly.LastRun != nil || weekly.Outputs == nil {
+		t.Errorf("unexpected status of weekly: %s", w.Body.String())
+	}
+
+	w = serveRequest(s, "GET", "/jobs/weekly", "s3cr3t-token", "")
+	var status jobStatus
+	err = json.Unmarshal(w.Body.Bytes(), &status)
+	if w.Code != http.StatusOK || err != nil || status.Name != "weekly" {
+		t.Errorf("expected the status of weekly, got %d: %s", w.Code, w.Body.String())
+	}
+
+	for _, tc := range []struct {
+		method   string
+		target   string
+		token    string
+		expected int
+	}{
+		{"GET", "/jobs/monthly", "s3cr3t-token", http.StatusNotFound},
+		{"POST", "/jobs", "s3cr3t-token", http.StatusMethodNotAllowed},
+		{"GET", "/jobs", "", http.StatusUnauthorized},
+	} {
+		w := serveRequest(s, tc.method, tc.target, tc.token, "")
+		if w.Code != tc.expected {
+			t.Errorf("%s %s: expected status %d, got %d", tc.method, tc.target, tc.expected, w.Code)
+		}
+	}
+}
+
+func TestRunJob(t *testing.T) {
+	db := requireDB(t)
+
+	dir := t.TempDir()
+	manifest := filepath.Join(dir, "users.yaml")
+	err := os.WriteFile(manifest, []byte("tables:\n  - table: users\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := ScheduledJob{Name: "users", Manifest: manifest, Output: filepath.Join(dir, "dumps"), Keep: 1}
+	s := &dumpServer{db: db, log: io.Discard}
+
+	for i := 0; i < 2; i++ {
+		_, err := s.dumpJob(job, time.Date(2026, 10, 17+i, 3, 0, 0, 0, time.UTC), nil)
+		if err != nil {
+			t.Fatalf("dumpJob error: %v", err)
+		}
+	}
+	outputs, _ := jobOutputs(job)
+	if len(outputs) != 1 || filepath.Base(outputs[0]) != "users-20261018T030000Z.sql" {
+		t.Fatalf("expected the latest dump only, got %v", outputs)
+	}
+	dump, _ := os.ReadFile(outputs[0])
+	if !strings.Contains(string(dump), "COPY users") {
+		t.Errorf("expected a dump of users, got:\n%s", dump)
+	}
+}
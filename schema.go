@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// schemaObject is a JSON Schema, or a part of one.
+type schemaObject = map[string]any
+
+// manifestSchema returns the JSON Schema of manifests, for editors and for
+// validating manifests before they are used.
+func manifestSchema() schemaObject {
+	str := func(description string) schemaObject {
+		return schemaObject{"type": "string", "description": description}
+	}
+	integer := func(description string, minimum int) schemaObject {
+		return schemaObject{"type": "integer", "minimum": minimum, "description": description}
+	}
+	enum := func(values ...string) []any {
+		sort.Strings(values)
+		choices := make([]any, 0, len(values))
+		for _, v := range values {
+			choices = append(choices, v)
+		}
+		return choices
+	}
+	object := func(description string, properties schemaObject, required ...string) schemaObject {
+		o := schemaObject{
+			"type":                 "object",
+			"description":          description,
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+		if len(required) > 0 {
+			o["required"] = enum(required...)
+		}
+		return o
+	}
+
+	transformTypes := enum(slices.Collect(maps.Keys(transforms))...)
+	transform := schemaObject{
+		"description": "Transform of the column's values, by type or with its parameters",
+		"anyOf": []any{
+			schemaObject{"type": "string", "enum": transformTypes},
+			object("Transform of the column's values", schemaObject{
+				"type":        schemaObject{"type": "string", "enum": transformTypes, "description": "Type of transform"},
+				"when":        str("SQL condition; the transform only applies to rows matching it"),
+				"group":       str("Group of columns whose random values belong together"),
+				"key":         str("Column whose original value random values are derived from"),
+				"size":        schemaObject{"type": "number", "exclusiveMinimum": 0, "description": "Size of the buckets of bucket and generalize"},
+				"fill":        str("Character replacing the generalized characters"),
+				"max_days":    integer("Maximum number of days shift_date shifts dates by", 1),
+				"keep_prefix": integer("Number of leading characters kept by preserve_format", 0),
+				"keep_suffix": integer("Number of trailing characters kept by preserve_format", 0),
+				"length":      integer("Maximum number of characters of values kept by truncate", 1),
+			}, "type"),
+		},
+	}
+
+	varTypeNames := enum(slices.Collect(maps.Keys(varTypes))...)
+	vars := func(description string) schemaObject {
+		return schemaObject{
+			"type": "object",
+			"additionalProperties": schemaObject{
+				"description": "Value inserted as it is, or typed value inserted as an SQL literal",
+				"anyOf": []any{
+					schemaObject{"type": []any{"string", "number", "boolean"}},
+					object("Typed value, inserted as an SQL literal", schemaObject{
+						"type":  schemaObject{"type": "string", "enum": varTypeNames, "description": "Type of the value"},
+						"value": schemaObject{"description": "Value, a list of numbers or strings for list"},
+					}, "type", "value"),
+				},
+			},
+			"description": description,
+		}
+	}
+
+	compress := []string{"none"}
+	for name := range decompressors {
+		compress = append(compress, name)
+	}
+
+	table := object("Table to dump", schemaObject{
+		"table": str("Name of the table, optionally qualified with its schema"),
+		"query": str("Query selecting the rows to dump, a mustache template"),
+		"sample": object("Random sample of the rows to dump", schemaObject{
+			"percent":    schemaObject{"type": "number", "exclusiveMinimum": 0, "maximum": 100, "description": "Percentage of the rows to sample"},
+			"method":     schemaObject{"type": "string", "enum": enum("bernoulli", "system", "BERNOULLI", "SYSTEM"), "description": "Sampling method"},
+			"repeatable": schemaObject{"type": "integer", "description": "Seed making the sample the same on every run"},
+			"weight_by":  str("SQL expression the chance of rows to be sampled is proportional to, e.g. a column"),
+		}, "percent"),
+		"sample_hash": object("Rows whose key hashes into the first buckets, the same on every run", schemaObject{
+			"column":  str("Column hashed or, with parent, the column referencing the parent"),
+			"buckets": integer("Number of buckets the values of the column are hashed into", 1),
+			"keep":    integer("Number of buckets whose rows are dumped", 1),
+			"parent":  str("Table with a sample_hash whose kept rows the dumped rows reference"),
+		}),
+		"per_parent": object("First rows of every parent to dump", schemaObject{
+			"key":      str("Columns referencing the parent, an SQL PARTITION BY list"),
+			"limit":    integer("Number of rows dumped for every parent", 1),
+			"order_by": str("ORDER BY list telling which rows come first, the primary key by default"),
+		}, "key", "limit"),
+		"limit":        integer("Maximum number of rows to dump", 0),
+		"order_by":     str("ORDER BY list of the dumped rows"),
+		"chunk_by":     str("Column the table is read in ranges of"),
+		"chunk_size":   integer("Number of values of chunk_by in each range", 1),
+		"max_duration": schemaObject{"type": []any{"string", "integer"}, "description": "Time reading the data may take, e.g. 5m"},
+		"on_timeout":   schemaObject{"type": "string", "enum": enum(ON_TIMEOUT_FAIL, ON_TIMEOUT_PARTIAL), "description": "What to do when max_duration is exceeded"},
+		"columns":      schemaObject{"type": "array", "items": schemaObject{"type": "string"}, "description": "Columns to dump, all of them by default"},
+		"casts": schemaObject{
+			"type":                 "object",
+			"additionalProperties": schemaObject{"type": "string"},
+			"description":          "Types the columns are converted to, by column",
+		},
+		"transforms": schemaObject{
+			"type":                 "object",
+			"additionalProperties": transform,
+			"description":          "Transforms of the columns' values, by column",
+		},
+		"truncate": schemaObject{
+			"type":                 "object",
+			"additionalProperties": schemaObject{"type": "integer", "minimum": 1},
+			"description":          "Maximum number of characters of the columns' values, by column",
+		},
+		"validate":   str("SQL condition every dumped row has to match"),
+		"on_invalid": schemaObject{"type": "string", "enum": enum(ON_INVALID_FAIL, ON_INVALID_SKIP, ON_INVALID_FIX), "description": "What to do with rows not matching validate"},
+		"fix": schemaObject{
+			"type":                 "object",
+			"additionalProperties": transform,
+			"description":          "Transforms of the columns of rows not matching validate, by column",
+		},
+		"post_actions": schemaObject{"type": "array", "items": schemaObject{"type": "string"}, "description": "SQL statements run after the table is loaded"},
+		"compress":     schemaObject{"type": "string", "enum": enum(compress...), "description": "Compression of the table's data file in the directory format"},
+		"vars":         vars("Variables of the table's query and post actions, overriding the manifest's"),
+	}, "table")
+
+	return schemaObject{
+		"$schema":     "https://json-schema.org/draft/2020-12/schema",
+		"title":       "pg_dump_sample manifest",
+		"type":        "object",
+		"description": "Tables to dump and how to sample them",
+		"properties": schemaObject{
+			"vars": vars("Variables of the query templates, by name"),
+			"vars_sql": schemaObject{
+				"type":                 "object",
+				"additionalProperties": schemaObject{"type": "string"},
+				"description":          "Queries computing variables of the query templates when the dump starts, by name",
+			},
+			"preconditions": schemaObject{
+				"type":        "array",
+				"items":       schemaObject{"type": "string"},
+				"description": "Queries returning a boolean which must all be true for the dump to start",
+			},
+			"as_of":  str("Instant the dump is as of, the as_of var of every query; the time the dump starts by default"),
+			"header": str("SQL written at the start of the dump, a mustache template"),
+			"footer": str("SQL written at the end of the dump, a mustache template"),
+			"seed": object("Subset of the database following foreign keys from the seed rows", schemaObject{
+				"table":     str("Table of the seed rows"),
+				"where":     str("Condition selecting the seed rows"),
+				"max_depth": integer("Number of foreign keys followed from the seed rows", 0),
+				"exclude":   schemaObject{"type": "array", "items": schemaObject{"type": "string"}, "description": "Tables left out of the subset"},
+				"limits": schemaObject{
+					"type":                 "object",
+					"additionalProperties": schemaObject{"type": "integer", "minimum": 0},
+					"description":          "Maximum number of rows of tables, by table",
+				},
+			}, "table", "where"),
+			"tables": schemaObject{"type": "array", "items": table, "description": "Tables to dump"},
+		},
+		"additionalProperties": false,
+	}
+}
+
+// writeManifestSchema writes the JSON Schema of manifests to w.
+func writeManifestSchema(w io.Writer) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(manifestSchema())
+}
+
+// validateSchema validates the value v, decoded from YAML, against schema,
+// and returns the violations, prefixed with the path of the value.
+func validateSchema(schema schemaObject, v any, path string) []string {
+	if alternatives, ok := schema["anyOf"].([]any); ok {
+		return validateAnyOf(alternatives, v, path)
+	}
+
+	kind := schemaType(v)
+	if types, ok := schema["type"]; ok && !matchesType(types, kind) {
+		return []string{fmt.Sprintf("%s: expected %s, got %s", path, typeNames(types), kind)}
+	}
+	if choices, ok := schema["enum"].([]any); ok && !slices.Contains(choices, v) {
+		names := make([]string, 0, len(choices))
+		for _, c := range choices {
+			names = append(names, fmt.Sprint(c))
+		}
+		return []string{fmt.Sprintf("%s: %v isn't one of %s", path, v, strings.Join(names, ", "))}
+	}
+
+	errs := make([]string, 0)
+	switch kind {
+	case "number", "integer":
+		n := toFloat(v)
+		if minimum, ok := schema["minimum"]; ok && n < toFloat(minimum) {
+			errs = append(errs, fmt.Sprintf("%s: must be at least %v", path, minimum))
+		}
+		if maximum, ok := schema["maximum"]; ok && n > toFloat(maximum) {
+			errs = append(errs, fmt.Sprintf("%s: must be at most %v", path, maximum))
+		}
+		if minimum, ok := schema["exclusiveMinimum"]; ok && n <= toFloat(minimum) {
+			errs = append(errs, fmt.Sprintf("%s: must be greater than %v", path, minimum))
+		}
+	case "array":
+		if items, ok := schema["items"].(schemaObject); ok {
+			for i, item := range v.([]any) {
+				errs = append(errs, validateSchema(items, item, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	case "object":
+		fields := objectFields(v)
+		if required, ok := schema["required"].([]any); ok {
+			for _, name := range required {
+				if _, ok := fields[name.(string)]; !ok {
+					errs = append(errs, fmt.Sprintf("%s: missing %s", path, name))
+				}
+			}
+		}
+		properties, _ := schema["properties"].(schemaObject)
+		for _, name := range slices.Sorted(maps.Keys(fields)) {
+			field := strings.TrimPrefix(path+"."+name, ".")
+			if p, ok := properties[name].(schemaObject); ok {
+				errs = append(errs, validateSchema(p, fields[name], field)...)
+				continue
+			}
+			switch additional := schema["additionalProperties"].(type) {
+			case bool:
+				if !additional {
+					errs = append(errs, fmt.Sprintf("%s: unknown field", field))
+				}
+			case schemaObject:
+				errs = append(errs, validateSchema(additional, fields[name], field)...)
+			}
+		}
+	}
+	return errs
+}
+
+// validateAnyOf validates v against alternative schemas. If it matches none,
+// the violations of the alternative of its type are returned.
+func validateAnyOf(alternatives []any, v any, path string) []string {
+	kind := schemaType(v)
+	var errs []string
+	types := make([]any, 0, len(alternatives))
+	for _, alternative := range alternatives {
+		schema := alternative.(schemaObject)
+		altErrs := validateSchema(schema, v, path)
+		if len(altErrs) == 0 {
+			return nil
+		}
+		if errs == nil && matchesType(schema["type"], kind) {
+			errs = altErrs
+		}
+		types = append(types, schema["type"])
+	}
+	if errs == nil {
+		errs = []string{fmt.Sprintf("%s: expected %s, got %s", path, typeNames(types), kind)}
+	}
+	return errs
+}
+
+// schemaType returns the JSON Schema type of a value decoded from YAML.
+// Numbers without a fractional part are integers, as in JSON Schema.
+func schemaType(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string, time.Time:
+		// Timestamps are decoded as strings into manifests
+		return "string"
+	case int, int64, uint64:
+		return "integer"
+	case float64:
+		if v == math.Trunc(v) && !math.IsInf(v, 0) {
+			return "integer"
+		}
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any, map[any]any:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// matchesType tells whether a value of the given kind has one of types,
+// a type name or a list of them.
+func matchesType(types any, kind string) bool {
+	if list, ok := types.([]any); ok {
+		return slices.ContainsFunc(list, func(t any) bool { return matchesType(t, kind) })
+	}
+	return types == kind || (types == "number" && kind == "integer")
+}
+
+// typeNames describes types, a type name or a list of them.
+func typeNames(types any) string {
+	if list, ok := types.([]any); ok {
+		names := make([]string, 0, len(list))
+		for _, t := range list {
+			names = append(names, typeNames(t))
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(types)
+}
+
+// objectFields returns the fields of an object decoded from YAML, by name.
+func objectFields(v any) map[string]any {
+	if fields, ok := v.(map[string]any); ok {
+		return fields
+	}
+	fields := make(map[string]any)
+	for k, value := range v.(map[any]any) {
+		fields[fmt.Sprint(k)] = value
+	}
+	return fields
+}
+
+// toFloat converts a number decoded from YAML, or a bound of the schema, to
+// a float.
+func toFloat(v any) float64 {
+	switch v := v.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case float64:
+		return v
+	default:
+		return math.NaN()
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadManifest_Schema(t *testing.T) {
+	valid := `
+vars:
+  min_id: 10
+preconditions:
+  - SELECT count(*) > {{min_id}} FROM users
+seed:
+  table: users
+  where: id = 1
+  limits: {posts: 100}
+tables:
+  - table: users
+    sample: {percent: 10, method: system}
+    max_duration: 5m
+    on_timeout: partial
+    transforms:
+      email: fake_email
+      created_at: {type: shift_date, max_days: 30}
+  - table: posts
+    columns: [id, title]
+    compress: zstd
+`
+	_, err := readManifest(strings.NewReader(valid))
+	if err != nil {
+		t.Fatalf("readManifest error: %v", err)
+	}
+
+	invalid := `
+tables:
+  - table: users
+    sampel: {percent: 10}
+    limit: -1
+    transforms:
+      email: fake_mail
+      name: {type: redact, max_day: 3}
+  - columns: [id]
+    sample: {percent: 0}
+`
+	_, err = readManifest(strings.NewReader(invalid))
+	if !errors.Is(err, ErrManifestInvalid) {
+		t.Fatalf("expected ErrManifestInvalid, got %v", err)
+	}
+	for _, expected := range []string{
+		"tables[0].limit: must be at least 0",
+		"tables[0].sampel: unknown field",
+		"tables[0].transforms.email: fake_mail isn't one of",
+		"tables[0].transforms.name.max_day: unknown field",
+		"tables[1]: missing table",
+		"tables[1].sample.percent: must be greater than 0",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q in %q", expected, err)
+		}
+	}
+}
+
+func TestValidateSchema(t *testing.T) {
+	schema := schemaObject{
+		"type": "object",
+		"properties": schemaObject{
+			"size":  schemaObject{"type": "number", "maximum": 10},
+			"count": schemaObject{"type": "integer"},
+			"tags":  schemaObject{"type": "array", "items": schemaObject{"type": "string"}},
+		},
+	}
+	doc := map[string]any{"size": 12.5, "count": 1.5, "tags": []any{"a", 1}, "other": true}
+	errs := validateSchema(schema, doc, "")
+	expected := []string{
+		"count: expected integer, got number",
+		"size: must be at most 10",
+		"tags[1]: expected string, got integer",
+	}
+	if !reflect.DeepEqual(errs, expected) {
+		t.Errorf("expected %q, got %q", expected, errs)
+	}
+}
+
+func TestWriteManifestSchema(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeManifestSchema(&buf)
+	if err != nil {
+		t.Fatalf("writeManifestSchema error: %v", err)
+	}
+	var schema map[string]any
+	err = json.Unmarshal(buf.Bytes(), &schema)
+	if err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if schema["$schema"] != "https://json-schema.org/draft/2020-12/schema" {
+		t.Errorf("unexpected $schema %v", schema["$schema"])
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	pg "github.com/go-pg/pg/v10"
+)
+
+const (
+	// SELFTEST_SCHEMA holds the tables of the self-test, dropped when it ends
+	SELFTEST_SCHEMA = "pg_dump_sample_selftest"
+	// SELFTEST_ROWS is the number of random values the self-test generates,
+	// besides the fragments alone
+	SELFTEST_ROWS = 1000
+)
+
+// selftestFragments are the pieces the values of the self-test are made of,
+// chosen to trip up the escaping of COPY text format data, the end of data
+// marker and the splitting of the dump into statements.
+var selftestFragments = []string{
+	`\.`, "\\.\n", "\\.\r\n", `\N`, `\`, `\\`, `\0`, `\000`, `\x00`, `\x41`, `\101`,
+	"\t", "\n", "\r", "\r\n", "\b", "\f", "\v", "\x01", "\x1b", "\x7f",
+	"'", "''", `"`, ";", "$$", "$tag$", "--", "/*", "*/", " ", "",
+	"é", "日本語", "🎉", "\u00a0", "\u200b", "\ufeff", "\u2028",
+	"COPY t FROM stdin;", "NULL", "{}", `{"a":1}`, ",", "{", "}",
+}
+
+// selftestValues returns the values of the self-test: every fragment alone
+// and in between other characters, and n random concatenations of fragments
+// picked with seed.
+func selftestValues(seed uint64, n int) []string {
+	values := make([]string, 0, 2*len(selftestFragments)+n)
+	for _, f := range selftestFragments {
+		values = append(values, f, "a"+f+"b")
+	}
+	r := rand.New(rand.NewPCG(seed, seed>>1))
+	for i := 0; i < n; i++ {
+		var b strings.Builder
+		for j := r.IntN(6); j >= 0; j-- {
+			b.WriteString(selftestFragments[r.IntN(len(selftestFragments))])
+		}
+		values = append(values, b.String())
+	}
+	return values
+}
+
+// selftestMismatch is a row that differs between the generated table and the
+// restored one.
+type selftestMismatch struct {
+	ID       int
+	Expected *string
+	Restored *string
+}
+
+// runSelftest checks that dumps restore the data they were made of: it
+// generates a table of values hard to dump, dumps it, restores the dump with
+// psql over the emptied table and compares both. password is the one
+// pg_dump_sample connected with, passed on to psql.
+func runSelftest(w io.Writer, db *pg.DB, opts *Options, password string, seed uint64) error {
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+	values := selftestValues(seed, SELFTEST_ROWS)
+
+	table := SELFTEST_SCHEMA + ".data"
+	expected := SELFTEST_SCHEMA + ".expected"
+	_, err := db.Exec(fmt.Sprintf(`DROP SCHEMA IF EXISTS %s CASCADE; CREATE SCHEMA %s`, SELFTEST_SCHEMA, SELFTEST_SCHEMA))
+	if err != nil {
+		return err
+	}
+	defer db.Exec(fmt.Sprintf(`DROP SCHEMA IF EXISTS %s CASCADE`, SELFTEST_SCHEMA))
+	_, err = db.Exec(fmt.Sprintf(`CREATE TABLE %s (id integer PRIMARY KEY, value text, value_array text[], value_json jsonb, value_bytea bytea)`, table))
+	if err != nil {
+		return err
+	}
+
+	// Rows with every value alone, in arrays with a NULL, as JSON keys and
+	// strings, and as bytes ending with a NUL byte, and a row of NULLs
+	err = db.RunInTransaction(db.Context(), func(tx *pg.Tx) error {
+		for i, v := range values {
+			_, err := tx.Exec(fmt.Sprintf(`INSERT INTO %s VALUES (?, ?, ARRAY[?, NULL]::text[], jsonb_build_object(?::text, ?::text), ?)`, table),
+				i+1, v, v, v, v, []byte(v+"\x00"))
+			if err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(fmt.Sprintf(`INSERT INTO %s (id) VALUES (?)`, table), len(values)+1)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to generate the data: %v", err)
+	}
+
+	f, err := os.CreateTemp("", "pg_dump_sample_selftest_*.sql")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	manifest := &Manifest{Tables: []ManifestItem{{Table: table}}}
+	err = makeDump(db, manifest, f, DumpOptions{})
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to dump: %v", err)
+	}
+
+	_, err = db.Exec(fmt.Sprintf(`CREATE TABLE %s AS TABLE %s; TRUNCATE %s`, expected, table, table))
+	if err != nil {
+		return err
+	}
+	err = restoreWithPsql(opts, password, f.Name())
+	if err != nil {
+		return err
+	}
+
+	var mismatches []selftestMismatch
+	_, err = db.Query(&mismatches, fmt.Sprintf(`
+		SELECT id, e.value AS expected, r.value AS restored
+		FROM %s e FULL JOIN %s r USING (id)
+		WHERE e.id IS NULL OR r.id IS NULL
+			OR (e.value, e.value_array, e.value_json, e.value_bytea) IS DISTINCT FROM (r.value, r.value_array, r.value_json, r.value_bytea)
+		ORDER BY id`, expected, table))
+	if err != nil {
+		return err
+	}
+	rows := len(values) + 1
+	if len(mismatches) > 0 {
+		details := make([]string, 0, 5)
+		for _, m := range mismatches[:min(len(mismatches), 5)] {
+			details = append(details, fmt.Sprintf("id %d: expected %s, got %s", m.ID, quoteValue(m.Expected), quoteValue(m.Restored)))
+		}
+		return fmt.Errorf("%d of %d rows differ after restoring (seed %d): %s", len(mismatches), rows, seed, strings.Join(details, "; "))
+	}
+	fmt.Fprintf(w, "%d rows dumped and restored identically (seed %d)\n", rows, seed)
+	return nil
+}
+
+// quoteValue quotes a value of the self-test for messages.
+func quoteValue(v *string) string {
+	if v == nil {
+		return "NULL"
+	}
+	return strconv.Quote(*v)
+}
+
+// restoreWithPsql loads the dump at path with psql, connecting to the
+// database like pg_dump_sample does.
+func restoreWithPsql(opts *Options, password string, path string) error {
+	cmd := exec.Command("psql", "-X", "-q", "-v", "ON_ERROR_STOP=1",
+		"-h", opts.Host, "-p", strconv.Itoa(opts.Port), "-U", opts.Username, "-d", opts.Database, "-f", path)
+	cmd.Env = append(os.Environ(), "PGSSLMODE="+sslMode(opts))
+	if password != "" {
+		cmd.Env = append(cmd.Env, "PGPASSWORD="+password)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("psql failed to restore the dump: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSelftestValues(t *testing.T) {
+	values := selftestValues(1, 100)
+	if len(values) != 2*len(selftestFragments)+100 {
+		t.Fatalf("expected %d values, got %d", 2*len(selftestFragments)+100, len(values))
+	}
+	if !slices.Contains(values, `\.`) || !slices.Contains(values, "a\\.\nb") {
+		t.Errorf("expected the end of data marker alone and within a value, got %q", values[:10])
+	}
+	if !slices.Equal(values, selftestValues(1, 100)) {
+		t.Errorf("expected the same values for the same seed")
+	}
+	if slices.Equal(values, selftestValues(2, 100)) {
+		t.Errorf("expected other values for another seed")
+	}
+}
+
+func TestSelftestValues_CopyRoundTrip(t *testing.T) {
+	values := selftestValues(1, SELFTEST_ROWS)
+	for _, v := range values {
+		row := []*string{&v, nil, &v}
+		line := encodeCopyRow(row)
+		if line == `\.` || strings.ContainsAny(line, "\r\n") {
+			t.Fatalf("value %q encoded as %q, which doesn't fit on a line of data", v, line)
+		}
+		decoded := decodeCopyRow(line)
+		if len(decoded) != 3 || decoded[0] == nil || *decoded[0] != v || decoded[1] != nil || *decoded[2] != v {
+			t.Fatalf("value %q encoded as %q isn't decoded back", v, line)
+		}
+	}
+}
+
+func FuzzCopyValue(f *testing.F) {
+	for _, v := range selftestFragments {
+		f.Add(v)
+	}
+	f.Fuzz(func(t *testing.T, v string) {
+		encoded := encodeCopyValue(v)
+		if strings.ContainsAny(encoded, "\t\r\n") || encoded == `\.` || encoded == `\N` {
+			t.Fatalf("value %q encoded as %q", v, encoded)
+		}
+		if decoded := decodeCopyValue(encoded); decoded != v {
+			t.Fatalf("value %q encoded as %q decoded as %q", v, encoded, decoded)
+		}
+	})
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	pg "github.com/go-pg/pg/v10"
+)
+
+// SERVE_TOKEN_ENV is the environment variable holding the token clients of
+// serve authenticate with, unless it's read from `--token-file`.
+const SERVE_TOKEN_ENV = "PG_DUMP_SAMPLE_TOKEN"
+
+// MAX_MANIFEST_BYTES is the size of the largest manifest accepted by serve.
+const MAX_MANIFEST_BYTES = 1 << 20
+
+// Names of profiles, which are manifest files of the profiles directory
+var profileNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// dumpServer serves dumps of db over HTTP, of the manifest posted by the
+// client or of a profile.
+type dumpServer struct {
+	db       *pg.DB
+	database string
+	token    string
+	// Directory of the manifests of the profiles, none if empty
+	profiles string
+	// Vars from the config file, defaults for those of the manifests
+	vars    map[string]string
+	encrypt string
+	expires time.Duration
+	opts    DumpOptions
+	// URL and format of the notifications of scheduled jobs
+	notify string
+	format string
+	// Scheduled jobs
+	jobs   []*jobState
+	jobsMu sync.Mutex
+	// Where requests and jobs are logged
+	log   io.Writer
+	logMu sync.Mutex
+}
+
+// readServeToken returns the token clients of serve authenticate with, read
+// from path or else from SERVE_TOKEN_ENV.
+func readServeToken(path string) (string, error) {
+	token := os.Getenv(SERVE_TOKEN_ENV)
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		token = string(data)
+	}
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return "", fmt.Errorf("serve requires a token, in `--token-file` or %s", SERVE_TOKEN_ENV)
+	}
+	addSecret(token)
+	return token, nil
+}
+
+func (s *dumpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	status, err := s.serve(w, r)
+	if err != nil {
+		s.logf("%s %s %s: %d %s\n", r.RemoteAddr, r.Method, r.URL.Path, status, redact(err.Error()))
+	} else {
+		s.logf("%s %s %s: %d in %s\n", r.RemoteAddr, r.Method, r.URL.Path, status, time.Since(start).Round(time.Millisecond))
+	}
+	if status == 0 {
+		// The dump failed halfway, so the response is cut short for the
+		// client to tell it from a complete one
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// serve answers a request, returning its status, or 0 if the dump failed
+// after it started to be sent.
+func (s *dumpServer) serve(w http.ResponseWriter, r *http.Request) (int, error) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="pg_dump_sample"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return http.StatusUnauthorized, fmt.Errorf("unauthorized")
+	}
+	if r.URL.Path == "/jobs" || strings.HasPrefix(r.URL.Path, "/jobs/") {
+		return s.serveJobs(w, r)
+	}
+	if r.URL.Path != "/dump" {
+		http.NotFound(w, r)
+		return http.StatusNotFound, nil
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	manifest, status, err := s.readManifest(w, r)
+	if err != nil {
+		http.Error(w, redact(err.Error()), status)
+		return status, err
+	}
+
+	opts := s.opts
+	if s.expires > 0 {
+		opts.Expires = time.Now().Add(s.expires).Truncate(time.Second)
+	}
+	out := &responseOutput{w: w}
+	var dump io.WriteCloser = out
+	if s.encrypt != "" {
+		dump, err = newEncryptWriter(out, s.encrypt)
+		if err != nil {
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return http.StatusInternalServerError, err
+		}
+	}
+	w.Header().Set("Content-Type", "application/sql; charset=utf-8")
+	if s.encrypt != "" {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	err = s.makeDump(manifest, dump, opts)
+	if closeErr := dump.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil && !out.written {
+		status := dumpErrorStatus(err)
+		http.Error(w, redact(err.Error()), status)
+		return status, err
+	}
+	if err != nil {
+		return 0, err
+	}
+	return http.StatusOK, nil
+}
+
+// makeDump dumps manifest on connections of its own, so that dumps served at
+// the same time don't share sessions or the metadata of their catalog. The
+// transactions of the sessions are read only by default, so that a query of a
+// client's manifest doesn't change the database by accident, e.g. through a
+// function it calls. Only a role which can only read stops a malicious one.
+func (s *dumpServer) makeDump(manifest *Manifest, w io.Writer, opts DumpOptions) error {
+	pgOpts := *s.db.Options()
+	onConnect := pgOpts.OnConnect
+	pgOpts.OnConnect = func(ctx context.Context, cn *pg.Conn) error {
+		if onConnect != nil {
+			err := onConnect(ctx, cn)
+			if err != nil {
+				return err
+			}
+		}
+		_, err := cn.ExecContext(ctx, "SET default_transaction_read_only = on")
+		return err
+	}
+	db, err := connectDB(&pgOpts)
+	if err != nil {
+		return err
+	}
+	defer closeDumpSessions(db)
+	return makeDump(db, manifest, w, opts)
+}
+
+// logf writes a line to the log of the server.
+func (s *dumpServer) logf(format string, a ...any) {
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	fmt.Fprintf(s.log, format, a...)
+}
+
+// authorized tells whether r carries the token of the server.
+func (s *dumpServer) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+// readManifest reads the manifest of the profile named in the query string
+// of r, or else the one posted in its body. The status of the response is
+// returned with errors.
+func (s *dumpServer) readManifest(w http.ResponseWriter, r *http.Request) (*Manifest, int, error) {
+	var body io.Reader = http.MaxBytesReader(w, r.Body, MAX_MANIFEST_BYTES)
+	profile := r.URL.Query().Get("profile")
+	if profile != "" {
+		if s.profiles == "" {
+			return nil, http.StatusNotFound, fmt.Errorf("no profiles are served")
+		}
+		if !profileNameRegexp.MatchString(profile) {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid profile name %q", profile)
+		}
+		f, err := os.Open(filepath.Join(s.profiles, profile+".yaml"))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, http.StatusNotFound, fmt.Errorf("profile %s not found", profile)
+		}
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		defer f.Close()
+		body = f
+	}
+
+	manifest, err := readManifest(body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("manifest larger than %d bytes", tooLarge.Limit)
+	}
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	// vars_sql and preconditions run SQL as it's written, which could turn the
+	// read-only transactions off, so only the trusted profiles may have them
+	if profile == "" && (len(manifest.VarsSQL) > 0 || len(manifest.Preconditions) > 0) {
+		return nil, http.StatusBadRequest, fmt.Errorf("posted manifests can't have vars_sql or preconditions, only profiles")
+	}
+	mergeVars(manifest, s.vars)
+	return manifest, http.StatusOK, nil
+}
+
+// dumpErrorStatus returns the status of the response to a dump which failed
+// with err before anything was sent.
+func dumpErrorStatus(err error) int {
+	var tableErr *TableNotFoundError
+	switch {
+	case errors.Is(err, ErrManifestInvalid):
+		return http.StatusBadRequest
+	case errors.As(err, &tableErr):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// responseOutput passes a dump on to the response, noting whether any of it
+// was sent.
+type responseOutput struct {
+	w       http.ResponseWriter
+	written bool
+}
+
+func (o *responseOutput) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		o.written = true
+	}
+	return o.w.Write(p)
+}
+
+func (o *responseOutput) Close() error {
+	return nil
+}
+
+// serveDumps serves dumps on the address listen and runs the scheduled jobs
+// until ctx is done, and then waits for the dumps in progress.
+func serveDumps(ctx context.Context, listen string, s *dumpServer) error {
+	// The jobs are stopped before they are waited for, also if serving fails
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for _, state := range s.jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.runSchedule(ctx, state)
+		}()
+	}
+
+	server := &http.Server{Addr: listen, Handler: s}
+	done := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		done <- server.Shutdown(context.Background())
+	}()
+
+	s.logf("serving dumps on %s\n", listen)
+	err := server.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return <-done
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func serveRequest(s *dumpServer, method string, target string, token string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestDumpServer_Requests(t *testing.T) {
+	profiles := t.TempDir()
+	err := os.WriteFile(filepath.Join(profiles, "broken.yaml"), []byte("tables: [\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dumpServer{token: "s3cr3t-token", profiles: profiles, log: io.Discard}
+
+	for _, tc := range []struct {
+		name     string
+		method   string
+		target   string
+		token    string
+		body     string
+		expected int
+	}{
+		{"no token", "POST", "/dump", "", "tables: [{table: users}]", http.StatusUnauthorized},
+		{"wrong token", "POST", "/dump", "s3cr3t-tokem", "tables: [{table: users}]", http.StatusUnauthorized},
+		{"unknown path", "POST", "/restore", "s3cr3t-token", "", http.StatusNotFound},
+		{"wrong method", "GET", "/dump", "s3cr3t-token", "", http.StatusMethodNotAllowed},
+		{"invalid manifest", "POST", "/dump", "s3cr3t-token", "tables: [\n", http.StatusBadRequest},
+		{"vars_sql", "POST", "/dump", "s3cr3t-token", "vars_sql:\n  x: SET transaction_read_only = off\ntables: [{table: users}]", http.StatusBadRequest},
+		{"preconditions", "POST", "/dump", "s3cr3t-token", "preconditions: [\"SELECT true\"]\ntables: [{table: users}]", http.StatusBadRequest},
+		{"invalid profile name", "POST", "/dump?profile=../secrets", "s3cr3t-token", "", http.StatusBadRequest},
+		{"missing profile", "POST", "/dump?profile=missing", "s3cr3t-token", "", http.StatusNotFound},
+		{"invalid profile", "POST", "/dump?profile=broken", "s3cr3t-token", "", http.StatusBadRequest},
+		{"manifest too large", "POST", "/dump", "s3cr3t-token", "# " + strings.Repeat("x", MAX_MANIFEST_BYTES), http.StatusRequestEntityTooLarge},
+	} {
+		w := serveRequest(s, tc.method, tc.target, tc.token, tc.body)
+		if w.Code != tc.expected {
+			t.Errorf("%s: expected status %d, got %d: %s", tc.name, tc.expected, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestDumpServer_NoProfiles(t *testing.T) {
+	s := &dumpServer{token: "s3cr3t-token", log: io.Discard}
+	w := serveRequest(s, "POST", "/dump?profile=users", "s3cr3t-token", "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 without a profiles directory, got %d", w.Code)
+	}
+}
+
+func TestReadServeToken(t *testing.T) {
+	t.Setenv(SERVE_TOKEN_ENV, "")
+	_, err := readServeToken("")
+	if err == nil {
+		t.Error("expected an error without a token")
+	}
+
+	t.Setenv(SERVE_TOKEN_ENV, "from-env-token")
+	token, err := readServeToken("")
+	if err != nil || token != "from-env-token" {
+		t.Errorf("expected the token of the environment, got %q, %v", token, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "token")
+	err = os.WriteFile(path, []byte("from-file-token\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err = readServeToken(path)
+	if err != nil || token != "from-file-token" {
+		t.Errorf("expected the token of the file, got %q, %v", token, err)
+	}
+	if out := redact("token from-file-token"); strings.Contains(out, "from-file-token") {
+		t.Errorf("expected the token to be redacted, got %s", out)
+	}
+}
+
+func TestDumpServer_Dump(t *testing.T) {
+	db := requireDB(t)
+
+	profiles := t.TempDir()
+	err := os.WriteFile(filepath.Join(profiles, "users.yaml"), []byte("tables:\n  - table: users\n    query: SELECT * FROM users WHERE id <= 2\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dumpServer{db: db, token: "s3cr3t-token", profiles: profiles, log: io.Discard}
+
+	w := serveRequest(s, "POST", "/dump", "s3cr3t-token", "tables:\n  - table: posts\n")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "COPY posts") {
+		t.Errorf("expected a dump of posts, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = serveRequest(s, "POST", "/dump?profile=users", "s3cr3t-token", "")
+	out := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(out, "alice@example.com") || strings.Contains(out, "charlie@example.com") {
+		t.Errorf("expected a dump of the profile, got %d: %s", w.Code, out)
+	}
+
+	w = serveRequest(s, "POST", "/dump", "s3cr3t-token", "tables:\n  - table: no_such_table\n")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for a missing table, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Manifests of clients can't change the database
+	w = serveRequest(s, "POST", "/dump", "s3cr3t-token", "tables:\n  - table: users\n    query: SELECT * FROM users WHERE nextval('users_id_seq') > 0\n")
+	if w.Code == http.StatusOK || !strings.Contains(w.Body.String(), "read-only transaction") {
+		t.Errorf("expected the dump to be read only, got %d: %s", w.Code, w.Body.String())
+	}
+}
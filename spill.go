@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Units of memory sizes, as in the PostgreSQL configuration
+var sizeUnits = map[string]int64{
+	"":   1,
+	"B":  1,
+	"kB": 1 << 10,
+	"MB": 1 << 20,
+	"GB": 1 << 30,
+	"TB": 1 << 40,
+}
+
+// parseSize parses a memory size like 512MB, in bytes without a unit.
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if i == -1 {
+		i = len(s)
+	}
+	unit, ok := sizeUnits[strings.TrimSpace(s[i:])]
+	n, err := strconv.ParseInt(s[:i], 10, 64)
+	if !ok || err != nil {
+		return 0, fmt.Errorf("%q is not a size like 512MB", s)
+	}
+	return n * unit, nil
+}
+
+// memoryBudget is the memory buffers may take together, after which they
+// spill to temporary files. A nil budget is unlimited.
+type memoryBudget struct {
+	mu   sync.Mutex
+	left int64
+}
+
+// newMemoryBudget returns a budget of size bytes, or nil for no limit if
+// size is 0.
+func newMemoryBudget(size int64) *memoryBudget {
+	if size == 0 {
+		return nil
+	}
+	return &memoryBudget{left: size}
+}
+
+// reserve takes n bytes of the budget, if they are left.
+func (m *memoryBudget) reserve(n int) bool {
+	if m == nil {
+		return true
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if int64(n) > m.left {
+		return false
+	}
+	m.left -= int64(n)
+	return true
+}
+
+func (m *memoryBudget) release(n int64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.left += n
+}
+
+// spillBuffer buffers data in memory while its budget allows, and in a
+// temporary file after that. Data is read back in the order it was written.
+type spillBuffer struct {
+	budget   *memoryBudget
+	mem      bytes.Buffer
+	reserved int64
+	file     *tempFile
+	reading  bool
+}
+
+func (b *spillBuffer) Write(p []byte) (int, error) {
+	if b.file == nil && b.budget.reserve(len(p)) {
+		b.reserved += int64(len(p))
+		return b.mem.Write(p)
+	}
+	if b.file == nil {
+		f, err := createTempFile("pg_dump_sample-*.copy")
+		if err != nil {
+			return 0, err
+		}
+		b.file = f
+	}
+	return b.file.Write(p)
+}
+
+func (b *spillBuffer) Read(p []byte) (int, error) {
+	if b.mem.Len() > 0 {
+		return b.mem.Read(p)
+	}
+	if b.file == nil {
+		return 0, io.EOF
+	}
+	if !b.reading {
+		err := b.file.Rewind()
+		if err != nil {
+			return 0, err
+		}
+		b.reading = true
+	}
+	return b.file.Read(p)
+}
+
+// Reset empties the buffer, giving its memory back to the budget and
+// removing its temporary file.
+func (b *spillBuffer) Reset() {
+	b.mem = bytes.Buffer{}
+	b.budget.release(b.reserved)
+	b.reserved = 0
+	if b.file != nil {
+		b.file.Close()
+		b.file = nil
+	}
+	b.reading = false
+}
+
+// tempFile is a temporary file encrypted with a key only kept in memory, so
+// that buffered table data never sits on disk in the clear, e.g. while the
+// dump itself is encrypted. It's written and then read back from the start.
+type tempFile struct {
+	f      *os.File
+	block  cipher.Block
+	iv     []byte
+	stream cipher.Stream
+}
+
+// createTempFile creates a temporary file named after pattern, as
+// os.CreateTemp does.
+func createTempFile(pattern string) (*tempFile, error) {
+	f, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return nil, err
+	}
+	t := &tempFile{f: f}
+	err = t.Truncate()
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// Truncate empties the file, whose data is then encrypted with a new key, as
+// a key stream must not encrypt different data.
+func (t *tempFile) Truncate() error {
+	_, err := t.f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	err = t.f.Truncate(0)
+	if err != nil {
+		return err
+	}
+	key := make([]byte, 32)
+	t.iv = make([]byte, aes.BlockSize)
+	_, err = rand.Read(key)
+	if err == nil {
+		_, err = rand.Read(t.iv)
+	}
+	if err != nil {
+		return err
+	}
+	t.block, err = aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	t.stream = cipher.NewCTR(t.block, t.iv)
+	return nil
+}
+
+func (t *tempFile) Write(p []byte) (int, error) {
+	encrypted := make([]byte, len(p))
+	t.stream.XORKeyStream(encrypted, p)
+	return t.f.Write(encrypted)
+}
+
+// Rewind makes the file read from the start.
+func (t *tempFile) Rewind() error {
+	_, err := t.f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	t.stream = cipher.NewCTR(t.block, t.iv)
+	return nil
+}
+
+func (t *tempFile) Read(p []byte) (int, error) {
+	n, err := t.f.Read(p)
+	t.stream.XORKeyStream(p[:n], p[:n])
+	return n, err
+}
+
+func (t *tempFile) Name() string {
+	return t.f.Name()
+}
+
+// Close closes and removes the file.
+func (t *tempFile) Close() error {
+	err := t.f.Close()
+	os.Remove(t.f.Name())
+	return err
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	for _, tc := range []struct {
+		s        string
+		expected int64
+	}{
+		{"1024", 1024},
+		{"64kB", 64 << 10},
+		{"512MB", 512 << 20},
+		{" 2 GB", 2 << 30},
+	} {
+		size, err := parseSize(tc.s)
+		if err != nil || size != tc.expected {
+			t.Errorf("%q: expected %d, got %d (%v)", tc.s, tc.expected, size, err)
+		}
+	}
+
+	for _, s := range []string{"", "MB", "12mb", "1.5GB", "-1MB"} {
+		_, err := parseSize(s)
+		if err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestSpillBuffer(t *testing.T) {
+	budget := newMemoryBudget(10)
+	a := &spillBuffer{budget: budget}
+	b := &spillBuffer{budget: budget}
+
+	io.WriteString(a, "12345")
+	io.WriteString(b, "abcde")
+	if a.file != nil || b.file != nil || budget.left != 0 {
+		t.Fatalf("expected the data to fit in memory, %d bytes left", budget.left)
+	}
+	// The memory of a buffer which is reset can be taken by another
+	io.WriteString(a, "67890")
+	a.Reset()
+	b.Write([]byte("fghij"))
+	b.Write([]byte("k"))
+	b.Write([]byte("l"))
+	if b.file == nil {
+		t.Fatalf("expected the buffer to spill")
+	}
+	name := b.file.Name()
+
+	data, err := io.ReadAll(b)
+	if err != nil || string(data) != "abcdefghijkl" {
+		t.Errorf("expected the data in the order it was written, got %q (%v)", data, err)
+	}
+	b.Reset()
+	if budget.left != 10 {
+		t.Errorf("expected the memory to be given back, %d bytes left", budget.left)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("expected the temporary file to be removed, got %v", err)
+	}
+}
+
+func TestTempFile(t *testing.T) {
+	f, err := createTempFile("pg_dump_sample-*.copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for _, data := range []string{"first attempt\n", "secret row\n"} {
+		err = f.Truncate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(f, data)
+		err = f.Rewind()
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err := io.ReadAll(f)
+		if err != nil || string(read) != data {
+			t.Errorf("expected %q, got %q (%v)", data, read, err)
+		}
+	}
+	// The data is encrypted on disk
+	onDisk, err := os.ReadFile(f.Name())
+	if err != nil || len(onDisk) != len("secret row\n") || bytes.Contains(onDisk, []byte("secret")) {
+		t.Errorf("expected the data to be encrypted, got %q (%v)", onDisk, err)
+	}
+}
+
+func TestMakeDump_ParallelSpilled(t *testing.T) {
+	db := requireDB(t)
+
+	dump := func(jobs int, maxMemory int64) string {
+		manifest := &Manifest{Tables: []ManifestItem{{Table: "users"}, {Table: "posts", ChunkBy: "id", ChunkSize: 2}, {Table: "comments"}}}
+		var buf bytes.Buffer
+		err := makeDump(db, manifest, &buf, DumpOptions{Deterministic: true, Jobs: jobs, MaxMemory: maxMemory})
+		if err != nil {
+			t.Fatalf("makeDump error: %v", err)
+		}
+		return buf.String()
+	}
+
+	if serial, spilled := dump(1, 0), dump(3, 64); spilled != serial {
+		t.Errorf("expected the spilled dump to equal the serial one, got:\n%s\nand:\n%s", spilled, serial)
+	}
+}
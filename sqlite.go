@@ -0,0 +1,246 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	pg "github.com/go-pg/pg/v10"
+	_ "modernc.org/sqlite"
+)
+
+// sqliteDumpWriter writes the dump into a SQLite database, creating a table
+// with converted column types for every dumped table. Tables in the public
+// schema keep their names, others are named schema.table.
+type sqliteDumpWriter struct {
+	db   *pg.DB
+	conn *sql.DB
+	tx   *sql.Tx
+	opts DumpOptions
+	info *DumpInfo
+
+	// Table being written, its column types and the statement inserting
+	// its rows
+	table  string
+	types  []string
+	insert *sql.Stmt
+}
+
+// newSQLiteDumpWriter returns a writer creating the SQLite database path,
+// replacing any existing file, from the tables of db.
+func newSQLiteDumpWriter(path string, db *pg.DB, opts DumpOptions) (*sqliteDumpWriter, error) {
+	err := os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	conn, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// Pragmas apply to a connection
+	conn.SetMaxOpenConns(1)
+	// The database is written in a single transaction and is useless if
+	// the dump fails, so there's no need for a journal
+	_, err = conn.Exec("PRAGMA journal_mode = OFF; PRAGMA synchronous = OFF")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &sqliteDumpWriter{db: db, conn: conn, opts: opts}, nil
+}
+
+func (s *sqliteDumpWriter) BeginDump(info *DumpInfo) error {
+	s.info = info
+	var err error
+	s.tx, err = s.conn.Begin()
+	return err
+}
+
+func (s *sqliteDumpWriter) BeginTable(table string, query string, cols []string) error {
+	types, err := getColumnTypes(s.db, table)
+	if err != nil {
+		return err
+	}
+	pk, err := getPrimaryKey(s.db, table)
+	if err != nil {
+		return err
+	}
+	fks, err := getTableForeignKeys(s.db, table)
+	if err != nil {
+		return err
+	}
+
+	s.table = table
+	s.types = make([]string, 0, len(cols))
+	defs := make([]string, 0, len(cols))
+	for _, col := range cols {
+		s.types = append(s.types, types[col])
+		defs = append(defs, fmt.Sprintf("%s %s", quoteIdent(col), sqliteType(types[col])))
+	}
+	if len(pk) > 0 && containsAll(cols, pk) {
+		defs = append(defs, fmt.Sprintf("PRIMARY KEY (%s)", quoteIdents(pk)))
+	}
+	// SQLite doesn't check foreign keys unless told to, so tables can
+	// reference tables created after them
+	for _, fk := range fks {
+		if !containsAll(cols, fk.Columns) || !s.dumped(fk.RefTable) {
+			continue
+		}
+		defs = append(defs, fmt.Sprintf("FOREIGN KEY (%s) REFERENCES %s (%s)",
+			quoteIdents(fk.Columns), quoteIdent(sqliteTableName(fk.RefTable)), quoteIdents(fk.RefColumns)))
+	}
+
+	name := quoteIdent(sqliteTableName(table))
+	_, err = s.tx.Exec(fmt.Sprintf("CREATE TABLE %s (%s)", name, strings.Join(defs, ", ")))
+	if err != nil {
+		return fmt.Errorf("table %s: %w", table, err)
+	}
+	params := strings.TrimSuffix(strings.Repeat("?, ", len(cols)), ", ")
+	s.insert, err = s.tx.Prepare(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", name, quoteIdents(cols), params))
+	return err
+}
+
+func (s *sqliteDumpWriter) WriteRow(row []*string) error {
+	values := make([]any, 0, len(row))
+	for i, v := range row {
+		values = append(values, sqliteValue(s.types[i], v))
+	}
+	_, err := s.insert.Exec(values...)
+	if err != nil {
+		return fmt.Errorf("table %s: %w", s.table, err)
+	}
+	return nil
+}
+
+func (s *sqliteDumpWriter) EndTable(rows int, duration time.Duration) error {
+	err := s.insert.Close()
+	s.insert = nil
+	return err
+}
+
+func (s *sqliteDumpWriter) PostAction(sql string) error {
+	// Post actions are written for PostgreSQL
+	s.opts.warn("post action of %s skipped in the SQLite database: %s", s.table, sql)
+	return nil
+}
+
+func (s *sqliteDumpWriter) EndDump() error {
+	err := s.tx.Commit()
+	s.tx = nil
+	return err
+}
+
+// Close closes the database, discarding what was written so far unless the
+// dump is complete.
+func (s *sqliteDumpWriter) Close() error {
+	if s.tx != nil {
+		s.tx.Rollback()
+		s.tx = nil
+	}
+	return s.conn.Close()
+}
+
+// dumped tells whether table is among the dumped tables.
+func (s *sqliteDumpWriter) dumped(table string) bool {
+	return slices.ContainsFunc(s.info.Items, func(v ManifestItem) bool { return v.Table == table })
+}
+
+// getColumnTypes returns the names of the types of the table's columns, by
+// column. Domains are replaced by their base types.
+func getColumnTypes(db *pg.DB, table string) (map[string]string, error) {
+	var model []struct {
+		Name string
+		Type string
+	}
+	sql := `
+		SELECT a.attname AS name, t.typname AS type
+		FROM pg_catalog.pg_attribute a
+		JOIN pg_catalog.pg_type d ON d.oid = a.atttypid
+		JOIN pg_catalog.pg_type t
+			ON t.oid = CASE WHEN d.typtype = 'd' THEN d.typbasetype ELSE d.oid END
+		WHERE
+			a.attrelid = ?::regclass
+			AND a.attnum > 0
+			AND NOT a.attisdropped
+	`
+	_, err := db.Query(&model, sql, table)
+	if err != nil {
+		return nil, err
+	}
+
+	types := make(map[string]string, len(model))
+	for _, v := range model {
+		types[v.Name] = v.Type
+	}
+	return types, nil
+}
+
+// sqliteType returns the SQLite column type storing values of a PostgreSQL
+// type. Types without a SQLite counterpart, like arrays and JSON, are stored
+// as text.
+func sqliteType(pgType string) string {
+	switch pgType {
+	case "int2", "int4", "int8", "oid", "bool":
+		return "INTEGER"
+	case "float4", "float8":
+		return "REAL"
+	case "numeric":
+		return "NUMERIC"
+	case "bytea":
+		return "BLOB"
+	default:
+		return "TEXT"
+	}
+}
+
+// sqliteValue converts a value of a PostgreSQL type, in COPY text format, to
+// the value stored by SQLite. Values failing to convert are stored as text.
+func sqliteValue(pgType string, v *string) any {
+	if v == nil {
+		return nil
+	}
+	switch sqliteType(pgType) {
+	case "INTEGER":
+		if pgType == "bool" {
+			return *v == "t"
+		}
+		if n, err := strconv.ParseInt(*v, 10, 64); err == nil {
+			return n
+		}
+	case "REAL":
+		if f, err := strconv.ParseFloat(*v, 64); err == nil {
+			return f
+		}
+	case "BLOB":
+		if b, err := hex.DecodeString(strings.TrimPrefix(*v, `\x`)); err == nil {
+			return b
+		}
+	}
+	return *v
+}
+
+// sqliteTableName returns the name of the SQLite table holding the rows of a
+// table given by its canonical name.
+func sqliteTableName(table string) string {
+	schema, name := splitTableName(table)
+	if schema == "public" {
+		return name
+	}
+	return schema + "." + name
+}
+
+// containsAll tells whether all of values are in s.
+func containsAll(s []string, values []string) bool {
+	for _, v := range values {
+		if !slices.Contains(s, v) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSQLiteValue(t *testing.T) {
+	str := func(s string) *string { return &s }
+	for _, tc := range []struct {
+		pgType   string
+		v        *string
+		expected any
+	}{
+		{"int4", str("42"), int64(42)},
+		{"int8", nil, nil},
+		{"bool", str("t"), true},
+		{"bool", str("f"), false},
+		{"float8", str("1.5"), 1.5},
+		{"numeric", str("12345678901234567890.5"), "12345678901234567890.5"},
+		{"bytea", str(`\x0aff`), []byte{0x0a, 0xff}},
+		{"jsonb", str(`{"a": 1}`), `{"a": 1}`},
+		{"_int4", str("{1,2}"), "{1,2}"},
+		// Values failing to convert are kept as text
+		{"bytea", str("zz"), "zz"},
+	} {
+		if got := sqliteValue(tc.pgType, tc.v); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("sqliteValue(%q, %v) = %#v, expected %#v", tc.pgType, tc.v, got, tc.expected)
+		}
+	}
+}
+
+func TestSQLiteTableName(t *testing.T) {
+	for table, expected := range map[string]string{
+		"users":              "users",
+		"public.users":       "users",
+		`other."Users.Data"`: "other.Users.Data",
+	} {
+		if got := sqliteTableName(table); got != expected {
+			t.Errorf("sqliteTableName(%q) = %q, expected %q", table, got, expected)
+		}
+	}
+}
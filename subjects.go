@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	pg "github.com/go-pg/pg/v10"
+)
+
+// subjectExclusions filters the rows of data subjects which must never be
+// dumped, e.g. people who asked for their data to be deleted, out of every
+// table, together with the rows referencing them through foreign keys.
+type subjectExclusions struct {
+	// Excluded values by table and column
+	values map[string]map[string][]string
+	fks    []ForeignKey
+}
+
+// readSubjects reads the excluded subjects from a CSV file with the columns
+// table, column and value. A header row naming these columns is skipped.
+func readSubjects(r io.Reader) (map[string]map[string][]string, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	subjects := make(map[string]map[string][]string)
+	for i, record := range records {
+		if len(record) != 3 {
+			return nil, fmt.Errorf("line %d: expected table, column and value, got %d fields", i+1, len(record))
+		}
+		if i == 0 && slices.Equal(record, []string{"table", "column", "value"}) {
+			continue
+		}
+		table, col, value := record[0], record[1], record[2]
+		if subjects[table] == nil {
+			subjects[table] = make(map[string][]string)
+		}
+		subjects[table][col] = append(subjects[table][col], value)
+	}
+	return subjects, nil
+}
+
+// loadSubjectExclusions reads the excluded subjects from the CSV file path.
+func loadSubjectExclusions(db *pg.DB, path string) (*subjectExclusions, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	subjects, err := readSubjects(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	// Tables are tracked by their canonical names, the same names foreign
+	// keys are reported with
+	e := subjectExclusions{values: make(map[string]map[string][]string)}
+	for table, cols := range subjects {
+		name, err := resolveTable(db, table)
+		if err != nil {
+			return nil, err
+		}
+		e.values[name] = cols
+	}
+	e.fks, err = getForeignKeys(db)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// filter returns query, selecting rows of table, without the rows which are
+// excluded.
+func (e *subjectExclusions) filter(table string, query string) string {
+	cond := e.excluded(table, "x", nil)
+	if cond == "" {
+		return query
+	}
+	if query == "" {
+		return fmt.Sprintf("SELECT * FROM %s AS x WHERE NOT %s", table, cond)
+	}
+	return fmt.Sprintf("SELECT * FROM (%s) AS x WHERE NOT %s", query, cond)
+}
+
+// excluded returns an SQL condition telling whether the row alias of table is
+// excluded, either as a subject or because it references an excluded row, or
+// an empty string if no row of the table can be excluded. Tables on path are
+// not followed again, so references of a table to itself aren't followed.
+func (e *subjectExclusions) excluded(table string, alias string, path []string) string {
+	conds := make([]string, 0)
+
+	cols := make([]string, 0, len(e.values[table]))
+	for col := range e.values[table] {
+		cols = append(cols, col)
+	}
+	slices.Sort(cols)
+	for _, col := range cols {
+		values := make([]string, 0, len(e.values[table][col]))
+		for _, v := range e.values[table][col] {
+			values = append(values, quoteLiteral(v))
+		}
+		conds = append(conds, fmt.Sprintf("%s.%s IN (%s)", alias, quoteIdent(col), strings.Join(values, ", ")))
+	}
+
+	path = append(path, table)
+	for _, fk := range e.fks {
+		if fk.Table != table || slices.Contains(path, fk.RefTable) {
+			continue
+		}
+		refAlias := fmt.Sprintf("x%d", len(path))
+		refCond := e.excluded(fk.RefTable, refAlias, path)
+		if refCond == "" {
+			continue
+		}
+		join := make([]string, 0, len(fk.Columns))
+		for i := range fk.Columns {
+			join = append(join, fmt.Sprintf("%s.%s = %s.%s", refAlias, quoteIdent(fk.RefColumns[i]), alias, quoteIdent(fk.Columns[i])))
+		}
+		conds = append(conds, fmt.Sprintf("EXISTS (SELECT 1 FROM %s AS %s WHERE %s AND %s)",
+			fk.RefTable, refAlias, strings.Join(join, " AND "), refCond))
+	}
+
+	if len(conds) == 0 {
+		return ""
+	}
+	// NULL values are never excluded
+	return fmt.Sprintf("COALESCE(%s, false)", strings.Join(conds, " OR "))
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadSubjects(t *testing.T) {
+	subjects, err := readSubjects(strings.NewReader("table,column,value\nusers,id,1\nusers,id,5\nusers,email,a@example.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]map[string][]string{"users": {"id": {"1", "5"}, "email": {"a@example.com"}}}
+	if !reflect.DeepEqual(subjects, expected) {
+		t.Errorf("expected %v, got %v", expected, subjects)
+	}
+
+	_, err = readSubjects(strings.NewReader("users,1\n"))
+	if err == nil {
+		t.Error("expected an error for a line without a column")
+	}
+}
+
+func TestSubjectExclusionsFilter(t *testing.T) {
+	e := &subjectExclusions{
+		values: map[string]map[string][]string{"users": {"id": {"1", "o'neil"}}},
+		fks: []ForeignKey{
+			{Table: "posts", Columns: []string{"user_id"}, RefTable: "users", RefColumns: []string{"id"}},
+			{Table: "comments", Columns: []string{"post_id"}, RefTable: "posts", RefColumns: []string{"id"}},
+			{Table: "users", Columns: []string{"invited_by"}, RefTable: "users", RefColumns: []string{"id"}},
+			{Table: "tags", Columns: []string{"id"}, RefTable: "labels", RefColumns: []string{"id"}},
+		},
+	}
+
+	tests := []struct {
+		table, query, expected string
+	}{
+		{"users", "", `SELECT * FROM users AS x WHERE NOT COALESCE(x."id" IN ('1', 'o''neil'), false)`},
+		{"posts", "SELECT * FROM posts LIMIT 5", `SELECT * FROM (SELECT * FROM posts LIMIT 5) AS x WHERE NOT COALESCE(EXISTS (SELECT 1 FROM users AS x1 WHERE x1."id" = x."user_id" AND COALESCE(x1."id" IN ('1', 'o''neil'), false)), false)`},
+		{"comments", "", `SELECT * FROM comments AS x WHERE NOT COALESCE(EXISTS (SELECT 1 FROM posts AS x1 WHERE x1."id" = x."post_id" AND COALESCE(EXISTS (SELECT 1 FROM users AS x2 WHERE x2."id" = x1."user_id" AND COALESCE(x2."id" IN ('1', 'o''neil'), false)), false)), false)`},
+		{"tags", "SELECT * FROM tags", "SELECT * FROM tags"},
+	}
+	for _, tt := range tests {
+		if got := e.filter(tt.table, tt.query); got != tt.expected {
+			t.Errorf("%s: expected:\n%s\ngot:\n%s", tt.table, tt.expected, got)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	pg "github.com/go-pg/pg/v10"
+)
+
+// Seed selects the rows the subsetting engine starts from. Every row
+// referencing a seed row (directly or transitively) is dumped, together with
+// every row those rows reference.
+//
+// MaxDepth, Exclude and Limits restrict how far the engine follows references
+// to the seed rows. They never apply to referenced rows, which are always
+// dumped to keep the dump loadable.
+type Seed struct {
+	Table    string         `yaml:"table"`
+	Where    string         `yaml:"where"`
+	MaxDepth int            `yaml:"max_depth"`
+	Exclude  []string       `yaml:"exclude,flow"`
+	Limits   map[string]int `yaml:"limits"`
+}
+
+// ForeignKey describes a foreign key constraint Table(Columns) referencing
+// RefTable(RefColumns). Definition is the constraint as reported by
+// pg_get_constraintdef().
+type ForeignKey struct {
+	Name       string
+	Table      string
+	Columns    []string
+	RefTable   string
+	RefColumns []string
+	Definition string
+}
+
+type subsetter struct {
+	seed Seed
+	fks  []ForeignKey
+	down map[string]bool
+	all  map[string]bool
+}
+
+func newSubsetter(seed Seed, fks []ForeignKey) *subsetter {
+	s := subsetter{
+		seed,
+		fks,
+		make(map[string]bool),
+		make(map[string]bool),
+	}
+
+	// Tables reachable from the seed table by following foreign keys
+	// backwards, i.e. tables holding rows that reference the seed rows
+	depth := map[string]int{seed.Table: 0}
+	s.down[seed.Table] = true
+	queue := []string{seed.Table}
+	for len(queue) > 0 {
+		table := queue[0]
+		queue = queue[1:]
+		if seed.MaxDepth > 0 && depth[table] >= seed.MaxDepth {
+			continue
+		}
+		for _, fk := range s.fks {
+			if fk.RefTable == table && !s.down[fk.Table] && !s.excluded(fk) {
+				s.down[fk.Table] = true
+				depth[fk.Table] = depth[table] + 1
+				queue = append(queue, fk.Table)
+			}
+		}
+	}
+
+	// Every table referenced by an included table has to be included too,
+	// otherwise the dump could not be loaded
+	queue = make([]string, 0)
+	for table := range s.down {
+		s.all[table] = true
+		queue = append(queue, table)
+	}
+	for len(queue) > 0 {
+		table := queue[0]
+		queue = queue[1:]
+		for _, fk := range s.fks {
+			if fk.Table == table && !s.all[fk.RefTable] {
+				s.all[fk.RefTable] = true
+				queue = append(queue, fk.RefTable)
+			}
+		}
+	}
+
+	return &s
+}
+
+// Tables returns the tables of the subset in a stable order.
+func (s *subsetter) Tables() []string {
+	tables := make([]string, 0, len(s.all))
+	for table := range s.all {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+// Query returns the SELECT statement producing the rows of table which
+// belong to the subset.
+func (s *subsetter) Query(table string) string {
+	query := selectWhere(table, s.conds(table, nil))
+	for _, fk := range s.fks {
+		if fk.Table == table && fk.RefTable == table {
+			query = withReferencedRows(query, fk)
+		}
+	}
+	return query
+}
+
+func (s *subsetter) excluded(fk ForeignKey) bool {
+	return slices.Contains(s.seed.Exclude, fk.Name) || slices.Contains(s.seed.Exclude, fk.Table)
+}
+
+func (s *subsetter) limit(fk ForeignKey) int {
+	if n, ok := s.seed.Limits[fk.Name]; ok {
+		return n
+	}
+	return s.seed.Limits[fk.Table]
+}
+
+func (s *subsetter) conds(table string, path []string) []string {
+	conds := s.downConds(table, s.seed.MaxDepth, path)
+	path = append(path, table)
+	for _, fk := range s.fks {
+		if fk.RefTable != table || !s.all[fk.Table] || slices.Contains(path, fk.Table) {
+			continue
+		}
+		sub := s.conds(fk.Table, path)
+		if len(sub) == 0 {
+			continue
+		}
+		conds = append(conds, inSubquery(fk.RefColumns, fk.Columns, selectWhere(fk.Table, sub)))
+	}
+	return conds
+}
+
+// downConds returns the conditions selecting rows of table which reach the
+// seed rows in at most depth references (any number if depth is 0).
+func (s *subsetter) downConds(table string, depth int, path []string) []string {
+	conds := make([]string, 0)
+	if !s.down[table] {
+		return conds
+	}
+	if table == s.seed.Table {
+		conds = append(conds, fmt.Sprintf("(%s)", s.seed.Where))
+	}
+	if s.seed.MaxDepth > 0 && depth == 0 {
+		return conds
+	}
+	path = append(path, table)
+	for _, fk := range s.fks {
+		if fk.Table != table || !s.down[fk.RefTable] || s.excluded(fk) || slices.Contains(path, fk.RefTable) {
+			continue
+		}
+		sub := s.downConds(fk.RefTable, depth-1, path)
+		if len(sub) == 0 {
+			continue
+		}
+		cond := inSubquery(fk.Columns, fk.RefColumns, selectWhere(fk.RefTable, sub))
+		if n := s.limit(fk); n > 0 {
+			cond = fmt.Sprintf("(tableoid, ctid) IN (SELECT tableoid, ctid FROM %s WHERE %s LIMIT %d)", table, cond, n)
+		}
+		conds = append(conds, cond)
+	}
+	return conds
+}
+
+// withReferencedRows extends query, selecting rows of a table with the
+// self-referencing foreign key fk, with all rows the selected rows reference
+// directly or transitively through fk.
+func withReferencedRows(query string, fk ForeignKey) string {
+	return fmt.Sprintf(`SELECT * FROM %s WHERE (%s) IN (
+	WITH RECURSIVE k AS (
+		SELECT %s FROM (%s) AS s
+		UNION
+		SELECT %s FROM %s AS p
+		JOIN %s AS c ON (%s) = (%s)
+		JOIN k ON (%s) = (%s)
+	)
+	SELECT * FROM k
+)`,
+		fk.Table, quoteIdents(fk.RefColumns),
+		qualifiedIdents("s", fk.RefColumns), query,
+		qualifiedIdents("p", fk.RefColumns), fk.Table,
+		fk.Table, qualifiedIdents("p", fk.RefColumns), qualifiedIdents("c", fk.Columns),
+		qualifiedIdents("c", fk.RefColumns), qualifiedIdents("k", fk.RefColumns))
+}
+
+func qualifiedIdents(alias string, v []string) string {
+	qualified := make([]string, 0, len(v))
+	for _, ident := range v {
+		qualified = append(qualified, alias+"."+quoteIdent(ident))
+	}
+	return strings.Join(qualified, ", ")
+}
+
+func selectWhere(table string, conds []string) string {
+	if len(conds) == 0 {
+		return fmt.Sprintf("SELECT * FROM %s WHERE false", table)
+	}
+	return fmt.Sprintf("SELECT * FROM %s WHERE %s", table, strings.Join(conds, " OR "))
+}
+
+func inSubquery(cols []string, subCols []string, subquery string) string {
+	return fmt.Sprintf("(%s) IN (SELECT %s FROM (%s) AS s)",
+		quoteIdents(cols), qualifiedIdents("s", subCols), subquery)
+}
+
+func quoteIdent(v string) string {
+	return `"` + strings.ReplaceAll(v, `"`, `""`) + `"`
+}
+
+func quoteIdents(v []string) string {
+	quoted := make([]string, 0, len(v))
+	for _, ident := range v {
+		quoted = append(quoted, quoteIdent(ident))
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// quoteLiteral quotes v as a string literal, assuming
+// standard_conforming_strings, as set by the dump.
+func quoteLiteral(v string) string {
+	return `'` + strings.ReplaceAll(v, `'`, `''`) + `'`
+}
+
+// expandSeed adds an entry for every table of the seed subset which is not
+// explicitly listed in the manifest.
+func expandSeed(db *pg.DB, manifest *Manifest) error {
+	if manifest.Seed.Table == "" || manifest.Seed.Where == "" {
+		return fmt.Errorf("seed requires both `table` and `where`")
+	}
+
+	seed := *manifest.Seed
+	table, err := resolveTable(db, seed.Table)
+	if err != nil {
+		return err
+	}
+	seed.Table = table
+
+	fks, err := getForeignKeys(db)
+	if err != nil {
+		return err
+	}
+
+	listed := make(map[string]bool)
+	for _, item := range manifest.Tables {
+		table, err := resolveTable(db, item.Table)
+		if err != nil {
+			return err
+		}
+		listed[table] = true
+	}
+
+	s := newSubsetter(seed, fks)
+	for _, table := range s.Tables() {
+		if listed[table] {
+			continue
+		}
+		manifest.Tables = append(manifest.Tables, ManifestItem{
+			Table:   table,
+			Sampler: subsetSampler{s},
+		})
+	}
+
+	return nil
+}
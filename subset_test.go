@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testForeignKeys mirrors the foreign keys of testdata/schema.sql.
+func testForeignKeys() []ForeignKey {
+	return []ForeignKey{
+		{Name: "comments_post_id_fkey", Table: "comments", Columns: []string{"post_id"}, RefTable: "posts", RefColumns: []string{"id"}},
+		{Name: "comments_user_id_fkey", Table: "comments", Columns: []string{"user_id"}, RefTable: "users", RefColumns: []string{"id"}},
+		{Name: "posts_user_id_fkey", Table: "posts", Columns: []string{"user_id"}, RefTable: "users", RefColumns: []string{"id"}},
+	}
+}
+
+func TestSubsetter_Tables(t *testing.T) {
+	s := newSubsetter(Seed{Table: "posts", Where: "id = 1"}, testForeignKeys())
+
+	expected := []string{"comments", "posts", "users"}
+	if tables := s.Tables(); !reflect.DeepEqual(tables, expected) {
+		t.Errorf("expected tables %v, got %v", expected, tables)
+	}
+}
+
+func TestSubsetter_Query(t *testing.T) {
+	s := newSubsetter(Seed{Table: "posts", Where: "id = 1"}, testForeignKeys())
+
+	posts := s.Query("posts")
+	if !strings.HasPrefix(posts, "SELECT * FROM posts WHERE (id = 1)") {
+		t.Errorf("posts query should start from the seed condition, got %q", posts)
+	}
+
+	comments := s.Query("comments")
+	expected := `SELECT * FROM comments WHERE ("post_id") IN (SELECT s."id" FROM (SELECT * FROM posts WHERE (id = 1)) AS s)`
+	if comments != expected {
+		t.Errorf("unexpected comments query:\n got: %s\nwant: %s", comments, expected)
+	}
+
+	// users is only a parent table, it must be restricted to users referenced
+	// by the dumped posts and comments
+	users := s.Query("users")
+	if !strings.Contains(users, `("id") IN (SELECT s."user_id" FROM (SELECT * FROM posts`) {
+		t.Errorf("users query should include authors of dumped posts, got %q", users)
+	}
+	if !strings.Contains(users, `("id") IN (SELECT s."user_id" FROM (SELECT * FROM comments`) {
+		t.Errorf("users query should include authors of dumped comments, got %q", users)
+	}
+}
+
+func TestSubsetter_UnrelatedTable(t *testing.T) {
+	s := newSubsetter(Seed{Table: "comments", Where: "id = 1"}, testForeignKeys())
+
+	// Nothing references comments, so the closure only goes upwards
+	expected := []string{"comments", "posts", "users"}
+	if tables := s.Tables(); !reflect.DeepEqual(tables, expected) {
+		t.Errorf("expected tables %v, got %v", expected, tables)
+	}
+	if q := s.Query("comments"); q != "SELECT * FROM comments WHERE (id = 1)" {
+		t.Errorf("unexpected comments query %q", q)
+	}
+}
+
+func TestReadManifest_Seed(t *testing.T) {
+	f, err := os.Open("testdata/manifest_seed.yaml")
+	if err != nil {
+		t.Fatalf("failed to open manifest: %v", err)
+	}
+	defer f.Close()
+
+	m, err := readManifest(f)
+	if err != nil {
+		t.Fatalf("readManifest error: %v", err)
+	}
+
+	if m.Seed == nil {
+		t.Fatal("expected a seed, got nil")
+	}
+	if m.Seed.Table != "users" {
+		t.Errorf("expected seed table %q, got %q", "users", m.Seed.Table)
+	}
+	if m.Seed.Where != "username = 'diana'" {
+		t.Errorf("unexpected seed where %q", m.Seed.Where)
+	}
+}
+
+func TestMakeDump_Seed(t *testing.T) {
+	db := requireDB(t)
+
+	f, err := os.Open("testdata/manifest_seed.yaml")
+	if err != nil {
+		t.Fatalf("failed to open manifest: %v", err)
+	}
+	defer f.Close()
+
+	manifest, err := readManifest(f)
+	if err != nil {
+		t.Fatalf("readManifest error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	err = makeDump(db, manifest, &buf, DumpOptions{})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+
+	out := buf.String()
+
+	// diana, charlie (commented on her post) and alice (wrote the post
+	// diana commented on)
+	for _, email := range []string{"diana@example.com", "charlie@example.com", "alice@example.com"} {
+		if !strings.Contains(out, email) {
+			t.Errorf("seed dump should contain %s", email)
+		}
+	}
+	for _, email := range []string{"bob@example.com", "eve@example.com"} {
+		if strings.Contains(out, email) {
+			t.Errorf("seed dump should NOT contain %s", email)
+		}
+	}
+
+	if !strings.Contains(out, "Diana's Post") {
+		t.Error("seed dump should contain diana's post")
+	}
+	if !strings.Contains(out, "Second Post") {
+		t.Error("seed dump should contain the post diana commented on")
+	}
+	if strings.Contains(out, "First Post") {
+		t.Error("seed dump should NOT contain unrelated posts")
+	}
+}
+
+func TestSubsetter_QuerySkipsEmptyBranches(t *testing.T) {
+	s := newSubsetter(Seed{Table: "posts", Where: "id = 1"}, testForeignKeys())
+
+	if q := s.Query("posts"); strings.Contains(q, "WHERE false") {
+		t.Errorf("posts query should not contain empty subqueries, got %q", q)
+	}
+}
+
+func TestSubsetter_MaxDepth(t *testing.T) {
+	seed := Seed{Table: "users", Where: "id = 1", MaxDepth: 1}
+	s := newSubsetter(seed, testForeignKeys())
+
+	// comments reference users directly, but the path through posts takes
+	// two references
+	comments := s.Query("comments")
+	if strings.Contains(comments, `("post_id") IN`) {
+		t.Errorf("comments query should not follow posts beyond max_depth, got %q", comments)
+	}
+	if !strings.Contains(comments, `("user_id") IN`) {
+		t.Errorf("comments query should follow users, got %q", comments)
+	}
+}
+
+func TestSubsetter_Exclude(t *testing.T) {
+	seed := Seed{Table: "users", Where: "id = 1", Exclude: []string{"comments"}}
+	s := newSubsetter(seed, testForeignKeys())
+
+	expected := []string{"posts", "users"}
+	if tables := s.Tables(); !reflect.DeepEqual(tables, expected) {
+		t.Errorf("expected tables %v, got %v", expected, tables)
+	}
+}
+
+func TestSubsetter_ExcludeConstraint(t *testing.T) {
+	seed := Seed{Table: "users", Where: "id = 1", Exclude: []string{"comments_post_id_fkey"}}
+	s := newSubsetter(seed, testForeignKeys())
+
+	if q := s.Query("comments"); strings.Contains(q, `("post_id") IN`) {
+		t.Errorf("comments query should not follow an excluded constraint, got %q", q)
+	}
+}
+
+func TestSubsetter_Limit(t *testing.T) {
+	seed := Seed{Table: "users", Where: "id = 1", Limits: map[string]int{"posts": 5}}
+	s := newSubsetter(seed, testForeignKeys())
+
+	expected := `SELECT * FROM posts WHERE (tableoid, ctid) IN (SELECT tableoid, ctid FROM posts WHERE ("user_id") IN (SELECT s."id" FROM (SELECT * FROM users WHERE (id = 1)) AS s) LIMIT 5)`
+	if q := s.Query("posts"); !strings.HasPrefix(q, expected) {
+		t.Errorf("unexpected posts query:\n got: %s\nwant: %s...", q, expected)
+	}
+}
+
+func TestSubsetter_SelfReference(t *testing.T) {
+	fks := []ForeignKey{
+		{Name: "employees_manager_id_fkey", Table: "employees", Columns: []string{"manager_id"}, RefTable: "employees", RefColumns: []string{"id"}},
+	}
+	s := newSubsetter(Seed{Table: "employees", Where: "id = 3"}, fks)
+
+	// The managers of the seed rows have to be dumped too
+	q := s.Query("employees")
+	if !strings.Contains(q, "WITH RECURSIVE k AS") {
+		t.Errorf("employees query should include referenced managers, got %q", q)
+	}
+	if !strings.Contains(q, `JOIN employees AS c ON (p."id") = (c."manager_id")`) {
+		t.Errorf("employees query should follow manager_id, got %q", q)
+	}
+}
+
+func TestSubsetter_MultiColumn(t *testing.T) {
+	fks := []ForeignKey{
+		{Name: "revision_notes_post_id_revision_fkey", Table: "revision_notes", Columns: []string{"post_id", "revision"}, RefTable: "post_revisions", RefColumns: []string{"post_id", "revision"}},
+	}
+	s := newSubsetter(Seed{Table: "revision_notes", Where: "id = 1"}, fks)
+
+	expected := `SELECT * FROM post_revisions WHERE ("post_id", "revision") IN (SELECT s."post_id", s."revision" FROM (SELECT * FROM revision_notes WHERE (id = 1)) AS s)`
+	if q := s.Query("post_revisions"); q != expected {
+		t.Errorf("unexpected post_revisions query:\n got: %s\nwant: %s", q, expected)
+	}
+}
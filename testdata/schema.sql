@@ -13,6 +13,8 @@ CREATE TABLE posts (
     created_at TIMESTAMP NOT NULL DEFAULT NOW()
 );
 
+CREATE INDEX posts_created_at_idx ON posts (created_at);
+
 CREATE TABLE comments (
     id SERIAL PRIMARY KEY,
     post_id INTEGER NOT NULL REFERENCES posts(id),
@@ -20,3 +22,42 @@ CREATE TABLE comments (
     body TEXT NOT NULL,
     created_at TIMESTAMP NOT NULL DEFAULT NOW()
 );
+
+CREATE TABLE employees (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    manager_id INTEGER REFERENCES employees(id)
+);
+
+-- profiles references a unique (non primary key) column of users
+CREATE TABLE profiles (
+    id SERIAL PRIMARY KEY,
+    username VARCHAR(100) NOT NULL REFERENCES users(username),
+    reviewer VARCHAR(100) REFERENCES users(username),
+    bio TEXT NOT NULL
+);
+
+CREATE TABLE post_revisions (
+    post_id INTEGER NOT NULL REFERENCES posts(id),
+    revision INTEGER NOT NULL,
+    body TEXT NOT NULL,
+    PRIMARY KEY (post_id, revision)
+);
+
+-- revision_notes references post_revisions through a multi-column foreign key
+CREATE TABLE revision_notes (
+    id SERIAL PRIMARY KEY,
+    post_id INTEGER NOT NULL,
+    revision INTEGER NOT NULL,
+    note TEXT NOT NULL,
+    FOREIGN KEY (post_id, revision) REFERENCES post_revisions(post_id, revision)
+);
+
+CREATE SCHEMA billing;
+
+-- billing.invoices references a table in another schema
+CREATE TABLE billing.invoices (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES public.users(id),
+    amount NUMERIC(10, 2) NOT NULL
+);
@@ -32,3 +32,35 @@ INSERT INTO comments (id, post_id, user_id, body, created_at) VALUES
     (10, 8, 3, 'Bob, welcome back!',           '2024-03-08 19:00:00');
 
 SELECT setval('comments_id_seq', 10);
+
+-- Subordinates are deliberately inserted before their managers so that the
+-- physical row order differs from the reference order.
+INSERT INTO employees (id, name, manager_id) VALUES
+    (3, 'Carol', 2),
+    (2, 'Brian', 1),
+    (1, 'Agnes', NULL);
+
+SELECT setval('employees_id_seq', 3);
+
+INSERT INTO profiles (id, username, reviewer, bio) VALUES
+    (1, 'alice', 'bob',  'Writes a lot.'),
+    (2, 'bob',   'alice', 'Comments a lot.');
+
+SELECT setval('profiles_id_seq', 2);
+
+INSERT INTO post_revisions (post_id, revision, body) VALUES
+    (1, 1, 'Hello!'),
+    (1, 2, 'Hello world!'),
+    (3, 1, 'Bob here.');
+
+INSERT INTO revision_notes (id, post_id, revision, note) VALUES
+    (1, 1, 2, 'Added the world.'),
+    (2, 3, 1, 'Initial version.');
+
+SELECT setval('revision_notes_id_seq', 2);
+
+INSERT INTO billing.invoices (id, user_id, amount) VALUES
+    (1, 1, 10.00),
+    (2, 3, 25.50);
+
+SELECT setval('billing.invoices_id_seq', 2);
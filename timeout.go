@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+)
+
+// Policies for tables exceeding their max_duration
+const (
+	ON_TIMEOUT_FAIL    = "fail"
+	ON_TIMEOUT_PARTIAL = "partial"
+)
+
+// copyWithin runs copy, copying the data of table to w, canceling it once
+// the max_duration of the item is exceeded. With the partial policy the rows
+// copied so far are kept, otherwise the dump fails. Rows skipped for not
+// matching the validate condition of the item aren't counted.
+func copyWithin(table string, q *itemQuery, copy func(ctx context.Context, w io.Writer) (int, error)) (int, error) {
+	rows, err := copyWithinDuration(table, q, copy)
+	if err != nil || q.validator == nil || q.validator.invalid == 0 {
+		return rows, err
+	}
+
+	// Skipped rows were copied, but aren't in the dump
+	if skipped := q.validator.Skipped(); skipped > 0 {
+		q.warn("skipped %d rows of %s not matching validate", skipped, table)
+		return rows - skipped, nil
+	}
+	q.warn("fixed %d rows of %s not matching validate", q.validator.invalid, table)
+	return rows, nil
+}
+
+// copyWithinDuration runs copy like copyWithin, counting all copied rows.
+func copyWithinDuration(table string, q *itemQuery, copy func(ctx context.Context, w io.Writer) (int, error)) (int, error) {
+	if q.MaxDuration == 0 {
+		return copyWatched(context.Background(), table, q, q.Data, copy)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), q.MaxDuration)
+	defer cancel()
+	counter := &rowCounter{w: q.Data}
+	rows, err := copyWatched(ctx, table, q, counter, copy)
+	if err == nil || ctx.Err() == nil {
+		return rows, err
+	}
+	if q.OnTimeout == ON_TIMEOUT_PARTIAL {
+		q.warn("%s exceeded max_duration of %s, keeping the %d rows dumped so far", table, q.MaxDuration, counter.rows)
+		return counter.rows, nil
+	}
+	return 0, fmt.Errorf("max_duration of %s exceeded: %w", q.MaxDuration, err)
+}
+
+// rowCounter counts the rows of COPY data passed to w.
+type rowCounter struct {
+	w    io.Writer
+	rows int
+}
+
+func (c *rowCounter) Write(p []byte) (int, error) {
+	c.rows += bytes.Count(p, []byte{'\n'})
+	return c.w.Write(p)
+}
+
+// checkOnTimeout checks the timeout policy of a manifest item.
+func checkOnTimeout(v ManifestItem) error {
+	switch v.OnTimeout {
+	case "", ON_TIMEOUT_FAIL, ON_TIMEOUT_PARTIAL:
+	default:
+		return fmt.Errorf("unknown on_timeout policy %q", v.OnTimeout)
+	}
+	if v.OnTimeout != "" && v.MaxDuration == 0 {
+		return fmt.Errorf("on_timeout requires max_duration")
+	}
+	if v.MaxDuration < 0 {
+		return fmt.Errorf("max_duration must not be negative")
+	}
+	return nil
+}
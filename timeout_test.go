@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowCopy writes two rows, then waits for the query to be canceled.
+func slowCopy(ctx context.Context, w io.Writer) (int, error) {
+	_, err := io.WriteString(w, "1\talice\n2\tbob\n")
+	if err != nil {
+		return 0, err
+	}
+	<-ctx.Done()
+	return 0, fmt.Errorf("canceling statement due to user request")
+}
+
+func TestCopyWithin(t *testing.T) {
+	for _, policy := range []string{ON_TIMEOUT_FAIL, ON_TIMEOUT_PARTIAL} {
+		var buf bytes.Buffer
+		var warnings []string
+		q := &itemQuery{
+			MaxDuration: 10 * time.Millisecond,
+			OnTimeout:   policy,
+			Data:        &buf,
+			warn: func(format string, args ...interface{}) {
+				warnings = append(warnings, fmt.Sprintf(format, args...))
+			},
+		}
+
+		rows, err := copyWithin("users", q, slowCopy)
+		if policy == ON_TIMEOUT_FAIL {
+			if err == nil || !strings.Contains(err.Error(), "max_duration of 10ms exceeded") {
+				t.Errorf("expected the table to fail, got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("expected the partial rows to be kept, got %v", err)
+		}
+		if rows != 2 || buf.String() != "1\talice\n2\tbob\n" {
+			t.Errorf("expected the 2 rows dumped so far, got %d: %q", rows, buf.String())
+		}
+		if len(warnings) != 1 || !strings.Contains(warnings[0], "keeping the 2 rows") {
+			t.Errorf("expected a warning about the partial table, got %v", warnings)
+		}
+	}
+}
+
+func TestCheckOnTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		item  ManifestItem
+		valid bool
+	}{
+		{ManifestItem{}, true},
+		{ManifestItem{MaxDuration: time.Minute}, true},
+		{ManifestItem{MaxDuration: time.Minute, OnTimeout: "partial"}, true},
+		{ManifestItem{MaxDuration: time.Minute, OnTimeout: "retry"}, false},
+		{ManifestItem{OnTimeout: "partial"}, false},
+		{ManifestItem{MaxDuration: -time.Minute}, false},
+	} {
+		err := checkOnTimeout(tc.item)
+		if (err == nil) != tc.valid {
+			t.Errorf("%+v: expected valid=%v, got %v", tc.item, tc.valid, err)
+		}
+	}
+}
+
+func TestReadManifest_MaxDuration(t *testing.T) {
+	m, err := readManifest(strings.NewReader("tables:\n  - table: events\n    max_duration: 90s\n    on_timeout: partial\n"))
+	if err != nil {
+		t.Fatalf("readManifest error: %v", err)
+	}
+	if m.Tables[0].MaxDuration != 90*time.Second || m.Tables[0].OnTimeout != "partial" {
+		t.Errorf("unexpected table %+v", m.Tables[0])
+	}
+}
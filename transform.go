@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// TRANSFORM_KEY_ENV is the environment variable holding the key of the hash
+// and fake transforms, unless it's read from `--transform-key-file`.
+const TRANSFORM_KEY_ENV = "PG_DUMP_SAMPLE_TRANSFORM_KEY"
+
+// transformKey keys the hashes the hash and fake transforms derive their
+// values from, so that the original values can't be found by hashing every
+// candidate, e.g. every phone number. Unless it's set, randomKey is used, and
+// values are only consistent within a run.
+var transformKey []byte
+
+var randomKey = randomTransformKey()
+
+func randomTransformKey() []byte {
+	key := make([]byte, 32)
+	_, err := cryptorand.Read(key)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// setTransformKey sets the key of the transforms, read from path or else
+// from TRANSFORM_KEY_ENV. The random key is used if there is none.
+func setTransformKey(path string) error {
+	key := os.Getenv(TRANSFORM_KEY_ENV)
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		key = string(data)
+	}
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return nil
+	}
+	addSecret(key)
+	transformKey = []byte(key)
+	return nil
+}
+
+// keyedHash returns the HMAC-SHA256 of v with the key of the transforms.
+func keyedHash(v string) []byte {
+	key := transformKey
+	if key == nil {
+		key = randomKey
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(v))
+	return mac.Sum(nil)
+}
+
+// keyedTransform tells whether the values of a transform of type typ are
+// derived from the key of the transforms.
+func keyedTransform(typ string) bool {
+	return typ == "hash" || typ == "preserve_format" || typ == "shift_date" || strings.HasPrefix(typ, "fake_")
+}
+
+// checkTransformKey returns an error if a deterministic dump would transform
+// values with the random key, which changes with every run.
+func checkTransformKey(manifest *Manifest, opts DumpOptions) error {
+	if !opts.Deterministic || transformKey != nil {
+		return nil
+	}
+	for _, v := range manifest.Tables {
+		// Fixes of invalid rows are transforms too
+		for _, transforms := range []map[string]Transform{v.Transforms, v.Fix} {
+			for _, col := range slices.Sorted(maps.Keys(transforms)) {
+				if typ := transforms[col].Type; keyedTransform(typ) {
+					return fmt.Errorf("--deterministic requires a key of the transforms, in --transform-key-file or $%s, as the %s transform of %s.%s would change with every run", TRANSFORM_KEY_ENV, typ, v.Table, col)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Transform describes how the values of a column are rewritten before they
+// are written to the dump. In the manifest it's either just the name of the
+// transform or a mapping with a `type` key.
+type Transform struct {
+	Type string `yaml:"type"`
+
+	// SQL condition; if set, the transform only applies to rows matching it
+	When string `yaml:"when,omitempty"`
+
+	// Transforms of the same group derive their random values from all the
+	// original values of the group, so that e.g. a fake name and a fake
+	// e-mail address of a row belong to the same fake person
+	Group string `yaml:"group,omitempty"`
+
+	// Column whose original value random values are derived from instead,
+	// e.g. to shift all dates of the same user by the same offset
+	Key string `yaml:"key,omitempty"`
+
+	// Parameters of the generalization transforms
+	Size    float64 `yaml:"size,omitempty"`
+	Fill    string  `yaml:"fill,omitempty"`
+	MaxDays int     `yaml:"max_days,omitempty"`
+
+	// Number of leading and trailing characters left as they are by
+	// preserve_format
+	KeepPrefix int `yaml:"keep_prefix,omitempty"`
+	KeepSuffix int `yaml:"keep_suffix,omitempty"`
+
+	// Maximum number of characters of values kept by truncate
+	Length int `yaml:"length,omitempty"`
+
+	// Type of the column, which placeholders are made for, set before the
+	// transform is used
+	columnType string
+}
+
+func (t *Transform) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		t.Type = value.Value
+		return nil
+	}
+	type plain Transform
+	return value.Decode((*plain)(t))
+}
+
+func (t Transform) MarshalYAML() (interface{}, error) {
+	if t == (Transform{Type: t.Type}) {
+		return t.Type, nil
+	}
+	type plain Transform
+	return plain(t), nil
+}
+
+// transformFunc returns the new value of a column; nil is SQL NULL. Random
+// values are derived from key, which is the original value itself unless the
+// column is part of a group.
+type transformFunc func(v *string, key string) *string
+
+var transforms = map[string]func(t Transform) (transformFunc, error){
+	"null": func(t Transform) (transformFunc, error) {
+		return func(v *string, key string) *string {
+			return nil
+		}, nil
+	},
+	"redact": func(t Transform) (transformFunc, error) {
+		return func(v *string, key string) *string {
+			if v == nil {
+				return nil
+			}
+			redacted := "REDACTED"
+			return &redacted
+		}, nil
+	},
+	"hash": func(t Transform) (transformFunc, error) {
+		return func(v *string, key string) *string {
+			if v == nil {
+				return nil
+			}
+			// 128 bits of the HMAC are plenty to keep distinct values
+			// distinct
+			hashed := hex.EncodeToString(keyedHash(*v)[:16])
+			return &hashed
+		}, nil
+	},
+	"fake_first_name":  fakeTransform(func(r *rand.Rand, _ string) string { return fakeFirstName(r) }),
+	"fake_last_name":   fakeTransform(func(r *rand.Rand, _ string) string { return fakeLastName(r) }),
+	"fake_name":        fakeTransform(func(r *rand.Rand, _ string) string { return fakeName(r) }),
+	"fake_email":       fakeTransform(fakeEmail),
+	"fake_phone":       fakeTransform(func(r *rand.Rand, _ string) string { return fakePhone(r) }),
+	"fake_address":     fakeTransform(func(r *rand.Rand, _ string) string { return fakeAddress(r) }),
+	"fake_credit_card": fakeTransform(func(r *rand.Rand, _ string) string { return fakeCreditCard(r) }),
+	"fake_uuid":        fakeTransform(func(r *rand.Rand, _ string) string { return fakeUUID(r) }),
+	"preserve_format": func(t Transform) (transformFunc, error) {
+		if t.KeepPrefix < 0 || t.KeepSuffix < 0 {
+			return nil, fmt.Errorf("keep_prefix and keep_suffix must not be negative")
+		}
+		return fakeTransform(func(r *rand.Rand, original string) string {
+			return preserveFormat(r, original, t.KeepPrefix, t.KeepSuffix)
+		})(t)
+	},
+	"bucket": func(t Transform) (transformFunc, error) {
+		if t.Size <= 0 {
+			return nil, fmt.Errorf("bucket requires a positive size")
+		}
+		return func(v *string, key string) *string {
+			if v == nil {
+				return nil
+			}
+			bucketed := bucket(*v, t.Size)
+			return &bucketed
+		}, nil
+	},
+	"generalize": func(t Transform) (transformFunc, error) {
+		if t.KeepPrefix < 0 {
+			return nil, fmt.Errorf("keep_prefix must not be negative")
+		}
+		fill := t.Fill
+		if fill == "" {
+			fill = "0"
+		}
+		return func(v *string, key string) *string {
+			if v == nil {
+				return nil
+			}
+			generalized := generalize(*v, t.KeepPrefix, fill)
+			return &generalized
+		}, nil
+	},
+	"truncate": func(t Transform) (transformFunc, error) {
+		if t.Length <= 0 {
+			return nil, fmt.Errorf("truncate requires a positive length")
+		}
+		return func(v *string, key string) *string {
+			if v == nil {
+				return nil
+			}
+			truncated := truncate(*v, t.Length)
+			return &truncated
+		}, nil
+	},
+	"placeholder": func(t Transform) (transformFunc, error) {
+		placeholder, ok := placeholders[t.columnType]
+		if !ok {
+			return nil, fmt.Errorf("placeholder doesn't support columns of type %q", t.columnType)
+		}
+		return func(v *string, key string) *string {
+			if v == nil {
+				return nil
+			}
+			replaced := placeholder(*v)
+			return &replaced
+		}, nil
+	},
+	"shift_date": func(t Transform) (transformFunc, error) {
+		if t.MaxDays <= 0 {
+			return nil, fmt.Errorf("shift_date requires a positive max_days")
+		}
+		return fakeTransform(func(r *rand.Rand, original string) string {
+			return shiftDate(original, r.IntN(2*t.MaxDays+1)-t.MaxDays)
+		})(t)
+	},
+}
+
+// TRUNCATED_MARKER ends values cut short by truncate
+const TRUNCATED_MARKER = "…"
+
+// truncate cuts v down to length characters, the last one being a marker of
+// the truncation, so that the value still fits a column of that length.
+func truncate(v string, length int) string {
+	if utf8.RuneCountInString(v) <= length {
+		return v
+	}
+	runes := []rune(v)
+	return string(runes[:length-1]) + TRUNCATED_MARKER
+}
+
+// itemTransforms returns the transforms of the columns of a manifest item,
+// including the truncation of long values and the fixes of invalid rows.
+func itemTransforms(v ManifestItem) (map[string]Transform, error) {
+	transforms := make(map[string]Transform, len(v.Transforms)+len(v.Truncate))
+	maps.Copy(transforms, v.Transforms)
+	for _, col := range slices.Sorted(maps.Keys(v.Truncate)) {
+		_, transformed := transforms[col]
+		_, fixed := v.Fix[col]
+		if transformed || fixed {
+			return nil, fmt.Errorf("column %q has both a transform and a truncation", col)
+		}
+		transforms[col] = Transform{Type: "truncate", Length: v.Truncate[col]}
+	}
+	if v.OnInvalid == ON_INVALID_FIX {
+		transforms = fixTransforms(v, transforms)
+	}
+	return transforms, nil
+}
+
+func newTransformFunc(t Transform) (transformFunc, error) {
+	constructor, ok := transforms[t.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown transform %q", t.Type)
+	}
+	return constructor(t)
+}
+
+// copyTransformer is a writer rewriting the rows of COPY text format data
+// passing through it.
+//
+// Rows of tables with conditional transforms are expected to be followed by
+// one boolean column per condition, as listed by Conditions(). These columns
+// are removed from the output.
+type copyTransformer struct {
+	w      io.Writer
+	ncols  int
+	funcs  map[int]transformFunc
+	when   map[int]int
+	conds  []string
+	groups map[int]string
+	keys   map[int]int
+	buf    []byte
+}
+
+func newCopyTransformer(w io.Writer, cols []string, specs map[string]Transform) (*copyTransformer, error) {
+	t := copyTransformer{
+		w:      w,
+		ncols:  len(cols),
+		funcs:  make(map[int]transformFunc),
+		when:   make(map[int]int),
+		conds:  make([]string, 0),
+		groups: make(map[int]string),
+		keys:   make(map[int]int),
+	}
+	for i, col := range cols {
+		spec, ok := specs[col]
+		if !ok {
+			continue
+		}
+		f, err := newTransformFunc(spec)
+		if err != nil {
+			return nil, fmt.Errorf("column %q: %v", col, err)
+		}
+		t.funcs[i] = f
+		if spec.Group != "" {
+			t.groups[i] = spec.Group
+		}
+		if spec.Key != "" {
+			k := slices.Index(cols, spec.Key)
+			if k == -1 {
+				return nil, fmt.Errorf("column %q: unknown key column %q", col, spec.Key)
+			}
+			t.keys[i] = k
+		}
+		if spec.When != "" {
+			t.when[i] = len(t.conds)
+			t.conds = append(t.conds, fmt.Sprintf("(%s)", spec.When))
+		}
+	}
+	for col := range specs {
+		if !slices.Contains(cols, col) {
+			return nil, fmt.Errorf("transform of unknown column %q", col)
+		}
+	}
+	return &t, nil
+}
+
+// Conditions returns the SQL conditions of conditional transforms, in the
+// order their values are expected to follow the dumped columns.
+func (t *copyTransformer) Conditions() []string {
+	return t.conds
+}
+
+func (t *copyTransformer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	for {
+		// Newlines inside values are escaped, so every line is a row
+		end := bytes.IndexByte(t.buf, '\n')
+		if end == -1 {
+			break
+		}
+		row := decodeCopyRow(string(t.buf[:end]))
+		flags := make([]*string, 0)
+		if len(t.conds) > 0 && len(row) > t.ncols {
+			flags = row[t.ncols:]
+			row = row[:t.ncols]
+		}
+		original := slices.Clone(row)
+		keys := t.groupKeys(row)
+		for i, f := range t.funcs {
+			if i >= len(row) {
+				continue
+			}
+			if k, ok := t.when[i]; ok && (k >= len(flags) || flags[k] == nil || *flags[k] != "t") {
+				continue
+			}
+			key := ""
+			if group, ok := t.groups[i]; ok {
+				key = keys[group]
+			} else if k, ok := t.keys[i]; ok {
+				if original[k] != nil {
+					key = *original[k]
+				}
+			} else if row[i] != nil {
+				key = *row[i]
+			}
+			row[i] = f(row[i], key)
+		}
+		_, err := io.WriteString(t.w, encodeCopyRow(row)+"\n")
+		if err != nil {
+			return 0, err
+		}
+		t.buf = t.buf[end+1:]
+	}
+	return len(p), nil
+}
+
+// groupKeys returns the original values of the columns of each group,
+// combined into a single string.
+func (t *copyTransformer) groupKeys(row []*string) map[string]string {
+	values := make(map[string][]*string)
+	for i := range row {
+		if group, ok := t.groups[i]; ok {
+			values[group] = append(values[group], row[i])
+		}
+	}
+	keys := make(map[string]string)
+	for group, v := range values {
+		keys[group] = encodeCopyRow(v)
+	}
+	return keys
+}
+
+// decodeCopyRow splits a line of COPY text format data into its values.
+func decodeCopyRow(line string) []*string {
+	row := make([]*string, 0)
+	for _, field := range strings.Split(line, "\t") {
+		if field == `\N` {
+			row = append(row, nil)
+			continue
+		}
+		v := decodeCopyValue(field)
+		row = append(row, &v)
+	}
+	return row
+}
+
+func decodeCopyValue(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		c := field[i]
+		if c != '\\' || i+1 == len(field) {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		switch c = field[i]; c {
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'v':
+			b.WriteByte('\v')
+		case 'x':
+			j := i + 1
+			for j < len(field) && j < i+3 && isHexDigit(field[j]) {
+				j++
+			}
+			if j == i+1 {
+				b.WriteByte('x')
+				continue
+			}
+			n, _ := strconv.ParseUint(field[i+1:j], 16, 8)
+			b.WriteByte(byte(n))
+			i = j - 1
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			j := i
+			for j < len(field) && j < i+3 && field[j] >= '0' && field[j] <= '7' {
+				j++
+			}
+			n, _ := strconv.ParseUint(field[i:j], 8, 16)
+			b.WriteByte(byte(n))
+			i = j - 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// encodeCopyRow formats values as a line of COPY text format data.
+func encodeCopyRow(row []*string) string {
+	fields := make([]string, 0, len(row))
+	for _, v := range row {
+		if v == nil {
+			fields = append(fields, `\N`)
+			continue
+		}
+		fields = append(fields, encodeCopyValue(*v))
+	}
+	return strings.Join(fields, "\t")
+}
+
+var copyEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	"\b", `\b`,
+	"\f", `\f`,
+	"\n", `\n`,
+	"\r", `\r`,
+	"\t", `\t`,
+	"\v", `\v`,
+)
+
+func encodeCopyValue(v string) string {
+	return copyEscaper.Replace(v)
+}
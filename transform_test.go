@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDecodeCopyRow(t *testing.T) {
+	row := decodeCopyRow(`1` + "\t" + `\N` + "\t" + `a\tb\nc\\d` + "\t" + `\101\x42`)
+
+	if len(row) != 4 {
+		t.Fatalf("expected 4 values, got %d", len(row))
+	}
+	if row[0] == nil || *row[0] != "1" {
+		t.Errorf("value[0]: expected %q, got %v", "1", row[0])
+	}
+	if row[1] != nil {
+		t.Errorf("value[1]: expected NULL, got %q", *row[1])
+	}
+	if row[2] == nil || *row[2] != "a\tb\nc\\d" {
+		t.Errorf("value[2]: expected escapes to be decoded, got %v", row[2])
+	}
+	if row[3] == nil || *row[3] != "AB" {
+		t.Errorf("value[3]: expected octal and hex escapes to be decoded, got %v", row[3])
+	}
+}
+
+func TestEncodeCopyRow_RoundTrip(t *testing.T) {
+	for _, line := range []string{
+		`1` + "\t" + `\N` + "\t" + `plain`,
+		`a\tb\nc\\d\re`,
+		`\\.`,
+		"",
+	} {
+		if out := encodeCopyRow(decodeCopyRow(line)); out != line {
+			t.Errorf("round trip of %q produced %q", line, out)
+		}
+	}
+}
+
+func TestCopyTransformer(t *testing.T) {
+	var buf bytes.Buffer
+	cols := []string{"id", "email", "note"}
+	specs := map[string]Transform{
+		"email": {Type: "redact"},
+		"note":  {Type: "null"},
+	}
+	tr, err := newCopyTransformer(&buf, cols, specs)
+	if err != nil {
+		t.Fatalf("newCopyTransformer error: %v", err)
+	}
+
+	// Rows may be split across writes arbitrarily
+	data := "1\talice@example.com\thi\n2\t\\N\tthere\n"
+	for _, chunk := range []string{data[:5], data[5:20], data[20:]} {
+		if _, err := tr.Write([]byte(chunk)); err != nil {
+			t.Fatalf("Write error: %v", err)
+		}
+	}
+
+	expected := "1\tREDACTED\t\\N\n2\t\\N\t\\N\n"
+	if out := buf.String(); out != expected {
+		t.Errorf("unexpected output:\n got: %q\nwant: %q", out, expected)
+	}
+}
+
+func TestCopyTransformer_When(t *testing.T) {
+	var buf bytes.Buffer
+	cols := []string{"id", "email", "role"}
+	specs := map[string]Transform{
+		"email": {Type: "redact", When: "role <> 'test'"},
+	}
+	tr, err := newCopyTransformer(&buf, cols, specs)
+	if err != nil {
+		t.Fatalf("newCopyTransformer error: %v", err)
+	}
+
+	if conds := tr.Conditions(); len(conds) != 1 || conds[0] != "(role <> 'test')" {
+		t.Fatalf("unexpected conditions %v", conds)
+	}
+
+	// The value of the condition follows the dumped columns
+	_, err = tr.Write([]byte("1\ta@example.com\tcustomer\tt\n2\tb@example.com\ttest\tf\n3\tc@example.com\t\\N\t\\N\n"))
+	if err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+
+	expected := "1\tREDACTED\tcustomer\n2\tb@example.com\ttest\n3\tc@example.com\t\\N\n"
+	if out := buf.String(); out != expected {
+		t.Errorf("unexpected output:\n got: %q\nwant: %q", out, expected)
+	}
+}
+
+func TestCopyTransformer_Group(t *testing.T) {
+	var buf bytes.Buffer
+	cols := []string{"first_name", "last_name", "full_name", "email"}
+	specs := map[string]Transform{
+		"first_name": {Type: "fake_first_name", Group: "person"},
+		"last_name":  {Type: "fake_last_name", Group: "person"},
+		"full_name":  {Type: "fake_name", Group: "person"},
+		"email":      {Type: "fake_email", Group: "person"},
+	}
+	tr, err := newCopyTransformer(&buf, cols, specs)
+	if err != nil {
+		t.Fatalf("newCopyTransformer error: %v", err)
+	}
+
+	_, err = tr.Write([]byte("Alice\tSmith\tAlice Smith\talice@corp.example\n"))
+	if err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+
+	row := decodeCopyRow(strings.TrimSuffix(buf.String(), "\n"))
+	first, last, full, email := *row[0], *row[1], *row[2], *row[3]
+	if first == "Alice" || last == "Smith" {
+		t.Errorf("names should be replaced, got %q %q", first, last)
+	}
+	if full != first+" "+last {
+		t.Errorf("full name %q should match first and last name %q %q", full, first, last)
+	}
+	if !strings.HasPrefix(email, strings.ToLower(first+"."+last)) || !strings.HasSuffix(email, "@corp.example") {
+		t.Errorf("e-mail %q should belong to %s %s", email, first, last)
+	}
+}
+
+func TestHashTransform_Keyed(t *testing.T) {
+	defer func(key []byte) { transformKey = key }(transformKey)
+	f, err := newTransformFunc(Transform{Type: "hash"})
+	if err != nil {
+		t.Fatalf("newTransformFunc error: %v", err)
+	}
+	v := "555-0100"
+
+	transformKey = []byte("one key")
+	hashed := *f(&v, v)
+	faked := fakeUUID(fakeRand(v))
+	if again := *f(&v, v); again != hashed {
+		t.Errorf("expected equal values to hash the same, got %q and %q", hashed, again)
+	}
+	if len(hashed) != 32 {
+		t.Errorf("expected 32 hex digits, got %q", hashed)
+	}
+	// The unkeyed MD5 hash could be found by hashing every phone number
+	if hashed == fmt.Sprintf("%x", md5.Sum([]byte(v))) {
+		t.Errorf("expected a keyed hash, got the MD5 hash %q", hashed)
+	}
+
+	transformKey = []byte("another key")
+	if other := *f(&v, v); other == hashed {
+		t.Errorf("expected the hash to depend on the key, got %q with both", other)
+	}
+	if other := fakeUUID(fakeRand(v)); other == faked {
+		t.Errorf("expected fake values to depend on the key, got %q with both", other)
+	}
+}
+
+func TestSetTransformKey(t *testing.T) {
+	defer func(key []byte) { transformKey = key }(transformKey)
+	transformKey = nil
+
+	t.Setenv(TRANSFORM_KEY_ENV, "")
+	if err := setTransformKey(""); err != nil {
+		t.Fatalf("setTransformKey error: %v", err)
+	}
+	if transformKey != nil || len(randomKey) != 32 {
+		t.Errorf("expected the random key to be used, got %q", transformKey)
+	}
+
+	t.Setenv(TRANSFORM_KEY_ENV, "from the environment")
+	if err := setTransformKey(""); err != nil {
+		t.Fatalf("setTransformKey error: %v", err)
+	}
+	if string(transformKey) != "from the environment" {
+		t.Errorf("expected the key of the environment, got %q", transformKey)
+	}
+
+	path := filepath.Join(t.TempDir(), "transform.key")
+	if err := os.WriteFile(path, []byte("from a file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := setTransformKey(path); err != nil {
+		t.Fatalf("setTransformKey error: %v", err)
+	}
+	if string(transformKey) != "from a file" {
+		t.Errorf("expected the key of the file, got %q", transformKey)
+	}
+}
+
+func TestCheckTransformKey(t *testing.T) {
+	defer func(key []byte) { transformKey = key }(transformKey)
+	transformKey = nil
+	manifest := &Manifest{Tables: []ManifestItem{
+		{Table: "users", Transforms: map[string]Transform{"name": {Type: "redact"}}},
+		{Table: "posts", Fix: map[string]Transform{"author_email": {Type: "fake_email"}}},
+	}}
+
+	if err := checkTransformKey(manifest, DumpOptions{}); err != nil {
+		t.Errorf("expected the random key to do without --deterministic, got %v", err)
+	}
+	err := checkTransformKey(manifest, DumpOptions{Deterministic: true})
+	if err == nil || !strings.Contains(err.Error(), "fake_email transform of posts.author_email") {
+		t.Errorf("expected deterministic dumps to require a key, got %v", err)
+	}
+
+	transformKey = []byte("a key")
+	if err := checkTransformKey(manifest, DumpOptions{Deterministic: true}); err != nil {
+		t.Errorf("expected a key to do, got %v", err)
+	}
+}
+
+func TestCopyTransformer_UnknownColumn(t *testing.T) {
+	_, err := newCopyTransformer(&bytes.Buffer{}, []string{"id"}, map[string]Transform{"email": {Type: "null"}})
+	if err == nil {
+		t.Fatal("expected an error for a transform of an unknown column")
+	}
+}
+
+func TestCopyTransformer_UnknownTransform(t *testing.T) {
+	_, err := newCopyTransformer(&bytes.Buffer{}, []string{"id"}, map[string]Transform{"id": {Type: "nope"}})
+	if err == nil {
+		t.Fatal("expected an error for an unknown transform")
+	}
+}
+
+func TestReadManifest_Transforms(t *testing.T) {
+	f, err := os.Open("testdata/manifest_transforms.yaml")
+	if err != nil {
+		t.Fatalf("failed to open manifest: %v", err)
+	}
+	defer f.Close()
+
+	m, err := readManifest(f)
+	if err != nil {
+		t.Fatalf("readManifest error: %v", err)
+	}
+
+	transforms := m.Tables[0].Transforms
+	if transforms["email"].Type != "redact" {
+		t.Errorf("expected email to be redacted, got %+v", transforms["email"])
+	}
+	if transforms["username"].Type != "hash" {
+		t.Errorf("expected username to be hashed, got %+v", transforms["username"])
+	}
+}
+
+func TestMakeDump_Transforms(t *testing.T) {
+	db := requireDB(t)
+
+	f, err := os.Open("testdata/manifest_transforms.yaml")
+	if err != nil {
+		t.Fatalf("failed to open manifest: %v", err)
+	}
+	defer f.Close()
+
+	manifest, err := readManifest(f)
+	if err != nil {
+		t.Fatalf("readManifest error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	err = makeDump(db, manifest, &buf, DumpOptions{})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+
+	out := buf.String()
+
+	if strings.Contains(out, "alice") {
+		t.Error("transformed dump should NOT contain alice's username or email")
+	}
+	if strings.Count(out, "REDACTED") != 5 {
+		t.Errorf("expected 5 redacted emails, got:\n%s", out)
+	}
+}
+
+func TestMakeDump_TransformsWhen(t *testing.T) {
+	db := requireDB(t)
+
+	f, err := os.Open("testdata/manifest_transforms_when.yaml")
+	if err != nil {
+		t.Fatalf("failed to open manifest: %v", err)
+	}
+	defer f.Close()
+
+	manifest, err := readManifest(f)
+	if err != nil {
+		t.Fatalf("readManifest error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	err = makeDump(db, manifest, &buf, DumpOptions{})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+
+	out := buf.String()
+
+	for _, email := range []string{"alice@example.com", "bob@example.com"} {
+		if !strings.Contains(out, email) {
+			t.Errorf("dump should contain %s", email)
+		}
+	}
+	for _, email := range []string{"charlie@example.com", "diana@example.com", "eve@example.com"} {
+		if strings.Contains(out, email) {
+			t.Errorf("dump should NOT contain %s", email)
+		}
+	}
+	if strings.Count(out, "REDACTED") != 3 {
+		t.Errorf("expected 3 redacted emails, got:\n%s", out)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		length   int
+		expected string
+	}{
+		{"hello", 10, "hello"},
+		{"hello", 5, "hello"},
+		{"hello world", 5, "hell…"},
+		{"日本語のテキスト", 4, "日本語…"},
+		{"hello", 1, "…"},
+		{"", 1, ""},
+	} {
+		if out := truncate(tc.value, tc.length); out != tc.expected {
+			t.Errorf("truncate(%q, %d): expected %q, got %q", tc.value, tc.length, tc.expected, out)
+		}
+	}
+}
+
+func TestItemTransforms(t *testing.T) {
+	v := ManifestItem{
+		Table:      "posts",
+		Transforms: map[string]Transform{"title": {Type: "redact"}},
+		Truncate:   map[string]int{"body": 100},
+	}
+	transforms, err := itemTransforms(v)
+	if err != nil {
+		t.Fatalf("itemTransforms error: %v", err)
+	}
+	if len(transforms) != 2 || transforms["body"] != (Transform{Type: "truncate", Length: 100}) {
+		t.Errorf("unexpected transforms %+v", transforms)
+	}
+	if len(v.Transforms) != 1 {
+		t.Errorf("expected the transforms of the item to be left as they are, got %+v", v.Transforms)
+	}
+
+	v.Truncate["title"] = 10
+	_, err = itemTransforms(v)
+	if err == nil || err.Error() != `column "title" has both a transform and a truncation` {
+		t.Errorf("expected a conflict, got %v", err)
+	}
+
+	_, err = newCopyTransformer(io.Discard, []string{"body"}, map[string]Transform{"body": {Type: "truncate"}})
+	if err == nil || !strings.Contains(err.Error(), "truncate requires a positive length") {
+		t.Errorf("expected a missing length to be rejected, got %v", err)
+	}
+}
+
+func TestMakeDump_Truncate(t *testing.T) {
+	db := requireDB(t)
+
+	manifest := &Manifest{Tables: []ManifestItem{{Table: "users", Truncate: map[string]int{"email": 6}}}}
+	var buf bytes.Buffer
+	err := makeDump(db, manifest, &buf, DumpOptions{})
+	if err != nil {
+		t.Fatalf("makeDump error: %v", err)
+	}
+	out := buf.String()
+	if strings.Contains(out, "alice@example.com") || !strings.Contains(out, "\talice\talice…\t") {
+		t.Errorf("expected e-mail addresses to be truncated, got:\n%s", out)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// TransactionAgeError is returned when a table is still being read once the
+// transaction it's read in is older than `--max-transaction-age`.
+type TransactionAgeError struct {
+	Table  string
+	MaxAge time.Duration
+	Rows   int64
+}
+
+func (e *TransactionAgeError) Error() string {
+	return fmt.Sprintf("dumping %s: transaction older than --max-transaction-age of %s after %d rows", e.Table, e.MaxAge, e.Rows)
+}
+
+// progressCounter counts the rows of COPY data passed to w, which may be
+// read while they are being copied.
+type progressCounter struct {
+	w    io.Writer
+	rows atomic.Int64
+}
+
+func (c *progressCounter) Write(p []byte) (int, error) {
+	c.rows.Add(int64(bytes.Count(p, []byte{'\n'})))
+	return c.w.Write(p)
+}
+
+// copyWatched runs copy, copying the data of table to w. Slow tables, e.g.
+// with expensive transforms, report how many rows they've copied every
+// progress interval, and fail once the transaction they're read in is older
+// than the max transaction age, so that the snapshot it holds doesn't keep
+// the server from cleaning up dead rows for too long.
+func copyWatched(ctx context.Context, table string, q *itemQuery, w io.Writer, copy func(ctx context.Context, w io.Writer) (int, error)) (int, error) {
+	if q.progressInterval == 0 && q.maxTransactionAge == 0 {
+		return copy(ctx, w)
+	}
+
+	start := time.Now()
+	txStart := q.transactionStart
+	if txStart.IsZero() {
+		// Tables are read in a transaction of their own
+		txStart = start
+	}
+	counter := &progressCounter{w: w}
+
+	var deadline time.Time
+	if q.maxTransactionAge > 0 {
+		deadline = txStart.Add(q.maxTransactionAge)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	if q.progressInterval > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			ticker := time.NewTicker(q.progressInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+				}
+				q.warn("still dumping %s: %d rows after %s, in a transaction open for %s", table, counter.rows.Load(), time.Since(start).Round(time.Second), time.Since(txStart).Round(time.Second))
+			}
+		}()
+	}
+
+	rows, err := copy(ctx, counter)
+	if err != nil && !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, &TransactionAgeError{Table: table, MaxAge: q.maxTransactionAge, Rows: counter.rows.Load()}
+	}
+	return rows, err
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCopyWatched_Progress(t *testing.T) {
+	var mu sync.Mutex
+	var warnings []string
+	q := &itemQuery{progressInterval: 10 * time.Millisecond, warn: func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}}
+
+	var buf bytes.Buffer
+	rows, err := copyWatched(context.Background(), "users", q, &buf, func(ctx context.Context, w io.Writer) (int, error) {
+		io.WriteString(w, "1\talice\n2\tbob\n")
+		time.Sleep(50 * time.Millisecond)
+		return 2, nil
+	})
+	if err != nil || rows != 2 || buf.String() != "1\talice\n2\tbob\n" {
+		t.Fatalf("expected the rows to be copied, got %d, %v: %q", rows, err, buf.String())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(warnings) == 0 || !strings.HasPrefix(warnings[0], "still dumping users: 2 rows after ") {
+		t.Errorf("expected the progress to be reported, got %v", warnings)
+	}
+}
+
+func TestCopyWatched_MaxTransactionAge(t *testing.T) {
+	waitForCancel := func(ctx context.Context, w io.Writer) (int, error) {
+		io.WriteString(w, "1\talice\n")
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}
+
+	// The transaction shared by all tables is already too old
+	q := &itemQuery{maxTransactionAge: time.Minute, transactionStart: time.Now().Add(-time.Hour)}
+	_, err := copyWatched(context.Background(), "users", q, io.Discard, waitForCancel)
+	var ageErr *TransactionAgeError
+	if !errors.As(err, &ageErr) || ageErr.Table != "users" || ageErr.Rows != 1 {
+		t.Errorf("expected a transaction age error, got %v", err)
+	}
+
+	// The transaction of the table gets too old while it's read
+	q = &itemQuery{maxTransactionAge: 20 * time.Millisecond}
+	_, err = copyWatched(context.Background(), "users", q, io.Discard, waitForCancel)
+	if !errors.As(err, &ageErr) {
+		t.Errorf("expected a transaction age error, got %v", err)
+	}
+	if msg := err.Error(); msg != "dumping users: transaction older than --max-transaction-age of 20ms after 1 rows" {
+		t.Errorf("unexpected message: %s", msg)
+	}
+
+	// Other errors are left alone
+	failure := errors.New("connection reset")
+	_, err = copyWatched(context.Background(), "users", q, io.Discard, func(ctx context.Context, w io.Writer) (int, error) {
+		return 0, failure
+	})
+	if err != failure {
+		t.Errorf("expected the error to be passed on, got %v", err)
+	}
+}
+
+func TestMakeDump_PerTableTransactions(t *testing.T) {
+	db := requireDB(t)
+
+	dump := func(opts DumpOptions) string {
+		manifest := &Manifest{Tables: []ManifestItem{{Table: "users"}, {Table: "posts"}, {Table: "comments"}}}
+		var buf bytes.Buffer
+		err := makeDump(db, manifest, &buf, opts)
+		if err != nil {
+			t.Fatalf("makeDump error: %v", err)
+		}
+		return buf.String()
+	}
+
+	shared := dump(DumpOptions{Deterministic: true, Jobs: 3})
+	perTable := dump(DumpOptions{Deterministic: true, Jobs: 3, PerTableTransactions: true, MaxTransactionAge: time.Minute})
+	if perTable != shared {
+		t.Errorf("expected per-table transactions to dump the same data, got:\n%s\nand:\n%s", perTable, shared)
+	}
+}
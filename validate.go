@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Policies for rows not matching the validate condition of their table
+const (
+	ON_INVALID_FAIL = "fail"
+	ON_INVALID_SKIP = "skip"
+	ON_INVALID_FIX  = "fix"
+)
+
+// checkValidate checks the validation of the rows of a manifest item.
+func checkValidate(v ManifestItem) error {
+	switch v.OnInvalid {
+	case "", ON_INVALID_FAIL, ON_INVALID_SKIP, ON_INVALID_FIX:
+	default:
+		return fmt.Errorf("unknown on_invalid policy %q", v.OnInvalid)
+	}
+	if v.OnInvalid != "" && v.Validate == "" {
+		return fmt.Errorf("on_invalid requires validate")
+	}
+	if (v.OnInvalid == ON_INVALID_FIX) != (len(v.Fix) > 0) {
+		return fmt.Errorf("on_invalid: fix requires fix transforms, and fix transforms require it")
+	}
+	for _, col := range slices.Sorted(maps.Keys(v.Fix)) {
+		if _, ok := v.Transforms[col]; ok {
+			return fmt.Errorf("column %q has both a transform and a fix", col)
+		}
+	}
+	return nil
+}
+
+// fixTransforms returns transforms with the fixes of the rows of a manifest
+// item not matching its validate condition, which only apply to those rows.
+func fixTransforms(v ManifestItem, transforms map[string]Transform) map[string]Transform {
+	fixed := make(map[string]Transform, len(transforms)+len(v.Fix))
+	maps.Copy(fixed, transforms)
+	for col, t := range v.Fix {
+		when := fmt.Sprintf("(%s) IS NOT TRUE", v.Validate)
+		if t.When != "" {
+			when = fmt.Sprintf("%s AND (%s)", when, t.When)
+		}
+		t.When = when
+		fixed[col] = t
+	}
+	return fixed
+}
+
+// rowValidator is a writer checking the rows of COPY text format data passing
+// through it against the validate condition of their table, evaluated by the
+// database as a boolean column following the others. The column is removed
+// from the output.
+type rowValidator struct {
+	w      io.Writer
+	table  string
+	cond   string
+	policy string
+	// Primary key columns identifying invalid rows, and their positions
+	key []string
+	pos []int
+	// Number of rows not matching the condition
+	invalid int
+	buf     []byte
+}
+
+func newRowValidator(w io.Writer, v ManifestItem, cols []string, pk []string) *rowValidator {
+	r := &rowValidator{w: w, table: v.Table, cond: v.Validate, policy: v.OnInvalid}
+	if r.policy == "" {
+		r.policy = ON_INVALID_FAIL
+	}
+	for _, col := range pk {
+		i := slices.Index(cols, col)
+		if i == -1 {
+			// Rows can't be identified by a partial key
+			r.key, r.pos = nil, nil
+			break
+		}
+		r.key = append(r.key, col)
+		r.pos = append(r.pos, i)
+	}
+	return r
+}
+
+// Condition returns the SQL expression of the boolean column expected after
+// the others.
+func (r *rowValidator) Condition() string {
+	return fmt.Sprintf("((%s) IS TRUE)", r.cond)
+}
+
+// Skipped returns the number of rows left out of the output.
+func (r *rowValidator) Skipped() int {
+	if r.policy == ON_INVALID_SKIP {
+		return r.invalid
+	}
+	return 0
+}
+
+func (r *rowValidator) Write(p []byte) (int, error) {
+	r.buf = append(r.buf, p...)
+	for {
+		// Newlines inside values are escaped, so every line is a row
+		end := bytes.IndexByte(r.buf, '\n')
+		if end == -1 {
+			break
+		}
+		line := string(r.buf[:end])
+		r.buf = r.buf[end+1:]
+		tab := strings.LastIndexByte(line, '\t')
+		row, valid := line[:max(tab, 0)], line[tab+1:] == "t"
+		if !valid {
+			r.invalid++
+			switch r.policy {
+			case ON_INVALID_SKIP:
+				continue
+			case ON_INVALID_FAIL:
+				return 0, fmt.Errorf("row of %s %sdoesn't match validate: %s", r.table, r.describe(row), r.cond)
+			}
+		}
+		_, err := io.WriteString(r.w, row+"\n")
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// describe identifies a row by its primary key, if it's dumped.
+func (r *rowValidator) describe(line string) string {
+	if len(r.key) == 0 {
+		return ""
+	}
+	row := decodeCopyRow(line)
+	values := make([]string, 0, len(r.key))
+	for i, col := range r.key {
+		value := "NULL"
+		if r.pos[i] < len(row) && row[r.pos[i]] != nil {
+			value = *row[r.pos[i]]
+		}
+		values = append(values, fmt.Sprintf("%s=%s", col, value))
+	}
+	return fmt.Sprintf("with %s ", strings.Join(values, ", "))
+}
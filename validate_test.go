@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCheckValidate(t *testing.T) {
+	for _, tc := range []struct {
+		item ManifestItem
+		err  string
+	}{
+		{ManifestItem{}, ""},
+		{ManifestItem{Validate: "id > 0"}, ""},
+		{ManifestItem{Validate: "id > 0", OnInvalid: ON_INVALID_SKIP}, ""},
+		{ManifestItem{Validate: "id > 0", OnInvalid: ON_INVALID_FIX, Fix: map[string]Transform{"email": {Type: "null"}}}, ""},
+		{ManifestItem{Validate: "id > 0", OnInvalid: "drop"}, `unknown on_invalid policy "drop"`},
+		{ManifestItem{OnInvalid: ON_INVALID_SKIP}, "on_invalid requires validate"},
+		{ManifestItem{Validate: "id > 0", OnInvalid: ON_INVALID_FIX}, "on_invalid: fix requires fix transforms"},
+		{ManifestItem{Validate: "id > 0", Fix: map[string]Transform{"email": {Type: "null"}}}, "fix transforms require it"},
+		{ManifestItem{
+			Validate:   "id > 0",
+			OnInvalid:  ON_INVALID_FIX,
+			Transforms: map[string]Transform{"email": {Type: "redact"}},
+			Fix:        map[string]Transform{"email": {Type: "null"}},
+		}, `column "email" has both a transform and a fix`},
+	} {
+		err := checkValidate(tc.item)
+		if tc.err == "" && err != nil {
+			t.Errorf("%+v: unexpected error %v", tc.item, err)
+		}
+		if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%+v: expected error %q, got %v", tc.item, tc.err, err)
+		}
+	}
+}
+
+func TestFixTransforms(t *testing.T) {
+	v := ManifestItem{
+		Validate:   "email LIKE '%@%'",
+		OnInvalid:  ON_INVALID_FIX,
+		Transforms: map[string]Transform{"name": {Type: "fake_name"}},
+		Fix: map[string]Transform{
+			"email": {Type: "null"},
+			"note":  {Type: "redact", When: "note <> ''"},
+		},
+	}
+	transforms := fixTransforms(v, v.Transforms)
+	if len(transforms) != 3 || transforms["name"] != (Transform{Type: "fake_name"}) {
+		t.Fatalf("unexpected transforms %+v", transforms)
+	}
+	if when := transforms["email"].When; when != "(email LIKE '%@%') IS NOT TRUE" {
+		t.Errorf("unexpected condition of email %q", when)
+	}
+	if when := transforms["note"].When; when != "(email LIKE '%@%') IS NOT TRUE AND (note <> '')" {
+		t.Errorf("unexpected condition of note %q", when)
+	}
+	if len(v.Transforms) != 1 {
+		t.Errorf("expected the transforms of the item to be left as they are, got %+v", v.Transforms)
+	}
+}
+
+func TestRowValidator(t *testing.T) {
+	cols := []string{"id", "email"}
+	data := "1\ta@example.com\tt\n2\tnobody\tf\n3\t\\N\tf\n"
+	for _, tc := range []struct {
+		policy   string
+		expected string
+		err      string
+	}{
+		{ON_INVALID_SKIP, "1\ta@example.com\n", ""},
+		{ON_INVALID_FIX, "1\ta@example.com\n2\tnobody\n3\t\\N\n", ""},
+		{"", "1\ta@example.com\n", "row of users with id=2 doesn't match validate: email LIKE '%@%'"},
+	} {
+		var buf bytes.Buffer
+		v := ManifestItem{Table: "users", Validate: "email LIKE '%@%'", OnInvalid: tc.policy}
+		r := newRowValidator(&buf, v, cols, []string{"id"})
+		if cond := r.Condition(); cond != "((email LIKE '%@%') IS TRUE)" {
+			t.Fatalf("unexpected condition %q", cond)
+		}
+
+		// Rows may be split across writes arbitrarily
+		var err error
+		for _, chunk := range []string{data[:7], data[7:20], data[20:]} {
+			_, err = r.Write([]byte(chunk))
+			if err != nil {
+				break
+			}
+		}
+		if tc.err == "" && err != nil {
+			t.Errorf("%s: Write error: %v", tc.policy, err)
+		}
+		if tc.err != "" && (err == nil || err.Error() != tc.err) {
+			t.Errorf("%s: expected error %q, got %v", tc.policy, tc.err, err)
+		}
+		if buf.String() != tc.expected {
+			t.Errorf("%s: expected %q, got %q", tc.policy, tc.expected, buf.String())
+		}
+	}
+}
+
+func TestRowValidator_NoKey(t *testing.T) {
+	v := ManifestItem{Table: "users", Validate: "email LIKE '%@%'"}
+	r := newRowValidator(io.Discard, v, []string{"email"}, []string{"id"})
+	_, err := r.Write([]byte("nobody\tf\n"))
+	if err == nil || err.Error() != "row of users doesn't match validate: email LIKE '%@%'" {
+		t.Errorf("expected the row not to be identified, got %v", err)
+	}
+}
+
+func TestCopyWithin_Validate(t *testing.T) {
+	var buf bytes.Buffer
+	var warnings []string
+	v := ManifestItem{Table: "users", Validate: "email LIKE '%@%'", OnInvalid: ON_INVALID_SKIP}
+	r := newRowValidator(&buf, v, []string{"id", "email"}, []string{"id"})
+	q := &itemQuery{
+		Data:      r,
+		validator: r,
+		warn: func(format string, args ...interface{}) {
+			warnings = append(warnings, fmt.Sprintf(format, args...))
+		},
+	}
+
+	rows, err := copyWithin("users", q, func(ctx context.Context, w io.Writer) (int, error) {
+		_, err := io.WriteString(w, "1\ta@example.com\tt\n2\tnobody\tf\n")
+		return 2, err
+	})
+	if err != nil {
+		t.Fatalf("copyWithin error: %v", err)
+	}
+	if rows != 1 || buf.String() != "1\ta@example.com\n" {
+		t.Errorf("expected the invalid row to be skipped, got %d rows %q", rows, buf.String())
+	}
+	if len(warnings) != 1 || warnings[0] != "skipped 1 rows of users not matching validate" {
+		t.Errorf("unexpected warnings %q", warnings)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	pg "github.com/go-pg/pg/v10"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// AS_OF_VAR is the var holding the instant the dump is as of, which queries
+// filter by time with instead of now() so that all tables share a cutoff.
+const AS_OF_VAR = "as_of"
+
+// Vars are the values of the placeholders of query templates, by var. They
+// are inserted into the queries as they are.
+//
+// In manifests a var is either a plain value, inserted as it is, or a typed
+// value, converted to an SQL literal of its type:
+//
+//	min_id: {type: int, value: 1000}
+//	name: {type: string, value: "O'Hare"}
+//	since: {type: date, value: 2024-01-01}
+//	statuses: {type: list, value: [active, trial]}
+//
+// Lists expand to a comma-separated list of literals, for IN lists.
+type Vars map[string]string
+
+// varTypes are the types of typed vars, converting the YAML value of a var to
+// its SQL literal.
+var varTypes = map[string]func(value *yaml.Node) (string, error){
+	"int": intLiteral,
+	"string": func(value *yaml.Node) (string, error) {
+		if value.Kind != yaml.ScalarNode {
+			return "", fmt.Errorf("expected a string")
+		}
+		return quoteLiteral(value.Value), nil
+	},
+	"date": func(value *yaml.Node) (string, error) {
+		if value.Kind != yaml.ScalarNode {
+			return "", fmt.Errorf("expected a date")
+		}
+		t, err := time.Parse(time.DateOnly, value.Value)
+		if err != nil {
+			return "", fmt.Errorf("%q is not a date like 2006-01-02", value.Value)
+		}
+		return fmt.Sprintf("DATE '%s'", t.Format(time.DateOnly)), nil
+	},
+	"list": func(value *yaml.Node) (string, error) {
+		if value.Kind != yaml.SequenceNode {
+			return "", fmt.Errorf("expected a list")
+		}
+		// An empty IN list is a syntax error, while IN (NULL) matches
+		// nothing
+		if len(value.Content) == 0 {
+			return "NULL", nil
+		}
+		literals := make([]string, 0, len(value.Content))
+		for _, item := range value.Content {
+			if item.Kind != yaml.ScalarNode {
+				return "", fmt.Errorf("expected a list of numbers or strings")
+			}
+			literal := quoteLiteral(item.Value)
+			if item.Tag == "!!int" {
+				var err error
+				literal, err = intLiteral(item)
+				if err != nil {
+					return "", err
+				}
+			}
+			literals = append(literals, literal)
+		}
+		return strings.Join(literals, ", "), nil
+	},
+}
+
+// intLiteral returns the literal of an integer.
+func intLiteral(value *yaml.Node) (string, error) {
+	if value.Kind != yaml.ScalarNode {
+		return "", fmt.Errorf("expected an integer")
+	}
+	n, err := strconv.ParseInt(value.Value, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("%q is not an integer", value.Value)
+	}
+	return strconv.FormatInt(n, 10), nil
+}
+
+// UnmarshalYAML reads vars, converting typed vars to SQL literals.
+func (v *Vars) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: vars must be a mapping", node.Line)
+	}
+	vars := make(Vars, len(node.Content)/2)
+	for i := 0; i < len(node.Content); i += 2 {
+		name, value := node.Content[i].Value, node.Content[i+1]
+		if value.Kind != yaml.MappingNode {
+			var s string
+			err := value.Decode(&s)
+			if err != nil {
+				return err
+			}
+			vars[name] = s
+			continue
+		}
+
+		var typed struct {
+			Type  string    `yaml:"type"`
+			Value yaml.Node `yaml:"value"`
+		}
+		err := value.Decode(&typed)
+		if err != nil {
+			return err
+		}
+		literal, ok := varTypes[typed.Type]
+		if !ok {
+			return fmt.Errorf("line %d: var %s has unknown type %q", value.Line, name, typed.Type)
+		}
+		vars[name], err = literal(&typed.Value)
+		if err != nil {
+			return fmt.Errorf("line %d: var %s: %v", value.Line, name, err)
+		}
+	}
+	*v = vars
+	return nil
+}
+
+// setAsOf fixes the instant the dump is as of, the manifest's as_of or the
+// database's current time, and sets the as_of var to its TIMESTAMPTZ literal.
+// The database parses as_of, so it may be any timestamp it accepts.
+func setAsOf(db *pg.DB, manifest *Manifest) error {
+	var given *string
+	if manifest.AsOf != "" {
+		given = &manifest.AsOf
+	}
+	var asOf time.Time
+	_, err := db.QueryOne(pg.Scan(&asOf), "SELECT coalesce(?::timestamptz, now())", given)
+	if err != nil {
+		return fmt.Errorf("as_of %s: %w", manifest.AsOf, err)
+	}
+	manifest.asOf = asOf.UTC()
+	if manifest.Vars == nil {
+		manifest.Vars = make(Vars)
+	}
+	manifest.Vars[AS_OF_VAR] = asOfLiteral(manifest.asOf)
+	return nil
+}
+
+// asOfLiteral returns the TIMESTAMPTZ literal of an instant, to the
+// microsecond like timestamps in the database.
+func asOfLiteral(t time.Time) string {
+	return fmt.Sprintf("TIMESTAMPTZ '%s'", t.UTC().Format("2006-01-02 15:04:05.999999Z07:00"))
+}
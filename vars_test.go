@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+func TestVars_UnmarshalYAML(t *testing.T) {
+	var vars Vars
+	err := yaml.Unmarshal([]byte(`
+condition: "users.id < 100"
+min_id: {type: int, value: 1000}
+name: {type: string, value: "O'Hare"}
+since: {type: date, value: 2024-01-01}
+statuses: {type: list, value: [active, "it's", 3]}
+none: {type: list, value: []}
+`), &vars)
+	if err != nil {
+		t.Fatalf("Unmarshal error: %v", err)
+	}
+	expected := Vars{
+		"condition": "users.id < 100",
+		"min_id":    "1000",
+		"name":      `'O''Hare'`,
+		"since":     "DATE '2024-01-01'",
+		"statuses":  `'active', 'it''s', 3`,
+		"none":      "NULL",
+	}
+	for name, value := range expected {
+		if vars[name] != value {
+			t.Errorf("%s: expected %q, got %q", name, value, vars[name])
+		}
+	}
+}
+
+func TestVars_UnmarshalYAML_Invalid(t *testing.T) {
+	for _, doc := range []string{
+		"id: {type: int, value: 1; DROP TABLE users}",
+		"since: {type: date, value: yesterday}",
+		"ids: {type: list, value: 1}",
+		"ids: {type: list, value: [[1]]}",
+		"id: {type: uuid, value: x}",
+	} {
+		var vars Vars
+		if err := yaml.Unmarshal([]byte(doc), &vars); err == nil {
+			t.Errorf("%s: expected an error, got %v", doc, vars)
+		}
+	}
+}
+
+func TestReadManifest_TypedVars(t *testing.T) {
+	m, err := readManifest(strings.NewReader(`
+vars:
+  statuses: {type: list, value: [active, trial]}
+  filter: "status <> 'deleted'"
+tables:
+  - table: users
+    vars:
+      min_id: {type: int, value: 10}
+    query: "SELECT * FROM users WHERE id > {{min_id}} AND status IN ({{statuses}}) AND {{filter}}"
+`))
+	if err != nil {
+		t.Fatalf("readManifest error: %v", err)
+	}
+	sampler, err := samplerFor(m, m.Tables[0])
+	if err != nil {
+		t.Fatalf("samplerFor error: %v", err)
+	}
+	query, err := sampler.Query(nil, "users")
+	if err != nil {
+		t.Fatalf("Query error: %v", err)
+	}
+	expected := "SELECT * FROM users WHERE id > 10 AND status IN ('active', 'trial') AND status <> 'deleted'"
+	if query != expected {
+		t.Errorf("expected %q, got %q", expected, query)
+	}
+
+	_, err = readManifest(strings.NewReader("vars:\n  id: {type: int, value: abc}\n"))
+	if !errors.Is(err, ErrManifestInvalid) {
+		t.Errorf("expected ErrManifestInvalid, got %v", err)
+	}
+}
+
+func TestAsOfLiteral(t *testing.T) {
+	at := time.Date(2024, 6, 1, 12, 30, 0, 123456789, time.FixedZone("", 2*60*60))
+	if literal := asOfLiteral(at); literal != "TIMESTAMPTZ '2024-06-01 10:30:00.123456Z'" {
+		t.Errorf("unexpected literal %s", literal)
+	}
+	if literal := asOfLiteral(at.Truncate(time.Second)); literal != "TIMESTAMPTZ '2024-06-01 10:30:00Z'" {
+		t.Errorf("unexpected literal %s", literal)
+	}
+}
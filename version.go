@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	pg "github.com/go-pg/pg/v10"
+)
+
+// MIN_SERVER_VERSION is the oldest supported PostgreSQL version, in the
+// format of server_version_num.
+const MIN_SERVER_VERSION = 90600
+
+// Versions introducing catalog changes the queries have to adapt to
+const (
+	PG10 = 100000 // Declarative partitioning, WAL functions renamed from xlog
+	PG12 = 120000 // Generated columns
+)
+
+// serverVersions holds the versions detected by connectDB, by database. They
+// aren't kept as parameters of the databases, since go-pg formats every query
+// of a database with parameters, rewriting placeholders in manifest queries.
+var serverVersions sync.Map
+
+// detectServerVersion returns the version of the server as a number, as in
+// server_version_num, and as a string, as in server_version.
+func detectServerVersion(db *pg.DB) (int, string, error) {
+	var model struct {
+		Num     int
+		Version string
+	}
+	sql := `
+		SELECT
+			current_setting('server_version_num')::int AS num,
+			current_setting('server_version') AS version
+	`
+	_, err := db.QueryOne(&model, sql)
+	if err != nil {
+		return 0, "", err
+	}
+	return model.Num, model.Version, nil
+}
+
+func checkServerVersion(num int, version string) error {
+	if num < MIN_SERVER_VERSION {
+		return fmt.Errorf("PostgreSQL %s is not supported, the server must run PostgreSQL 9.6 or later", version)
+	}
+	return nil
+}
+
+// serverVersion returns the server_version_num of the server db is connected
+// to, as detected by connectDB, or the latest version if unknown.
+func serverVersion(db *pg.DB) int {
+	if num, ok := serverVersions.Load(db); ok {
+		return num.(int)
+	}
+	return math.MaxInt
+}
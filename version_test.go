@@ -0,0 +1,55 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	pg "github.com/go-pg/pg/v10"
+)
+
+func TestCheckServerVersion(t *testing.T) {
+	for _, tc := range []struct {
+		num     int
+		version string
+		ok      bool
+	}{
+		{90500, "9.5.25", false},
+		{90600, "9.6.0", true},
+		{100023, "10.23", true},
+		{170002, "17.2", true},
+	} {
+		err := checkServerVersion(tc.num, tc.version)
+		if (err == nil) != tc.ok {
+			t.Errorf("checkServerVersion(%d, %q) = %v, expected ok=%v", tc.num, tc.version, err, tc.ok)
+		}
+	}
+}
+
+func TestServerVersion(t *testing.T) {
+	db := pg.Connect(&pg.Options{})
+	defer db.Close()
+
+	if v := serverVersion(db); v != math.MaxInt {
+		t.Errorf("expected the latest version when unknown, got %d", v)
+	}
+	serverVersions.Store(db, 90624)
+	defer serverVersions.Delete(db)
+	if v := serverVersion(db); v != 90624 {
+		t.Errorf("expected 90624, got %d", v)
+	}
+}
+
+func TestDetectServerVersion(t *testing.T) {
+	db := requireDB(t)
+
+	num, version, err := detectServerVersion(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num < MIN_SERVER_VERSION || version == "" {
+		t.Errorf("unexpected server version %d (%q)", num, version)
+	}
+	if serverVersion(db) != num {
+		t.Errorf("connectDB didn't record the server version: %d, expected %d", serverVersion(db), num)
+	}
+}